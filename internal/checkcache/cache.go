@@ -0,0 +1,136 @@
+// Package checkcache caches rspamd check results by the hash of the checked
+// message and its metadata headers.
+package checkcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+// DefaultMaxEntries is the number of results that are cached at most, if no
+// other limit is specified.
+const DefaultMaxEntries = 1000
+
+type key [sha256.Size]byte
+
+type entry struct {
+	key       key
+	result    *rspamc.CheckResult
+	expiresAt time.Time
+}
+
+// Cache is an in-memory cache of check results.
+// Results expire after a TTL, when the cache is full the least recently used
+// result is evicted.
+type Cache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[key]*list.Element
+	// lru contains the entries ordered by their last use, the most
+	// recently used entry is at the front
+	lru *list.List
+}
+
+// New returns a cache that keeps results for ttl and contains at most
+// maxEntries results. If maxEntries is 0, [DefaultMaxEntries] is used.
+func New(ttl time.Duration, maxEntries int) *Cache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+
+	return &Cache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[key]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+// newKey returns the hash of msg and hdrs.
+func newKey(msg []byte, hdrs *rspamc.MailHeaders) key {
+	var sb strings.Builder
+
+	h := sha256.New()
+	_, _ = h.Write(msg)
+
+	sb.WriteString("\x00" + hdrs.DeliverTo)
+	sb.WriteString("\x00" + hdrs.Subject)
+	for _, l := range [][]string{hdrs.From, hdrs.Recipients} {
+		sb.WriteString("\x00" + strings.Join(slices.Sorted(slices.Values(l)), "\x01"))
+	}
+	_, _ = h.Write([]byte(sb.String()))
+
+	var result key
+	h.Sum(result[:0])
+
+	return result
+}
+
+// Get returns the cached result for msg with hdrs.
+// The result is shared and must not be modified.
+func (c *Cache) Get(msg []byte, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, bool) {
+	k := newKey(msg, hdrs)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, exists := c.entries[k]
+	if !exists {
+		return nil, false
+	}
+
+	e := elem.Value.(*entry)
+	if !time.Now().Before(e.expiresAt) {
+		c.remove(elem)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+
+	return e.result, true
+}
+
+// Add stores result for msg with hdrs.
+func (c *Cache) Add(msg []byte, hdrs *rspamc.MailHeaders, result *rspamc.CheckResult) {
+	k := newKey(msg, hdrs)
+	expiresAt := time.Now().Add(c.ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, exists := c.entries[k]; exists {
+		e := elem.Value.(*entry)
+		e.result = result
+		e.expiresAt = expiresAt
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[k] = c.lru.PushFront(&entry{key: k, result: result, expiresAt: expiresAt})
+
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Len returns the number of cached results, including expired ones that were
+// not evicted yet.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*entry).key)
+}
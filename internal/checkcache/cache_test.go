@@ -0,0 +1,67 @@
+package checkcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestGetAdd(t *testing.T) {
+	c := New(time.Hour, 0)
+	msg := []byte("mail")
+	hdrs := &rspamc.MailHeaders{Subject: "hello", Recipients: []string{"a@example.com", "b@example.com"}}
+	result := &rspamc.CheckResult{Score: 1.5}
+
+	_, exists := c.Get(msg, hdrs)
+	assert.Equal(t, false, exists)
+
+	c.Add(msg, hdrs, result)
+
+	cached, exists := c.Get(msg, hdrs)
+	assert.Equal(t, true, exists)
+	assert.Equal(t, result, cached)
+
+	// the order of recipients does not matter
+	_, exists = c.Get(msg, &rspamc.MailHeaders{Subject: "hello", Recipients: []string{"b@example.com", "a@example.com"}})
+	assert.Equal(t, true, exists)
+
+	_, exists = c.Get(msg, &rspamc.MailHeaders{Subject: "hello", Recipients: []string{"a@example.com"}})
+	assert.Equal(t, false, exists)
+
+	_, exists = c.Get([]byte("other mail"), hdrs)
+	assert.Equal(t, false, exists)
+}
+
+func TestExpiry(t *testing.T) {
+	c := New(-time.Second, 0)
+	msg := []byte("mail")
+	hdrs := &rspamc.MailHeaders{}
+
+	c.Add(msg, hdrs, &rspamc.CheckResult{})
+
+	_, exists := c.Get(msg, hdrs)
+	assert.Equal(t, false, exists)
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestMaxEntries(t *testing.T) {
+	c := New(time.Hour, 2)
+	hdrs := &rspamc.MailHeaders{}
+
+	c.Add([]byte("1"), hdrs, &rspamc.CheckResult{})
+	c.Add([]byte("2"), hdrs, &rspamc.CheckResult{})
+	// 1 becomes the most recently used entry, 2 is evicted
+	_, exists := c.Get([]byte("1"), hdrs)
+	assert.Equal(t, true, exists)
+	c.Add([]byte("3"), hdrs, &rspamc.CheckResult{})
+
+	assert.Equal(t, 2, c.Len())
+	_, exists = c.Get([]byte("2"), hdrs)
+	assert.Equal(t, false, exists)
+	for _, msg := range []string{"1", "3"} {
+		_, exists = c.Get([]byte(msg), hdrs)
+		assert.Equal(t, true, exists)
+	}
+}
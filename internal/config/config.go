@@ -1,30 +1,77 @@
 package config
 
 import (
+	"cmp"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pelletier/go-toml/v2"
 )
 
 type Config struct {
 	RspamdURL               string
+	RspamdPrimaryURL        string
+	RspamdBalancing         string
 	RspamdPassword          string
+	RspamdCompression       bool
+	RspamdFuzzyFlag         int
+	RspamdFuzzyWeight       int
+	RspamdUnavailablePolicy string
+	RspamdUnavailableAfter  Duration
+	RspamdCacheTTL          Duration
+	RspamdCacheMaxEntries   int
 	ImapAddr                string
 	ImapUser                string
 	ImapPassword            string
+	ImapAuthMechanism       string
+	OAuth2TokenURL          string
+	OAuth2ClientID          string
+	OAuth2ClientSecret      string
+	OAuth2RefreshToken      string
+	OAuth2Scopes            []string
+	ImapTLSMode             string
+	ImapTLSCAFile           string
+	ImapTLSServerName       string
+	ImapTLSClientCertFile   string
+	ImapTLSClientKeyFile    string
+	ImapTLSPinnedCertSHA256 []string
+	ImapProxy               string
+	ImapAllowExpunge        bool
+	ImapDisableCompression  bool
+	ImapQuotaMinFreeKiB     int64
+	Maildir                 string
 	InboxMailbox            string
 	SpamMailbox             string
 	ScanMailbox             string
 	HamMailbox              string
 	BackupMailbox           string
 	UndetectedMailbox       string
+	PendingMailbox          string
+	CreateMissingMailboxes  bool
+	DetectSpecialUse        bool
 	SpamThreshold           float32
+	SkippedPolicy           string
+	GreylistPolicy          string
+	RescanDelay             Duration
+	MaxRescans              int
+	LateRescanMargin        float32
+	LateRescanDelay         Duration
+	TagOnly                 bool
+	LMTPAddr                string
+	LMTPRecipient           string
+	LMTPSpamRecipient       string
+	SpamFlags               []string
+	InboxFlags              []string
 	TempDir                 string
 	KeepTempFiles           bool
+	SyncStateFile           string
+	LearnSpoolDir           string
 	LogIMAPData             bool
+	LogIMAPDataMaxBodySize  int
 	MarkLearnedAsSpamAsRead bool
 	LogLevel                string
 }
@@ -33,8 +80,11 @@ type Config struct {
 func New() *Config {
 	return &Config{
 		LogLevel:                "info",
+		ImapAuthMechanism:       "LOGIN",
+		ImapTLSMode:             "auto",
 		MarkLearnedAsSpamAsRead: true,
 		TempDir:                 os.TempDir(),
+		RspamdUnavailableAfter:  Duration{5 * time.Minute},
 	}
 }
 
@@ -49,6 +99,10 @@ func (c *Config) String() string {
 
 	sb.WriteString("Configuration:\n")
 	printKv("Rspamd URL", c.RspamdURL)
+	if urls := c.RspamdURLs(); len(urls) > 1 {
+		printKv("Rspamd Primary URL", cmp.Or(c.RspamdPrimaryURL, urls[0]))
+		printKv("Rspamd Balancing", cmp.Or(c.RspamdBalancing, "priority"))
+	}
 
 	if c.RspamdPassword == "" {
 		printKv("Rspamd Password", unset)
@@ -56,8 +110,21 @@ func (c *Config) String() string {
 		printKv("Rspamd Password", hiddenPasswd)
 	}
 
+	if c.RspamdFuzzyFlag > 0 {
+		printKv("Rspamd Fuzzy Flag", c.RspamdFuzzyFlag)
+		printKv("Rspamd Fuzzy Weight", cmp.Or(c.RspamdFuzzyWeight, 1))
+	}
+	printKv("Rspamd Compression", c.RspamdCompression)
+	printKv("Rspamd Unavailable Policy", cmp.Or(c.RspamdUnavailablePolicy, "fail-closed"))
+	printKv("Rspamd Unavailable After", c.RspamdUnavailableAfter)
+	printKv("Rspamd Cache TTL", c.RspamdCacheTTL)
+	if c.RspamdCacheTTL.Duration > 0 {
+		printKv("Rspamd Cache Max Entries", cmp.Or(c.RspamdCacheMaxEntries, 1000))
+	}
+
 	printKv("IMAP Server Address", c.ImapAddr)
 	printKv("IMAP User", c.ImapUser)
+	printKv("Maildir", c.Maildir)
 
 	if c.ImapPassword == "" {
 		printKv("IMAP Password", unset)
@@ -65,22 +132,108 @@ func (c *Config) String() string {
 		printKv("IMAP Password", hiddenPasswd)
 	}
 
-	printKv("Spam Treshold", c.SpamThreshold)
+	printKv("IMAP Auth Mechanism", c.ImapAuthMechanism)
+	if c.UsesOAuth2() {
+		printKv("OAuth2 Token URL", c.OAuth2TokenURL)
+		printKv("OAuth2 Client ID", c.OAuth2ClientID)
+
+		if c.OAuth2ClientSecret == "" {
+			printKv("OAuth2 Client Secret", unset)
+		} else {
+			printKv("OAuth2 Client Secret", hiddenPasswd)
+		}
+
+		if c.OAuth2RefreshToken == "" {
+			printKv("OAuth2 Refresh Token", unset)
+		} else {
+			printKv("OAuth2 Refresh Token", hiddenPasswd)
+		}
+
+		printKv("OAuth2 Scopes", strings.Join(c.OAuth2Scopes, " "))
+	}
+
+	printKv("IMAP TLS Mode", c.ImapTLSMode)
+	if c.ImapTLSCAFile != "" {
+		printKv("IMAP TLS CA File", c.ImapTLSCAFile)
+	}
+	if c.ImapTLSServerName != "" {
+		printKv("IMAP TLS Server Name", c.ImapTLSServerName)
+	}
+	if c.ImapTLSClientCertFile != "" {
+		printKv("IMAP TLS Client Cert File", c.ImapTLSClientCertFile)
+		printKv("IMAP TLS Client Key File", c.ImapTLSClientKeyFile)
+	}
+	if len(c.ImapTLSPinnedCertSHA256) > 0 {
+		printKv("IMAP TLS Pinned Certs", strings.Join(c.ImapTLSPinnedCertSHA256, ", "))
+	}
+
+	if c.ImapProxy != "" {
+		// the URL can contain the proxy password
+		if u, err := url.Parse(c.ImapProxy); err == nil {
+			printKv("IMAP Proxy", u.Redacted())
+		} else {
+			printKv("IMAP Proxy", "INVALID")
+		}
+	}
+
+	printKv("IMAP Allow EXPUNGE", c.ImapAllowExpunge)
+	printKv("IMAP Disable Compression", c.ImapDisableCompression)
+	if c.ImapQuotaMinFreeKiB > 0 {
+		printKv("IMAP Quota Min Free (KiB)", c.ImapQuotaMinFreeKiB)
+	}
+
+	if c.SpamThreshold == 0 {
+		printKv("Spam Treshold", "required score reported by rspamd")
+	} else {
+		printKv("Spam Treshold", c.SpamThreshold)
+	}
 	printKv("Scan Mailbox", c.ScanMailbox)
 	printKv("Inbox Mailbox", c.InboxMailbox)
 	printKv("Spam Mailbox", c.SpamMailbox)
 	printKv("Undetected Mailbox", c.UndetectedMailbox)
 	printKv("Backup Mailbox", c.BackupMailbox)
+	if c.PendingMailbox != "" {
+		printKv("Pending Mailbox", c.PendingMailbox)
+	}
+	printKv("Skipped Policy", cmp.Or(c.SkippedPolicy, "pass"))
+	printKv("Greylist Policy", cmp.Or(c.GreylistPolicy, "pass"))
+	if c.RescanDelay.Duration != 0 {
+		printKv("Rescan Delay", c.RescanDelay)
+	}
+	if c.MaxRescans != 0 {
+		printKv("Max Rescans", c.MaxRescans)
+	}
+	if c.LateRescanMargin > 0 {
+		printKv("Late Rescan Margin", c.LateRescanMargin)
+	}
+	if c.LateRescanDelay.Duration != 0 {
+		printKv("Late Rescan Delay", c.LateRescanDelay)
+	}
+	printKv("Create Missing Mailboxes", c.CreateMissingMailboxes)
+	printKv("Detect Special-Use Mailboxes", c.DetectSpecialUse)
 	printKv("Mark Learned Spam as Read", c.MarkLearnedAsSpamAsRead)
+	printKv("Tag Only", c.TagOnly)
+	printKv("LMTP Address", c.LMTPAddr)
+	printKv("LMTP Recipient", c.LMTPRecipient)
+	printKv("LMTP Spam Recipient", c.LMTPSpamRecipient)
+	printKv("Spam Flags", c.SpamFlags)
+	printKv("Inbox Flags", c.InboxFlags)
 
 	printKv("Temporary Directory", c.TempDir)
 	printKv("Keep Temporary Files", c.KeepTempFiles)
+	printKv("Sync State File", c.SyncStateFile)
+	printKv("Learn Spool Directory", c.LearnSpoolDir)
 	printKv("Log IMAP Data", c.LogIMAPData)
+	printKv("Log IMAP Data Max Body Size", c.LogIMAPDataMaxBodySize)
 	printKv("Log Level", c.LogLevel)
 
 	sb.WriteRune('\n')
 	fmt.Fprintf(&sb, "Mails in %q are scanned and backuped to %q.\n", c.ScanMailbox, c.BackupMailbox)
-	fmt.Fprintf(&sb, "Mails with a spam score of >=%f are moved to %q,\n", c.SpamThreshold, c.SpamMailbox)
+	if c.SpamThreshold == 0 {
+		fmt.Fprintf(&sb, "Mails with a spam score of >= the required score of rspamd are moved to %q,\n", c.SpamMailbox)
+	} else {
+		fmt.Fprintf(&sb, "Mails with a spam score of >=%f are moved to %q,\n", c.SpamThreshold, c.SpamMailbox)
+	}
 	fmt.Fprintf(&sb, "others are moved to %q.\n", c.InboxMailbox)
 	if c.UndetectedMailbox != "" {
 		fmt.Fprintf(&sb, "Mails in %q are learned as Spam and moved to %q.\n", c.UndetectedMailbox, c.SpamMailbox)
@@ -90,6 +243,38 @@ func (c *Config) String() string {
 	return sb.String()
 }
 
+// RspamdURLs returns the URLs of the rspamd instances, RspamdURL is a comma
+// separated list.
+func (c *Config) RspamdURLs() []string {
+	var result []string
+
+	for url := range strings.SplitSeq(c.RspamdURL, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			result = append(result, url)
+		}
+	}
+
+	return result
+}
+
+// UsesOAuth2 returns true if an OAuth2 SASL mechanism is configured for the
+// IMAP authentication.
+func (c *Config) UsesOAuth2() bool {
+	switch strings.ToUpper(c.ImapAuthMechanism) {
+	case "XOAUTH2", "OAUTHBEARER":
+		return true
+	default:
+		return false
+	}
+}
+
+// UsesJMAP returns true if ImapAddr is the URL of a JMAP session resource
+// instead of the address of an IMAP server.
+func (c *Config) UsesJMAP() bool {
+	addr := strings.ToLower(c.ImapAddr)
+	return strings.HasPrefix(addr, "https://") || strings.HasPrefix(addr, "http://")
+}
+
 func FromFile(path string) (*Config, error) {
 	result := New()
 
@@ -121,6 +306,10 @@ func (c *Config) LoadCredentialsFromDirectory(dir string) error {
 		{"RspamdPassword", &c.RspamdPassword},
 		{"ImapUser", &c.ImapUser},
 		{"ImapPassword", &c.ImapPassword},
+		{"ImapProxy", &c.ImapProxy},
+		{"OAuth2ClientID", &c.OAuth2ClientID},
+		{"OAuth2ClientSecret", &c.OAuth2ClientSecret},
+		{"OAuth2RefreshToken", &c.OAuth2RefreshToken},
 	}
 
 	for _, cred := range credentials {
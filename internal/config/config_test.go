@@ -3,7 +3,9 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/fho/rspamd-iscan/internal/testutils/assert"
 )
@@ -79,3 +81,50 @@ func TestDefaults(t *testing.T) {
 	assert.Equal(t, cfg.MarkLearnedAsSpamAsRead, true)
 	assert.Equal(t, cfg.LogLevel, "info")
 }
+
+func TestLoadCredentialsFromDirectory_OAuth2(t *testing.T) {
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "OAuth2ClientSecret"), []byte("clientsecret\n"), 0o600)
+	_ = os.WriteFile(filepath.Join(dir, "OAuth2RefreshToken"), []byte("refreshtoken\n"), 0o600)
+
+	cfg := &Config{ImapAuthMechanism: "xoauth2", OAuth2ClientID: "id"}
+	err := cfg.LoadCredentialsFromDirectory(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, "id", cfg.OAuth2ClientID)
+	assert.Equal(t, "clientsecret", cfg.OAuth2ClientSecret)
+	assert.Equal(t, "refreshtoken", cfg.OAuth2RefreshToken)
+	assert.Equal(t, true, cfg.UsesOAuth2())
+}
+
+func TestUsesJMAP(t *testing.T) {
+	for addr, expected := range map[string]bool{
+		"imap.example.com:993":                      false,
+		"https://api.fastmail.com/jmap/session":     true,
+		"HTTPS://mail.example.com/.well-known/jmap": true,
+		"http://localhost:8080/jmap/session":        true,
+	} {
+		cfg := Config{ImapAddr: addr}
+		assert.Equal(t, expected, cfg.UsesJMAP())
+	}
+}
+
+func TestFromFile_Duration(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "cfg.toml")
+	assert.NoError(t, os.WriteFile(f, []byte(`RescanDelay = "1h30m"`), 0o600))
+
+	cfg, err := FromFile(f)
+	assert.NoError(t, err)
+	assert.Equal(t, 90*time.Minute, cfg.RescanDelay.Duration)
+
+	assert.NoError(t, os.WriteFile(f, []byte(`RescanDelay = "90"`), 0o600))
+	_, err = FromFile(f)
+	assert.Error(t, err)
+}
+
+func TestRspamdURLs(t *testing.T) {
+	cfg := Config{RspamdURL: "http://rspamd1:11334, http://rspamd2:11334,"}
+	assert.Equal(t, "http://rspamd1:11334|http://rspamd2:11334", strings.Join(cfg.RspamdURLs(), "|"))
+
+	cfg.RspamdURL = ""
+	assert.Equal(t, 0, len(cfg.RspamdURLs()))
+}
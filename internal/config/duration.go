@@ -0,0 +1,20 @@
+package config
+
+import "time"
+
+// Duration is a [time.Duration] that is specified as string in the config
+// file, e.g. "15m" or "1h30m".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
@@ -0,0 +1,143 @@
+package imapclt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-sasl"
+)
+
+// Supported authentication mechanisms.
+const (
+	AuthLogin       = "LOGIN"
+	AuthXOAuth2     = "XOAUTH2"
+	AuthOAuthBearer = "OAUTHBEARER"
+)
+
+// TokenSource provides OAuth2 access tokens.
+type TokenSource interface {
+	// Token returns a valid access token, it is refreshed if needed.
+	Token(context.Context) (string, error)
+	// Invalidate discards a cached token.
+	Invalidate()
+}
+
+// IsSupportedAuthMechanism returns true if mech is one of the mechanisms
+// supported by [Client].
+func IsSupportedAuthMechanism(mech string) bool {
+	switch strings.ToUpper(mech) {
+	case "", AuthLogin, AuthXOAuth2, AuthOAuthBearer:
+		return true
+	default:
+		return false
+	}
+}
+
+// xoauth2Client implements the non-standard XOAUTH2 SASL mechanism used by
+// Google and Microsoft.
+// https://developers.google.com/workspace/gmail/imap/xoauth2-protocol
+type xoauth2Client struct {
+	user  string
+	token string
+}
+
+func (c *xoauth2Client) Start() (string, []byte, error) {
+	ir := "user=" + c.user + "\x01auth=Bearer " + c.token + "\x01\x01"
+	return AuthXOAuth2, []byte(ir), nil
+}
+
+// Next is called when the server sends an error challenge, the response is
+// an empty message, afterwards the server responds with a tagged NO.
+func (*xoauth2Client) Next([]byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// oauthBearerClient wraps the OAUTHBEARER client of go-sasl.
+// When the server sends an error challenge, the client has to respond with a
+// dummy response (RFC 7628, section 3.2.3), the go-sasl client aborts the
+// exchange instead, which is not understood by all servers.
+type oauthBearerClient struct {
+	sasl.Client
+}
+
+func (c *oauthBearerClient) Next(challenge []byte) ([]byte, error) {
+	_, err := c.Client.Next(challenge)
+	if _, ok := errors.AsType[*sasl.OAuthBearerError](err); ok {
+		return []byte{0x01}, nil
+	}
+
+	return nil, err
+}
+
+// authenticate logs in to the IMAP server with the configured mechanism.
+func (c *Client) authenticate() error {
+	switch c.authMechanism {
+	case "", AuthLogin:
+		return c.clt.Login(c.user, c.password).Wait()
+
+	case AuthXOAuth2, AuthOAuthBearer:
+		err := c.authenticateOAuth()
+		if err == nil || !isAuthRejectedErr(err) {
+			return err
+		}
+
+		// the cached token might have been revoked, retry once with a
+		// freshly requested one
+		c.logger.Info("oauth authentication failed, retrying with a new access token",
+			"error", err, "imap.auth_mechanism", c.authMechanism)
+		c.tokenSource.Invalidate()
+		return c.authenticateOAuth()
+
+	default:
+		return fmt.Errorf("unsupported authentication mechanism: %q", c.authMechanism)
+	}
+}
+
+func (c *Client) authenticateOAuth() error {
+	if c.tokenSource == nil {
+		return errors.New("oauth authentication mechanism configured but token source is nil")
+	}
+
+	token, err := c.tokenSource.Token(context.Background())
+	if err != nil {
+		return fmt.Errorf("retrieving oauth2 access token failed: %w", err)
+	}
+
+	var saslClt sasl.Client
+	if c.authMechanism == AuthXOAuth2 {
+		saslClt = &xoauth2Client{user: c.user, token: token}
+	} else {
+		opts := sasl.OAuthBearerOptions{Username: c.user, Token: token}
+		if host, port, err := net.SplitHostPort(c.address); err == nil {
+			opts.Host = host
+			opts.Port, _ = strconv.Atoi(port)
+		}
+		saslClt = &oauthBearerClient{Client: sasl.NewOAuthBearerClient(&opts)}
+	}
+
+	return c.clt.Authenticate(saslClt)
+}
+
+// isAuthRejectedErr returns true if err is a NO response of the server to
+// AUTHENTICATE.
+func isAuthRejectedErr(err error) bool {
+	var imapErr *imap.Error
+
+	if errors.As(err, &imapErr) {
+		return imapErr.Type == imap.StatusResponseTypeNo
+	}
+
+	return false
+}
+
+func (c *Client) authMechanismName() string {
+	if c.authMechanism == "" {
+		return AuthLogin
+	}
+	return c.authMechanism
+}
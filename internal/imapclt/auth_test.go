@@ -0,0 +1,92 @@
+package imapclt
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/imapserver"
+)
+
+type staticTokenSource struct {
+	tokens      []string
+	err         error
+	invalidated int
+}
+
+func (s *staticTokenSource) Token(context.Context) (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	return s.tokens[min(s.invalidated, len(s.tokens)-1)], nil
+}
+
+func (s *staticTokenSource) Invalidate() {
+	s.invalidated++
+}
+
+func testOAuthClient(t *testing.T, srv *imapserver.Server, mech string, ts TokenSource) *Client {
+	cfg := testClientCfg(t, srv)
+	cfg.Password = ""
+	cfg.AuthMechanism = mech
+	cfg.TokenSource = ts
+
+	return NewClient(cfg)
+}
+
+func TestAuthenticateOAuth(t *testing.T) {
+	srv := imapserver.StartServer(t)
+
+	for _, mech := range []string{AuthXOAuth2, AuthOAuthBearer} {
+		t.Run(mech, func(t *testing.T) {
+			clt := testOAuthClient(t, srv, mech, &staticTokenSource{
+				tokens: []string{srv.OAuthAccessToken},
+			})
+			assert.NoError(t, clt.Connect())
+			t.Cleanup(func() { _ = clt.Close() })
+
+			for _, err := range clt.Messages(srv.InboxMailBox, nil) {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticateOAuth_RetriesWithNewToken(t *testing.T) {
+	srv := imapserver.StartServer(t)
+
+	for _, mech := range []string{AuthXOAuth2, AuthOAuthBearer} {
+		t.Run(mech, func(t *testing.T) {
+			ts := staticTokenSource{tokens: []string{"expired", srv.OAuthAccessToken}}
+			clt := testOAuthClient(t, srv, mech, &ts)
+			assert.NoError(t, clt.Connect())
+			t.Cleanup(func() { _ = clt.Close() })
+			assert.Equal(t, 1, ts.invalidated)
+		})
+	}
+}
+
+func TestAuthenticateOAuth_InvalidToken(t *testing.T) {
+	srv := imapserver.StartServer(t)
+
+	for _, mech := range []string{AuthXOAuth2, AuthOAuthBearer} {
+		t.Run(mech, func(t *testing.T) {
+			clt := testOAuthClient(t, srv, mech, &staticTokenSource{
+				tokens: []string{"invalid"},
+			})
+			assert.Error(t, clt.Connect())
+			t.Cleanup(func() { _ = clt.Close() })
+		})
+	}
+}
+
+func TestAuthenticateOAuth_TokenErrorIsNotRetried(t *testing.T) {
+	srv := imapserver.StartServer(t)
+
+	ts := staticTokenSource{err: errors.New("token endpoint unreachable")}
+	clt := testOAuthClient(t, srv, AuthXOAuth2, &ts)
+	assert.Error(t, clt.Connect())
+	t.Cleanup(func() { _ = clt.Close() })
+	assert.Equal(t, 0, ts.invalidated)
+}
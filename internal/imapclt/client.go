@@ -1,12 +1,17 @@
 package imapclt
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,11 +19,19 @@ import (
 	"github.com/emersion/go-imap/v2/imapclient"
 
 	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/proxy"
 )
 
 const (
 	defChanBufSiz = 1
 	dialTimeout   = 120 * time.Second
+	// uploadPipelineDepth is the maximum number of APPEND commands that
+	// are sent by [Client.UploadBatch] before waiting for their tagged
+	// responses.
+	uploadPipelineDepth = 50
+	// literalMinusMaxSize is the maximum size of a non-synchronizing
+	// literal with LITERAL- (RFC 7888).
+	literalMinusMaxSize = 4096
 )
 
 type Client struct {
@@ -26,29 +39,72 @@ type Client struct {
 	user          string
 	password      string
 	allowInsecure bool
+	authMechanism string
+	tokenSource   TokenSource
+	tlsMode       string
+	tlsConfig     *tls.Config
+	proxy         *url.URL
 
-	clt         *imapclient.Client
-	logger      *slog.Logger
-	logIMAPData bool
+	allowExpungeFallback bool
+	disableCompression   bool
+
+	clt *imapclient.Client
+	// compressConn is the connection used by clt, it is nil when
+	// compression is disabled or not supported for the connection
+	compressConn *compressConn
+	logger       *slog.Logger
+	logIMAPData  bool
+
+	logIMAPDataMaxBodySize int
 
 	newMessagesCh chan<- *EventNewMessages
 	mu            sync.Mutex
 }
 
 type Config struct {
-	// Address is the address of the IMAP server. If the port is "993" or
-	// "imaps" an implicit TLS (SSL) is established.
-	// Otherwise a explicitl TLS (STARTTLS) connection is established.
+	// Address is the address of the IMAP server.
 	Address  string
 	User     string
 	Password string
+	// AuthMechanism is the SASL mechanism used for authentication, one of
+	// [AuthLogin], [AuthXOAuth2] or [AuthOAuthBearer].
+	// If empty, [AuthLogin] is used.
+	AuthMechanism string
+	// TokenSource provides the access tokens for the OAuth2 mechanisms,
+	// it must be set when AuthMechanism is [AuthXOAuth2] or
+	// [AuthOAuthBearer].
+	TokenSource TokenSource
+	// TLSMode is one of [TLSModeAuto], [TLSModeImplicit] or
+	// [TLSModeStartTLS]. If empty, [TLSModeAuto] is used.
+	TLSMode string
+	// TLSConfig is optional, if nil the default configuration is used.
+	// It can be created via [NewTLSConfig].
+	TLSConfig *tls.Config
+	// Proxy is optional, if set connections are established via the
+	// SOCKS5 or HTTP CONNECT proxy, see [proxy.NewDialer] for the
+	// supported URLs.
+	Proxy *url.URL
+	// AllowExpungeFallback allows to move messages via COPY, STORE
+	// \Deleted and EXPUNGE when the server supports neither MOVE nor
+	// UIDPLUS.
+	// EXPUNGE also permanently removes all other messages in the mailbox
+	// that are flagged as \Deleted.
+	AllowExpungeFallback bool
+	// DisableCompression disables enabling DEFLATE compression (RFC 4978)
+	// when the server supports it.
+	DisableCompression bool
 	// AllowInsecure enables falling back to establishing the
 	// connection without encryption when the server does not support TLS
 	AllowInsecure bool
 	Logger        *slog.Logger
 	// LogIMAPData enables logging raw IMAP protocol data with debug
-	// priority, it can contain sensitive information
+	// priority, credentials are redacted but message data can contain
+	// sensitive information
 	LogIMAPData bool
+	// LogIMAPDataMaxBodySize is optional, if positive logged message
+	// literals of FETCH responses and APPEND commands are truncated to
+	// this number of bytes.
+	LogIMAPDataMaxBodySize int
 }
 
 type EventNewMessages struct {
@@ -63,8 +119,18 @@ func NewClient(cfg *Config) *Client {
 		user:          cfg.User,
 		password:      cfg.Password,
 		allowInsecure: cfg.AllowInsecure,
+		authMechanism: strings.ToUpper(cfg.AuthMechanism),
+		tokenSource:   cfg.TokenSource,
+		tlsMode:       strings.ToLower(cfg.TLSMode),
+		tlsConfig:     cfg.TLSConfig,
+		proxy:         cfg.Proxy,
 		logger:        log.EnsureLoggerInstance(cfg.Logger),
 		logIMAPData:   cfg.LogIMAPData,
+
+		logIMAPDataMaxBodySize: cfg.LogIMAPDataMaxBodySize,
+
+		allowExpungeFallback: cfg.AllowExpungeFallback,
+		disableCompression:   cfg.DisableCompression,
 	}
 }
 
@@ -72,14 +138,13 @@ func NewClient(cfg *Config) *Client {
 func (c *Client) Connect() error {
 	var debugWriter io.Writer
 	if c.logIMAPData {
-		debugWriter = NewDebugWriter(c.logger)
+		debugWriter = NewDebugWriter(c.logger, c.logIMAPDataMaxBodySize)
 	}
 
 	clt, err := c.dial(c.address, c.allowInsecure, &imapclient.Options{
 		UnilateralDataHandler: &imapclient.UnilateralDataHandler{
 			Mailbox: c.mailboxUpdateHandler,
 		},
-		Dialer:      &net.Dialer{Timeout: dialTimeout},
 		DebugWriter: debugWriter,
 	})
 	if err != nil {
@@ -87,41 +152,144 @@ func (c *Client) Connect() error {
 	}
 	c.clt = clt
 
-	if err := clt.Login(c.user, c.password).Wait(); err != nil {
+	if err := c.authenticate(); err != nil {
 		return fmt.Errorf("login at imap server failed: %w", err)
 	}
 
+	if err := c.enableCompression(); err != nil {
+		return fmt.Errorf("enabling compression failed: %w", err)
+	}
+
 	c.logger.Info("connection established, authentication succeeded",
-		"event", "imap.connection_established")
+		"event", "imap.connection_established",
+		"imap.auth_mechanism", c.authMechanismName())
 
 	return nil
 }
 
 func (c *Client) Close() error {
+	c.logCompressionStats()
 	return c.clt.Close()
 }
 
 func (c *Client) dial(address string, allowInsecure bool, opts *imapclient.Options) (*imapclient.Client, error) {
-	_, port, err := net.SplitHostPort(address)
+	c.compressConn = nil
+
+	tlsMode, err := resolveTLSMode(c.tlsMode, address)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, err := c.dialer()
 	if err != nil {
 		return nil, err
 	}
 
 	logger := c.logger.With("server", address).With("timeout", dialTimeout)
+	if c.proxy != nil {
+		logger = logger.With("proxy", c.proxy.Redacted())
+	}
 
-	if port == "993" || port == "imaps" {
-		logger.Debug("connecting to imap server", "tlsmode", "implicit")
-		return imapclient.DialTLS(address, opts)
+	tlsCfg := withConnectionLogging(c.tlsConfig, c.logger, tlsMode)
+	if tlsCfg.ServerName == "" {
+		tlsCfg.ServerName = host
 	}
+	opts.TLSConfig = tlsCfg
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
 
-	logger.Debug("connecting to imap server", "tlsmode", "explicit")
-	clt, err := imapclient.DialStartTLS(address, opts)
+	logger.Debug("connecting to imap server", "tlsmode", tlsMode)
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsMode == TLSModeImplicit {
+		if tlsCfg.NextProtos == nil {
+			tlsCfg.NextProtos = []string{"imap"}
+		}
+
+		tlsConn := tls.Client(conn, tlsCfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+
+		return imapclient.New(c.wrapConn(tlsConn), opts), nil
+	}
+
+	// STARTTLS is negotiated before the connection is passed to
+	// imapclient. [imapclient.NewStartTLS] wraps its connection in a
+	// tls.Conn internally and offers no hook to add a layer above it, the
+	// compression layer would end up below TLS, compressing encrypted
+	// data. Negotiating it here only requires reading the greeting and
+	// the tagged STARTTLS response before the handshake, the synthetic
+	// greeting of [startTLS] is read by imapclient instead of the real
+	// one, RFC 9051 forbids the server to send another after STARTTLS.
+	tlsConn, err := startTLS(ctx, conn, tlsCfg)
+	if err != nil {
+		_ = conn.Close()
+	}
 	if err != nil && allowInsecure && isStartTLSNotSupportedErr(err) {
 		logger.Warn("establishing secure connection failed, connecting without encryption", "tlsmode", "none", "error", err)
-		return imapclient.DialInsecure(address, opts)
+
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+
+		return imapclient.New(c.wrapConn(conn), opts), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return imapclient.New(c.wrapConn(tlsConn), opts), nil
+}
+
+// dialer returns the dialer that is used to connect to the IMAP server.
+func (c *Client) dialer() (proxy.Dialer, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	if c.proxy == nil {
+		return d, nil
 	}
 
-	return clt, err
+	pd, err := proxy.NewDialer(c.proxy, d)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy configuration: %w", err)
+	}
+
+	return pd, nil
+}
+
+// resolveTLSMode returns the TLS mode that is used to connect to address.
+// For [TLSModeAuto], [TLSModeImplicit] is returned if the port is "993" or
+// "imaps", otherwise [TLSModeStartTLS].
+func resolveTLSMode(mode, address string) (string, error) {
+	switch mode {
+	case TLSModeImplicit, TLSModeStartTLS:
+		return mode, nil
+	case "", TLSModeAuto:
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return "", err
+		}
+
+		if port == "993" || port == "imaps" {
+			return TLSModeImplicit, nil
+		}
+
+		return TLSModeStartTLS, nil
+	default:
+		return "", fmt.Errorf("unsupported tls mode: %q", mode)
+	}
 }
 
 func isStartTLSNotSupportedErr(err error) bool {
@@ -154,45 +322,159 @@ func (c *Client) mailboxUpdateHandler(d *imapclient.UnilateralDataMailbox) {
 }
 
 // Upload reads a message (mail) from file and appends it to an imap mailbox.
-// The internal date of the message is set to ts.
-func (c *Client) Upload(path, mailbox string, ts time.Time) error {
-	fi, err := os.Stat(path)
+// The internal date of the message is set to ts and the message is stored
+// with flags.
+// The \Recent flag can not be set by clients, it is ignored.
+func (c *Client) Upload(path, mailbox string, ts time.Time, flags []string) error {
+	appendCmd, _, err := c.startAppend(path, mailbox, ts, flags)
 	if err != nil {
 		return err
 	}
 
+	_, err = appendCmd.Wait()
+	if err != nil {
+		return fmt.Errorf("waiting for append to finish failed: %w", err)
+	}
+
+	c.logger.Debug(
+		"uploaded message to imap mailbox",
+		lkMailbox, mailbox,
+		"event", "imap.message_uploaded",
+		"filepath", path,
+		"imap.flags", flags,
+	)
+
+	return nil
+}
+
+// UploadRequest describes a message that is uploaded by
+// [Client.UploadBatch].
+type UploadRequest struct {
+	Path    string
+	Mailbox string
+	Time    time.Time
+	Flags   []string
+}
+
+// UploadBatch uploads multiple messages like [Client.Upload].
+// The APPEND commands are pipelined, up to [uploadPipelineDepth] commands
+// are sent before waiting for their tagged responses.
+// imapclient sends a message as synchronizing literal if it is larger than
+// [literalMinusMaxSize] or the server does not support LITERAL-, even if the
+// server supports LITERAL+, MULTIAPPEND is not supported. Sending such a
+// command blocks until the server requested the message with a continuation
+// request, pipelining then only saves waiting for the completion of the
+// previous commands.
+// It returns a slice with an error for each request, the error is nil if
+// the message was uploaded successfully.
+func (c *Client) UploadBatch(reqs []*UploadRequest) []error {
+	errs := make([]error, len(reqs))
+	var syncLiterals int
+
+	offset := 0
+	for chunk := range slices.Chunk(reqs, uploadPipelineDepth) {
+		cmds := make([]*imapclient.AppendCommand, len(chunk))
+
+		for i, req := range chunk {
+			var size int64
+			cmds[i], size, errs[offset+i] = c.startAppend(req.Path, req.Mailbox, req.Time, req.Flags)
+			if cmds[i] != nil && c.isSyncLiteral(size) {
+				syncLiterals++
+			}
+		}
+
+		for i, cmd := range cmds {
+			if cmd == nil {
+				continue
+			}
+
+			if _, err := cmd.Wait(); err != nil {
+				errs[offset+i] = fmt.Errorf("waiting for append to finish failed: %w", err)
+				continue
+			}
+
+			c.logger.Debug(
+				"uploaded message to imap mailbox",
+				lkMailbox, chunk[i].Mailbox,
+				"event", "imap.message_uploaded",
+				"filepath", chunk[i].Path,
+				"imap.flags", chunk[i].Flags,
+			)
+		}
+
+		offset += len(chunk)
+	}
+
+	if len(reqs) > 1 && syncLiterals > 0 {
+		c.logger.Debug(
+			"messages were sent as synchronizing literals, their APPEND commands were only partially pipelined",
+			"event", "imap.append_sync_literals",
+			"count", syncLiterals,
+			"imap.literal_minus", c.clt.Caps().Has(imap.CapLiteralMinus),
+			"imap.literal_plus", c.clt.Caps().Has(imap.CapLiteralPlus),
+		)
+	}
+
+	return errs
+}
+
+// isSyncLiteral returns true if imapclient sends a literal of size bytes as
+// synchronizing literal, the command waits for a continuation request of the
+// server before the literal is sent.
+func (c *Client) isSyncLiteral(size int64) bool {
+	return size > literalMinusMaxSize || !c.clt.Caps().Has(imap.CapLiteralMinus)
+}
+
+// startAppend sends an APPEND command with the message read from the file
+// at path, without waiting for its completion.
+// It returns the command and the size of the message.
+func (c *Client) startAppend(path, mailbox string, ts time.Time, flags []string) (*imapclient.AppendCommand, int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
 	fd, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 	defer fd.Close()
 
-	appendCmd := c.clt.Append(mailbox, fi.Size(), &imap.AppendOptions{Time: ts})
+	appendCmd := c.clt.Append(mailbox, fi.Size(), &imap.AppendOptions{
+		Time:  ts,
+		Flags: appendFlags(flags),
+	})
 
 	_, err = io.Copy(appendCmd, fd)
 	if err != nil {
 		_ = appendCmd.Close()
-		return fmt.Errorf("uploading mail to imap mailbox failed: %w", err)
+		return nil, 0, fmt.Errorf("uploading mail to imap mailbox failed: %w", err)
 	}
 
 	err = appendCmd.Close()
 	if err != nil {
-		return fmt.Errorf("closing append command failed: %w", err)
+		return nil, 0, fmt.Errorf("closing append command failed: %w", err)
 	}
 
-	_, err = appendCmd.Wait()
-	if err != nil {
-		return fmt.Errorf("waiting for append to finish failed: %w", err)
-	}
+	return appendCmd, fi.Size(), nil
+}
 
-	c.logger.Debug(
-		"uploaded message to imap mailbox",
-		lkMailbox, mailbox,
-		"event", "imap.message_uploaded",
-		"filepath", path,
-	)
+// flagRecent is the IMAP4rev1 \Recent flag, it is not defined in the
+// imap package because it was removed in IMAP4rev2.
+const flagRecent = `\Recent`
 
-	return nil
+func appendFlags(flags []string) []imap.Flag {
+	result := make([]imap.Flag, 0, len(flags))
+
+	for _, f := range flags {
+		// the case of system flags is not significant
+		if strings.EqualFold(f, flagRecent) {
+			continue
+		}
+		result = append(result, imap.Flag(f))
+	}
+
+	return result
 }
 
 // Monitor starts to monitor mailbox for new messages.
@@ -259,13 +541,28 @@ func asUIDSet(uids []uint32) imap.UIDSet {
 	return result
 }
 
-// Move moves the messages with the given uids to mailbox.
+// Move moves the messages with the given uids from the currently selected
+// mailbox to mailbox.
+// If the server does not support the MOVE extension, the messages are
+// copied, flagged as \Deleted and expunged via UID EXPUNGE. If UIDPLUS is
+// also not supported, EXPUNGE is only used when AllowExpungeFallback is
+// enabled.
 func (c *Client) Move(uids []uint32, mailbox string) error {
 	if len(uids) == 0 {
 		return errors.New("no uids were given")
 	}
 
-	_, err := c.clt.Move(asUIDSet(uids), mailbox).Wait()
+	strategy, err := c.moveStrategy()
+	if err != nil {
+		return err
+	}
+
+	uidSet := asUIDSet(uids)
+	if strategy == moveStrategyMove {
+		_, err = c.clt.Move(uidSet, mailbox).Wait()
+	} else {
+		err = c.copyAndExpunge(uidSet, mailbox, strategy)
+	}
 	if err != nil {
 		return err
 	}
@@ -275,36 +572,107 @@ func (c *Client) Move(uids []uint32, mailbox string) error {
 		lkMailbox, mailbox,
 		"count", len(uids),
 		"event", "imap.messages_moved",
+		"imap.move_strategy", strategy,
 	)
-	return err
+
+	return nil
 }
 
 // MarkSeen adds the \Seen flag to the messages with the given UIDs in the
 // currently selected mailbox.
 func (c *Client) MarkSeen(uids []uint32) error {
+	if err := c.storeFlags(uids, imap.StoreFlagsAdd, []imap.Flag{imap.FlagSeen}); err != nil {
+		return fmt.Errorf("marking messages as seen failed: %w", err)
+	}
+
+	c.logger.Debug(
+		"marked imap messages as seen",
+		"count", len(uids),
+		"event", "imap.messages_marked_seen",
+	)
+
+	return nil
+}
+
+// AddFlags adds flags to the messages with the given UIDs in the currently
+// selected mailbox.
+func (c *Client) AddFlags(uids []uint32, flags []string) error {
+	if err := c.storeFlags(uids, imap.StoreFlagsAdd, appendFlags(flags)); err != nil {
+		return fmt.Errorf("adding flags to messages failed: %w", err)
+	}
+
+	c.logger.Debug(
+		"added flags to imap messages",
+		"count", len(uids),
+		"event", "imap.messages_flags_added",
+		"imap.flags", flags,
+	)
+
+	return nil
+}
+
+// RemoveFlags removes flags from the messages with the given UIDs in the
+// currently selected mailbox.
+func (c *Client) RemoveFlags(uids []uint32, flags []string) error {
+	if err := c.storeFlags(uids, imap.StoreFlagsDel, appendFlags(flags)); err != nil {
+		return fmt.Errorf("removing flags from messages failed: %w", err)
+	}
+
+	c.logger.Debug(
+		"removed flags from imap messages",
+		"count", len(uids),
+		"event", "imap.messages_flags_removed",
+		"imap.flags", flags,
+	)
+
+	return nil
+}
+
+// Delete flags the messages with the given UIDs in the currently selected
+// mailbox as \Deleted and expunges them via UID EXPUNGE.
+// If the server does not support UIDPLUS, EXPUNGE is only used when
+// AllowExpungeFallback is enabled.
+func (c *Client) Delete(uids []uint32) error {
 	if len(uids) == 0 {
 		return errors.New("no uids were given")
 	}
 
-	storeCmd := c.clt.Store(asUIDSet(uids), &imap.StoreFlags{
-		Op:     imap.StoreFlagsAdd,
-		Silent: true,
-		Flags:  []imap.Flag{imap.FlagSeen},
-	}, nil)
+	strategy := moveStrategyUIDExpunge
+	if !c.clt.Caps().Has(imap.CapUIDPlus) {
+		if !c.allowExpungeFallback {
+			return errNoExpungeStrategy
+		}
+		strategy = moveStrategyExpunge
+	}
 
-	if err := storeCmd.Close(); err != nil {
-		return fmt.Errorf("marking messages as seen failed: %w", err)
+	uidSet := asUIDSet(uids)
+	if err := c.expunge(uidSet, strategy); err != nil {
+		return fmt.Errorf("deleting messages failed: %w", err)
 	}
 
 	c.logger.Debug(
-		"marked imap messages as seen",
+		"deleted imap messages",
 		"count", len(uids),
-		"event", "imap.messages_marked_seen",
+		"event", "imap.messages_deleted",
 	)
 
 	return nil
 }
 
+func (c *Client) storeFlags(uids []uint32, op imap.StoreFlagsOp, flags []imap.Flag) error {
+	if len(uids) == 0 {
+		return errors.New("no uids were given")
+	}
+
+	storeCmd := c.clt.Store(asUIDSet(uids), &imap.StoreFlags{
+		Op:     op,
+		Silent: true,
+		Flags:  flags,
+	}, nil)
+
+	return storeCmd.Close()
+}
+
 func (c *Client) setNewMessagesCH(ch chan<- *EventNewMessages) {
 	c.mu.Lock()
 	c.newMessagesCh = ch
@@ -16,7 +16,7 @@ func TestMonitor(t *testing.T) {
 	assert.NoError(t, err)
 
 	clt2 := newTestClient(t, srv)
-	assert.NoError(t, clt2.Upload(testMailPath, srv.InboxMailBox, time.Now()))
+	assert.NoError(t, clt2.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
 	_ = clt2.Close()
 
 	ev := <-ch
@@ -36,9 +36,9 @@ func TestMonitorChanIsNonBlocking(t *testing.T) {
 	assert.NoError(t, err)
 
 	clt2 := newTestClient(t, srv)
-	assert.NoError(t, clt2.Upload(testMailPath, srv.InboxMailBox, time.Now()))
+	assert.NoError(t, clt2.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
 
-	assert.NoError(t, clt2.Upload(testMailPath, srv.InboxMailBox, time.Now()))
+	assert.NoError(t, clt2.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
 	clt2.Close()
 
 	assert.NoError(t, stopFn())
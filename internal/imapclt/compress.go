@@ -0,0 +1,325 @@
+package imapclt
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// CapCompressDeflate is the capability of the COMPRESS=DEFLATE extension
+// (RFC 4978).
+const CapCompressDeflate imap.Cap = "COMPRESS=DEFLATE"
+
+const (
+	// compressTag is the tag of the COMPRESS command, it differs from the
+	// tags used by imapclient.
+	compressTag     = "Z1"
+	compressTimeout = 30 * time.Second
+)
+
+// compressConn is a connection that can be switched to DEFLATE compression
+// (RFC 4978).
+//
+// The COMPRESS command is sent by compressConn itself, bypassing the
+// imapclient that uses the connection. Until the tagged response is received,
+// data is read line by line and forwarded, except the tagged response.
+// Afterwards all data is compressed in both directions.
+type compressConn struct {
+	net.Conn
+
+	// br buffers the data read from Conn, it is only accessed by Read
+	br *bufio.Reader
+	// fr decompresses the data read from br, it is nil until compression
+	// was enabled. It is only accessed by Read.
+	fr io.Reader
+	// pending is the remainder of a line that was read while the COMPRESS
+	// command was in progress. It is only accessed by Read.
+	pending []byte
+
+	mu sync.Mutex
+	// tag is the tag of the COMPRESS command that is in progress
+	tag string
+	// result receives the outcome of the COMPRESS command
+	result chan error
+
+	wmu sync.Mutex
+	fw  *flate.Writer
+
+	// bytesIn and bytesOut are the number of bytes that were received and
+	// sent on Conn
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	// dataIn and dataOut are the number of uncompressed bytes
+	dataIn  atomic.Int64
+	dataOut atomic.Int64
+}
+
+// compressionStats are the number of bytes transferred on a connection.
+type compressionStats struct {
+	// Compressed is the number of bytes that were sent and received.
+	Compressed int64
+	// Uncompressed is the number of bytes the IMAP client sent and
+	// received.
+	Uncompressed int64
+}
+
+// Saved returns the number of bytes that were not transferred because of
+// compression.
+func (s *compressionStats) Saved() int64 {
+	return s.Uncompressed - s.Compressed
+}
+
+func newCompressConn(conn net.Conn) *compressConn {
+	c := compressConn{Conn: conn}
+	c.br = bufio.NewReader(countingReader{r: conn, n: &c.bytesIn})
+	return &c
+}
+
+// countingReader adds the number of bytes read from r to n.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+func (c *compressConn) Read(p []byte) (int, error) {
+	n, err := c.read(p)
+	c.dataIn.Add(int64(n))
+	return n, err
+}
+
+func (c *compressConn) read(p []byte) (int, error) {
+	for {
+		if len(c.pending) > 0 {
+			n := copy(p, c.pending)
+			c.pending = c.pending[n:]
+			return n, nil
+		}
+
+		if c.fr != nil {
+			return c.fr.Read(p)
+		}
+
+		// the mode is determined after data was received, when the
+		// COMPRESS command is sent while a Read is blocked, the
+		// response is not forwarded
+		if c.br.Buffered() == 0 {
+			if _, err := c.br.Peek(1); err != nil {
+				c.finishCompress(err)
+				return 0, err
+			}
+		}
+
+		tag := c.compressTag()
+		if tag == "" {
+			return c.br.Read(p)
+		}
+
+		line, err := c.br.ReadBytes('\n')
+		if err != nil {
+			c.finishCompress(err)
+			c.pending = line
+			if len(line) == 0 {
+				return 0, err
+			}
+			continue
+		}
+
+		if !bytes.HasPrefix(line, []byte(tag+" ")) {
+			c.pending = line
+			continue
+		}
+
+		status, text, _ := strings.Cut(strings.TrimSpace(string(line[len(tag)+1:])), " ")
+		if strings.ToUpper(status) != string(imap.StatusResponseTypeOK) {
+			c.finishCompress(&compressRejectedError{status: status, text: text})
+			continue
+		}
+
+		c.fr = flate.NewReader(c.br)
+		c.finishCompress(nil)
+	}
+}
+
+// compressRejectedError is returned when the server responded with NO or BAD
+// to the COMPRESS command.
+type compressRejectedError struct {
+	status string
+	text   string
+}
+
+func (e *compressRejectedError) Error() string {
+	return fmt.Sprintf("server rejected COMPRESS command: %s %s", e.status, e.text)
+}
+
+func (c *compressConn) compressTag() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.tag
+}
+
+// finishCompress sends err to the caller of [compressConn.startCompression],
+// if a COMPRESS command is in progress.
+func (c *compressConn) finishCompress(err error) {
+	c.mu.Lock()
+	ch := c.result
+	c.tag = ""
+	c.result = nil
+	c.mu.Unlock()
+
+	if ch != nil {
+		ch <- err
+	}
+}
+
+func (c *compressConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.fw == nil {
+		n, err := c.writeRaw(p)
+		c.dataOut.Add(int64(n))
+		return n, err
+	}
+
+	n, err := c.fw.Write(p)
+	if err == nil {
+		err = c.fw.Flush()
+	}
+	c.dataOut.Add(int64(n))
+
+	return n, err
+}
+
+// writeRaw writes p to the underlying connection.
+// c.wmu must be held.
+func (c *compressConn) writeRaw(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// startCompression sends the COMPRESS DEFLATE command and enables compression
+// when the server accepted it.
+// The IMAP client that uses the connection must not run any commands
+// concurrently.
+// If the server rejects the command an error is returned and the connection
+// can still be used without compression.
+func (c *compressConn) startCompression() error {
+	result := make(chan error, 1)
+
+	c.mu.Lock()
+	c.tag = compressTag
+	c.result = result
+	c.mu.Unlock()
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if _, err := c.writeRaw([]byte(compressTag + " COMPRESS DEFLATE\r\n")); err != nil {
+		c.finishCompress(nil)
+		return err
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			return err
+		}
+	case <-time.After(compressTimeout):
+		return errors.New("timeout waiting for response to COMPRESS command")
+	}
+
+	fw, err := flate.NewWriter(writerFunc(c.writeRaw), flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	c.fw = fw
+
+	return nil
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// enabled returns true if compression is active.
+func (c *compressConn) enabled() bool {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return c.fw != nil
+}
+
+func (c *compressConn) stats() *compressionStats {
+	return &compressionStats{
+		Compressed:   c.bytesIn.Load() + c.bytesOut.Load(),
+		Uncompressed: c.dataIn.Load() + c.dataOut.Load(),
+	}
+}
+
+// wrapConn returns conn wrapped in a [compressConn] and stores it in
+// c.compressConn, if compression is not disabled.
+func (c *Client) wrapConn(conn net.Conn) net.Conn {
+	if c.disableCompression {
+		return conn
+	}
+
+	c.compressConn = newCompressConn(conn)
+	return c.compressConn
+}
+
+// enableCompression enables DEFLATE compression when the server supports it.
+// If the server rejects the COMPRESS command, the connection is used
+// uncompressed.
+func (c *Client) enableCompression() error {
+	if c.disableCompression || !c.clt.Caps().Has(CapCompressDeflate) {
+		return nil
+	}
+
+	err := c.compressConn.startCompression()
+	if err != nil {
+		if _, ok := errors.AsType[*compressRejectedError](err); ok {
+			c.logger.Warn("enabling compression failed, continuing without compression", "error", err)
+			return nil
+		}
+		return err
+	}
+
+	c.logger.Info("compression enabled", "event", "imap.compression_enabled")
+
+	return nil
+}
+
+// logCompressionStats logs the number of bytes saved by compression.
+func (c *Client) logCompressionStats() {
+	if c.compressConn == nil || !c.compressConn.enabled() {
+		return
+	}
+
+	stats := c.compressConn.stats()
+	c.logger.Info("compression statistics",
+		"event", "imap.compression_stats",
+		"imap.bytes_compressed", stats.Compressed,
+		"imap.bytes_uncompressed", stats.Uncompressed,
+		"imap.bytes_saved", stats.Saved(),
+	)
+}
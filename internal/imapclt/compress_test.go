@@ -0,0 +1,83 @@
+package imapclt
+
+import (
+	"crypto/tls"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/imapserver"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+)
+
+func TestConnect_Compression(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		serverCompression bool
+		tlsMode           string
+		disable           bool
+		expectCompression bool
+	}{
+		{name: "enabled", serverCompression: true, expectCompression: true},
+		{name: "starttls", serverCompression: true, tlsMode: TLSModeStartTLS, expectCompression: true},
+		{name: "implicit_tls", serverCompression: true, tlsMode: TLSModeImplicit, expectCompression: true},
+		{name: "disabled", serverCompression: true, disable: true},
+		{name: "unsupported_by_server"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var opts []imapserver.Option
+			if tc.serverCompression {
+				opts = append(opts, imapserver.WithCompression())
+			}
+
+			var serverCert *imapserver.Cert
+			if tc.tlsMode != "" {
+				serverCert = imapserver.GenerateCert(t, testTLSServerName)
+				opts = append(opts, imapserver.WithTLS(&tls.Config{
+					Certificates: []tls.Certificate{serverCert.TLSCert},
+					MinVersion:   tls.VersionTLS12,
+				}, tc.tlsMode == TLSModeImplicit))
+			}
+
+			srv := imapserver.StartServer(t, opts...)
+
+			cfg := testClientCfg(t, srv)
+			cfg.DisableCompression = tc.disable
+			if tc.tlsMode != "" {
+				tlsCfg, err := NewTLSConfig(&TLSOptions{PinnedCertSHA256: []string{serverCert.SHA256}})
+				assert.NoError(t, err)
+
+				cfg.AllowInsecure = false
+				cfg.TLSMode = tc.tlsMode
+				cfg.TLSConfig = tlsCfg
+			}
+			clt := NewClient(cfg)
+			assert.NoError(t, clt.Connect())
+			t.Cleanup(func() { _ = clt.Close() })
+
+			assert.Equal(t, tc.expectCompression, clt.compressConn != nil && clt.compressConn.enabled())
+
+			for range 3 {
+				assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), srv.InboxMailBox, time.Now(), nil))
+			}
+
+			cnt := 0
+			for msg, err := range clt.Messages(srv.InboxMailBox, nil) {
+				assert.NoError(t, err)
+				body, err := io.ReadAll(msg.Message)
+				assert.NoError(t, err)
+				assert.Equal(t, string(testMailData(t)), string(body))
+				cnt++
+			}
+			assert.Equal(t, 3, cnt)
+
+			if tc.expectCompression {
+				stats := clt.compressConn.stats()
+				if stats.Saved() <= 0 {
+					t.Errorf("compression saved no bytes: %+v", stats)
+				}
+			}
+		})
+	}
+}
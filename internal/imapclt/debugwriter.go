@@ -1,26 +1,99 @@
 package imapclt
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"log/slog"
+	"regexp"
 	"runtime"
+	"strconv"
+	"sync"
 	"time"
 )
 
+const (
+	redacted = "***"
+	// maxPendingLine is the maximum size of an incomplete line that is
+	// buffered, longer lines are logged in parts.
+	maxPendingLine = 64 * 1024
+)
+
+// literalRe matches the literal marker at the end of a line, e.g. "{12}" or
+// the non-synchronizing variant "{12+}".
+var literalRe = regexp.MustCompile(`\{(\d+)(\+?)\}\r?\n$`)
+
+// lineContext is the command or response a line belongs to, it is kept for
+// the remainder of a line after a literal.
+type lineContext int
+
+const (
+	ctxOther lineContext = iota
+	// ctxLogin is a LOGIN command, all its arguments except the username
+	// are secrets.
+	ctxLogin
+	// ctxMessage is a FETCH response or APPEND command, its literals
+	// contain message data.
+	ctxMessage
+)
+
+// DebugWriter logs raw IMAP protocol data with debug priority.
+//
+// Credentials of LOGIN commands and the client responses of AUTHENTICATE
+// exchanges, including SASL initial responses, are replaced with "***".
+// Literals in FETCH responses and APPEND commands can be truncated.
+//
+// Data that is sent and received is written to the same DebugWriter, it is
+// processed line by line. Incomplete lines are buffered until they are
+// complete, literal data is logged when it is written.
 type DebugWriter struct {
 	l *slog.Logger
+	// maxBodySize is the maximum number of bytes of message literals that
+	// are logged, if 0 they are not truncated.
+	maxBodySize int
+
+	mu sync.Mutex
+	// pending is the beginning of an incomplete line
+	pending []byte
+	// lineCtx is the context of the current line
+	lineCtx lineContext
+	// continuation is true when the current line is continued after a
+	// literal
+	continuation bool
+	// fromClient is true if the current line is a command
+	fromClient bool
+	// authTag is the tag of the AUTHENTICATE command that is in progress
+	authTag string
+
+	// syncLiteral is the size of a synchronizing literal of a command,
+	// its data is sent after the continuation request of the server
+	syncLiteral   int
+	literalLeft   int
+	literalLogged int
+	literalCtx    lineContext
 }
 
-func NewDebugWriter(l *slog.Logger) *DebugWriter {
-	return &DebugWriter{l: l}
+// NewDebugWriter creates a DebugWriter.
+// If maxBodySize is positive, literals of FETCH responses and APPEND commands
+// are truncated to maxBodySize bytes.
+func NewDebugWriter(l *slog.Logger, maxBodySize int) *DebugWriter {
+	return &DebugWriter{l: l, maxBodySize: maxBodySize}
 }
 
 func (w *DebugWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	out := w.process(p)
+	w.mu.Unlock()
+
+	if len(out) == 0 {
+		return len(p), nil
+	}
+
 	var pcs [1]uintptr
 
 	runtime.Callers(2, pcs[:])
 
-	r := slog.NewRecord(time.Now(), slog.LevelDebug, string(p), pcs[0])
+	r := slog.NewRecord(time.Now(), slog.LevelDebug, string(out), pcs[0])
 	err = w.l.Handler().Handle(context.Background(), r)
 	if err != nil {
 		return 0, err
@@ -28,3 +101,280 @@ func (w *DebugWriter) Write(p []byte) (n int, err error) {
 
 	return len(p), nil
 }
+
+// process returns the redacted data of p that can be logged.
+// w.mu must be held.
+func (w *DebugWriter) process(p []byte) []byte {
+	var out []byte
+
+	for len(p) > 0 {
+		if w.literalLeft > 0 {
+			n := min(w.literalLeft, len(p))
+			out = w.appendLiteral(out, p[:n])
+			p = p[n:]
+			continue
+		}
+
+		idx := bytes.IndexByte(p, '\n')
+		if idx == -1 {
+			w.pending = append(w.pending, p...)
+			if len(w.pending) > maxPendingLine {
+				out = append(out, w.redactLine(w.pending, false)...)
+				w.pending = w.pending[:0]
+			}
+			break
+		}
+
+		line := p[:idx+1]
+		if len(w.pending) != 0 {
+			line = append(w.pending, line...)
+		}
+		p = p[idx+1:]
+
+		out = append(out, w.redactLine(line, true)...)
+		w.pending = w.pending[:0]
+	}
+
+	return out
+}
+
+func (w *DebugWriter) appendLiteral(out, data []byte) []byte {
+	switch {
+	case w.literalCtx == ctxLogin:
+		if w.literalLogged == 0 {
+			out = append(out, redacted...)
+		}
+
+	case w.literalCtx == ctxMessage && w.maxBodySize > 0:
+		if w.literalLogged < w.maxBodySize {
+			out = append(out, data[:min(len(data), w.maxBodySize-w.literalLogged)]...)
+		}
+
+		if w.literalLogged+len(data) >= w.maxBodySize && w.literalLeft == len(data) {
+			total := w.literalLogged + len(data)
+			if total > w.maxBodySize {
+				out = fmt.Appendf(out, "[... %d bytes truncated]", total-w.maxBodySize)
+			}
+		}
+
+	default:
+		out = append(out, data...)
+	}
+
+	w.literalLogged += len(data)
+	w.literalLeft -= len(data)
+
+	return out
+}
+
+// redactLine returns line with secrets replaced.
+// complete is false if the line is logged before its end was received.
+func (w *DebugWriter) redactLine(line []byte, complete bool) []byte {
+	if w.syncLiteral > 0 {
+		if bytes.HasPrefix(line, []byte("+")) {
+			w.startLiteral(w.syncLiteral)
+			w.syncLiteral = 0
+			return line
+		}
+
+		// the server rejected the command
+		w.syncLiteral = 0
+		w.continuation = false
+	}
+
+	if w.authTag != "" && !w.continuation {
+		return w.redactAuthLine(line)
+	}
+
+	if !w.continuation {
+		w.lineCtx = classifyLine(line)
+		tag, _ := commandFields(line)
+		w.fromClient = len(tag) > 0 && string(tag) != "*" && string(tag) != "+"
+	}
+
+	var result []byte
+
+	switch {
+	case w.lineCtx == ctxLogin && w.continuation:
+		result = redactLoginContinuation(line)
+	case w.lineCtx == ctxLogin:
+		result = redactLogin(line)
+	case isAuthenticate(line):
+		result = w.redactAuthenticate(line)
+	default:
+		result = line
+	}
+
+	if !complete {
+		w.continuation = true
+		return result
+	}
+
+	if m := literalRe.FindSubmatch(line); m != nil {
+		size, err := strconv.Atoi(string(m[1]))
+		if err == nil && size > 0 {
+			w.continuation = true
+			if w.fromClient && len(m[2]) == 0 {
+				w.syncLiteral = size
+			} else {
+				w.startLiteral(size)
+			}
+			return result
+		}
+	}
+
+	w.continuation = false
+
+	return result
+}
+
+func (w *DebugWriter) startLiteral(size int) {
+	w.literalLeft = size
+	w.literalLogged = 0
+	w.literalCtx = w.lineCtx
+}
+
+// commandFields returns the tag and the upper-cased command or response
+// name of line.
+func commandFields(line []byte) (tag, cmd []byte) {
+	fields := bytes.Fields(line)
+	if len(fields) < 2 {
+		return nil, nil
+	}
+
+	return fields[0], bytes.ToUpper(fields[1])
+}
+
+func classifyLine(line []byte) lineContext {
+	tag, cmd := commandFields(line)
+
+	switch {
+	case string(cmd) == "LOGIN":
+		return ctxLogin
+	case string(cmd) == "APPEND":
+		return ctxMessage
+	case string(tag) == "*" && bytes.Contains(bytes.ToUpper(line), []byte(" FETCH ")):
+		return ctxMessage
+	default:
+		return ctxOther
+	}
+}
+
+func isAuthenticate(line []byte) bool {
+	_, cmd := commandFields(line)
+	return string(cmd) == "AUTHENTICATE"
+}
+
+// lineEnd returns the length of line without a trailing literal marker and
+// line break, and the suffix.
+func lineEnd(line []byte) (int, []byte) {
+	if loc := literalRe.FindIndex(line); loc != nil {
+		return loc[0], line[loc[0]:]
+	}
+
+	end := len(line)
+	for end > 0 && (line[end-1] == '\n' || line[end-1] == '\r') {
+		end--
+	}
+
+	return end, line[end:]
+}
+
+// redactLogin redacts the arguments of a LOGIN command except the username,
+// when it is an atom or quoted string.
+func redactLogin(line []byte) []byte {
+	end, suffix := lineEnd(line)
+	fields := bytes.SplitN(line[:end], []byte(" "), 3)
+	if len(fields) < 3 {
+		return concat(line[:end], suffix)
+	}
+
+	prefix := concat(fields[0], []byte(" "), fields[1], []byte(" "))
+	args := fields[2]
+
+	user, rest := splitString(args)
+	if user == nil {
+		// the username is a literal
+		return concat(prefix, suffix)
+	}
+
+	if len(bytes.TrimSpace(rest)) == 0 {
+		// the password follows as literal
+		return concat(prefix, user, []byte(" "), suffix)
+	}
+
+	return concat(prefix, user, []byte(" "+redacted), suffix)
+}
+
+// redactLoginContinuation redacts the remainder of a LOGIN command after a
+// literal.
+func redactLoginContinuation(line []byte) []byte {
+	end, suffix := lineEnd(line)
+	if len(bytes.TrimSpace(line[:end])) == 0 {
+		return concat(line[:end], suffix)
+	}
+
+	return concat([]byte(" "+redacted), suffix)
+}
+
+// splitString splits an atom or quoted string from the beginning of s.
+// It returns nil if s starts with a literal.
+func splitString(s []byte) (str, rest []byte) {
+	if len(s) == 0 || s[0] == '{' {
+		return nil, s
+	}
+
+	if s[0] != '"' {
+		if idx := bytes.IndexByte(s, ' '); idx != -1 {
+			return s[:idx], s[idx:]
+		}
+		return s, nil
+	}
+
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return s[:i+1], s[i+1:]
+		}
+	}
+
+	return s, nil
+}
+
+// redactAuthenticate redacts the SASL initial response of an AUTHENTICATE
+// command and starts redacting the client responses of the exchange.
+func (w *DebugWriter) redactAuthenticate(line []byte) []byte {
+	end, suffix := lineEnd(line)
+	fields := bytes.Fields(line[:end])
+
+	w.authTag = string(fields[0])
+
+	// an empty initial response is sent as "="
+	if len(fields) > 3 && string(fields[3]) != "=" {
+		return concat(bytes.Join(fields[:3], []byte(" ")), []byte(" "+redacted), suffix)
+	}
+
+	return line
+}
+
+// redactAuthLine redacts a line while an AUTHENTICATE exchange is in
+// progress. Server challenges, untagged responses and the tagged completion
+// response are logged, all other lines are client responses.
+func (w *DebugWriter) redactAuthLine(line []byte) []byte {
+	switch {
+	case bytes.HasPrefix(line, []byte("+ ")), bytes.HasPrefix(line, []byte("* ")):
+		return line
+	case bytes.HasPrefix(line, []byte(w.authTag+" ")):
+		w.authTag = ""
+		return line
+	default:
+		_, suffix := lineEnd(line)
+		return concat([]byte(redacted), suffix)
+	}
+}
+
+func concat(s ...[]byte) []byte {
+	return bytes.Join(s, nil)
+}
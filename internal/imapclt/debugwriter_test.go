@@ -0,0 +1,166 @@
+package imapclt
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/imapserver"
+)
+
+// recordHandler records the messages of log records.
+type recordHandler struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (*recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.msgs = append(h.msgs, r.Message)
+	return nil
+}
+
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler      { return h }
+
+func (h *recordHandler) output() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return strings.Join(h.msgs, "")
+}
+
+func TestDebugWriter(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		maxBodySize int
+		writes      []string
+		expected    string
+	}{
+		{
+			name:     "login quoted",
+			writes:   []string{"T1 LOGIN \"user\" \"s3cret\"\r\n", "T1 OK done\r\n"},
+			expected: "T1 LOGIN \"user\" ***\r\nT1 OK done\r\n",
+		},
+		{
+			name:     "login split across writes",
+			writes:   []string{"T1 LOGIN user s3c", "ret\r\n"},
+			expected: "T1 LOGIN user ***\r\n",
+		},
+		{
+			name: "login synchronizing literal",
+			writes: []string{
+				"T1 LOGIN user {6}\r\n", "+ Ready\r\n", "s3cret", "\r\n", "T1 OK done\r\n",
+			},
+			expected: "T1 LOGIN user {6}\r\n+ Ready\r\n***\r\nT1 OK done\r\n",
+		},
+		{
+			name:     "login non-synchronizing literals",
+			writes:   []string{"T1 LOGIN {4+}\r\nuser {6+}\r\ns3cret\r\n"},
+			expected: "T1 LOGIN {4+}\r\n*** {6+}\r\n***\r\n",
+		},
+		{
+			name: "login literal rejected",
+			writes: []string{
+				"T1 LOGIN user {6}\r\n", "T1 NO too long\r\n", "T2 NOOP\r\n",
+			},
+			expected: "T1 LOGIN user {6}\r\nT1 NO too long\r\nT2 NOOP\r\n",
+		},
+		{
+			name:     "authenticate initial response",
+			writes:   []string{"T2 AUTHENTICATE PLAIN AHVzZXIAczNjcmV0\r\n", "T2 OK\r\n"},
+			expected: "T2 AUTHENTICATE PLAIN ***\r\nT2 OK\r\n",
+		},
+		{
+			name: "authenticate continuation",
+			writes: []string{
+				"T2 AUTHENTICATE PLAIN\r\n", "+ \r\n", "AHVzZXIAczNjcmV0\r\n",
+				"T2 OK Success\r\n", "T3 SELECT INBOX\r\n",
+			},
+			expected: "T2 AUTHENTICATE PLAIN\r\n+ \r\n***\r\nT2 OK Success\r\nT3 SELECT INBOX\r\n",
+		},
+		{
+			name: "authenticate error challenge",
+			writes: []string{
+				"T2 AUTHENTICATE XOAUTH2 dXNlcj1zb21ldXNlcgFhdXRoPUJlYXJlcgEB\r\n",
+				"+ eyJzdGF0dXMiOiI0MDEifQ==\r\n", "\r\n", "T2 NO invalid token\r\n",
+			},
+			expected: "T2 AUTHENTICATE XOAUTH2 ***\r\n+ eyJzdGF0dXMiOiI0MDEifQ==\r\n***\r\n" +
+				"T2 NO invalid token\r\n",
+		},
+		{
+			name:        "fetch body truncated",
+			maxBodySize: 5,
+			writes:      []string{"* 1 FETCH (UID 1 BODY[] {12}\r\nHel", "lo World!", ")\r\n"},
+			expected:    "* 1 FETCH (UID 1 BODY[] {12}\r\nHello[... 7 bytes truncated])\r\n",
+		},
+		{
+			name:        "append body truncated",
+			maxBodySize: 5,
+			writes:      []string{"T4 APPEND INBOX {12}\r\n", "+ Ready\r\n", "Hello World!", "\r\n"},
+			expected:    "T4 APPEND INBOX {12}\r\n+ Ready\r\nHello[... 7 bytes truncated]\r\n",
+		},
+		{
+			name:     "fetch body not truncated",
+			writes:   []string{"* 1 FETCH (UID 1 BODY[] {12}\r\nHello World!)\r\n"},
+			expected: "* 1 FETCH (UID 1 BODY[] {12}\r\nHello World!)\r\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := recordHandler{}
+			w := NewDebugWriter(slog.New(&h), tc.maxBodySize)
+
+			for _, s := range tc.writes {
+				n, err := w.Write([]byte(s))
+				assert.NoError(t, err)
+				assert.Equal(t, len(s), n)
+			}
+
+			assert.Equal(t, tc.expected, h.output())
+		})
+	}
+}
+
+func TestConnect_LogIMAPDataRedactsCredentials(t *testing.T) {
+	srv := imapserver.StartServer(t)
+
+	for _, tc := range []struct {
+		mech     string
+		expected string
+	}{
+		{AuthLogin, `T1 LOGIN \"user\" ***\r\n`},
+		{AuthXOAuth2, `T1 AUTHENTICATE XOAUTH2 ***\r\n`},
+		{AuthOAuthBearer, `T1 AUTHENTICATE OAUTHBEARER ***\r\n`},
+	} {
+		t.Run(tc.mech, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			cfg := testClientCfg(t, srv)
+			cfg.AuthMechanism = tc.mech
+			cfg.LogIMAPData = true
+			cfg.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+			if tc.mech != AuthLogin {
+				cfg.Password = ""
+				cfg.TokenSource = &staticTokenSource{tokens: []string{srv.OAuthAccessToken}}
+			}
+
+			clt := NewClient(cfg)
+			assert.NoError(t, clt.Connect())
+			t.Cleanup(func() { _ = clt.Close() })
+
+			if !strings.Contains(buf.String(), tc.expected) {
+				t.Errorf("log does not contain redacted command %q:\n%s", tc.expected, buf.String())
+			}
+
+			if strings.Contains(buf.String(), `\"`+srv.UserPasswd+`\"`) {
+				t.Errorf("password was logged:\n%s", buf.String())
+			}
+		})
+	}
+}
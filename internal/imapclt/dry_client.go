@@ -15,17 +15,34 @@ func NewDryClient(cfg *Config) *DryClient {
 }
 
 // Upload logs a debug message and returns nil
-func (c *DryClient) Upload(path, mailbox string, _ time.Time) error {
+func (c *DryClient) Upload(path, mailbox string, _ time.Time, flags []string) error {
 	c.logger.Debug("dry-client: skipping uploading mail to mailbox",
-		lkMailbox, mailbox, "filepath", path)
+		lkMailbox, mailbox, "filepath", path, "imap.flags", flags)
 	return nil
 }
 
-// Move logs a debug message and returns nil
+// UploadBatch logs a debug message for each request and returns nil errors.
+func (c *DryClient) UploadBatch(reqs []*UploadRequest) []error {
+	for _, req := range reqs {
+		c.logger.Debug("dry-client: skipping uploading mail to mailbox",
+			lkMailbox, req.Mailbox, "filepath", req.Path, "imap.flags", req.Flags)
+	}
+	return make([]error, len(reqs))
+}
+
+// Move logs a debug message with the strategy that would be used to move the
+// messages and returns nil.
+// If the server supports no usable strategy an error is returned.
 func (c *DryClient) Move(uids []uint32, mailbox string) error {
+	strategy, err := c.moveStrategy()
+	if err != nil {
+		return err
+	}
+
 	c.logger.Debug("dry-client: skipping moving messages to mailbox",
 		lkMailbox, mailbox,
 		"count", len(uids),
+		"imap.move_strategy", strategy,
 	)
 	return nil
 }
@@ -37,3 +54,33 @@ func (c *DryClient) MarkSeen(uids []uint32) error {
 	)
 	return nil
 }
+
+// AddFlags logs a debug message and returns nil
+func (c *DryClient) AddFlags(uids []uint32, flags []string) error {
+	c.logger.Debug("dry-client: skipping adding flags to messages",
+		"count", len(uids), "imap.flags", flags,
+	)
+	return nil
+}
+
+// RemoveFlags logs a debug message and returns nil
+func (c *DryClient) RemoveFlags(uids []uint32, flags []string) error {
+	c.logger.Debug("dry-client: skipping removing flags from messages",
+		"count", len(uids), "imap.flags", flags,
+	)
+	return nil
+}
+
+// Delete logs a debug message and returns nil
+func (c *DryClient) Delete(uids []uint32) error {
+	c.logger.Debug("dry-client: skipping deleting messages",
+		"count", len(uids),
+	)
+	return nil
+}
+
+// CreateMailbox logs a debug message and returns nil
+func (c *DryClient) CreateMailbox(name string) error {
+	c.logger.Debug("dry-client: skipping creating mailbox", lkMailbox, name)
+	return nil
+}
@@ -0,0 +1,69 @@
+package imapclt
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// MailboxInfo describes a mailbox on the IMAP server.
+type MailboxInfo struct {
+	// Name is the UTF-8 decoded name of the mailbox.
+	Name string
+	// Delim is the hierarchy delimiter, it is 0 if the server has no
+	// hierarchy.
+	Delim rune
+	// Attrs are the mailbox attributes, including the RFC 6154
+	// SPECIAL-USE attributes like \Junk and \Archive.
+	Attrs []string
+}
+
+// HasAttr returns true if the mailbox has the attribute attr.
+func (m *MailboxInfo) HasAttr(attr string) bool {
+	return slices.Contains(m.Attrs, attr)
+}
+
+// Mailboxes returns all mailboxes of the user.
+// If the server supports SPECIAL-USE, the special use attributes are
+// requested.
+func (c *Client) Mailboxes() ([]*MailboxInfo, error) {
+	var opts *imap.ListOptions
+	if c.clt.Caps().Has(imap.CapSpecialUse) {
+		opts = &imap.ListOptions{ReturnSpecialUse: true}
+	}
+
+	// mailbox names are decoded from modified UTF-7 by the imapclient
+	// package
+	data, err := c.clt.List("", "*", opts).Collect()
+	if err != nil {
+		return nil, fmt.Errorf("listing mailboxes failed: %w", err)
+	}
+
+	result := make([]*MailboxInfo, 0, len(data))
+	for _, d := range data {
+		attrs := make([]string, 0, len(d.Attrs))
+		for _, a := range d.Attrs {
+			attrs = append(attrs, string(a))
+		}
+
+		result = append(result, &MailboxInfo{
+			Name:  d.Mailbox,
+			Delim: d.Delim,
+			Attrs: attrs,
+		})
+	}
+
+	return result, nil
+}
+
+// CreateMailbox creates a mailbox.
+func (c *Client) CreateMailbox(name string) error {
+	if err := c.clt.Create(name, nil).Wait(); err != nil {
+		return fmt.Errorf("creating mailbox %q failed: %w", name, err)
+	}
+
+	c.logger.Info("created mailbox", lkMailbox, name, "event", "imap.mailbox_created")
+
+	return nil
+}
@@ -2,10 +2,12 @@ package imapclt
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"iter"
 	"slices"
+	"strings"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
@@ -16,6 +18,11 @@ type Message struct {
 	UID      uint32
 	Message  io.Reader
 	Envelope Envelope
+	// Flags are the system flags and keywords of the message.
+	Flags []string
+	// InternalDate is the date when the message was received by the
+	// server.
+	InternalDate time.Time
 }
 
 type Envelope struct {
@@ -27,23 +34,97 @@ type Envelope struct {
 	MessageID  string
 }
 
+// SyncState is the synchronization state of a mailbox.
+// It allows [Client.Messages] to only fetch messages that were added or
+// changed since the previous call.
+type SyncState struct {
+	// UIDValidity is the UIDVALIDITY value of the mailbox, when it changes
+	// previously assigned UIDs are invalid.
+	UIDValidity uint32 `json:"uid_validity"`
+	// LastUID is the highest UID of the messages that were fetched.
+	LastUID uint32 `json:"last_uid"`
+	// HighestModSeq is the HIGHESTMODSEQ value of the mailbox, it is only
+	// set when the server supports CONDSTORE (RFC 7162).
+	HighestModSeq uint64 `json:"highest_mod_seq,omitempty"`
+}
+
 // Messages returns an iterator over the messages in mailbox.
 // When an error happens a nil message and an error is passed via the yield
 // function.
-func (c *Client) Messages(mailbox string) iter.Seq2[*Message, error] {
+//
+// If state is nil, all messages in the mailbox are fetched.
+// Otherwise only messages with an UID higher than state.LastUID are fetched.
+// If the server supports CONDSTORE, messages whose flags changed since
+// state.HighestModSeq are fetched too and no messages are fetched when
+// the mailbox did not change.
+// If the UIDVALIDITY of the mailbox differs from the one in state, all
+// messages are fetched.
+// state is updated while iterating, callers should only persist it when
+// all returned messages were processed.
+func (c *Client) Messages(mailbox string, state *SyncState) iter.Seq2[*Message, error] {
 	return func(yield func(*Message, error) bool) {
 		logger := c.logger.With(lkMailbox, mailbox)
-		mbox, err := c.clt.Select(mailbox, &imap.SelectOptions{}).Wait()
+
+		condStore := state != nil && c.clt.Caps().Has(imap.CapCondStore)
+		mbox, err := c.clt.Select(mailbox, &imap.SelectOptions{CondStore: condStore}).Wait()
 		if err != nil {
 			yield(nil, fmt.Errorf("selecting mailbox failed: %w", err))
 			return
 		}
 
+		if state != nil && state.UIDValidity != mbox.UIDValidity {
+			if state.UIDValidity != 0 {
+				logger.Warn("uidvalidity of mailbox changed, fetching all messages",
+					"event", "imap.uidvalidity_changed",
+					"imap.uidvalidity.old", state.UIDValidity,
+					"imap.uidvalidity.new", mbox.UIDValidity,
+				)
+			}
+			*state = SyncState{UIDValidity: mbox.UIDValidity}
+		}
+
 		if mbox.NumMessages == 0 {
 			logger.Debug("mailbox is empty", "event", "imap.mailbox_empty")
+			if state != nil {
+				state.HighestModSeq = mbox.HighestModSeq
+			}
 			return
 		}
 
+		fetchOpts := messageFetchOptions()
+
+		var fetchSet imap.NumSet
+		var minUID uint32
+
+		switch {
+		case state == nil:
+			n := imap.SeqSet{}
+			n.AddRange(1, 0)
+			fetchSet = n
+
+		case state.unchanged(mbox):
+			logger.Debug("mailbox did not change since last sync",
+				"event", "imap.mailbox_unchanged",
+				"imap.last_uid", state.LastUID,
+			)
+			return
+
+		case state.HighestModSeq != 0 && mbox.HighestModSeq != 0:
+			fetchOpts.ChangedSince = state.HighestModSeq
+			fetchSet = imap.UIDSet{imap.UIDRange{Start: 1, Stop: 0}}
+
+		default:
+			// "n:*" also matches the message with the highest UID
+			// when it is smaller than n, it is skipped when
+			// iterating
+			minUID = state.LastUID + 1
+			fetchSet = imap.UIDSet{imap.UIDRange{Start: imap.UID(minUID), Stop: 0}}
+		}
+
+		if state != nil {
+			state.HighestModSeq = mbox.HighestModSeq
+		}
+
 		logger.Debug(
 			"new messages found",
 			"event",
@@ -51,18 +132,22 @@ func (c *Client) Messages(mailbox string) iter.Seq2[*Message, error] {
 			"count", mbox.NumMessages,
 		)
 
-		n := imap.SeqSet{}
-		n.AddRange(1, 0)
-
-		fetchCmd := c.clt.Fetch(n, &imap.FetchOptions{
-			Envelope:    true,
-			UID:         true,
-			BodySection: []*imap.FetchItemBodySection{{Peek: true}},
-		})
+		fetchCmd := c.clt.Fetch(fetchSet, fetchOpts)
 
 		for {
 			msg, err := c.fetchNext(fetchCmd)
-			if (msg == nil && err == nil) || !yield(msg, err) {
+			if msg == nil && err == nil {
+				break
+			}
+
+			if uid := messageUID(msg, err); uid != 0 && state != nil {
+				if uid < minUID {
+					continue
+				}
+				state.LastUID = max(state.LastUID, uid)
+			}
+
+			if !yield(msg, err) {
 				break
 			}
 		}
@@ -74,6 +159,153 @@ func (c *Client) Messages(mailbox string) iter.Seq2[*Message, error] {
 	}
 }
 
+// MessagesByID returns an iterator over the messages in mailbox whose
+// Message-ID header is one of messageIDs.
+// The IDs are compared with and without enclosing angle brackets.
+// When an error happens a nil message and an error is passed via the yield
+// function.
+func (c *Client) MessagesByID(mailbox string, messageIDs []string) iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		if len(messageIDs) == 0 {
+			return
+		}
+
+		if _, err := c.clt.Select(mailbox, nil).Wait(); err != nil {
+			yield(nil, fmt.Errorf("selecting mailbox failed: %w", err))
+			return
+		}
+
+		wanted := make(map[string]struct{}, len(messageIDs))
+		var uids imap.UIDSet
+		for _, id := range messageIDs {
+			id = trimMsgID(id)
+			if id == "" {
+				continue
+			}
+			wanted[id] = struct{}{}
+
+			data, err := c.clt.UIDSearch(&imap.SearchCriteria{
+				Header: []imap.SearchCriteriaHeaderField{{Key: "Message-Id", Value: id}},
+			}, nil).Wait()
+			if err != nil {
+				yield(nil, fmt.Errorf("searching message %q failed: %w", id, err))
+				return
+			}
+
+			uids.AddNum(data.AllUIDs()...)
+		}
+
+		for msg, err := range c.fetchUIDs(mailbox, uids) {
+			// the search matches substrings of the header
+			if msg != nil {
+				if _, ok := wanted[trimMsgID(msg.Envelope.MessageID)]; !ok {
+					continue
+				}
+			}
+
+			if !yield(msg, err) {
+				return
+			}
+		}
+	}
+}
+
+// SearchMessages returns an iterator over the messages in mailbox that match
+// criteria.
+// When an error happens a nil message and an error is passed via the yield
+// function.
+func (c *Client) SearchMessages(mailbox string, criteria *imap.SearchCriteria) iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		if _, err := c.clt.Select(mailbox, nil).Wait(); err != nil {
+			yield(nil, fmt.Errorf("selecting mailbox failed: %w", err))
+			return
+		}
+
+		data, err := c.clt.UIDSearch(criteria, nil).Wait()
+		if err != nil {
+			yield(nil, fmt.Errorf("searching messages failed: %w", err))
+			return
+		}
+
+		var uids imap.UIDSet
+		uids.AddNum(data.AllUIDs()...)
+
+		for msg, err := range c.fetchUIDs(mailbox, uids) {
+			if !yield(msg, err) {
+				return
+			}
+		}
+	}
+}
+
+// fetchUIDs returns an iterator over the messages with uids in the selected
+// mailbox.
+func (c *Client) fetchUIDs(mailbox string, uids imap.UIDSet) iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		if len(uids) == 0 {
+			return
+		}
+
+		fetchCmd := c.clt.Fetch(uids, messageFetchOptions())
+		defer func() {
+			if err := fetchCmd.Close(); err != nil {
+				c.logger.Warn("releasing fetch command failed",
+					lkMailbox, mailbox, "error", err)
+			}
+		}()
+
+		for {
+			msg, err := c.fetchNext(fetchCmd)
+			if msg == nil && err == nil {
+				return
+			}
+
+			if !yield(msg, err) {
+				return
+			}
+		}
+	}
+}
+
+// trimMsgID removes whitespace and the enclosing angle brackets from a
+// message ID.
+func trimMsgID(id string) string {
+	return strings.Trim(strings.TrimSpace(id), "<>")
+}
+
+func messageFetchOptions() *imap.FetchOptions {
+	return &imap.FetchOptions{
+		Envelope:     true,
+		Flags:        true,
+		InternalDate: true,
+		UID:          true,
+		BodySection:  []*imap.FetchItemBodySection{{Peek: true}},
+	}
+}
+
+// unchanged returns true if the selected mailbox does not contain new or
+// modified messages since state was recorded.
+func (s *SyncState) unchanged(mbox *imap.SelectData) bool {
+	if s.HighestModSeq != 0 && mbox.HighestModSeq != 0 {
+		return s.HighestModSeq == mbox.HighestModSeq
+	}
+
+	return mbox.UIDNext != 0 && uint32(mbox.UIDNext) <= s.LastUID+1
+}
+
+// messageUID returns the UID of msg or of the malformed message in err.
+func messageUID(msg *Message, err error) uint32 {
+	if msg != nil {
+		return msg.UID
+	}
+
+	if errMalformed, ok := errors.AsType[*ErrMalformedMsg](err); ok {
+		return errMalformed.UID
+	}
+
+	return 0
+}
+
 // fetchNext calls Next() and returns the message as [Message].
 // When there is no next message nil,nil is returned.
 func (c *Client) fetchNext(fetchCmd *imapclient.FetchCommand) (*Message, error) {
@@ -110,15 +342,23 @@ func (c *Client) fetchNext(fetchCmd *imapclient.FetchCommand) (*Message, error)
 		return nil, NewErrMalformedMsg("message data reader is empty", uint32(msg.UID))
 	}
 
+	flags := make([]string, 0, len(msg.Flags))
+	for _, f := range msg.Flags {
+		flags = append(flags, string(f))
+	}
+
 	return &Message{
-		UID: uint32(msg.UID),
+		UID:          uint32(msg.UID),
+		Flags:        flags,
+		InternalDate: msg.InternalDate,
 		// TODO: Can we stream the body instead of
 		// storing it in memory?
 		Message: bytes.NewReader(body),
 		Envelope: Envelope{
-			Date:    msg.Envelope.Date,
-			Subject: msg.Envelope.Subject,
-			From:    addressesToStrings(msg.Envelope.From),
+			Date:      msg.Envelope.Date,
+			Subject:   msg.Envelope.Subject,
+			MessageID: formatMsgID(msg.Envelope.MessageID),
+			From:      addressesToStrings(msg.Envelope.From),
 			Recipients: slices.Concat(
 				addressesToStrings(msg.Envelope.To),
 				addressesToStrings(msg.Envelope.Cc),
@@ -128,6 +368,16 @@ func (c *Client) fetchNext(fetchCmd *imapclient.FetchCommand) (*Message, error)
 	}, nil
 }
 
+// formatMsgID returns id enclosed in angle brackets, as in the Message-ID
+// header.
+func formatMsgID(id string) string {
+	if id == "" {
+		return ""
+	}
+
+	return "<" + id + ">"
+}
+
 func addressesToStrings(addrs []imap.Address) []string {
 	result := make([]string, 0, len(addrs))
 
@@ -1,11 +1,15 @@
 package imapclt
 
 import (
+	"bytes"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/emersion/go-imap/v2"
+
 	"github.com/fho/rspamd-iscan/internal/testutils/assert"
 	"github.com/fho/rspamd-iscan/internal/testutils/mail"
 )
@@ -20,12 +24,12 @@ func TestMessages(t *testing.T) {
 	testMailPath := mail.TestHamMailPath(t)
 	srv, clt := startServerClient(t)
 
-	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now()))
-	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now()))
-	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now()))
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
 
 	cnt := 0
-	for msg, err := range clt.Messages(srv.InboxMailBox) {
+	for msg, err := range clt.Messages(srv.InboxMailBox, nil) {
 		assert.NoError(t, err)
 		if msg.UID == 0 {
 			t.Error("msg.uid is 0")
@@ -46,3 +50,150 @@ func TestMessages(t *testing.T) {
 	}
 	assert.Equal(t, 3, cnt)
 }
+
+func fetchedUIDs(t *testing.T, clt *Client, mailbox string, state *SyncState) []uint32 {
+	var result []uint32
+
+	for msg, err := range clt.Messages(mailbox, state) {
+		assert.NoError(t, err)
+		result = append(result, msg.UID)
+	}
+
+	return result
+}
+
+func TestMessages_SyncState(t *testing.T) {
+	testMailPath := mail.TestHamMailPath(t)
+	srv, clt := startServerClient(t)
+
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
+
+	var state SyncState
+	uids := fetchedUIDs(t, clt, srv.InboxMailBox, &state)
+	assert.Equal(t, 2, len(uids))
+	assert.Equal(t, uids[1], state.LastUID)
+	assert.NotEqual(t, 0, state.UIDValidity)
+
+	// no new messages
+	assert.Equal(t, 0, len(fetchedUIDs(t, clt, srv.InboxMailBox, &state)))
+
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), nil))
+	uids = fetchedUIDs(t, clt, srv.InboxMailBox, &state)
+	assert.Equal(t, 1, len(uids))
+	assert.Equal(t, uids[0], state.LastUID)
+
+	// LastUID is higher than the UIDs of all messages in the mailbox
+	lastUIDState := SyncState{UIDValidity: state.UIDValidity, LastUID: state.LastUID + 10}
+	assert.Equal(t, 0, len(fetchedUIDs(t, clt, srv.InboxMailBox, &lastUIDState)))
+	assert.Equal(t, state.LastUID+10, lastUIDState.LastUID)
+
+	// changed UIDVALIDITY
+	state.UIDValidity++
+	uids = fetchedUIDs(t, clt, srv.InboxMailBox, &state)
+	assert.Equal(t, 3, len(uids))
+	assert.Equal(t, uids[2], state.LastUID)
+}
+
+func TestUploadBatch(t *testing.T) {
+	testMailPath := mail.TestHamMailPath(t)
+	srv, clt := startServerClient(t)
+
+	reqs := []*UploadRequest{
+		{Path: testMailPath, Mailbox: srv.InboxMailBox, Time: time.Now()},
+		{Path: testMailPath, Mailbox: "missing", Time: time.Now()},
+		{Path: filepath.Join(t.TempDir(), "missing"), Mailbox: srv.InboxMailBox},
+	}
+	for range uploadPipelineDepth {
+		reqs = append(reqs, &UploadRequest{Path: testMailPath, Mailbox: srv.SpamMailbox, Flags: []string{`\Seen`}})
+	}
+
+	errs := clt.UploadBatch(reqs)
+	assert.Equal(t, len(reqs), len(errs))
+	assert.NoError(t, errs[0])
+	assert.Error(t, errs[1])
+	assert.Error(t, errs[2])
+	for _, err := range errs[3:] {
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, 1, len(fetchedUIDs(t, clt, srv.InboxMailBox, nil)))
+	assert.Equal(t, uploadPipelineDepth, len(fetchedUIDs(t, clt, srv.SpamMailbox, nil)))
+}
+
+func TestUploadBatch_SyncLiterals(t *testing.T) {
+	srv, clt := startServerClient(t)
+	// the test server only supports LITERAL-, messages larger than
+	// literalMinusMaxSize are sent as synchronizing literals
+	assert.Equal(t, false, clt.clt.Caps().Has(imap.CapLiteralPlus))
+
+	data := testMailData(t)
+	data = append(data, bytes.Repeat([]byte("padding line\r\n"), literalMinusMaxSize/10)...)
+	testMailPath := filepath.Join(t.TempDir(), "large.eml")
+	assert.NoError(t, os.WriteFile(testMailPath, data, 0o600))
+	assert.Equal(t, true, clt.isSyncLiteral(int64(len(data))))
+
+	var reqs []*UploadRequest
+	for range 3 {
+		reqs = append(reqs, &UploadRequest{Path: testMailPath, Mailbox: srv.InboxMailBox, Time: time.Now()})
+	}
+	reqs = append(reqs, &UploadRequest{Path: testMailPath, Mailbox: "missing", Time: time.Now()})
+	reqs = append(reqs, &UploadRequest{Path: testMailPath, Mailbox: srv.SpamMailbox, Time: time.Now()})
+
+	errs := clt.UploadBatch(reqs)
+	assert.Equal(t, len(reqs), len(errs))
+	for _, err := range errs[:3] {
+		assert.NoError(t, err)
+	}
+	assert.Error(t, errs[3])
+	assert.NoError(t, errs[4])
+
+	assert.Equal(t, 3, len(fetchedUIDs(t, clt, srv.InboxMailBox, nil)))
+	assert.Equal(t, 1, len(fetchedUIDs(t, clt, srv.SpamMailbox, nil)))
+}
+
+func TestMessagesByID(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	assert.NoError(t, clt.Upload(mail.TestSpamMailPath(t), srv.InboxMailBox, time.Now(), nil))
+	assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), srv.InboxMailBox, time.Now(), nil))
+	assert.NoError(t, clt.Upload(mail.TestSpamMailPath(t), srv.InboxMailBox, time.Now(), nil))
+
+	cnt := 0
+	for msg, err := range clt.MessagesByID(srv.InboxMailBox, []string{"<GTUBE1.1010101@example.net>"}) {
+		assert.NoError(t, err)
+		assert.Equal(t, "<GTUBE1.1010101@example.net>", msg.Envelope.MessageID)
+		cnt++
+	}
+	assert.Equal(t, 2, cnt)
+
+	// substrings of message IDs do not match
+	for _, err := range clt.MessagesByID(srv.InboxMailBox, []string{"1.1010101@example.net"}) {
+		assert.NoError(t, err)
+		t.Error("message with a different message ID was returned")
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	assert.NoError(t, clt.Upload(mail.TestSpamMailPath(t), srv.InboxMailBox, time.Now(), []string{"$tagged"}))
+	assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), srv.InboxMailBox, time.Now(), []string{"$tagged", `\Seen`}))
+	assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), srv.InboxMailBox, time.Now(), nil))
+
+	cnt := 0
+	for msg, err := range clt.SearchMessages(srv.InboxMailBox, &imap.SearchCriteria{
+		Flag:    []imap.Flag{"$tagged"},
+		NotFlag: []imap.Flag{imap.FlagSeen},
+	}) {
+		assert.NoError(t, err)
+		assert.Equal(t, "<GTUBE1.1010101@example.net>", msg.Envelope.MessageID)
+		cnt++
+	}
+	assert.Equal(t, 1, cnt)
+
+	for _, err := range clt.SearchMessages(srv.InboxMailBox, &imap.SearchCriteria{Flag: []imap.Flag{"$other"}}) {
+		assert.NoError(t, err)
+		t.Error("message without the keyword was returned")
+	}
+}
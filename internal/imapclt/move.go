@@ -0,0 +1,110 @@
+package imapclt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// moveStrategy is the sequence of IMAP commands that is used to move
+// messages to another mailbox.
+type moveStrategy int
+
+const (
+	// moveStrategyMove uses the UID MOVE command (RFC 6851).
+	moveStrategyMove moveStrategy = iota
+	// moveStrategyUIDExpunge uses UID COPY, UID STORE +FLAGS \Deleted and
+	// UID EXPUNGE (RFC 4315, UIDPLUS), only the moved messages are
+	// expunged.
+	moveStrategyUIDExpunge
+	// moveStrategyExpunge uses UID COPY, UID STORE +FLAGS \Deleted and
+	// EXPUNGE. EXPUNGE removes all messages with the \Deleted flag from
+	// the mailbox, also ones that were flagged by other clients.
+	moveStrategyExpunge
+)
+
+func (s moveStrategy) String() string {
+	switch s {
+	case moveStrategyMove:
+		return "move"
+	case moveStrategyUIDExpunge:
+		return "copy+uid-expunge"
+	case moveStrategyExpunge:
+		return "copy+expunge"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// errNoMoveStrategy is returned when the server supports neither MOVE nor
+// UIDPLUS and the EXPUNGE fallback is not allowed.
+var errNoMoveStrategy = errors.New(
+	"imap server supports neither the MOVE nor the UIDPLUS extension, " +
+		"moving messages requires allowing the EXPUNGE fallback",
+)
+
+// errNoExpungeStrategy is returned when messages should be deleted, the server
+// does not support UIDPLUS and the EXPUNGE fallback is not allowed.
+var errNoExpungeStrategy = errors.New(
+	"imap server does not support the UIDPLUS extension, " +
+		"deleting messages requires allowing the EXPUNGE fallback",
+)
+
+// moveStrategy determines how messages are moved, depending on the
+// capabilities of the server.
+func (c *Client) moveStrategy() (moveStrategy, error) {
+	caps := c.clt.Caps()
+
+	switch {
+	case caps.Has(imap.CapMove):
+		return moveStrategyMove, nil
+	case caps.Has(imap.CapUIDPlus):
+		return moveStrategyUIDExpunge, nil
+	case c.allowExpungeFallback:
+		return moveStrategyExpunge, nil
+	default:
+		return 0, errNoMoveStrategy
+	}
+}
+
+// copyAndExpunge copies the messages to mailbox, flags them as \Deleted and
+// expunges them from the currently selected mailbox.
+func (c *Client) copyAndExpunge(uids imap.UIDSet, mailbox string, strategy moveStrategy) error {
+	if _, err := c.clt.Copy(uids, mailbox).Wait(); err != nil {
+		return fmt.Errorf("copying messages failed: %w", err)
+	}
+
+	return c.expunge(uids, strategy)
+}
+
+// expunge flags the messages as \Deleted and expunges them from the currently
+// selected mailbox.
+// With [moveStrategyExpunge] all messages flagged as \Deleted are expunged.
+func (c *Client) expunge(uids imap.UIDSet, strategy moveStrategy) error {
+	storeCmd := c.clt.Store(uids, &imap.StoreFlags{
+		Op:     imap.StoreFlagsAdd,
+		Silent: true,
+		Flags:  []imap.Flag{imap.FlagDeleted},
+	}, nil)
+	if err := storeCmd.Close(); err != nil {
+		return fmt.Errorf("flagging messages as deleted failed: %w", err)
+	}
+
+	if strategy == moveStrategyUIDExpunge {
+		if err := c.clt.UIDExpunge(uids).Close(); err != nil {
+			return fmt.Errorf("expunging messages failed: %w", err)
+		}
+		return nil
+	}
+
+	c.logger.Warn("server does not support UIDPLUS, expunging all messages flagged as deleted in the mailbox",
+		"event", "imap.expunge_all",
+	)
+
+	if err := c.clt.Expunge().Close(); err != nil {
+		return fmt.Errorf("expunging messages failed: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package imapclt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/imapserver"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+)
+
+func messageUIDs(t *testing.T, clt *Client, mailbox string) []uint32 {
+	var result []uint32
+
+	for msg, err := range clt.Messages(mailbox, nil) {
+		assert.NoError(t, err)
+		result = append(result, msg.UID)
+	}
+
+	return result
+}
+
+func TestMove(t *testing.T) {
+	tests := []struct {
+		name             string
+		caps             []imap.Cap
+		allowExpunge     bool
+		expectedStrategy moveStrategy
+		// expungesOthers is true when messages flagged as \Deleted by
+		// other clients are expunged as side-effect
+		expungesOthers bool
+	}{
+		{
+			name:             "move",
+			caps:             []imap.Cap{imap.CapIMAP4rev1, imap.CapMove},
+			expectedStrategy: moveStrategyMove,
+		},
+		{
+			name:             "uidplus",
+			caps:             []imap.Cap{imap.CapIMAP4rev1, imap.CapUIDPlus},
+			expectedStrategy: moveStrategyUIDExpunge,
+		},
+		{
+			name:             "expunge",
+			caps:             []imap.Cap{imap.CapIMAP4rev1},
+			allowExpunge:     true,
+			expectedStrategy: moveStrategyExpunge,
+			expungesOthers:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := imapserver.StartServer(t, imapserver.WithCaps(tc.caps...))
+			cfg := testClientCfg(t, srv)
+			cfg.AllowExpungeFallback = tc.allowExpunge
+			clt := NewClient(cfg)
+			assert.NoError(t, clt.Connect())
+			t.Cleanup(func() { _ = clt.Close() })
+
+			for range 3 {
+				assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+			}
+
+			uids := messageUIDs(t, clt, srv.ScanMailbox)
+			assert.Equal(t, 3, len(uids))
+
+			// flag the last message as deleted, like another client
+			// would do
+			err := clt.clt.Store(asUIDSet(uids[2:]), &imap.StoreFlags{
+				Op:    imap.StoreFlagsAdd,
+				Flags: []imap.Flag{imap.FlagDeleted},
+			}, nil).Close()
+			assert.NoError(t, err)
+
+			strategy, err := clt.moveStrategy()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedStrategy, strategy)
+
+			// Messages() selected ScanMailbox
+			assert.NoError(t, clt.Move(uids[:2], srv.BackupMailbox))
+
+			assert.Equal(t, 2, len(messageUIDs(t, clt, srv.BackupMailbox)))
+
+			remaining := messageUIDs(t, clt, srv.ScanMailbox)
+			if tc.expungesOthers {
+				assert.Equal(t, 0, len(remaining))
+			} else {
+				assert.Equal(t, 1, len(remaining))
+				assert.Equal(t, uids[2], remaining[0])
+			}
+		})
+	}
+}
+
+func TestMove_NoStrategy(t *testing.T) {
+	srv := imapserver.StartServer(t, imapserver.WithCaps(imap.CapIMAP4rev1))
+	clt := NewClient(testClientCfg(t, srv))
+	assert.NoError(t, clt.Connect())
+	t.Cleanup(func() { _ = clt.Close() })
+
+	assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	uids := messageUIDs(t, clt, srv.ScanMailbox)
+
+	err := clt.Move(uids, srv.BackupMailbox)
+	assert.Error(t, err)
+	assert.Equal(t, errNoMoveStrategy, err)
+
+	assert.Equal(t, 1, len(messageUIDs(t, clt, srv.ScanMailbox)))
+	assert.Equal(t, 0, len(messageUIDs(t, clt, srv.BackupMailbox)))
+
+	dryClt := &DryClient{Client: clt}
+	assert.Error(t, dryClt.Move(uids, srv.BackupMailbox))
+}
+
+func TestDelete(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	testMailPath := mail.TestHamMailPath(t)
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), []string{"$Keep"}))
+	assert.NoError(t, clt.Upload(testMailPath, srv.InboxMailBox, time.Now(), []string{"$Keep"}))
+
+	uids := messageUIDs(t, clt, srv.InboxMailBox)
+	assert.Equal(t, 2, len(uids))
+
+	assert.NoError(t, clt.RemoveFlags(uids[:1], []string{"$Keep"}))
+	assert.NoError(t, clt.Delete(uids[1:]))
+
+	cnt := 0
+	for msg, err := range clt.Messages(srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+		assert.Equal(t, uids[0], msg.UID)
+		assert.Equal(t, 0, len(msg.Flags))
+		cnt++
+	}
+	assert.Equal(t, 1, cnt)
+}
+
+func TestDelete_NoStrategy(t *testing.T) {
+	srv := imapserver.StartServer(t, imapserver.WithCaps(imap.CapIMAP4rev1))
+	clt := NewClient(testClientCfg(t, srv))
+	assert.NoError(t, clt.Connect())
+	t.Cleanup(func() { _ = clt.Close() })
+
+	assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), srv.InboxMailBox, time.Now(), nil))
+	uids := messageUIDs(t, clt, srv.InboxMailBox)
+
+	err := clt.Delete(uids)
+	assert.Error(t, err)
+	assert.Equal(t, errNoExpungeStrategy, err)
+
+	assert.Equal(t, 1, len(messageUIDs(t, clt, srv.InboxMailBox)))
+}
@@ -0,0 +1,95 @@
+package imapclt
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/imapserver"
+	"github.com/fho/rspamd-iscan/internal/testutils/proxyserver"
+)
+
+func TestConnectViaProxy(t *testing.T) {
+	serverCert := imapserver.GenerateCert(t, testTLSServerName)
+
+	for _, proto := range []struct {
+		name   string
+		scheme string
+		proto  proxyserver.Protocol
+	}{
+		{"socks5", "socks5", proxyserver.SOCKS5},
+		{"socks5h", "socks5h", proxyserver.SOCKS5},
+		{"http_connect", "http", proxyserver.HTTPConnect},
+	} {
+		for _, tlsMode := range []string{TLSModeImplicit, TLSModeStartTLS} {
+			t.Run(fmt.Sprintf("%s_%s", proto.name, tlsMode), func(t *testing.T) {
+				srv := imapserver.StartServer(t, imapserver.WithTLS(&tls.Config{
+					Certificates: []tls.Certificate{serverCert.TLSCert},
+					MinVersion:   tls.VersionTLS12,
+				}, tlsMode == TLSModeImplicit))
+
+				proxySrv := proxyserver.Start(t, proto.proto, "proxyuser", "proxypasswd")
+
+				tlsCfg, err := NewTLSConfig(&TLSOptions{PinnedCertSHA256: []string{serverCert.SHA256}})
+				assert.NoError(t, err)
+
+				cfg := testClientCfg(t, srv)
+				cfg.AllowInsecure = false
+				cfg.TLSMode = tlsMode
+				cfg.TLSConfig = tlsCfg
+				cfg.Proxy = &url.URL{
+					Scheme: proto.scheme,
+					Host:   proxySrv.ListenAddr,
+					User:   url.UserPassword("proxyuser", "proxypasswd"),
+				}
+
+				clt := NewClient(cfg)
+				assert.NoError(t, clt.Connect())
+				t.Cleanup(func() { _ = clt.Close() })
+
+				for _, err := range clt.Messages(srv.InboxMailBox, nil) {
+					assert.NoError(t, err)
+				}
+
+				targets := proxySrv.Targets()
+				assert.Equal(t, 1, len(targets))
+				assert.Equal(t, srv.ListenAddr, targets[0])
+
+				// TLS terminates at the IMAP server, the proxy
+				// must only see encrypted commands
+				relayed := proxySrv.Relayed()
+				assert.NotEqual(t, 0, len(relayed))
+				assert.Equal(t, false, bytes.Contains(relayed, []byte("LOGIN")))
+				assert.Equal(t, false, bytes.Contains(relayed, []byte("SELECT")))
+			})
+		}
+	}
+}
+
+func TestConnectViaProxy_AuthFails(t *testing.T) {
+	for _, proto := range []struct {
+		scheme string
+		proto  proxyserver.Protocol
+	}{
+		{"socks5", proxyserver.SOCKS5},
+		{"http", proxyserver.HTTPConnect},
+	} {
+		t.Run(proto.scheme, func(t *testing.T) {
+			srv := imapserver.StartServer(t)
+			proxySrv := proxyserver.Start(t, proto.proto, "proxyuser", "proxypasswd")
+
+			cfg := testClientCfg(t, srv)
+			cfg.Proxy = &url.URL{
+				Scheme: proto.scheme,
+				Host:   proxySrv.ListenAddr,
+				User:   url.UserPassword("proxyuser", "wrong"),
+			}
+
+			assert.Error(t, NewClient(cfg).Connect())
+			assert.Equal(t, 0, len(proxySrv.Targets()))
+		})
+	}
+}
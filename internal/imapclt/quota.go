@@ -0,0 +1,54 @@
+package imapclt
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// quotaUnit is the unit of the STORAGE quota resource (RFC 9208).
+const quotaUnit = 1024
+
+// Quota is the storage usage and limit of a quota root in bytes.
+type Quota struct {
+	Root  string
+	Usage int64
+	Limit int64
+}
+
+// Free returns the number of bytes that can still be stored, it is negative
+// when the quota is exceeded.
+func (q *Quota) Free() int64 {
+	return q.Limit - q.Usage
+}
+
+// Quota returns the storage quotas of the quota roots of mailbox.
+// Quota roots without a storage limit are omitted.
+// If the server does not support the QUOTA extension (RFC 9208), nil is
+// returned.
+func (c *Client) Quota(mailbox string) ([]*Quota, error) {
+	if !c.clt.Caps().Has(imap.CapQuota) {
+		return nil, nil
+	}
+
+	data, err := c.clt.GetQuotaRoot(mailbox).Wait()
+	if err != nil {
+		return nil, fmt.Errorf("retrieving quota of mailbox %q failed: %w", mailbox, err)
+	}
+
+	var result []*Quota
+	for _, d := range data {
+		res, ok := d.Resources[imap.QuotaResourceStorage]
+		if !ok {
+			continue
+		}
+
+		result = append(result, &Quota{
+			Root:  d.Root,
+			Usage: res.Usage * quotaUnit,
+			Limit: res.Limit * quotaUnit,
+		})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,33 @@
+package imapclt
+
+import (
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/imapserver"
+)
+
+func TestQuota(t *testing.T) {
+	srv := imapserver.StartServer(t, imapserver.WithQuota(100, 150))
+	clt := newTestClient(t, srv)
+
+	quotas, err := clt.Quota(srv.InboxMailBox)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(quotas))
+	assert.Equal(t, int64(100*1024), quotas[0].Usage)
+	assert.Equal(t, int64(150*1024), quotas[0].Limit)
+	assert.Equal(t, int64(50*1024), quotas[0].Free())
+
+	srv.SetQuota(200, 150)
+	quotas, err = clt.Quota(srv.InboxMailBox)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-50*1024), quotas[0].Free())
+}
+
+func TestQuota_Unsupported(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	quotas, err := clt.Quota(srv.InboxMailBox)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(quotas))
+}
@@ -0,0 +1,128 @@
+package imapclt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+const startTLSTag = "S1"
+
+// startTLSGreeting is prepended to the data read from connections that were
+// upgraded via [startTLS].
+const startTLSGreeting = "* OK TLS negotiation completed\r\n"
+
+// startTLS upgrades conn to TLS via the STARTTLS command (RFC 9051, section
+// 6.2.1).
+// Unlike [imapclient.NewStartTLS], the TLS connection is returned, this
+// allows to add the compression layer above TLS.
+// The server sends no greeting after the TLS negotiation, imapclient expects
+// one when a client is created, therefore [startTLSGreeting] is prepended to
+// the data read from the returned connection.
+func startTLS(ctx context.Context, conn net.Conn, tlsCfg *tls.Config) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+
+	greeting, err := readLine(conn)
+	if err != nil {
+		return nil, fmt.Errorf("reading greeting failed: %w", err)
+	}
+
+	status, _, _ := strings.Cut(strings.TrimPrefix(greeting, "* "), " ")
+	switch imap.StatusResponseType(strings.ToUpper(status)) {
+	case imap.StatusResponseTypeOK:
+	case imap.StatusResponseTypePreAuth:
+		// RFC 9051, section 7.1.4
+		return nil, errors.New("server sent PREAUTH on unencrypted connection")
+	default:
+		return nil, fmt.Errorf("unexpected greeting: %q", greeting)
+	}
+
+	if _, err := io.WriteString(conn, startTLSTag+" STARTTLS\r\n"); err != nil {
+		return nil, fmt.Errorf("sending STARTTLS command failed: %w", err)
+	}
+
+	if err := readStartTLSResponse(conn); err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, tlsCfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return &prefixConn{
+		Conn: tlsConn,
+		r:    io.MultiReader(strings.NewReader(startTLSGreeting), tlsConn),
+	}, nil
+}
+
+// readStartTLSResponse reads the responses to the STARTTLS command until the
+// tagged one. If it is not OK, an [*imap.Error] is returned.
+func readStartTLSResponse(conn net.Conn) error {
+	for {
+		line, err := readLine(conn)
+		if err != nil {
+			return fmt.Errorf("reading STARTTLS response failed: %w", err)
+		}
+
+		resp, ok := strings.CutPrefix(line, startTLSTag+" ")
+		if !ok {
+			// untagged response, e.g. CAPABILITY
+			continue
+		}
+
+		status, text, _ := strings.Cut(resp, " ")
+		typ := imap.StatusResponseType(strings.ToUpper(status))
+		if typ == imap.StatusResponseTypeOK {
+			return nil
+		}
+
+		var code string
+		if strings.HasPrefix(text, "[") {
+			code, text, _ = strings.Cut(text[1:], "] ")
+		}
+
+		return &imap.Error{Type: typ, Code: imap.ResponseCode(code), Text: text}
+	}
+}
+
+// readLine reads a CRLF terminated line from r and returns it without the
+// line ending.
+// It reads byte by byte, data after the line is not consumed, it is part of
+// the TLS handshake.
+func readLine(r io.Reader) (string, error) {
+	var sb strings.Builder
+	b := make([]byte, 1)
+
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+
+		if b[0] == '\n' {
+			return strings.TrimSuffix(sb.String(), "\r"), nil
+		}
+
+		sb.WriteByte(b[0])
+	}
+}
+
+// prefixConn is a connection whose data is read from r.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
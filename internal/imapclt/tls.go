@@ -0,0 +1,177 @@
+package imapclt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Supported TLS modes.
+const (
+	// TLSModeAuto uses implicit TLS when the port of the server address is
+	// 993 or "imaps", otherwise STARTTLS.
+	TLSModeAuto = "auto"
+	// TLSModeImplicit establishes a TLS connection before any IMAP data is
+	// exchanged.
+	TLSModeImplicit = "implicit"
+	// TLSModeStartTLS establishes an unencrypted connection and upgrades
+	// it to TLS via the STARTTLS command.
+	TLSModeStartTLS = "starttls"
+)
+
+// TLSOptions configures the TLS connection to the IMAP server.
+// The zero value verifies the server certificate with the system CA pool.
+type TLSOptions struct {
+	// CAFile is the path of a PEM file containing additional CA
+	// certificates that are trusted to sign the server certificate.
+	CAFile string
+	// ClientCertFile and ClientKeyFile are the paths of a PEM encoded
+	// client certificate and its private key, that are presented to the
+	// server.
+	ClientCertFile string
+	ClientKeyFile  string
+	// ServerName overrides the hostname that is sent via SNI and
+	// verified against the server certificate.
+	ServerName string
+	// PinnedCertSHA256 is a list of SHA-256 fingerprints of server
+	// certificates in hex notation (colons are allowed).
+	// When it is set, the server certificate is accepted if its
+	// fingerprint is in the list, the certificate chain is not verified.
+	// This allows to use self-signed certificates.
+	PinnedCertSHA256 []string
+}
+
+// IsSupportedTLSMode returns true if mode is one of the TLS modes supported
+// by [Client].
+func IsSupportedTLSMode(mode string) bool {
+	switch strings.ToLower(mode) {
+	case "", TLSModeAuto, TLSModeImplicit, TLSModeStartTLS:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewTLSConfig creates a TLS configuration from opts.
+func NewTLSConfig(opts *TLSOptions) (*tls.Config, error) {
+	cfg := tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: opts.ServerName,
+	}
+
+	if opts.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file failed: %w", err)
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA file %s does not contain any PEM encoded certificates", opts.CAFile)
+		}
+
+		cfg.RootCAs = pool
+	}
+
+	if opts.ClientCertFile != "" || opts.ClientKeyFile != "" {
+		if opts.ClientCertFile == "" || opts.ClientKeyFile == "" {
+			return nil, errors.New("client certificate and client key must both be set")
+		}
+
+		cert, err := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate failed: %w", err)
+		}
+
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(opts.PinnedCertSHA256) > 0 {
+		pins := make([][]byte, 0, len(opts.PinnedCertSHA256))
+		for _, p := range opts.PinnedCertSHA256 {
+			pin, err := hex.DecodeString(strings.ReplaceAll(p, ":", ""))
+			if err != nil || len(pin) != sha256.Size {
+				return nil, fmt.Errorf("pinned certificate fingerprint %q is not a hex encoded sha256 hash", p)
+			}
+			pins = append(pins, pin)
+		}
+
+		// the chain verification is replaced by the fingerprint check
+		// in VerifyConnection
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server did not present a certificate")
+			}
+
+			fp := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if !slices.ContainsFunc(pins, func(pin []byte) bool { return bytes.Equal(pin, fp[:]) }) {
+				return fmt.Errorf("server certificate fingerprint %s does not match any pinned fingerprint",
+					hex.EncodeToString(fp[:]))
+			}
+
+			return nil
+		}
+	}
+
+	return &cfg, nil
+}
+
+// withConnectionLogging returns a copy of cfg that logs the parameters of
+// established TLS connections.
+func withConnectionLogging(cfg *tls.Config, logger *slog.Logger, tlsMode string) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	result := cfg.Clone()
+	verify := cfg.VerifyConnection
+	pinned := cfg.InsecureSkipVerify
+
+	result.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+
+		attrs := []any{
+			"event", "imap.tls_established",
+			"tls.mode", tlsMode,
+			"tls.version", tls.VersionName(cs.Version),
+			"tls.cipher_suite", tls.CipherSuiteName(cs.CipherSuite),
+			"tls.server_name", cs.ServerName,
+			"tls.pinned", pinned,
+			"tls.client_cert", len(cfg.Certificates) > 0,
+		}
+
+		if len(cs.PeerCertificates) > 0 {
+			cert := cs.PeerCertificates[0]
+			fp := sha256.Sum256(cert.Raw)
+			attrs = append(attrs,
+				"tls.cert.subject", cert.Subject.String(),
+				"tls.cert.issuer", cert.Issuer.String(),
+				"tls.cert.not_after", cert.NotAfter,
+				"tls.cert.sha256", hex.EncodeToString(fp[:]),
+			)
+		}
+
+		logger.Info("tls connection established", attrs...)
+
+		return nil
+	}
+
+	return result
+}
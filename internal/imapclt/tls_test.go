@@ -0,0 +1,148 @@
+package imapclt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/imapserver"
+)
+
+const testTLSServerName = "imap.example.test"
+
+func TestConnectTLS(t *testing.T) {
+	serverCert := imapserver.GenerateCert(t, testTLSServerName)
+	clientCert := imapserver.GenerateCert(t, "client.example.test")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert.X509)
+
+	wrongPin := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name              string
+		implicit          bool
+		requireClientCert bool
+		tlsMode           string
+		opts              TLSOptions
+		expectErr         bool
+	}{
+		{
+			name:     "implicit_ca",
+			implicit: true,
+			tlsMode:  TLSModeImplicit,
+			opts:     TLSOptions{CAFile: serverCert.CertFile, ServerName: testTLSServerName},
+		},
+		{
+			name:    "starttls_ca",
+			tlsMode: TLSModeStartTLS,
+			opts:    TLSOptions{CAFile: serverCert.CertFile, ServerName: testTLSServerName},
+		},
+		{
+			name:      "implicit_untrusted",
+			implicit:  true,
+			tlsMode:   TLSModeImplicit,
+			opts:      TLSOptions{ServerName: testTLSServerName},
+			expectErr: true,
+		},
+		{
+			name:      "implicit_wrong_servername",
+			implicit:  true,
+			tlsMode:   TLSModeImplicit,
+			opts:      TLSOptions{CAFile: serverCert.CertFile, ServerName: "other.example.test"},
+			expectErr: true,
+		},
+		{
+			name:    "starttls_pinned",
+			tlsMode: TLSModeStartTLS,
+			opts:    TLSOptions{PinnedCertSHA256: []string{wrongPin, serverCert.SHA256}},
+		},
+		{
+			name:      "implicit_wrong_pin",
+			implicit:  true,
+			tlsMode:   TLSModeImplicit,
+			opts:      TLSOptions{PinnedCertSHA256: []string{wrongPin}},
+			expectErr: true,
+		},
+		{
+			name:              "implicit_client_cert",
+			implicit:          true,
+			requireClientCert: true,
+			tlsMode:           TLSModeImplicit,
+			opts: TLSOptions{
+				PinnedCertSHA256: []string{serverCert.SHA256},
+				ClientCertFile:   clientCert.CertFile,
+				ClientKeyFile:    clientCert.KeyFile,
+			},
+		},
+		{
+			name:              "implicit_missing_client_cert",
+			implicit:          true,
+			requireClientCert: true,
+			tlsMode:           TLSModeImplicit,
+			opts:              TLSOptions{PinnedCertSHA256: []string{serverCert.SHA256}},
+			expectErr:         true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srvTLSCfg := tls.Config{
+				Certificates: []tls.Certificate{serverCert.TLSCert},
+				MinVersion:   tls.VersionTLS12,
+			}
+			if tc.requireClientCert {
+				srvTLSCfg.ClientAuth = tls.RequireAndVerifyClientCert
+				srvTLSCfg.ClientCAs = clientCAs
+			}
+
+			srv := imapserver.StartServer(t, imapserver.WithTLS(&srvTLSCfg, tc.implicit))
+
+			tlsCfg, err := NewTLSConfig(&tc.opts)
+			assert.NoError(t, err)
+
+			cfg := testClientCfg(t, srv)
+			cfg.AllowInsecure = false
+			cfg.TLSMode = tc.tlsMode
+			cfg.TLSConfig = tlsCfg
+
+			clt := NewClient(cfg)
+			err = clt.Connect()
+			if tc.expectErr {
+				assert.Error(t, err)
+				if clt.clt != nil {
+					_ = clt.Close()
+				}
+				return
+			}
+
+			assert.NoError(t, err)
+			t.Cleanup(func() { _ = clt.Close() })
+
+			for _, err := range clt.Messages(srv.InboxMailBox, nil) {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestNewTLSConfig_InvalidPin(t *testing.T) {
+	_, err := NewTLSConfig(&TLSOptions{PinnedCertSHA256: []string{"abcd"}})
+	assert.Error(t, err)
+}
+
+func TestResolveTLSMode(t *testing.T) {
+	for _, tc := range []struct{ mode, addr, expected string }{
+		{TLSModeAuto, "imap.example.com:993", TLSModeImplicit},
+		{"", "imap.example.com:imaps", TLSModeImplicit},
+		{TLSModeAuto, "imap.example.com:143", TLSModeStartTLS},
+		{TLSModeStartTLS, "imap.example.com:993", TLSModeStartTLS},
+		{TLSModeImplicit, "imap.example.com:1993", TLSModeImplicit},
+	} {
+		mode, err := resolveTLSMode(tc.mode, tc.addr)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, mode)
+	}
+}
@@ -0,0 +1,47 @@
+package iscan
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+// check checks msg with rspamd.
+// If useCache is true and a check cache is configured, a cached result for
+// the same message and headers is returned instead of sending the message to
+// rspamd again. Only conclusive results are cached, greylisted or skipped
+// mails are checked again when they are rescanned.
+func (c *Client) check(logger *slog.Logger, msg io.Reader, hdrs *rspamc.MailHeaders, useCache bool) (*rspamc.CheckResult, error) {
+	if c.checkCache == nil || !useCache {
+		// TODO: retry Check if it failed with a temporary error
+		return c.rspamc.Check(context.Background(), msg, hdrs)
+	}
+
+	data, err := io.ReadAll(msg)
+	if err != nil {
+		return nil, fmt.Errorf("reading mail failed: %w", err)
+	}
+
+	if result, exists := c.checkCache.Get(data, hdrs); exists {
+		logger.Info("reusing cached scan result",
+			"event", "scan.cache_hit",
+			"mail.size", len(data),
+		)
+		return result, nil
+	}
+
+	result, err := c.rspamc.Check(context.Background(), bytes.NewReader(data), hdrs)
+	if err != nil {
+		return nil, err
+	}
+
+	if unverifiedReason(result) == "" {
+		c.checkCache.Add(data, hdrs, result)
+	}
+
+	return result, nil
+}
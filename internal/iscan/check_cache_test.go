@@ -0,0 +1,42 @@
+package iscan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/checkcache"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+	"github.com/fho/rspamd-iscan/internal/testutils/mock"
+)
+
+func TestProcessScanBox_CheckCache(t *testing.T) {
+	srv, clt := startServerClient(t)
+	var checks int
+	clt.rspamc = &mock.Rspamc{CheckFn: countingCheckFn(&rspamc.CheckResult{Score: 1, RequiredScore: 15}, &checks)}
+	clt.checkCache = checkcache.New(time.Hour, 0)
+
+	for range 2 {
+		assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	}
+	assert.NoError(t, clt.ProcessScanBox())
+
+	assert.Equal(t, 1, checks)
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, 2, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+}
+
+func TestProcessScanBox_CheckCacheSkipsInconclusiveResults(t *testing.T) {
+	srv, clt := startServerClient(t)
+	var checks int
+	clt.rspamc = &mock.Rspamc{CheckFn: countingCheckFn(&rspamc.CheckResult{IsSkipped: true}, &checks)}
+	clt.checkCache = checkcache.New(time.Hour, 0)
+
+	for range 2 {
+		assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	}
+	assert.NoError(t, clt.ProcessScanBox())
+
+	assert.Equal(t, 2, checks)
+}
@@ -1,11 +1,14 @@
 package iscan
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"os"
 	"slices"
 	"strconv"
@@ -15,26 +18,38 @@ import (
 	"time"
 
 	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/learnspool"
 	"github.com/fho/rspamd-iscan/internal/log"
 	"github.com/fho/rspamd-iscan/internal/mail"
 	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/syncstate"
 )
 
 const (
 	hdrPrefix      = "X-rspamd-iscan-"
 	hdrRspamdScore = hdrPrefix + "Score"
+
+	defFuzzyWeight = 1
 )
 
 type RspamdClient interface {
 	Check(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error)
 	Spam(context.Context, io.Reader, *rspamc.MailHeaders) error
 	Ham(context.Context, io.Reader, *rspamc.MailHeaders) error
+	FuzzyAdd(ctx context.Context, msg io.Reader, hdrs *rspamc.MailHeaders, flag, weight int) error
+	FuzzyDel(ctx context.Context, msg io.Reader, hdrs *rspamc.MailHeaders, flag int) error
+	Ping(context.Context) error
 }
 
 type Client struct {
-	clt    IMAPClient
-	rspamc RspamdClient
-	logger *slog.Logger
+	clt       IMAPClient
+	rspamc    RspamdClient
+	logger    *slog.Logger
+	syncState SyncStateStore
+	// learnSpool is optional, see [Config.LearnSpool]
+	learnSpool LearnSpool
+	// checkCache is optional, see [Config.CheckCache]
+	checkCache CheckCache
 
 	stopCh   chan struct{}
 	stopOnce sync.Once
@@ -48,6 +63,22 @@ type Client struct {
 	undetectedMailbox string
 	spamTreshold      float32
 
+	// spamFlags and inboxFlags are added to the flags of mails that are
+	// uploaded to the spam respectively inbox mailbox.
+	spamFlags  []string
+	inboxFlags []string
+
+	// deliverer is optional, when it is set modified mails are delivered
+	// to deliveryRecipient instead of being uploaded to the inbox mailbox.
+	// Spam is only delivered via it when spamDeliveryRecipient is set.
+	deliverer             Deliverer
+	deliveryRecipient     string
+	spamDeliveryRecipient string
+
+	// tagOnly enables tagging mails with keywords instead of uploading
+	// modified copies, see [Config.TagOnly].
+	tagOnly bool
+
 	tempDir       string
 	keepTempFiles bool
 
@@ -55,6 +86,55 @@ type Client struct {
 
 	learnInterval time.Duration
 
+	// fuzzyFlag and fuzzyWeight configure updating the fuzzy storage when
+	// learning, see [Config.FuzzyFlag].
+	fuzzyFlag   int
+	fuzzyWeight int
+
+	// quotaMinFree is the minimum free storage space in bytes, scanning
+	// is paused while less space is available, see [Config.QuotaMinFree].
+	quotaMinFree int64
+	// quotaPaused is true while scanning is paused because of
+	// insufficient free storage space.
+	quotaPaused bool
+	// quotaCheckInterval is the interval in which the quota is checked
+	// while scanning is paused.
+	quotaCheckInterval time.Duration
+
+	// skippedPolicy and greylistPolicy define the handling of mails that
+	// rspamd skipped respectively greylisted or soft rejected.
+	skippedPolicy  UnverifiedPolicy
+	greylistPolicy UnverifiedPolicy
+	pendingMailbox string
+	rescanDelay    time.Duration
+	maxRescans     int
+	// rescans are the mails in the scan mailbox that are scanned again
+	// after a delay, keyed by UID. The rescan counts are also stored in
+	// keywords on the mails, see [Client.scheduleRescan].
+	rescans map[uint32]*rescanState
+
+	// lateRescanMargin and lateRescanDelay configure rescanning mails in
+	// the inbox mailbox, see [Config.LateRescanMargin].
+	lateRescanMargin float32
+	lateRescanDelay  time.Duration
+	// lateRescans are the due times of the late rescans, keyed by
+	// Message-ID, they are persisted in syncState
+	lateRescans map[string]time.Time
+
+	// unavailablePolicy defines the handling of mails while rspamd is
+	// unavailable, see [Config.UnavailablePolicy].
+	unavailablePolicy UnavailablePolicy
+	// rspamdUnavailable is true while requests to rspamd fail because it
+	// is unavailable.
+	rspamdUnavailable bool
+	// rspamdRetryInterval is the interval in which the scan mailbox is
+	// processed while rspamd is unavailable.
+	rspamdRetryInterval time.Duration
+	// requeuePending is true if mails might have been moved unscanned to
+	// the inbox mailbox, they are searched and moved back to the scan
+	// mailbox when rspamd is available, see [Client.requeueUnscanned].
+	requeuePending bool
+
 	// cntProcessedMails counts the number of emails that have been processed
 	// in the [Client.scanMailbox], [Client.hamMailbox] and [Client.
 	// spamMailbox].
@@ -63,10 +143,18 @@ type Client struct {
 }
 
 type scannedMail struct {
-	Path        string
-	UID         uint32
-	Envelope    *imapclt.Envelope
-	CheckResult *rspamc.CheckResult
+	Path         string
+	UID          uint32
+	Envelope     *imapclt.Envelope
+	Flags        []string
+	InternalDate time.Time
+	CheckResult  *rspamc.CheckResult
+	// Skipped is the reason why the check result is not conclusive, when
+	// it is passed through.
+	Skipped string
+	// Unscanned is true if the mail is passed through without a scan
+	// because rspamd is unavailable, CheckResult is empty then.
+	Unscanned bool
 }
 
 type learnFn func(context.Context, io.Reader, *rspamc.MailHeaders) error
@@ -76,8 +164,16 @@ func NewClient(cfg *Config) (*Client, error) {
 		return nil, err
 	}
 
+	syncState := cfg.SyncState
+	if syncState == nil {
+		syncState = syncstate.NewMemoryStore()
+	}
+
 	c := &Client{
 		clt:                     cfg.IMAPClient,
+		syncState:               syncState,
+		learnSpool:              cfg.LearnSpool,
+		checkCache:              cfg.CheckCache,
 		logger:                  log.EnsureLoggerInstance(cfg.Logger),
 		inboxMailbox:            cfg.InboxMailbox,
 		scanMailbox:             cfg.ScanMailbox,
@@ -86,7 +182,29 @@ func NewClient(cfg *Config) (*Client, error) {
 		undetectedMailbox:       cfg.UndetectedMailboxName,
 		rspamc:                  cfg.Rspamc,
 		spamTreshold:            cfg.SpamTreshold,
+		spamFlags:               cfg.SpamFlags,
+		inboxFlags:              cfg.InboxFlags,
+		tagOnly:                 cfg.TagOnly,
+		deliverer:               cfg.Deliverer,
+		deliveryRecipient:       cfg.DeliveryRecipient,
+		spamDeliveryRecipient:   cfg.SpamDeliveryRecipient,
 		learnInterval:           30 * time.Minute,
+		fuzzyFlag:               cfg.FuzzyFlag,
+		fuzzyWeight:             cmp.Or(cfg.FuzzyWeight, defFuzzyWeight),
+		quotaMinFree:            cfg.QuotaMinFree,
+		quotaCheckInterval:      5 * time.Minute,
+		skippedPolicy:           cfg.SkippedPolicy,
+		greylistPolicy:          cfg.GreylistPolicy,
+		pendingMailbox:          cfg.PendingMailbox,
+		rescanDelay:             cmp.Or(cfg.RescanDelay, defRescanDelay),
+		maxRescans:              cmp.Or(cfg.MaxRescans, defMaxRescans),
+		rescans:                 map[uint32]*rescanState{},
+		lateRescanMargin:        cfg.LateRescanMargin,
+		lateRescanDelay:         cmp.Or(cfg.LateRescanDelay, defLateRescanDelay),
+		lateRescans:             map[string]time.Time{},
+		unavailablePolicy:       cfg.UnavailablePolicy,
+		rspamdRetryInterval:     defRspamdRetryInterval,
+		requeuePending:          cfg.UnavailablePolicy == PolicyFailOpen,
 		backupMailbox:           cfg.BackupMailbox,
 		tempDir:                 cfg.TempDir,
 		keepTempFiles:           cfg.KeepTempFiles,
@@ -94,6 +212,10 @@ func NewClient(cfg *Config) (*Client, error) {
 		stopCh:                  make(chan struct{}),
 	}
 
+	if c.lateRescanMargin > 0 {
+		maps.Copy(c.lateRescans, syncState.LateRescans())
+	}
+
 	return c, nil
 }
 
@@ -102,7 +224,7 @@ func (c *Client) ProcessHam() error {
 		return nil
 	}
 
-	return c.learn(c.hamMailbox, c.inboxMailbox, false, c.rspamc.Ham)
+	return c.learn(c.hamMailbox, c.inboxMailbox, false, learnspool.KindHam)
 }
 
 func (c *Client) ProcessSpam() error {
@@ -110,17 +232,62 @@ func (c *Client) ProcessSpam() error {
 		return nil
 	}
 
-	return c.learn(c.undetectedMailbox, c.spamMailbox, c.markLearnedAsSpamAsRead, c.rspamc.Spam)
+	return c.learn(c.undetectedMailbox, c.spamMailbox, c.markLearnedAsSpamAsRead, learnspool.KindSpam)
+}
+
+// learnFns returns the function to learn a message as kind and the function
+// to update the fuzzy storage with it.
+// fuzzyFn is nil if the fuzzy storage is not updated, both are nil if kind is
+// unsupported.
+func (c *Client) learnFns(kind learnspool.Kind) (learn, fuzzyFn learnFn) {
+	switch kind {
+	case learnspool.KindHam:
+		if c.fuzzyFlag > 0 {
+			fuzzyFn = func(ctx context.Context, msg io.Reader, hdrs *rspamc.MailHeaders) error {
+				return c.rspamc.FuzzyDel(ctx, msg, hdrs, c.fuzzyFlag)
+			}
+		}
+
+		return c.rspamc.Ham, fuzzyFn
+
+	case learnspool.KindSpam:
+		if c.fuzzyFlag > 0 {
+			fuzzyFn = func(ctx context.Context, msg io.Reader, hdrs *rspamc.MailHeaders) error {
+				return c.rspamc.FuzzyAdd(ctx, msg, hdrs, c.fuzzyFlag, c.fuzzyWeight)
+			}
+		}
+
+		return c.rspamc.Spam, fuzzyFn
+
+	default:
+		return nil, nil
+	}
 }
 
-func (c *Client) learn(srcMailbox, destMailbox string, markAsSeen bool, learnFn learnFn) error {
+// learn sends the messages in srcMailbox to rspamd to learn them as kind and
+// moves them to destMailbox afterwards.
+// If the fuzzy storage is updated, failing fuzzy updates are logged and do
+// not prevent moving the messages.
+// If a learn spool is configured, it is replayed first. Messages are spooled
+// when rspamd is unavailable or the spool still contains requests.
+// If learning or spooling a message fails, the remaining messages stay in
+// srcMailbox and are processed in the next run.
+func (c *Client) learn(srcMailbox, destMailbox string, markAsSeen bool, kind learnspool.Kind) error {
 	var processedMsgUIDs []uint32
+	// aborted is true if learning stopped before all messages were
+	// processed, the sync state is then not updated to fetch the
+	// remaining messages again in the next run
+	var aborted bool
 
+	learnFn, fuzzyFn := c.learnFns(kind)
 	logger := c.logger.With("mailbox.source", srcMailbox)
 
+	c.replayLearnSpool()
+
 	logger.Info("checking mailbox for new messages to learn")
 
-	for msg, err := range c.clt.Messages(srcMailbox) {
+	state := c.syncState.Get(srcMailbox)
+	for msg, err := range c.clt.Messages(srcMailbox, &state) {
 		if err != nil {
 			if errMalformed, ok := errors.AsType[*imapclt.ErrMalformedMsg](err); ok {
 				logger.Warn("skipping malformed message",
@@ -138,23 +305,53 @@ func (c *Client) learn(srcMailbox, destMailbox string, markAsSeen bool, learnFn
 		logger := c.logger.With("mail.subject", msg.Envelope.Subject, "mail.uid", msg.UID)
 		logger.Debug("fetched message")
 
+		// the message is sent twice when the fuzzy storage is updated
+		data, err := io.ReadAll(msg.Message)
+		if err != nil {
+			return fmt.Errorf("reading message %d failed: %w", msg.UID, err)
+		}
+		hdrs := envelopeToRspamcHdrs(&msg.Envelope)
+
+		if c.learnSpool != nil && c.learnSpool.Len() > 0 {
+			// the order of the learn requests is preserved
+			if !c.spoolLearnRequest(logger, kind, data, hdrs) {
+				aborted = true
+				break
+			}
+			processedMsgUIDs = append(processedMsgUIDs, msg.UID)
+			continue
+		}
+
 		// TODO: retry Check if it failed with a temporary error
-		err = learnFn(
-			context.TODO(),
-			msg.Message,
-			envelopeToRspamcHdrs(&msg.Envelope),
-		)
+		err = learnFn(context.TODO(), bytes.NewReader(data), hdrs)
 		if err != nil {
+			if c.learnSpool != nil && errors.Is(err, rspamc.ErrUnavailable) {
+				logger.Warn("learning message failed, spooling it", "error", err,
+					"event", "rspamd.msg_learn_failed")
+				if !c.spoolLearnRequest(logger, kind, data, hdrs) {
+					aborted = true
+					break
+				}
+				processedMsgUIDs = append(processedMsgUIDs, msg.UID)
+				continue
+			}
+
 			logger.Warn("learning message failed", "error", err,
 				"event", "rspamd.msg_learn_failed")
-			return nil
+			aborted = true
+			break
 		}
 
 		logger.Info("learned message", "event", "rspamd.msg_learned")
+
+		c.updateFuzzyStorage(logger, fuzzyFn, data, hdrs)
 		processedMsgUIDs = append(processedMsgUIDs, msg.UID)
 	}
 
 	if len(processedMsgUIDs) == 0 {
+		if !aborted {
+			c.saveSyncState(srcMailbox, state)
+		}
 		return nil
 	}
 
@@ -170,11 +367,34 @@ func (c *Client) learn(srcMailbox, destMailbox string, markAsSeen bool, learnFn
 		return fmt.Errorf("moving messages after learning failed: %w", err)
 	}
 
+	if !aborted {
+		c.saveSyncState(srcMailbox, state)
+	}
 	c.cntProcessedMails.Add(uint64(len(processedMsgUIDs)))
 
 	return nil
 }
 
+// updateFuzzyStorage updates the fuzzy storage with a learned message via
+// fuzzyFn, if it is not nil.
+func (c *Client) updateFuzzyStorage(logger *slog.Logger, fuzzyFn learnFn, data []byte, hdrs *rspamc.MailHeaders) {
+	if fuzzyFn == nil {
+		return
+	}
+
+	err := fuzzyFn(context.TODO(), bytes.NewReader(data), hdrs)
+	if err != nil {
+		logger.Warn("updating fuzzy storage failed", "error", err,
+			"event", "rspamd.msg_fuzzy_update_failed",
+			"rspamd.fuzzy_flag", c.fuzzyFlag,
+		)
+		return
+	}
+
+	logger.Info("updated fuzzy storage", "event", "rspamd.msg_fuzzy_updated",
+		"rspamd.fuzzy_flag", c.fuzzyFlag)
+}
+
 func asHdrMap(prefix string, scores map[string]*rspamc.Symbol, skipZeroScores bool) []*mail.Header {
 	result := make([]*mail.Header, 0, len(scores))
 
@@ -183,9 +403,14 @@ func asHdrMap(prefix string, scores map[string]*rspamc.Symbol, skipZeroScores bo
 			continue
 		}
 
+		body := fmt.Sprint(v.Score)
+		if len(v.Options) > 0 {
+			body += " [" + strings.Join(v.Options, ",") + "]"
+		}
+
 		result = append(result, &mail.Header{
 			Name: prefix + v.Name,
-			Body: fmt.Sprint(v.Score),
+			Body: body,
 		})
 	}
 
@@ -233,49 +458,144 @@ func sortHeaders(hdrs []*mail.Header) {
 }
 
 func (c *Client) isSpam(r *rspamc.CheckResult) bool {
-	return r.Score >= c.spamTreshold
+	threshold := c.spamThreshold(r)
+	if threshold <= 0 {
+		// rspamd did not report a required score, e.g. because the
+		// check was skipped
+		return false
+	}
+
+	return r.Score >= threshold
+}
+
+// spamThreshold returns the configured spam threshold, if it is not set the
+// required score reported by rspamd.
+func (c *Client) spamThreshold(r *rspamc.CheckResult) float32 {
+	if c.spamTreshold > 0 {
+		return c.spamTreshold
+	}
+
+	return r.RequiredScore
+}
+
+// logScanResult logs the score of a scanned message and with debug priority
+// its symbols.
+func (c *Client) logScanResult(logger *slog.Logger, r *rspamc.CheckResult) {
+	logger.Info("message scanned",
+		"scan.score", r.Score,
+		"scan.threshold", c.spamThreshold(r),
+		"scan.is_spam", c.isSpam(r),
+	)
+
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+
+	symbols := make([]string, 0, len(r.Symbols))
+	for _, sym := range r.Symbols {
+		symbols = append(symbols, sym.String())
+	}
+	slices.Sort(symbols)
+
+	logger.Debug("scan result details",
+		"scan.action", r.Action,
+		"scan.symbols", symbols,
+		"scan.message_id", r.MessageID,
+		"scan.urls", r.URLs,
+		"scan.emails", r.Emails,
+		"scan.time_real", r.TimeReal,
+	)
 }
 
 // replaceWithModifiedMails uploads mails to the spam or inbox mailbox, depending on their
 // spam score.
-// The original email is moved to the backup mailbox.
-// It returns an UIDSet of all successfully uploaded mails.
-// When errors happen, an error **and** a non-empty UIDSet can be returned.
+// The original emails are moved to the backup mailbox with a single command
+// before. Uploads are pipelined if the IMAP client implements
+// [BatchUploader].
+// Errors of individual mails are joined, failing uploads do not prevent
+// the remaining mails from being uploaded.
 func (c *Client) replaceWithModifiedMails(mails []*scannedMail) error {
 	var errs []error
+	var uploads []*imapclt.UploadRequest
+	var uploadMails []*scannedMail
 
-	for _, mail := range mails {
-		var mbox string
+	if len(mails) == 0 {
+		return nil
+	}
+
+	defer c.removeTempFiles(mails)
 
+	// TODO: support deleting emails from the mailbox, when backupMailbox is
+	// empty instead of keeping a copy of the original, deleting
+	// must happen after appendMail!
+	mails, err := c.moveToBackupMailbox(mails)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, mail := range mails {
 		logger := c.logger.With(
 			"mail.subject", mail.Envelope.Subject,
 			"mail.uid", mail.UID,
 		)
 
-		// TODO: support deleting emails from the mailbox, when backupMailbox is
-		// empty instead of keeping a copy of the original, deleting
-		// must happen after appendMail!
-		err := c.clt.Move([]uint32{mail.UID}, c.backupMailbox)
-		if err != nil {
-			errs = append(errs, fmt.Errorf(
-				"moving mail (%d) (%s) to backup mailbox %s failed: %w",
-				mail.UID, mail.Envelope.Subject, c.backupMailbox, err,
-			))
+		isSpam := c.isSpam(mail.CheckResult)
+
+		if rcpt := c.deliveryRecipientFor(isSpam); rcpt != "" {
+			err = c.deliverer.Deliver(context.Background(), mail.Path, rcpt)
+			if err != nil {
+				errs = append(errs, fmt.Errorf(
+					"delivering email %d (%s) (%s) to %s failed: %w",
+					mail.UID, mail.Envelope.Subject, mail.Path, rcpt, err,
+				))
+				logger.Warn(
+					"delivering scanned email failed, please find the original email in the backup mailbox!",
+					"event", "lmtp.msg_delivery_failed",
+					"filepath", mail.Path,
+					"mailbox.backup", c.backupMailbox,
+					"lmtp.recipient", rcpt,
+				)
+
+				continue
+			}
+
+			logger.Debug("delivered modified message", "lmtp.recipient", rcpt)
+			c.trackInboxMail(mail)
+			logger.Info("moved message to backup mailbox and delivered modified message with scan results")
 
 			continue
 		}
 
-		if c.isSpam(mail.CheckResult) {
-			mbox = c.spamMailbox
-		} else {
-			mbox = c.inboxMailbox
+		mbox, extraFlags := c.inboxMailbox, c.inboxFlags
+		if isSpam {
+			mbox, extraFlags = c.spamMailbox, c.spamFlags
 		}
 
-		err = c.clt.Upload(mail.Path, mbox, mail.Envelope.Date)
+		ts := mail.InternalDate
+		if ts.IsZero() {
+			ts = mail.Envelope.Date
+		}
+
+		uploads = append(uploads, &imapclt.UploadRequest{
+			Path:    mail.Path,
+			Mailbox: mbox,
+			Time:    ts,
+			Flags:   mergeFlags(withoutRescanKeywords(mail.Flags), extraFlags),
+		})
+		uploadMails = append(uploadMails, mail)
+	}
+
+	for i, err := range c.upload(uploads) {
+		mail := uploadMails[i]
+		logger := c.logger.With(
+			"mail.subject", mail.Envelope.Subject,
+			"mail.uid", mail.UID,
+		)
+
 		if err != nil {
 			errs = append(errs, fmt.Errorf(
 				"uploading email %d (%s) (%s) to %s failed: %w",
-				mail.UID, mail.Envelope.Subject, mail.Path, mbox, err,
+				mail.UID, mail.Envelope.Subject, mail.Path, uploads[i].Mailbox, err,
 			))
 			logger.Warn(
 				"uploading scanned email to inbox failed, please find the original email in the backup mailbox!",
@@ -288,83 +608,165 @@ func (c *Client) replaceWithModifiedMails(mails []*scannedMail) error {
 			continue
 		}
 
-		if c.keepTempFiles {
+		c.trackInboxMail(mail)
+		logger.Info("moved message to backup mailbox and uploaded modified message with scan results to inbox")
+	}
+
+	return errors.Join(errs...)
+}
+
+// upload uploads the mails described by reqs and returns an error for each
+// of them.
+// If the IMAP client implements [BatchUploader] the uploads are pipelined,
+// otherwise they are uploaded one after another.
+func (c *Client) upload(reqs []*imapclt.UploadRequest) []error {
+	if len(reqs) == 0 {
+		return nil
+	}
+
+	if bu, ok := c.clt.(BatchUploader); ok {
+		return bu.UploadBatch(reqs)
+	}
+
+	errs := make([]error, len(reqs))
+	for i, req := range reqs {
+		errs[i] = c.clt.Upload(req.Path, req.Mailbox, req.Time, req.Flags)
+	}
+
+	return errs
+}
+
+// moveToBackupMailbox moves mails to the backup mailbox with a single MOVE
+// command.
+// If it fails, e.g. because one of the mails was expunged meanwhile, the
+// mails are moved one by one. The mails that were moved are returned.
+func (c *Client) moveToBackupMailbox(mails []*scannedMail) ([]*scannedMail, error) {
+	uids := make([]uint32, 0, len(mails))
+	for _, mail := range mails {
+		uids = append(uids, mail.UID)
+	}
+
+	err := c.clt.Move(uids, c.backupMailbox)
+	if err == nil {
+		return mails, nil
+	}
+
+	if len(mails) == 1 {
+		return nil, fmt.Errorf("moving mail %d (%s) to backup mailbox %s failed: %w",
+			mails[0].UID, mails[0].Envelope.Subject, c.backupMailbox, err,
+		)
+	}
+
+	c.logger.Warn("moving mails to backup mailbox failed, moving them individually",
+		"event", "imap.msg_move_failed",
+		"mailbox.backup", c.backupMailbox,
+		"count", len(mails),
+		"error", err,
+	)
+
+	var moved []*scannedMail
+	var errs []error
+	for _, mail := range mails {
+		if err := c.clt.Move([]uint32{mail.UID}, c.backupMailbox); err != nil {
+			errs = append(errs, fmt.Errorf("moving mail %d (%s) to backup mailbox %s failed: %w",
+				mail.UID, mail.Envelope.Subject, c.backupMailbox, err,
+			))
 			continue
 		}
 
-		if err := os.Remove(mail.Path); err != nil {
-			logger.Warn(
-				"deleting email file failed",
-				"error", err,
-				"event", "imap.msg_delete_failed",
-				"filepath", mail.Path,
-			)
-		}
+		moved = append(moved, mail)
+	}
 
-		logger.Info("moved message to backup mailbox and uploaded modified message with scan results to inbox")
+	return moved, errors.Join(errs...)
+}
+
+// deliveryRecipientFor returns the recipient to which the modified mail is
+// delivered via [Client.deliverer].
+// If it returns an empty string, the mail is uploaded via IMAP.
+func (c *Client) deliveryRecipientFor(isSpam bool) string {
+	if c.deliverer == nil {
+		return ""
 	}
 
-	return errors.Join(errs...)
+	if isSpam {
+		return c.spamDeliveryRecipient
+	}
+
+	return c.deliveryRecipient
+}
+
+// downloadAndScan stores msg in a temporary file and scans it.
+func (c *Client) downloadAndScan(msg *imapclt.Message, useCache bool) (*scannedMail, error) {
+	path, err := c.download(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	sm, err := c.scanFile(path, msg, useCache)
+	if err != nil {
+		c.removeTempFile(&scannedMail{Path: path})
+		return nil, err
+	}
+
+	return sm, nil
 }
 
-func (c *Client) downloadAndScan(msg *imapclt.Message) (*scannedMail, error) {
+// download stores msg in a temporary file and returns its path.
+// Headers with scan results of previous scans are not stored.
+func (c *Client) download(msg *imapclt.Message) (string, error) {
 	tmpFile, err := os.CreateTemp(
 		c.tempDir,
 		"rspamd-iscan-mail-"+strconv.Itoa(int(msg.UID)),
 	)
 	if err != nil {
-		return nil, fmt.Errorf("creating temporary file failed: %w", err)
+		return "", fmt.Errorf("creating temporary file failed: %w", err)
 	}
 
-	errCleanupfn := func() {
+	err = mail.StripHeaders(msg.Message, tmpFile, hdrPrefix)
+	if err == nil {
+		err = tmpFile.Close()
+	} else {
 		_ = tmpFile.Close()
-
-		if c.keepTempFiles {
-			return
-		}
-
-		if err := os.Remove(tmpFile.Name()); err != nil {
-			c.logger.Error("deleting temporary file failed",
-				"error", err, "filepath", tmpFile.Name(),
-				"event", "file.deletion_failed")
-		}
 	}
-
-	_, err = io.Copy(tmpFile, msg.Message)
 	if err != nil {
-		errCleanupfn()
-		return nil, fmt.Errorf("downloading imap message to disk failed: %w", err)
+		c.removeTempFile(&scannedMail{Path: tmpFile.Name()})
+		return "", fmt.Errorf("downloading imap message to disk failed: %w", err)
 	}
 
 	env := &msg.Envelope
-	logger := c.logger.With("mail.subject", env.Subject, "mail.uid", msg.UID)
-	logger.Debug("downloaded imap message",
+	c.logger.Debug("downloaded imap message",
+		"mail.subject", env.Subject,
+		"mail.uid", msg.UID,
 		"filepath", tmpFile.Name(),
 		"mail.envelope.message_id", env.MessageID,
 		"mail.envelope.from", env.From,
 		"mail.envelope.recipients", env.Recipients,
 	)
 
-	_, err = tmpFile.Seek(0, 0)
+	return tmpFile.Name(), nil
+}
+
+// scanFile scans the mail stored at path and adds the scan result headers to
+// it.
+// msg is the IMAP message the file was downloaded from.
+func (c *Client) scanFile(path string, msg *imapclt.Message, useCache bool) (*scannedMail, error) {
+	env := &msg.Envelope
+	logger := c.logger.With("mail.subject", env.Subject, "mail.uid", msg.UID)
+
+	f, err := os.Open(path)
 	if err != nil {
-		errCleanupfn()
-		return nil, fmt.Errorf("setting %q file position to beginning failed: %w", tmpFile.Name(), err)
+		return nil, fmt.Errorf("opening downloaded mail failed: %w", err)
 	}
-	// TODO: retry Check if it failed with a temporary error
-	scanResult, err := c.rspamc.Check(context.Background(), tmpFile, envelopeToRspamcHdrs(env))
+
+	scanResult, err := c.check(logger, f, envelopeToRspamcHdrs(env), useCache)
+	_ = f.Close()
 	if err != nil {
-		errCleanupfn()
 		return nil, err
 	}
 
-	if err := tmpFile.Close(); err != nil {
-		errCleanupfn()
-		return nil, fmt.Errorf("closing file of downloaded mail failed: %w", err)
-	}
-
 	if scanResult.Subject != "" && scanResult.Subject != env.Subject {
 		err := mail.ReplaceHeader(
-			tmpFile.Name(),
+			path,
 			mail.Header{Name: "Subject", Body: scanResult.Subject},
 		)
 		if err != nil {
@@ -377,23 +779,37 @@ func (c *Client) downloadAndScan(msg *imapclt.Message) (*scannedMail, error) {
 		)
 	}
 
-	err = addScanResultHeaders(tmpFile.Name(), scanResult)
+	err = addScanResultHeaders(path, scanResult)
 	if err != nil {
 		return nil, fmt.Errorf("adding scan result headers to local mail copy failed: %w", err)
 	}
 
-	logger.Info("message scanned",
-		"scan.score", scanResult.Score, "scan.is_spam", c.isSpam(scanResult),
-	)
+	c.logScanResult(logger, scanResult)
 
 	return &scannedMail{
-		Path:        tmpFile.Name(),
-		UID:         msg.UID,
-		Envelope:    env,
-		CheckResult: scanResult,
+		Path:         path,
+		UID:          msg.UID,
+		Envelope:     env,
+		Flags:        msg.Flags,
+		InternalDate: msg.InternalDate,
+		CheckResult:  scanResult,
 	}, nil
 }
 
+// mergeFlags returns the union of flags and extra.
+// Flags are compared case-insensitively.
+func mergeFlags(flags, extra []string) []string {
+	result := slices.Clone(flags)
+
+	for _, f := range extra {
+		if !slices.ContainsFunc(result, func(e string) bool { return strings.EqualFold(e, f) }) {
+			result = append(result, f)
+		}
+	}
+
+	return result
+}
+
 func envelopeToRspamcHdrs(env *imapclt.Envelope) *rspamc.MailHeaders {
 	return &rspamc.MailHeaders{
 		Subject:    env.Subject,
@@ -407,10 +823,28 @@ func (c *Client) ProcessScanBox() error {
 	var malformedMailsUIDs []uint32
 	var errs []error
 
+	if !c.hasQuotaSpace() {
+		return nil
+	}
+
+	c.probeRspamd()
+	if !c.rspamdUnavailable {
+		if err := c.requeueUnscanned(); err != nil {
+			return err
+		}
+	}
+
 	logger := c.logger.With("mailbox.source", c.scanMailbox)
 	logger.Info("processing scan box")
 
-	for msg, err := range c.clt.Messages(c.scanMailbox) {
+	// rescanPending is true if mails remain in the scan mailbox to be
+	// scanned again later
+	var rescanPending bool
+	var pendingUIDs []uint32
+	seenUIDs := map[uint32]struct{}{}
+
+	state := c.syncState.Get(c.scanMailbox)
+	for msg, err := range c.clt.Messages(c.scanMailbox, &state) {
 		if err != nil {
 			if errMalformed, ok := errors.AsType[*imapclt.ErrMalformedMsg](err); ok {
 				logger.Warn("email is malformed, skipping scan",
@@ -425,8 +859,21 @@ func (c *Client) ProcessScanBox() error {
 			return fmt.Errorf("fetching messages from scanbox failed: %w", err)
 		}
 
-		sm, err := c.downloadAndScan(msg)
+		seenUIDs[msg.UID] = struct{}{}
+		if !c.rescanDue(msg) {
+			rescanPending = true
+			continue
+		}
+
+		sm, err := c.scanOrPassUnscanned(msg)
 		if err != nil {
+			if errors.Is(err, rspamc.ErrUnavailable) {
+				// the mails remain in the scan mailbox until rspamd
+				// is available again
+				rescanPending = true
+				break
+			}
+
 			// TODO: abort on local tmpfile errors immediately,
 			// unlikely that the following mail won't encounter the
 			// same issue
@@ -434,10 +881,32 @@ func (c *Client) ProcessScanBox() error {
 			break
 		}
 
+		ok, err := c.handleUnverified(sm, &pendingUIDs)
+		if err != nil {
+			c.removeTempFile(sm)
+			errs = append(errs, err)
+			break
+		}
+		if !ok {
+			if _, scheduled := c.rescans[sm.UID]; scheduled {
+				rescanPending = true
+			}
+			continue
+		}
+
 		scannedMails = append(scannedMails, sm)
 	}
 
-	err := c.replaceWithModifiedMails(scannedMails)
+	if len(errs) == 0 {
+		c.pruneRescans(seenUIDs)
+	}
+
+	var err error
+	if c.tagOnly {
+		err = c.tagAndMoveMails(scannedMails)
+	} else {
+		err = c.replaceWithModifiedMails(scannedMails)
+	}
 	if err != nil {
 		errs = append(errs, err)
 	}
@@ -452,15 +921,50 @@ func (c *Client) ProcessScanBox() error {
 			"count", len(malformedMailsUIDs))
 	}
 
+	if len(pendingUIDs) > 0 {
+		err = c.clt.Move(pendingUIDs, c.pendingMailbox)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("moving mails to pending mailbox failed: %w", err))
+		} else {
+			logger.Info("moved mails with inconclusive scan results to pending mailbox",
+				"event", "imap.pending_msgs_moved",
+				"mailbox.destination", c.pendingMailbox,
+				"count", len(pendingUIDs),
+			)
+		}
+	}
+
 	c.cntProcessedMails.Add(uint64(len(scannedMails)))
 
+	// when processing failed or mails are rescanned later, messages
+	// remain in the mailbox, the state is not updated to fetch them again
+	// in the next run
+	if len(errs) == 0 && !rescanPending {
+		c.saveSyncState(c.scanMailbox, state)
+	}
+
 	return errors.Join(errs...)
 }
 
+// saveSyncState stores the synchronization state of mailbox.
+// It must only be called when all messages that were fetched with state were
+// processed successfully.
+func (c *Client) saveSyncState(mailbox string, state imapclt.SyncState) {
+	if err := c.syncState.Set(mailbox, state); err != nil {
+		c.logger.Warn("storing mailbox sync state failed",
+			"error", err,
+			"event", "syncstate.store_failed",
+			"mailbox", mailbox,
+		)
+	}
+}
+
 // Monitor monitors the Unscanned mailbox for new messages and processes them
 // continuously,
 // It also checks periodically the Ham and Undetected Mailbox for new messages.
 // sents them to rspamd for leanring and moves them to their target inbox.
+// Mails in the inbox mailbox are rescanned when their late rescan is due, see
+// [Config.LateRescanMargin].
 //
 // The method blocks until an error occurred or [*Client.Stop] is called.
 // When an error happens [*Client.Stop] should still be called to ensure that
@@ -476,6 +980,39 @@ func (c *Client) Monitor() error {
 	lastLearnAt := time.Now()
 
 	for {
+		if wait, ok := c.scanBacklogWait(); ok {
+			// the scan mailbox is not monitored, it is not empty and
+			// events would be sent immediately
+			select {
+			case <-time.After(wait):
+			case <-c.lateRescanTimer():
+			case <-c.stopCh:
+				return nil
+			}
+
+			if err := c.ProcessLateRescans(); err != nil {
+				return err
+			}
+
+			if time.Since(lastLearnAt) >= c.learnInterval {
+				if err := c.ProcessHam(); err != nil {
+					return err
+				}
+
+				if err := c.ProcessSpam(); err != nil {
+					return err
+				}
+
+				lastLearnAt = time.Now()
+			}
+
+			if err := c.ProcessScanBox(); err != nil {
+				return err
+			}
+
+			continue
+		}
+
 		eventCh, monitorCancelFn, err := c.clt.Monitor(c.scanMailbox)
 		if err != nil {
 			return err
@@ -509,6 +1046,15 @@ func (c *Client) Monitor() error {
 
 			lastLearnAt = time.Now()
 
+		case <-c.lateRescanTimer():
+			if err := monitorCancelFn(); err != nil {
+				return err
+			}
+
+			if err := c.ProcessLateRescans(); err != nil {
+				return err
+			}
+
 		case evA, ok := <-eventCh:
 			if !ok {
 				c.logger.Debug("event channel was closed")
@@ -540,7 +1086,28 @@ func (c *Client) Monitor() error {
 	}
 }
 
-// RunOnce processes all mails in the ham, spam and scan mailbox once.
+// scanBacklogWait returns how long to wait before processing the scan
+// mailbox again when mails remain in it intentionally, because scanning is
+// paused, rspamd is unavailable or rescans are scheduled.
+// If it returns false, the scan mailbox can be monitored.
+func (c *Client) scanBacklogWait() (time.Duration, bool) {
+	if c.quotaPaused {
+		return c.quotaCheckInterval, true
+	}
+
+	if c.rspamdUnavailable {
+		return c.rspamdRetryInterval, true
+	}
+
+	if next := c.nextRescanAt(); !next.IsZero() {
+		return max(time.Until(next), 0), true
+	}
+
+	return 0, false
+}
+
+// RunOnce processes all mails in the ham, spam and scan mailbox and the due
+// late rescans once.
 func (c *Client) RunOnce() error {
 	err := c.ProcessHam()
 	if err != nil {
@@ -552,6 +1119,11 @@ func (c *Client) RunOnce() error {
 		return fmt.Errorf("learning spam failed: %w", err)
 	}
 
+	err = c.ProcessLateRescans()
+	if err != nil {
+		return fmt.Errorf("processing late rescans failed: %w", err)
+	}
+
 	return c.ProcessScanBox()
 }
 
@@ -4,6 +4,9 @@ import (
 	"context"
 	"errors"
 	"io"
+	"os"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -77,10 +80,10 @@ func TestProcessScanBox_DownloadAndScanFails(t *testing.T) {
 		},
 	}
 
-	err := clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now())
+	err := clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil)
 	assert.NoError(t, err)
 
-	err = clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now())
+	err = clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil)
 	assert.NoError(t, err)
 
 	err = clt.ProcessScanBox()
@@ -104,19 +107,19 @@ func TestRun(t *testing.T) {
 
 	clt2 := newTestClient(t, srv)
 
-	err := clt2.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now())
+	err := clt2.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil)
 	assert.NoError(t, err)
 
-	err = clt2.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now())
+	err = clt2.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil)
 	assert.NoError(t, err)
 
-	err = clt2.clt.Upload(mail.TestSuspiciousMailPath(t), srv.ScanMailbox, time.Now())
+	err = clt2.clt.Upload(mail.TestSuspiciousMailPath(t), srv.ScanMailbox, time.Now(), nil)
 	assert.NoError(t, err)
 
-	err = clt2.clt.Upload(mail.TestHamMailPath(t), srv.HamMailbox, time.Now())
+	err = clt2.clt.Upload(mail.TestHamMailPath(t), srv.HamMailbox, time.Now(), nil)
 	assert.NoError(t, err)
 
-	err = clt2.clt.Upload(mail.TestSpamMailPath(t), srv.UndetectedMailbox, time.Now())
+	err = clt2.clt.Upload(mail.TestSpamMailPath(t), srv.UndetectedMailbox, time.Now(), nil)
 	assert.NoError(t, err)
 
 	for clt.cntProcessedMails.Load() < 5 {
@@ -156,7 +159,7 @@ func TestRun(t *testing.T) {
 }
 
 func mailboxIsEmpty(t *testing.T, clt IMAPClient, mailbox string) bool {
-	for _, err := range clt.Messages(mailbox) {
+	for _, err := range clt.Messages(mailbox, nil) {
 		assert.NoError(t, err)
 		return false
 	}
@@ -170,7 +173,7 @@ func mailboxContainsMailCnt(
 	mailSubject string,
 ) int {
 	cnt := 0
-	for msg, err := range clt.Messages(mailbox) {
+	for msg, err := range clt.Messages(mailbox, nil) {
 		assert.NoError(t, err)
 		if msg.Envelope.Subject == mailSubject {
 			cnt++
@@ -190,11 +193,11 @@ func TestLearn_MalformedMessage(t *testing.T) {
 	spamMail := mail.TestSpamMailPath(t)
 	malformedMail := mail.TestMalformedMailPath(t)
 
-	assert.NoError(t, clt.clt.Upload(hamMail, srv.ScanMailbox, time.Now()))
-	assert.NoError(t, clt.clt.Upload(malformedMail, srv.ScanMailbox, time.Now()))
-	assert.NoError(t, clt.clt.Upload(spamMail, srv.ScanMailbox, time.Now()))
-	assert.NoError(t, clt.clt.Upload(malformedMail, srv.HamMailbox, time.Now()))
-	assert.NoError(t, clt.clt.Upload(malformedMail, srv.UndetectedMailbox, time.Now()))
+	assert.NoError(t, clt.clt.Upload(hamMail, srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(malformedMail, srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(spamMail, srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(malformedMail, srv.HamMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(malformedMail, srv.UndetectedMailbox, time.Now(), nil))
 
 	assert.NoError(t, clt.ProcessScanBox())
 	assert.NoError(t, clt.ProcessHam())
@@ -207,9 +210,63 @@ func TestLearn_MalformedMessage(t *testing.T) {
 	assert.Equal(t, 2, countMessagesInMailbox(t, clt.clt, srv.SpamMailbox))
 }
 
+func TestLearn_Fuzzy(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		fuzzyFlag     int
+		expectedCalls []mock.Call
+	}{
+		{
+			name:          "disabled",
+			expectedCalls: []mock.Call{{Method: "Spam"}, {Method: "Ham"}},
+		},
+		{
+			name:      "enabled",
+			fuzzyFlag: 11,
+			expectedCalls: []mock.Call{
+				{Method: "Spam"},
+				{Method: "FuzzyAdd", Flag: 11, Weight: 5},
+				{Method: "Ham"},
+				{Method: "FuzzyDel", Flag: 11},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, clt := startServerClient(t)
+			rspamc := mock.NewRspamc()
+			clt.rspamc = rspamc
+			clt.fuzzyFlag = tc.fuzzyFlag
+			clt.fuzzyWeight = 5
+
+			assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.UndetectedMailbox, time.Now(), nil))
+			assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.HamMailbox, time.Now(), nil))
+
+			assert.NoError(t, clt.ProcessSpam())
+			assert.NoError(t, clt.ProcessHam())
+
+			calls := rspamc.Calls()
+			assert.Equal(t, len(tc.expectedCalls), len(calls))
+			for i, call := range calls {
+				expected := tc.expectedCalls[i]
+				assert.Equal(t, expected.Method, call.Method)
+				assert.Equal(t, expected.Flag, call.Flag)
+				assert.Equal(t, expected.Weight, call.Weight)
+				if len(call.Body) == 0 {
+					t.Errorf("%s call has an empty body", call.Method)
+				}
+			}
+
+			if tc.fuzzyFlag > 0 {
+				assert.Equal(t, string(calls[0].Body), string(calls[1].Body))
+				assert.Equal(t, mail.SpamMailSubject, calls[1].Headers.Subject)
+			}
+		})
+	}
+}
+
 func countMessagesInMailbox(t *testing.T, clt IMAPClient, mailbox string) int {
 	cnt := 0
-	for _, err := range clt.Messages(mailbox) {
+	for _, err := range clt.Messages(mailbox, nil) {
 		var errMalformed *imapclt.ErrMalformedMsg
 		if err != nil && !errors.As(err, &errMalformed) {
 			assert.NoError(t, err)
@@ -218,3 +275,165 @@ func countMessagesInMailbox(t *testing.T, clt IMAPClient, mailbox string) int {
 	}
 	return cnt
 }
+
+func TestProcessScanBox_PreservesFlagsAndInternalDate(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.spamFlags = []string{`\Seen`, "$Junk"}
+	clt.inboxFlags = []string{"$NotJunk"}
+
+	receivedAt := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	flags := []string{`\Flagged`, "$Label1"}
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, receivedAt, flags))
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, receivedAt, flags))
+
+	assert.NoError(t, clt.ProcessScanBox())
+
+	tests := []struct {
+		mailbox       string
+		expectedFlags []string
+	}{
+		{srv.InboxMailBox, []string{`\Flagged`, "$Label1", "$NotJunk"}},
+		{srv.SpamMailbox, []string{`\Flagged`, "$Label1", `\Seen`, "$Junk"}},
+	}
+
+	for _, tt := range tests {
+		cnt := 0
+		for msg, err := range clt.clt.Messages(tt.mailbox, nil) {
+			assert.NoError(t, err)
+			cnt++
+
+			if !msg.InternalDate.Equal(receivedAt) {
+				t.Errorf("%s: internal date is %s, expected %s", tt.mailbox, msg.InternalDate, receivedAt)
+			}
+
+			// keywords are case-insensitive, the test server
+			// changes their case
+			for _, f := range tt.expectedFlags {
+				if !slices.ContainsFunc(msg.Flags, func(e string) bool { return strings.EqualFold(e, f) }) {
+					t.Errorf("%s: flag %q missing, message has flags: %v", tt.mailbox, f, msg.Flags)
+				}
+			}
+		}
+		assert.Equal(t, 1, cnt)
+	}
+}
+
+func TestProcessScanBox_UploadErrorsAreAttributedPerMail(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.spamMailbox = "missing"
+
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	err := clt.ProcessScanBox()
+	assert.Error(t, err)
+	if !strings.Contains(err.Error(), "to missing failed") {
+		t.Errorf("error does not refer to the failed upload: %s", err)
+	}
+
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, 2, mailboxContainsMailCnt(t, clt.clt, srv.BackupMailbox, mail.HamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.BackupMailbox, mail.SpamMailSubject))
+	assert.Equal(t, 2, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+	assertDirIsEmpty(t, clt.tempDir)
+}
+
+// batchMoveFailingClient fails MOVE commands for more than 1 mail.
+type batchMoveFailingClient struct {
+	IMAPClient
+}
+
+func (c *batchMoveFailingClient) Move(uids []uint32, mailbox string) error {
+	if len(uids) > 1 {
+		return errors.New("batch move failed")
+	}
+
+	return c.IMAPClient.Move(uids, mailbox)
+}
+
+func TestProcessScanBox_MovesBackupsIndividuallyWhenBatchMoveFails(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.clt = &batchMoveFailingClient{IMAPClient: clt.clt}
+
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.BackupMailbox, mail.HamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.BackupMailbox, mail.SpamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+	assertDirIsEmpty(t, clt.tempDir)
+}
+
+func assertDirIsEmpty(t *testing.T, dir string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	if len(entries) != 0 {
+		t.Errorf("directory %s is not empty, contains %d entries", dir, len(entries))
+	}
+}
+
+func TestIsSpam(t *testing.T) {
+	for _, tc := range []struct {
+		threshold float32
+		result    rspamc.CheckResult
+		expected  bool
+	}{
+		{threshold: 10, result: rspamc.CheckResult{Score: 10, RequiredScore: 15}, expected: true},
+		{threshold: 10, result: rspamc.CheckResult{Score: 9.9}},
+		{result: rspamc.CheckResult{Score: 10, RequiredScore: 15}},
+		{result: rspamc.CheckResult{Score: 15, RequiredScore: 15}, expected: true},
+		// no threshold known
+		{result: rspamc.CheckResult{Score: 1, IsSkipped: true}},
+	} {
+		clt := Client{spamTreshold: tc.threshold}
+		assert.Equal(t, tc.expected, clt.isSpam(&tc.result))
+	}
+}
+
+func TestAsHdrMap_SymbolOptions(t *testing.T) {
+	hdrs := asHdrMap("X-", map[string]*rspamc.Symbol{
+		"DKIM_TRACE": {Name: "DKIM_TRACE", Score: 0.5, Options: []string{"example.com:+", "example.org:-"}},
+		"R_SPF_NA":   {Name: "R_SPF_NA", Score: 0},
+	}, true)
+
+	assert.Equal(t, 1, len(hdrs))
+	assert.Equal(t, "X-DKIM_TRACE", hdrs[0].Name)
+	assert.Equal(t, "0.5 [example.com:+,example.org:-]", hdrs[0].Body)
+}
+
+func TestProcessScanBox_SymbolOptionsHeaders(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.rspamc = &mock.Rspamc{
+		CheckFn: func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			return &rspamc.CheckResult{
+				Score: 0.5,
+				Symbols: map[string]*rspamc.Symbol{
+					"DKIM_TRACE": {Name: "DKIM_TRACE", Score: 0.5, Options: []string{"example.com:+"}},
+				},
+			}, nil
+		},
+	}
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.ProcessScanBox())
+
+	cnt := 0
+	for msg, err := range clt.clt.Messages(srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+		cnt++
+
+		body, err := io.ReadAll(msg.Message)
+		assert.NoError(t, err)
+		if !strings.Contains(string(body), hdrPrefix+"Symbol-DKIM_TRACE: 0.5 [example.com:+]\r\n") {
+			t.Errorf("mail does not contain symbol header with options:\n%s", body)
+		}
+	}
+	assert.Equal(t, 1, cnt)
+}
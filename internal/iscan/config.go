@@ -1,24 +1,68 @@
 package iscan
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"iter"
 	"log/slog"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/learnspool"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
 )
 
 type IMAPClient interface {
+	MailboxManager
+
+	AddFlags(uids []uint32, flags []string) error
 	Close() error
 	Connect() error
 	MarkSeen(uids []uint32) error
-	Messages(mailbox string) iter.Seq2[*imapclt.Message, error]
+	Messages(mailbox string, state *imapclt.SyncState) iter.Seq2[*imapclt.Message, error]
 	Monitor(mailbox string) (<-chan *imapclt.EventNewMessages, func() error, error)
 	Move(uids []uint32, mailbox string) error
-	Upload(path, mailbox string, ts time.Time) error
+	Upload(path, mailbox string, ts time.Time, flags []string) error
+}
+
+// BatchUploader is implemented by IMAP clients that can upload multiple mails
+// without waiting for the completion of each upload.
+// It returns an error for each request, nil if the upload succeeded.
+type BatchUploader interface {
+	UploadBatch(reqs []*imapclt.UploadRequest) []error
+}
+
+// Deliverer delivers mails via another protocol than IMAP, e.g. LMTP.
+type Deliverer interface {
+	Deliver(ctx context.Context, path, recipient string) error
+}
+
+// SyncStateStore stores the synchronization state of mailboxes and the due
+// times of late rescans, keyed by Message-ID.
+type SyncStateStore interface {
+	Get(mailbox string) imapclt.SyncState
+	Set(mailbox string, state imapclt.SyncState) error
+	LateRescans() map[string]time.Time
+	SetLateRescans(rescans map[string]time.Time) error
+}
+
+// LearnSpool stores learn requests that failed because rspamd was
+// unavailable, to send them later in the same order.
+type LearnSpool interface {
+	Add(item *learnspool.Item) error
+	Len() int
+	Replay(fn func(*learnspool.Item) error) (int, error)
+}
+
+// CheckCache stores check results by the checked message and its metadata
+// headers.
+type CheckCache interface {
+	Get(msg []byte, hdrs *rspamc.MailHeaders) (*rspamc.CheckResult, bool)
+	Add(msg []byte, hdrs *rspamc.MailHeaders, result *rspamc.CheckResult)
 }
 
 type Config struct {
@@ -34,16 +78,104 @@ type Config struct {
 
 	MarkLearnedAsSpamAsRead bool
 
+	// SpamTreshold is the score from which on mails are classified as
+	// spam. If 0, the required_score reported by rspamd for each mail is
+	// used.
 	SpamTreshold float32
 
+	// TagOnly enables classifying mails without modifying them.
+	// Instead of uploading a copy with added headers, the original mail
+	// is tagged with keywords and moved to the spam or inbox mailbox.
+	// BackupMailbox is not used.
+	TagOnly bool
+
+	// SpamFlags are added to mails that are uploaded to the spam mailbox,
+	// e.g. \Seen and $Junk.
+	SpamFlags []string
+	// InboxFlags are added to mails that are uploaded to the inbox
+	// mailbox, e.g. $NotJunk.
+	InboxFlags []string
+
 	Logger     *slog.Logger
 	IMAPClient IMAPClient
 	Rspamc     RspamdClient
+	// Deliverer is optional, if set modified mails are delivered via it
+	// to DeliveryRecipient instead of being uploaded to InboxMailbox.
+	// Server-side filters (e.g. Sieve) are applied to delivered mails.
+	// Flags of the original mails are not preserved.
+	Deliverer         Deliverer
+	DeliveryRecipient string
+	// SpamDeliveryRecipient is optional, if set spam mails are delivered
+	// to it via Deliverer, otherwise they are uploaded to
+	// SpamMailboxName.
+	SpamDeliveryRecipient string
+	// SyncState is optional, if nil the states and late rescans are only
+	// kept in memory.
+	SyncState SyncStateStore
+	// LearnSpool is optional, if set learn requests that fail because
+	// rspamd is unavailable are stored in it and the mails are moved to
+	// their destination mailbox anyway. The spooled requests are sent
+	// before learning new mails.
+	LearnSpool LearnSpool
+	// CheckCache is optional, if set conclusive check results are
+	// cached in it and mails with the same content and metadata headers
+	// are not sent to rspamd again. Late rescans bypass the cache.
+	CheckCache CheckCache
+
+	// QuotaMinFree is optional, if positive and IMAPClient implements
+	// [QuotaReader], the storage quota of InboxMailbox and
+	// SpamMailboxName is checked before scanning. While fewer bytes are
+	// free, scanning is paused and mails remain in ScanMailbox.
+	QuotaMinFree int64
+
+	// SkippedPolicy defines the handling of mails that rspamd skipped
+	// (is_skipped), e.g. because of settings or their size.
+	// If empty, [PolicyPass] is used.
+	SkippedPolicy UnverifiedPolicy
+	// GreylistPolicy defines the handling of mails with the greylist or
+	// soft reject action.
+	// If empty, [PolicyPass] is used.
+	GreylistPolicy UnverifiedPolicy
+	// PendingMailbox is the mailbox mails are moved to with
+	// [PolicyPending].
+	PendingMailbox string
+	// RescanDelay is the time after which mails are scanned again with
+	// [PolicyRescan], if 0 it is 15 minutes.
+	RescanDelay time.Duration
+	// MaxRescans is the maximum number of times a mail is scanned again
+	// with [PolicyRescan], if 0 it is 3.
+	MaxRescans int
+
+	// FuzzyFlag is optional, if positive mails learned as spam are also
+	// added to the fuzzy storage of rspamd with this flag and FuzzyWeight,
+	// mails learned as ham are removed from it.
+	FuzzyFlag int
+	// FuzzyWeight is the weight of the fuzzy hashes of mails learned as
+	// spam, if 0 it is 1.
+	FuzzyWeight int
+
+	// LateRescanMargin is optional, if positive mails that are moved to
+	// InboxMailbox with a score of at least the spam threshold minus
+	// LateRescanMargin are scanned again after LateRescanDelay. If they
+	// are classified as spam then, they are moved to SpamMailboxName.
+	// Mails that were read or flagged meanwhile are left alone.
+	// IMAPClient must implement [LateRescanClient].
+	LateRescanMargin float32
+	// LateRescanDelay is the time after which mails are scanned again, if
+	// 0 it is 1 hour.
+	LateRescanDelay time.Duration
+
+	// UnavailablePolicy defines the handling of mails while rspamd is
+	// unavailable. If empty, [PolicyFailClosed] is used.
+	// [PolicyFailOpen] requires that Rspamc returns errors wrapping
+	// [rspamc.ErrCircuitOpen] and that IMAPClient implements
+	// [LateRescanClient].
+	UnavailablePolicy UnavailablePolicy
 }
 
 func (c *Config) validate() error {
-	if c.SpamTreshold <= 0 {
-		return errors.New("SpamTreshold must be >0")
+	if c.SpamTreshold < 0 {
+		return errors.New("SpamTreshold must be >=0")
 	}
 
 	if c.ScanMailbox == c.InboxMailbox {
@@ -58,19 +190,16 @@ func (c *Config) validate() error {
 		return errors.New("ScanMailbox and HamMailbox must differ")
 	}
 
-	if c.BackupMailbox == "" {
+	if c.BackupMailbox == "" && !c.TagOnly {
 		return errors.New("BackupMailbox can not be empty")
 	}
 
-	if c.BackupMailbox == c.InboxMailbox {
+	if c.BackupMailbox != "" && c.BackupMailbox == c.InboxMailbox {
 		return errors.New("BackupMailbox and InboxMailbox must differ")
 	}
 
 	// Using the same mailbox for Spam, Ham and/or Backup would be weird but
 	// should work fine!
-	if c.SpamTreshold == 0 {
-		return errors.New("SpamThreshold must be >0")
-	}
 
 	fd, err := os.Stat(c.TempDir)
 	if err != nil {
@@ -85,5 +214,69 @@ func (c *Config) validate() error {
 		return errors.New("rspamc can not be nil")
 	}
 
+	if c.Deliverer != nil && c.DeliveryRecipient == "" {
+		return errors.New("DeliveryRecipient can not be empty when a Deliverer is set")
+	}
+
+	for _, p := range []UnverifiedPolicy{c.SkippedPolicy, c.GreylistPolicy} {
+		if err := p.validate(); err != nil {
+			return err
+		}
+
+		if p == PolicyPending && c.PendingMailbox == "" {
+			return fmt.Errorf("PendingMailbox can not be empty with policy %q", p)
+		}
+	}
+
+	if c.PendingMailbox != "" && c.PendingMailbox == c.ScanMailbox {
+		return errors.New("ScanMailbox and PendingMailbox must differ")
+	}
+
+	if c.RescanDelay < 0 || c.MaxRescans < 0 {
+		return errors.New("RescanDelay and MaxRescans must be >=0")
+	}
+
+	if c.FuzzyFlag < 0 || c.FuzzyWeight < 0 {
+		return errors.New("FuzzyFlag and FuzzyWeight must be >=0")
+	}
+
+	if c.LateRescanMargin < 0 || c.LateRescanDelay < 0 {
+		return errors.New("LateRescanMargin and LateRescanDelay must be >=0")
+	}
+
+	if c.LateRescanMargin > 0 {
+		if _, ok := c.IMAPClient.(LateRescanClient); !ok {
+			return errors.New("the mail client does not support late rescans, LateRescanMargin must be 0")
+		}
+	}
+
+	if err := c.UnavailablePolicy.validate(); err != nil {
+		return err
+	}
+
+	if c.UnavailablePolicy == PolicyFailOpen {
+		if _, ok := c.IMAPClient.(LateRescanClient); !ok {
+			return fmt.Errorf("the mail client does not support rescanning mails in the inbox, policy %q can not be used", PolicyFailOpen)
+		}
+	}
+
+	for _, f := range slices.Concat(c.SpamFlags, c.InboxFlags) {
+		if !isValidFlag(f) {
+			return fmt.Errorf("invalid imap flag: %q", f)
+		}
+	}
+
 	return nil
 }
+
+// isValidFlag returns true if f is a valid IMAP system flag or keyword.
+func isValidFlag(f string) bool {
+	name := strings.TrimPrefix(f, `\`)
+	if name == "" {
+		return false
+	}
+
+	// atom-specials and list/resp-specials, RFC 3501 section 9
+	return !strings.ContainsAny(name, "(){ %*\"\\]") &&
+		!strings.ContainsFunc(name, func(r rune) bool { return r <= 0x1f || r >= 0x7f })
+}
@@ -0,0 +1,53 @@
+package iscan
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/lmtp"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/lmtpserver"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+)
+
+func TestProcessScanBox_DeliverViaLMTP(t *testing.T) {
+	srv, clt := startServerClient(t)
+	lmtpSrv := lmtpserver.Start(t)
+
+	deliverer, err := lmtp.NewClient(&lmtp.Config{Address: lmtpSrv.Address, Logger: log.SlogTestLogger(t)})
+	assert.NoError(t, err)
+
+	clt.deliverer = deliverer
+	clt.deliveryRecipient = srv.UserName
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+
+	// the ham mail was delivered via lmtp, spam is uploaded to the spam
+	// mailbox because no spam recipient is configured
+	msgs := lmtpSrv.Messages()
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, srv.UserName, msgs[0].Recipients[0])
+	if !strings.Contains(msgs[0].Data, "Subject: "+mail.HamMailSubject) ||
+		!strings.Contains(msgs[0].Data, hdrRspamdScore+": ") {
+		t.Errorf("delivered mail is not the scanned ham mail with scan headers:\n%s", msgs[0].Data)
+	}
+
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.InboxMailBox))
+	assert.Equal(t, 1, countMessagesInMailbox(t, clt.clt, srv.SpamMailbox))
+	assert.Equal(t, 2, countMessagesInMailbox(t, clt.clt, srv.BackupMailbox))
+
+	// spam is delivered via lmtp when a spam recipient is set
+	clt.spamDeliveryRecipient = srv.UserName + "+Spam"
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.ProcessScanBox())
+
+	msgs = lmtpSrv.Messages()
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, srv.UserName+"+Spam", msgs[1].Recipients[0])
+	assert.Equal(t, 1, countMessagesInMailbox(t, clt.clt, srv.SpamMailbox))
+}
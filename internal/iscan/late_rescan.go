@@ -0,0 +1,343 @@
+package iscan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+const defLateRescanDelay = time.Hour
+
+// LateRescanClient is implemented by IMAP clients that support the operations
+// required to rescan mails in the inbox mailbox, see
+// [Config.LateRescanMargin] and [PolicyFailOpen].
+type LateRescanClient interface {
+	MessagesByID(mailbox string, messageIDs []string) iter.Seq2[*imapclt.Message, error]
+	SearchMessages(mailbox string, criteria *imap.SearchCriteria) iter.Seq2[*imapclt.Message, error]
+	RemoveFlags(uids []uint32, flags []string) error
+	Delete(uids []uint32) error
+}
+
+// scheduleLateRescan schedules a rescan of a mail that was moved to the inbox
+// mailbox, if its score is within the late rescan margin below the spam
+// threshold.
+func (c *Client) scheduleLateRescan(sm *scannedMail) {
+	if c.lateRescanMargin <= 0 || c.isSpam(sm.CheckResult) {
+		return
+	}
+
+	threshold := c.spamThreshold(sm.CheckResult)
+	if threshold <= 0 || sm.CheckResult.Score < threshold-c.lateRescanMargin {
+		return
+	}
+
+	logger := c.logger.With("mail.subject", sm.Envelope.Subject, "mail.uid", sm.UID)
+
+	if sm.Envelope.MessageID == "" {
+		logger.Debug("mail has no message-id, it can not be rescanned later")
+		return
+	}
+
+	dueAt := time.Now().Add(c.lateRescanDelay)
+	c.lateRescans[sm.Envelope.MessageID] = dueAt
+	c.saveLateRescans()
+
+	logger.Debug("scheduled late rescan of mail",
+		"event", "scan.late_rescan_scheduled",
+		"scan.score", sm.CheckResult.Score,
+		"scan.rescan_at", dueAt,
+	)
+}
+
+// nextLateRescanAt returns the time of the next due late rescan, it is zero
+// if no late rescans are scheduled.
+func (c *Client) nextLateRescanAt() time.Time {
+	var result time.Time
+
+	for _, dueAt := range c.lateRescans {
+		if result.IsZero() || dueAt.Before(result) {
+			result = dueAt
+		}
+	}
+
+	return result
+}
+
+// lateRescanTimer returns a channel that receives a value when the next late
+// rescan is due. If none is scheduled, nil is returned.
+func (c *Client) lateRescanTimer() <-chan time.Time {
+	next := c.nextLateRescanAt()
+	if next.IsZero() {
+		return nil
+	}
+
+	return time.After(time.Until(next))
+}
+
+// ProcessLateRescans scans the mails in the inbox mailbox again whose late
+// rescan is due. Mails that are classified as spam now are moved to the spam
+// mailbox with updated scan results.
+// Mails that were read or flagged meanwhile or are not in the inbox mailbox
+// anymore are left alone.
+func (c *Client) ProcessLateRescans() error {
+	var dueIDs []string
+	var spamMails []*scannedMail
+
+	now := time.Now()
+	for id, dueAt := range c.lateRescans {
+		if !dueAt.After(now) {
+			dueIDs = append(dueIDs, id)
+		}
+	}
+
+	if len(dueIDs) == 0 {
+		return nil
+	}
+
+	lrc, ok := c.clt.(LateRescanClient)
+	if !ok {
+		return errors.New("imap client does not support late rescans")
+	}
+
+	logger := c.logger.With("mailbox.source", c.inboxMailbox)
+	logger.Info("rescanning delivered messages", "count", len(dueIDs))
+
+	for msg, err := range lrc.MessagesByID(c.inboxMailbox, dueIDs) {
+		if err != nil {
+			if errMalformed, ok := errors.AsType[*imapclt.ErrMalformedMsg](err); ok {
+				logger.Warn("email is malformed, skipping late rescan",
+					"mail.uid", errMalformed.UID,
+					"error", err,
+					"event", "imap.msg_malformed",
+				)
+				continue
+			}
+
+			c.removeTempFiles(spamMails)
+			return fmt.Errorf("fetching messages for late rescan failed: %w", err)
+		}
+
+		mlogger := logger.With("mail.subject", msg.Envelope.Subject, "mail.uid", msg.UID)
+
+		if hasFlag(msg.Flags, string(imap.FlagSeen)) || hasFlag(msg.Flags, string(imap.FlagFlagged)) {
+			mlogger.Info("mail was read or flagged, skipping late rescan",
+				"event", "scan.late_rescan_skipped",
+				"imap.flags", msg.Flags,
+			)
+			continue
+		}
+
+		sm, err := c.downloadOrScanMessage(msg)
+		if err != nil {
+			c.removeTempFiles(spamMails)
+
+			if errors.Is(err, rspamc.ErrUnavailable) {
+				c.setRspamdUnavailable(err)
+				c.postponeLateRescans(dueIDs)
+				return nil
+			}
+
+			return err
+		}
+
+		if !c.isSpam(sm.CheckResult) {
+			mlogger.Info("mail is still not classified as spam after late rescan",
+				"event", "scan.late_rescan_ham",
+				"scan.score", sm.CheckResult.Score,
+			)
+			c.removeTempFile(sm)
+			continue
+		}
+
+		mlogger.Info("mail is classified as spam after late rescan",
+			"event", "scan.late_rescan_spam",
+			"scan.score", sm.CheckResult.Score,
+		)
+		spamMails = append(spamMails, sm)
+	}
+
+	for _, id := range dueIDs {
+		delete(c.lateRescans, id)
+	}
+	c.saveLateRescans()
+
+	if len(spamMails) == 0 {
+		return nil
+	}
+
+	if c.tagOnly {
+		return c.retagAsSpam(lrc, spamMails)
+	}
+
+	return c.replaceWithSpamMails(lrc, spamMails)
+}
+
+// downloadOrScanMessage scans msg, in tag-only mode without storing it on
+// disk. Cached check results are not used, the mail is rescanned because
+// rspamd might classify it differently by now.
+func (c *Client) downloadOrScanMessage(msg *imapclt.Message) (*scannedMail, error) {
+	if c.tagOnly {
+		return c.scanMessage(msg, false)
+	}
+
+	return c.downloadAndScan(msg, false)
+}
+
+// postponeLateRescans schedules the late rescans of the mails with ids again
+// after the retry interval for an unavailable rspamd.
+func (c *Client) postponeLateRescans(ids []string) {
+	dueAt := time.Now().Add(c.rspamdRetryInterval)
+
+	for _, id := range ids {
+		c.lateRescans[id] = dueAt
+	}
+	c.saveLateRescans()
+}
+
+// saveLateRescans stores the schedule of the late rescans, to retain it when
+// the client is recreated or rspamd-iscan restarts.
+func (c *Client) saveLateRescans() {
+	if err := c.syncState.SetLateRescans(c.lateRescans); err != nil {
+		c.logger.Warn("storing late rescans failed",
+			"error", err,
+			"event", "syncstate.store_failed",
+		)
+	}
+}
+
+// isInboxScanFlag returns true if flag is a scan result keyword or was added
+// because the mail was moved to the inbox mailbox.
+func (c *Client) isInboxScanFlag(flag string) bool {
+	return strings.HasPrefix(flag, keywordPrefix) || hasFlag(c.inboxFlags, flag)
+}
+
+// retagAsSpam replaces the keywords of the previous scan of mails and moves
+// them to the spam mailbox.
+func (c *Client) retagAsSpam(lrc LateRescanClient, mails []*scannedMail) error {
+	var errs []error
+	var retagged []*scannedMail
+
+	for _, sm := range mails {
+		stale := slices.DeleteFunc(slices.Clone(sm.Flags), func(f string) bool {
+			return !c.isInboxScanFlag(f)
+		})
+		if len(stale) > 0 {
+			if err := lrc.RemoveFlags([]uint32{sm.UID}, stale); err != nil {
+				errs = append(errs, fmt.Errorf(
+					"removing keywords from mail %d (%s) failed: %w",
+					sm.UID, sm.Envelope.Subject, err,
+				))
+				continue
+			}
+		}
+
+		retagged = append(retagged, sm)
+	}
+
+	if err := c.tagAndMoveMails(retagged); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// replaceWithSpamMails uploads the modified mails to the spam mailbox,
+// respectively delivers them to the spam recipient, and deletes the mails in
+// the inbox mailbox afterwards.
+// The originals remain in the backup mailbox from the first scan.
+func (c *Client) replaceWithSpamMails(lrc LateRescanClient, mails []*scannedMail) error {
+	var errs []error
+	var uploads []*imapclt.UploadRequest
+	var uploadMails []*scannedMail
+	var replacedUIDs []uint32
+
+	for _, sm := range mails {
+		if rcpt := c.deliveryRecipientFor(true); rcpt != "" {
+			if err := c.deliverer.Deliver(context.Background(), sm.Path, rcpt); err != nil {
+				errs = append(errs, fmt.Errorf(
+					"delivering rescanned email %d (%s) to %s failed: %w",
+					sm.UID, sm.Envelope.Subject, rcpt, err,
+				))
+				c.removeTempFile(sm)
+				continue
+			}
+
+			replacedUIDs = append(replacedUIDs, sm.UID)
+			c.removeTempFile(sm)
+			continue
+		}
+
+		ts := sm.InternalDate
+		if ts.IsZero() {
+			ts = sm.Envelope.Date
+		}
+
+		uploads = append(uploads, &imapclt.UploadRequest{
+			Path:    sm.Path,
+			Mailbox: c.spamMailbox,
+			Time:    ts,
+			Flags: mergeFlags(
+				slices.DeleteFunc(slices.Clone(sm.Flags), c.isInboxScanFlag),
+				c.spamFlags,
+			),
+		})
+		uploadMails = append(uploadMails, sm)
+	}
+
+	for i, err := range c.upload(uploads) {
+		sm := uploadMails[i]
+		c.removeTempFile(sm)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf(
+				"uploading rescanned email %d (%s) to %s failed: %w",
+				sm.UID, sm.Envelope.Subject, c.spamMailbox, err,
+			))
+			continue
+		}
+
+		replacedUIDs = append(replacedUIDs, sm.UID)
+	}
+
+	if len(replacedUIDs) == 0 {
+		return errors.Join(errs...)
+	}
+
+	if err := lrc.Delete(replacedUIDs); err != nil {
+		errs = append(errs, fmt.Errorf(
+			"deleting %d rescanned mails from %s failed: %w",
+			len(replacedUIDs), c.inboxMailbox, err,
+		))
+		return errors.Join(errs...)
+	}
+
+	c.logger.Info("replaced rescanned mails in inbox with modified mails in spam mailbox",
+		"mailbox.source", c.inboxMailbox,
+		"mailbox.destination", c.spamMailbox,
+		"count", len(replacedUIDs),
+	)
+
+	return errors.Join(errs...)
+}
+
+// removeTempFiles deletes the local copies of mails.
+func (c *Client) removeTempFiles(mails []*scannedMail) {
+	for _, sm := range mails {
+		c.removeTempFile(sm)
+	}
+}
+
+// hasFlag returns true if flags contains flag, flags are compared
+// case-insensitively.
+func hasFlag(flags []string, flag string) bool {
+	return slices.ContainsFunc(flags, func(f string) bool { return strings.EqualFold(f, flag) })
+}
@@ -0,0 +1,175 @@
+package iscan
+
+import (
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/syncstate"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+	"github.com/fho/rspamd-iscan/internal/testutils/mock"
+)
+
+// setupLateRescan scans the spam test mail with a score of 8, which is within
+// the late rescan margin, and makes its late rescan due.
+// Afterwards rspamd reports a score of 15.
+func setupLateRescan(t *testing.T, clt *Client, scanMailbox string) *int {
+	var checks int
+
+	clt.lateRescanMargin = 3
+	clt.rspamc = &mock.Rspamc{CheckFn: countingCheckFn(&rspamc.CheckResult{Score: 8}, &checks)}
+
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), scanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, len(clt.lateRescans))
+
+	for id := range clt.lateRescans {
+		clt.lateRescans[id] = time.Now()
+	}
+
+	clt.rspamc = &mock.Rspamc{CheckFn: countingCheckFn(&rspamc.CheckResult{Score: 15}, &checks)}
+
+	return &checks
+}
+
+func TestProcessLateRescans(t *testing.T) {
+	srv, clt := startServerClient(t)
+	checks := setupLateRescan(t, clt, srv.ScanMailbox)
+
+	assert.NoError(t, clt.ProcessLateRescans())
+	assert.Equal(t, 2, *checks)
+	assert.Equal(t, 0, len(clt.lateRescans))
+
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.InboxMailBox))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.BackupMailbox, mail.SpamMailSubject))
+
+	cnt := 0
+	for msg, err := range clt.clt.Messages(srv.SpamMailbox, nil) {
+		assert.NoError(t, err)
+		cnt++
+
+		body, err := io.ReadAll(msg.Message)
+		assert.NoError(t, err)
+		if !strings.Contains(string(body), hdrRspamdScore+": 15\r\n") {
+			t.Errorf("mail does not contain updated %s header:\n%s", hdrRspamdScore, body)
+		}
+		if strings.Contains(string(body), hdrRspamdScore+": 8\r\n") {
+			t.Errorf("mail contains %s header of the first scan:\n%s", hdrRspamdScore, body)
+		}
+	}
+	assert.Equal(t, 1, cnt)
+}
+
+func TestProcessLateRescans_TagOnly(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.tagOnly = true
+	clt.backupMailbox = ""
+	clt.inboxFlags = []string{"$NotJunk"}
+	checks := setupLateRescan(t, clt, srv.ScanMailbox)
+
+	assert.NoError(t, clt.ProcessLateRescans())
+	assert.Equal(t, 2, *checks)
+
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.InboxMailBox))
+
+	cnt := 0
+	for msg, err := range clt.clt.Messages(srv.SpamMailbox, nil) {
+		assert.NoError(t, err)
+		cnt++
+
+		if !slices.Contains(msg.Flags, "$rspamd-score-15") {
+			t.Errorf("keyword of rescan is missing, message has flags: %v", msg.Flags)
+		}
+		for _, kw := range []string{"$rspamd-score-8", "$NotJunk"} {
+			if slices.Contains(msg.Flags, kw) {
+				t.Errorf("keyword %q was not removed, message has flags: %v", kw, msg.Flags)
+			}
+		}
+	}
+	assert.Equal(t, 1, cnt)
+}
+
+func TestProcessLateRescans_SkipsReadMails(t *testing.T) {
+	srv, clt := startServerClient(t)
+	checks := setupLateRescan(t, clt, srv.ScanMailbox)
+
+	var uids []uint32
+	for msg, err := range clt.clt.Messages(srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+		uids = append(uids, msg.UID)
+	}
+	assert.NoError(t, clt.clt.MarkSeen(uids))
+
+	assert.NoError(t, clt.ProcessLateRescans())
+	assert.Equal(t, 1, *checks)
+	assert.Equal(t, 0, len(clt.lateRescans))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.SpamMailSubject))
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.SpamMailbox))
+}
+
+func TestProcessLateRescans_ScheduleSurvivesRestart(t *testing.T) {
+	srv, clt := startServerClient(t)
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+
+	store, err := syncstate.Open(stateFile, srv.UserName, log.SlogTestLogger(t))
+	assert.NoError(t, err)
+	clt.syncState = store
+
+	checks := setupLateRescan(t, clt, srv.ScanMailbox)
+	clt.saveLateRescans()
+
+	store, err = syncstate.Open(stateFile, srv.UserName, log.SlogTestLogger(t))
+	assert.NoError(t, err)
+
+	cfg := testClientCfg(t, clt.clt, srv)
+	cfg.SyncState = store
+	cfg.LateRescanMargin = 3
+	cfg.Rspamc = clt.rspamc
+
+	clt, err = NewClient(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(clt.lateRescans))
+
+	assert.NoError(t, clt.RunOnce())
+	assert.Equal(t, 2, *checks)
+	assert.Equal(t, 0, len(clt.lateRescans))
+	assert.Equal(t, 0, len(store.LateRescans()))
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.InboxMailBox))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+}
+
+func TestScheduleLateRescan(t *testing.T) {
+	clt := &Client{
+		logger:           log.SlogTestLogger(t),
+		spamTreshold:     10,
+		lateRescanMargin: 2,
+		lateRescans:      map[string]time.Time{},
+		syncState:        syncstate.NewMemoryStore(),
+	}
+
+	for _, tc := range []struct {
+		score     float32
+		messageID string
+		scheduled bool
+	}{
+		{score: 7.9, messageID: "<a@example.com>"},
+		{score: 8, messageID: "<b@example.com>", scheduled: true},
+		{score: 9.9, messageID: ""},
+		{score: 10, messageID: "<c@example.com>"},
+	} {
+		clt.scheduleLateRescan(&scannedMail{
+			Envelope:    &imapclt.Envelope{MessageID: tc.messageID},
+			CheckResult: &rspamc.CheckResult{Score: tc.score},
+		})
+
+		_, scheduled := clt.lateRescans[tc.messageID]
+		assert.Equal(t, tc.scheduled, scheduled)
+	}
+}
@@ -0,0 +1,267 @@
+package iscan
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/log"
+)
+
+// RFC 6154 SPECIAL-USE attributes.
+const (
+	specialUseJunk    = `\Junk`
+	specialUseArchive = `\Archive`
+	attrNoSelect      = `\Noselect`
+	attrNonExistent   = `\NonExistent`
+)
+
+// MailboxManager lists and creates mailboxes.
+type MailboxManager interface {
+	Mailboxes() ([]*imapclt.MailboxInfo, error)
+	CreateMailbox(name string) error
+}
+
+type MailboxOptions struct {
+	// CreateMissing creates configured mailboxes that do not exist.
+	CreateMissing bool
+	// DetectSpecialUse sets unconfigured mailbox names from the
+	// SPECIAL-USE attributes of the mailboxes on the server.
+	// SpamMailboxName is set to the \Junk and BackupMailbox to the
+	// \Archive mailbox.
+	DetectSpecialUse bool
+	Logger           *slog.Logger
+}
+
+// mailboxRef references a mailbox name in [Config].
+type mailboxRef struct {
+	cfgName    string
+	name       *string
+	specialUse string
+}
+
+func (c *Config) mailboxRefs() []*mailboxRef {
+	return []*mailboxRef{
+		{cfgName: "ScanMailbox", name: &c.ScanMailbox},
+		{cfgName: "InboxMailbox", name: &c.InboxMailbox},
+		{cfgName: "SpamMailbox", name: &c.SpamMailboxName, specialUse: specialUseJunk},
+		{cfgName: "HamMailbox", name: &c.HamMailbox},
+		{cfgName: "UndetectedMailbox", name: &c.UndetectedMailboxName},
+		{cfgName: "BackupMailbox", name: &c.BackupMailbox, specialUse: specialUseArchive},
+		{cfgName: "PendingMailbox", name: &c.PendingMailbox},
+	}
+}
+
+// ProvisionMailboxes ensures that the mailboxes referenced in cfg exist on
+// the IMAP server.
+// Configured names use "/" as hierarchy delimiter, if the server uses
+// another delimiter and no mailbox with the configured name exists, the name
+// in cfg is translated to the delimiter of the server.
+// Depending on opts, unset mailbox names are set from SPECIAL-USE attributes
+// and missing mailboxes are created.
+// If mailboxes are missing and are not created, an error is returned that
+// lists them together with similar named existing mailboxes.
+func ProvisionMailboxes(clt MailboxManager, cfg *Config, opts *MailboxOptions) error {
+	logger := log.EnsureLoggerInstance(opts.Logger)
+
+	mailboxes, err := clt.Mailboxes()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	delim := hierarchyDelim(mailboxes)
+
+	for _, ref := range cfg.mailboxRefs() {
+		if *ref.name == "" {
+			if !opts.DetectSpecialUse || ref.specialUse == "" {
+				continue
+			}
+
+			mbox := findSpecialUseMailbox(mailboxes, ref.specialUse)
+			if mbox == nil {
+				logger.Debug("no mailbox with special-use attribute found",
+					"attribute", ref.specialUse, "config_key", ref.cfgName)
+				continue
+			}
+
+			*ref.name = mbox.Name
+			logger.Info("using special-use mailbox",
+				"event", "imap.mailbox_special_use_detected",
+				"config_key", ref.cfgName,
+				"attribute", ref.specialUse,
+				"mailbox", mbox.Name,
+			)
+		} else if findMailbox(mailboxes, *ref.name) == nil {
+			if name := toServerMailboxName(*ref.name, delim); name != *ref.name {
+				logger.Info("translated hierarchy delimiters of mailbox name",
+					"event", "imap.mailbox_name_translated",
+					"config_key", ref.cfgName,
+					"mailbox.configured", *ref.name,
+					"mailbox", name,
+				)
+				*ref.name = name
+			}
+		}
+
+		mbox := findMailbox(mailboxes, *ref.name)
+		if mbox != nil {
+			if mbox.HasAttr(attrNoSelect) {
+				errs = append(errs, fmt.Errorf("%s %q can not be selected, it has the %s attribute",
+					ref.cfgName, *ref.name, attrNoSelect))
+			}
+			continue
+		}
+
+		if opts.CreateMissing {
+			if err := clt.CreateMailbox(*ref.name); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", ref.cfgName, err))
+				continue
+			}
+
+			mailboxes = append(mailboxes, &imapclt.MailboxInfo{Name: *ref.name})
+			continue
+		}
+
+		err := fmt.Errorf("%s %q does not exist", ref.cfgName, *ref.name)
+		if suggestion := suggestMailbox(mailboxes, *ref.name); suggestion != "" {
+			err = fmt.Errorf("%w, did you mean %q?", err, suggestion)
+		}
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// hierarchyDelim returns the hierarchy delimiter of the server, it is the
+// delimiter of INBOX or 0 if the server has no hierarchy.
+func hierarchyDelim(mailboxes []*imapclt.MailboxInfo) rune {
+	for _, mbox := range mailboxes {
+		if strings.EqualFold(mbox.Name, "INBOX") && mbox.Delim != 0 {
+			return mbox.Delim
+		}
+	}
+
+	for _, mbox := range mailboxes {
+		if mbox.Delim != 0 {
+			return mbox.Delim
+		}
+	}
+
+	return 0
+}
+
+// toServerMailboxName replaces the "/" hierarchy delimiters in name with
+// delim.
+func toServerMailboxName(name string, delim rune) string {
+	if delim == 0 || delim == '/' {
+		return name
+	}
+
+	return strings.ReplaceAll(name, "/", string(delim))
+}
+
+func findSpecialUseMailbox(mailboxes []*imapclt.MailboxInfo, attr string) *imapclt.MailboxInfo {
+	for _, mbox := range mailboxes {
+		if mbox.HasAttr(attr) && !mbox.HasAttr(attrNoSelect) && !mbox.HasAttr(attrNonExistent) {
+			return mbox
+		}
+	}
+
+	return nil
+}
+
+// findMailbox returns the mailbox with the given name.
+// INBOX is matched case-insensitively (RFC 3501, section 5.1).
+func findMailbox(mailboxes []*imapclt.MailboxInfo, name string) *imapclt.MailboxInfo {
+	for _, mbox := range mailboxes {
+		if mbox.HasAttr(attrNonExistent) {
+			continue
+		}
+
+		if mbox.Name == name {
+			return mbox
+		}
+
+		if strings.EqualFold(name, "INBOX") && strings.EqualFold(mbox.Name, "INBOX") {
+			return mbox
+		}
+	}
+
+	return nil
+}
+
+// suggestMailbox returns the name of the existing mailbox that is the most
+// similar to name, or an empty string if none is similar enough.
+// Names are compared case-insensitively, hierarchy delimiters are treated as
+// equal and a leading "INBOX" hierarchy level is ignored.
+func suggestMailbox(mailboxes []*imapclt.MailboxInfo, name string) string {
+	var best string
+	bestDist := -1
+
+	want := normalizeMailboxName(name, 0)
+	maxDist := max(2, len([]rune(want))/3)
+
+	for _, mbox := range mailboxes {
+		if mbox.HasAttr(attrNoSelect) || mbox.HasAttr(attrNonExistent) {
+			continue
+		}
+
+		dist := levenshtein(want, normalizeMailboxName(mbox.Name, mbox.Delim))
+		if dist > maxDist {
+			continue
+		}
+
+		if bestDist == -1 || dist < bestDist {
+			best = mbox.Name
+			bestDist = dist
+		}
+	}
+
+	return best
+}
+
+func normalizeMailboxName(name string, delim rune) string {
+	name = strings.ToLower(name)
+
+	name = strings.Map(func(r rune) rune {
+		if r == delim || r == '/' || r == '.' {
+			return '/'
+		}
+		return r
+	}, name)
+
+	if rest, ok := strings.CutPrefix(name, "inbox/"); ok && rest != "" {
+		return rest
+	}
+
+	return name
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
@@ -0,0 +1,156 @@
+package iscan
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestProvisionMailboxes_Missing(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	cfg := testClientCfg(t, clt.clt, srv)
+	cfg.SpamMailboxName = strings.ToLower(srv.SpamMailbox) + "x"
+
+	err := ProvisionMailboxes(clt.clt, cfg, &MailboxOptions{Logger: log.SlogTestLogger(t)})
+	assert.Error(t, err)
+
+	if !strings.Contains(err.Error(), "did you mean \""+srv.SpamMailbox+"\"") {
+		t.Errorf("error does not contain a suggestion for %q: %s", srv.SpamMailbox, err)
+	}
+}
+
+func TestProvisionMailboxes_CreateMissing(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	cfg := testClientCfg(t, clt.clt, srv)
+	cfg.BackupMailbox = "Archiv/Geprüft"
+	cfg.HamMailbox = "Spåm-Lærning"
+
+	opts := MailboxOptions{CreateMissing: true, Logger: log.SlogTestLogger(t)}
+	err := ProvisionMailboxes(clt.clt, cfg, &opts)
+	assert.NoError(t, err)
+
+	mailboxes, err := clt.clt.Mailboxes()
+	assert.NoError(t, err)
+
+	for _, name := range []string{cfg.BackupMailbox, cfg.HamMailbox} {
+		if findMailbox(mailboxes, name) == nil {
+			t.Errorf("mailbox %q was not created", name)
+		}
+	}
+
+	// the created mailboxes are found when checking again
+	opts.CreateMissing = false
+	err = ProvisionMailboxes(clt.clt, cfg, &opts)
+	assert.NoError(t, err)
+}
+
+func TestProvisionMailboxes_SpecialUse(t *testing.T) {
+	clt := &fakeMailboxManager{mailboxes: []*imapclt.MailboxInfo{
+		{Name: "INBOX", Delim: '.'},
+		{Name: "INBOX.Junk-E-Mail", Delim: '.', Attrs: []string{specialUseJunk}},
+		{Name: "INBOX.Archives", Delim: '.', Attrs: []string{attrNoSelect, specialUseArchive}},
+	}}
+
+	cfg := Config{ScanMailbox: "INBOX", InboxMailbox: "inbox"}
+
+	opts := MailboxOptions{CreateMissing: true, DetectSpecialUse: true, Logger: log.SlogTestLogger(t)}
+	err := ProvisionMailboxes(clt, &cfg, &opts)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "INBOX.Junk-E-Mail", cfg.SpamMailboxName)
+	// the \Archive mailbox can not be selected
+	assert.Equal(t, "", cfg.BackupMailbox)
+	assert.Equal(t, 0, len(clt.created))
+}
+
+func TestProvisionMailboxes_SpecialUseArchive(t *testing.T) {
+	clt := &fakeMailboxManager{mailboxes: []*imapclt.MailboxInfo{
+		{Name: "INBOX", Delim: '/'},
+		{Name: "Spam", Delim: '/'},
+		{Name: "Archive", Delim: '/', Attrs: []string{specialUseArchive}},
+	}}
+
+	cfg := Config{ScanMailbox: "INBOX", InboxMailbox: "INBOX", SpamMailboxName: "Spam"}
+
+	opts := MailboxOptions{DetectSpecialUse: true, Logger: log.SlogTestLogger(t)}
+	err := ProvisionMailboxes(clt, &cfg, &opts)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "Spam", cfg.SpamMailboxName)
+	assert.Equal(t, "Archive", cfg.BackupMailbox)
+}
+
+func TestProvisionMailboxes_TranslatesDelimiter(t *testing.T) {
+	clt := &fakeMailboxManager{mailboxes: []*imapclt.MailboxInfo{
+		{Name: "INBOX", Delim: '.'},
+		{Name: "INBOX.Spam", Delim: '.'},
+		{Name: "Foo/Bar", Delim: '.'},
+	}}
+
+	cfg := Config{
+		ScanMailbox:     "INBOX/Unscanned",
+		InboxMailbox:    "INBOX",
+		SpamMailboxName: "INBOX/Spam",
+		// a mailbox with the configured name exists, it is not
+		// translated
+		HamMailbox: "Foo/Bar",
+	}
+
+	opts := MailboxOptions{CreateMissing: true, Logger: log.SlogTestLogger(t)}
+	err := ProvisionMailboxes(clt, &cfg, &opts)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "INBOX.Unscanned", cfg.ScanMailbox)
+	assert.Equal(t, "INBOX.Spam", cfg.SpamMailboxName)
+	assert.Equal(t, "Foo/Bar", cfg.HamMailbox)
+	assert.Equal(t, "INBOX.Unscanned", strings.Join(clt.created, ","))
+}
+
+func TestSuggestMailbox(t *testing.T) {
+	mailboxes := []*imapclt.MailboxInfo{
+		{Name: "INBOX", Delim: '.'},
+		{Name: "INBOX.Spam", Delim: '.'},
+		{Name: "INBOX.Undetected", Delim: '.'},
+		{Name: "INBOX.rspamd", Delim: '.', Attrs: []string{attrNoSelect}},
+		{Name: "INBOX.rspamd.Backup", Delim: '.'},
+	}
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"Spam", "INBOX.Spam"},
+		{"spam", "INBOX.Spam"},
+		{"INBOX/Undetceted", "INBOX.Undetected"},
+		{"rspamd/Backup", "INBOX.rspamd.Backup"},
+		{"Drafts", ""},
+		{"Trash", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, suggestMailbox(mailboxes, tt.name))
+		})
+	}
+}
+
+type fakeMailboxManager struct {
+	mailboxes []*imapclt.MailboxInfo
+	created   []string
+}
+
+func (f *fakeMailboxManager) Mailboxes() ([]*imapclt.MailboxInfo, error) {
+	return slices.Clone(f.mailboxes), nil
+}
+
+func (f *fakeMailboxManager) CreateMailbox(name string) error {
+	f.created = append(f.created, name)
+	f.mailboxes = append(f.mailboxes, &imapclt.MailboxInfo{Name: name})
+	return nil
+}
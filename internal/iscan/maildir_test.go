@@ -0,0 +1,71 @@
+package iscan
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/maildir"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+	"github.com/fho/rspamd-iscan/internal/testutils/mock"
+)
+
+var _ IMAPClient = (*maildir.Client)(nil)
+
+func newMaildirTestClient(t *testing.T) *Client {
+	root := t.TempDir()
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		assert.NoError(t, os.Mkdir(filepath.Join(root, sub), 0o700))
+	}
+
+	mdClt := maildir.NewClient(&maildir.Config{Path: root, Logger: log.SlogTestLogger(t)})
+	assert.NoError(t, mdClt.Connect())
+
+	cfg := Config{
+		ScanMailbox:           "Unscanned",
+		InboxMailbox:          "INBOX",
+		BackupMailbox:         "Backup",
+		HamMailbox:            "Ham",
+		SpamMailboxName:       "Spam",
+		UndetectedMailboxName: "Undetected",
+		Logger:                log.SlogTestLogger(t),
+		Rspamc:                mock.NewRspamc(),
+		IMAPClient:            mdClt,
+		SpamTreshold:          10,
+		TempDir:               t.TempDir(),
+	}
+
+	err := ProvisionMailboxes(mdClt, &cfg, &MailboxOptions{CreateMissing: true, Logger: cfg.Logger})
+	assert.NoError(t, err)
+
+	clt, err := NewClient(&cfg)
+	assert.NoError(t, err)
+
+	return clt
+}
+
+func TestRunOnce_Maildir(t *testing.T) {
+	clt := newMaildirTestClient(t)
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), clt.scanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), clt.scanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestSuspiciousMailPath(t), clt.scanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), clt.hamMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), clt.undetectedMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.RunOnce())
+
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, clt.scanMailbox))
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, clt.hamMailbox))
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, clt.undetectedMailbox))
+	assert.Equal(t, 3, countMessagesInMailbox(t, clt.clt, clt.backupMailbox))
+
+	assert.Equal(t, 2, mailboxContainsMailCnt(t, clt.clt, clt.inboxMailbox, mail.HamMailSubject))
+	assert.Equal(t, 1,
+		mailboxContainsMailCnt(t, clt.clt, clt.inboxMailbox, mail.SuspiciousMailRewrittenSubject),
+	)
+	assert.Equal(t, 2, mailboxContainsMailCnt(t, clt.clt, clt.spamMailbox, mail.SpamMailSubject))
+}
@@ -0,0 +1,69 @@
+package iscan
+
+import (
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+)
+
+// QuotaReader is implemented by IMAP clients that can report the storage
+// quotas of mailboxes.
+type QuotaReader interface {
+	Quota(mailbox string) ([]*imapclt.Quota, error)
+}
+
+// hasQuotaSpace returns false if the free storage space of a quota root of
+// the mailboxes that scanned mails are uploaded to is below
+// [Client.quotaMinFree].
+// If quotas are not checked or retrieving them fails, true is returned.
+func (c *Client) hasQuotaSpace() bool {
+	if c.quotaMinFree <= 0 || c.tagOnly {
+		return true
+	}
+
+	qr, ok := c.clt.(QuotaReader)
+	if !ok {
+		return true
+	}
+
+	mailboxes := []string{c.inboxMailbox}
+	if c.spamMailbox != c.inboxMailbox {
+		mailboxes = append(mailboxes, c.spamMailbox)
+	}
+
+	for _, mbox := range mailboxes {
+		quotas, err := qr.Quota(mbox)
+		if err != nil {
+			c.logger.Warn("retrieving mailbox quota failed, scanning without quota check",
+				"error", err,
+				"event", "imap.quota_check_failed",
+				"mailbox", mbox,
+			)
+			return true
+		}
+
+		for _, q := range quotas {
+			if q.Free() >= c.quotaMinFree {
+				continue
+			}
+
+			c.logger.Warn("free storage space is below the quota margin, pausing scanning, mails remain in the scan mailbox",
+				"event", "imap.quota_exceeded",
+				"mailbox", mbox,
+				"imap.quota_root", q.Root,
+				"imap.quota_usage", q.Usage,
+				"imap.quota_limit", q.Limit,
+				"imap.quota_min_free", c.quotaMinFree,
+			)
+			c.quotaPaused = true
+
+			return false
+		}
+	}
+
+	if c.quotaPaused {
+		c.logger.Info("free storage space is above the quota margin, resuming scanning",
+			"event", "imap.quota_available")
+		c.quotaPaused = false
+	}
+
+	return true
+}
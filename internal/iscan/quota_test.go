@@ -0,0 +1,30 @@
+package iscan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/imapserver"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+)
+
+func TestProcessScanBox_QuotaExceeded(t *testing.T) {
+	srv := imapserver.StartServer(t, imapserver.WithQuota(100, 150))
+	clt := newTestClient(t, srv)
+	clt.quotaMinFree = 100 * 1024
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, true, clt.quotaPaused)
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.HamMailSubject))
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.BackupMailbox))
+
+	srv.SetQuota(10, 150)
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, false, clt.quotaPaused)
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+}
@@ -0,0 +1,280 @@
+package iscan
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/mail"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+// UnverifiedPolicy defines how mails are handled that rspamd did not
+// classify conclusively.
+type UnverifiedPolicy string
+
+const (
+	// PolicyPass classifies the mail by its score, a
+	// X-rspamd-iscan-Skipped header respectively the $rspamd-skipped
+	// keyword is added.
+	PolicyPass UnverifiedPolicy = "pass"
+	// PolicyRescan leaves the mail in the scan mailbox and scans it again
+	// after a delay. When the maximum number of rescans is reached, the
+	// mail is handled like with [PolicyPass].
+	// The number of rescans is stored in a $rspamd-rescan-<n> keyword on
+	// the mail, it is retained when the client reconnects or restarts, the
+	// due time is then derived from it, see [Client.rescanDue].
+	PolicyRescan UnverifiedPolicy = "rescan"
+	// PolicyPending moves the unmodified mail to the pending mailbox.
+	PolicyPending UnverifiedPolicy = "pending"
+)
+
+const (
+	hdrSkipped     = hdrPrefix + "Skipped"
+	keywordSkipped = keywordPrefix + "skipped"
+
+	keywordRescanPrefix = keywordPrefix + "rescan-"
+
+	actionGreylist   = "greylist"
+	actionSoftReject = "soft reject"
+
+	defRescanDelay = 15 * time.Minute
+	defMaxRescans  = 3
+)
+
+func (p UnverifiedPolicy) validate() error {
+	switch p {
+	case "", PolicyPass, PolicyRescan, PolicyPending:
+		return nil
+	default:
+		return fmt.Errorf("unsupported policy: %q, supported: %s, %s, %s",
+			p, PolicyPass, PolicyRescan, PolicyPending)
+	}
+}
+
+// rescanState tracks the rescans of a mail in the scan mailbox.
+type rescanState struct {
+	count  int
+	nextAt time.Time
+}
+
+// unverifiedReason returns why r is not a conclusive result, it is empty if
+// the result is conclusive.
+func unverifiedReason(r *rspamc.CheckResult) string {
+	switch {
+	case r.IsSkipped:
+		return "is_skipped"
+	case r.Action == actionGreylist, r.Action == actionSoftReject:
+		return r.Action
+	default:
+		return ""
+	}
+}
+
+// unverifiedPolicy returns the policy for a mail with the unverified result
+// reason.
+func (c *Client) unverifiedPolicy(reason string) UnverifiedPolicy {
+	p := c.greylistPolicy
+	if reason == "is_skipped" {
+		p = c.skippedPolicy
+	}
+
+	if p == "" {
+		return PolicyPass
+	}
+
+	return p
+}
+
+// rescanDue returns false if msg was scheduled for a rescan that is not due
+// yet.
+// If the client was recreated since the rescan was scheduled, the rescan
+// state is restored from the keyword of msg. The n-th rescan is due
+// n*rescanDelay after the INTERNALDATE of msg, the time when it was received
+// and scanned the first time.
+func (c *Client) rescanDue(msg *imapclt.Message) bool {
+	state, exists := c.rescans[msg.UID]
+	if !exists {
+		count := rescanCount(msg.Flags)
+		if count == 0 {
+			return true
+		}
+
+		state = &rescanState{
+			count:  count,
+			nextAt: msg.InternalDate.Add(time.Duration(count) * c.rescanDelay),
+		}
+		c.rescans[msg.UID] = state
+	}
+
+	return !time.Now().Before(state.nextAt)
+}
+
+// scheduleRescan schedules a rescan of sm and adds a keyword with the number
+// of rescans to it.
+// It returns false if the mail was already rescanned the maximum number of
+// times.
+func (c *Client) scheduleRescan(sm *scannedMail) (bool, error) {
+	state, exists := c.rescans[sm.UID]
+	if !exists {
+		// the client was recreated since the last rescan, the count is
+		// restored from the keyword
+		state = &rescanState{count: rescanCount(sm.Flags)}
+	}
+
+	if state.count >= c.maxRescans {
+		delete(c.rescans, sm.UID)
+		return false, nil
+	}
+
+	keyword := keywordRescanPrefix + strconv.Itoa(state.count+1)
+	if err := c.clt.AddFlags([]uint32{sm.UID}, []string{keyword}); err != nil {
+		return false, fmt.Errorf("adding %s keyword to mail %d (%s) failed: %w",
+			keyword, sm.UID, sm.Envelope.Subject, err)
+	}
+
+	state.count++
+	state.nextAt = time.Now().Add(c.rescanDelay)
+	c.rescans[sm.UID] = state
+
+	return true, nil
+}
+
+// rescanCount returns the highest number of the $rspamd-rescan-<n> keywords
+// in flags, it is 0 if there are none.
+func rescanCount(flags []string) int {
+	var result int
+
+	for _, f := range flags {
+		if !isRescanKeyword(f) {
+			continue
+		}
+
+		n, err := strconv.Atoi(f[len(keywordRescanPrefix):])
+		if err == nil {
+			result = max(result, n)
+		}
+	}
+
+	return result
+}
+
+// isRescanKeyword returns true if flag is a $rspamd-rescan-<n> keyword.
+func isRescanKeyword(flag string) bool {
+	return len(flag) > len(keywordRescanPrefix) &&
+		strings.EqualFold(flag[:len(keywordRescanPrefix)], keywordRescanPrefix)
+}
+
+// withoutRescanKeywords returns flags without the $rspamd-rescan-<n>
+// keywords.
+func withoutRescanKeywords(flags []string) []string {
+	return slices.DeleteFunc(slices.Clone(flags), isRescanKeyword)
+}
+
+// pruneRescans removes the rescan states of mails that are not in seen.
+func (c *Client) pruneRescans(seen map[uint32]struct{}) {
+	for uid := range c.rescans {
+		if _, exists := seen[uid]; !exists {
+			delete(c.rescans, uid)
+		}
+	}
+}
+
+// nextRescanAt returns the time of the next due rescan, it is zero if no
+// rescans are scheduled.
+func (c *Client) nextRescanAt() time.Time {
+	var result time.Time
+
+	for _, state := range c.rescans {
+		if result.IsZero() || state.nextAt.Before(result) {
+			result = state.nextAt
+		}
+	}
+
+	return result
+}
+
+// handleUnverified applies the policy for sm, when its check result is not
+// conclusive.
+// It returns true if sm is processed further like a conclusive result.
+// For [PolicyPending] the UID is added to pendingUIDs.
+func (c *Client) handleUnverified(sm *scannedMail, pendingUIDs *[]uint32) (bool, error) {
+	reason := unverifiedReason(sm.CheckResult)
+	if reason == "" {
+		delete(c.rescans, sm.UID)
+		return true, nil
+	}
+
+	logger := c.logger.With(
+		"mail.subject", sm.Envelope.Subject,
+		"mail.uid", sm.UID,
+		"scan.unverified_reason", reason,
+	)
+
+	policy := c.unverifiedPolicy(reason)
+
+	switch policy {
+	case PolicyRescan:
+		scheduled, err := c.scheduleRescan(sm)
+		if err != nil {
+			return false, err
+		}
+		if scheduled {
+			logger.Info("rspamd result is not conclusive, scheduled rescan",
+				"event", "scan.rescan_scheduled",
+				"scan.rescan_count", c.rescans[sm.UID].count,
+				"scan.rescan_at", c.rescans[sm.UID].nextAt,
+			)
+			c.removeTempFile(sm)
+			return false, nil
+		}
+
+		logger.Warn("rspamd result is still not conclusive after the maximum number of rescans, passing it through",
+			"event", "scan.rescan_limit_reached",
+			"scan.rescan_count", c.maxRescans,
+		)
+
+	case PolicyPending:
+		delete(c.rescans, sm.UID)
+		*pendingUIDs = append(*pendingUIDs, sm.UID)
+		c.removeTempFile(sm)
+		return false, nil
+	}
+
+	delete(c.rescans, sm.UID)
+	sm.Skipped = reason
+
+	if sm.Path == "" {
+		return true, nil
+	}
+
+	hdr, err := mail.AsHeaders([]*mail.Header{{Name: hdrSkipped, Body: reason}})
+	if err != nil {
+		return false, err
+	}
+
+	if err := mail.AddHeaders(sm.Path, hdr); err != nil {
+		return false, fmt.Errorf("adding %s header failed: %w", hdrSkipped, err)
+	}
+
+	return true, nil
+}
+
+// removeTempFile deletes the local copy of sm, if it has one.
+func (c *Client) removeTempFile(sm *scannedMail) {
+	if sm.Path == "" || c.keepTempFiles {
+		return
+	}
+
+	if err := os.Remove(sm.Path); err != nil {
+		c.logger.Warn("deleting email file failed",
+			"error", err,
+			"event", "imap.msg_delete_failed",
+			"filepath", sm.Path,
+		)
+	}
+}
@@ -0,0 +1,214 @@
+package iscan
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/imapserver"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+	"github.com/fho/rspamd-iscan/internal/testutils/mock"
+)
+
+// countingCheckFn returns a check function that returns result and counts
+// its calls in cnt.
+func countingCheckFn(result *rspamc.CheckResult, cnt *int) func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+	return func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+		*cnt++
+		return result, nil
+	}
+}
+
+func TestProcessScanBox_SkippedPass(t *testing.T) {
+	srv, clt := startServerClient(t)
+	var checks int
+	clt.rspamc = &mock.Rspamc{CheckFn: countingCheckFn(&rspamc.CheckResult{IsSkipped: true}, &checks)}
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.ProcessScanBox())
+
+	cnt := 0
+	for msg, err := range clt.clt.Messages(srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+		cnt++
+
+		body, err := io.ReadAll(msg.Message)
+		assert.NoError(t, err)
+		if !strings.Contains(string(body), hdrSkipped+": is_skipped\r\n") {
+			t.Errorf("mail does not contain %s header:\n%s", hdrSkipped, body)
+		}
+	}
+	assert.Equal(t, 1, cnt)
+}
+
+func TestProcessScanBox_SkippedRescan(t *testing.T) {
+	srv, clt := startServerClient(t)
+	var checks int
+	clt.rspamc = &mock.Rspamc{CheckFn: countingCheckFn(&rspamc.CheckResult{IsSkipped: true}, &checks)}
+	clt.skippedPolicy = PolicyRescan
+	clt.maxRescans = 2
+	clt.rescanDelay = time.Hour
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, checks)
+	wait, ok := clt.scanBacklogWait()
+	assert.Equal(t, true, ok)
+	if wait <= 59*time.Minute {
+		t.Errorf("wait time for rescan is %s, expected ~1h", wait)
+	}
+
+	// the rescan is not due yet
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, checks)
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.HamMailSubject))
+
+	clt.rescanDelay = 0
+	for _, state := range clt.rescans {
+		state.nextAt = time.Now()
+	}
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 2, checks)
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.HamMailSubject))
+
+	// the maximum number of rescans is reached, the mail is passed through
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 3, checks)
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+	assert.Equal(t, 0, len(clt.rescans))
+
+	_, ok = clt.scanBacklogWait()
+	assert.Equal(t, false, ok)
+}
+
+func TestProcessScanBox_SkippedRescanCountSurvivesReconnect(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	var checks int
+
+	newClient := func() *Client {
+		clt := newTestClient(t, srv)
+		clt.rspamc = &mock.Rspamc{CheckFn: countingCheckFn(&rspamc.CheckResult{IsSkipped: true}, &checks)}
+		clt.skippedPolicy = PolicyRescan
+		clt.maxRescans = 2
+		clt.rescanDelay = time.Hour
+		return clt
+	}
+
+	// the mail was received long enough ago that the rescans are due
+	// after reconnecting
+	clt := newClient()
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now().Add(-3*time.Hour), nil))
+
+	for i := range 2 {
+		assert.NoError(t, clt.ProcessScanBox())
+		assert.Equal(t, i+1, checks)
+		assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.HamMailSubject))
+
+		clt = newClient()
+	}
+
+	// the maximum number of rescans is reached, the mail is passed through
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 3, checks)
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+
+	cnt := 0
+	for msg, err := range clt.clt.Messages(srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+		cnt++
+
+		if slices.ContainsFunc(msg.Flags, isRescanKeyword) {
+			t.Errorf("mail in inbox has rescan keywords: %v", msg.Flags)
+		}
+	}
+	assert.Equal(t, 1, cnt)
+}
+
+func TestProcessScanBox_SkippedRescanDelaySurvivesReconnect(t *testing.T) {
+	srv := imapserver.StartServer(t)
+	var checks int
+
+	newClient := func() *Client {
+		clt := newTestClient(t, srv)
+		clt.rspamc = &mock.Rspamc{CheckFn: countingCheckFn(&rspamc.CheckResult{IsSkipped: true}, &checks)}
+		clt.skippedPolicy = PolicyRescan
+		clt.rescanDelay = time.Hour
+		return clt
+	}
+
+	clt := newClient()
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, checks)
+
+	// the rescan is not due yet after reconnecting
+	clt = newClient()
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, checks)
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.HamMailSubject))
+
+	wait, ok := clt.scanBacklogWait()
+	assert.Equal(t, true, ok)
+	if wait <= 59*time.Minute {
+		t.Errorf("wait time for rescan is %s, expected ~1h", wait)
+	}
+}
+
+func TestRescanCount(t *testing.T) {
+	for _, tc := range []struct {
+		flags    []string
+		expected int
+	}{
+		{nil, 0},
+		{[]string{`\Seen`, "$rspamd-skipped"}, 0},
+		{[]string{"$rspamd-rescan-1"}, 1},
+		{[]string{"$rspamd-rescan-1", "$Rspamd-Rescan-3", "$rspamd-rescan-2"}, 3},
+		{[]string{"$rspamd-rescan-x", "$rspamd-rescan-"}, 0},
+	} {
+		assert.Equal(t, tc.expected, rescanCount(tc.flags))
+	}
+}
+
+func TestProcessScanBox_GreylistPending(t *testing.T) {
+	srv, clt := startServerClient(t)
+	var checks int
+	clt.rspamc = &mock.Rspamc{CheckFn: countingCheckFn(&rspamc.CheckResult{Action: "soft reject", Score: 4}, &checks)}
+	clt.greylistPolicy = PolicyPending
+	clt.pendingMailbox = "pending"
+	assert.NoError(t, clt.clt.CreateMailbox(clt.pendingMailbox))
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.ProcessScanBox())
+
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.BackupMailbox))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, clt.pendingMailbox, mail.HamMailSubject))
+}
+
+func TestConfigValidate_UnverifiedPolicies(t *testing.T) {
+	cfg := Config{
+		ScanMailbox:    "scan",
+		InboxMailbox:   "INBOX",
+		BackupMailbox:  "backup",
+		SpamTreshold:   10,
+		TempDir:        t.TempDir(),
+		Rspamc:         mock.NewRspamc(),
+		SkippedPolicy:  PolicyPending,
+		GreylistPolicy: PolicyRescan,
+	}
+	assert.Error(t, cfg.validate())
+
+	cfg.PendingMailbox = "pending"
+	assert.NoError(t, cfg.validate())
+
+	cfg.GreylistPolicy = "drop"
+	assert.Error(t, cfg.validate())
+}
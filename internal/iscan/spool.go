@@ -0,0 +1,86 @@
+package iscan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/fho/rspamd-iscan/internal/learnspool"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+// spoolLearnRequest stores a learn request in the learn spool.
+// It returns false if storing it failed, the message must not be moved then.
+func (c *Client) spoolLearnRequest(logger *slog.Logger, kind learnspool.Kind, data []byte, hdrs *rspamc.MailHeaders) bool {
+	err := c.learnSpool.Add(&learnspool.Item{Kind: kind, Headers: hdrs, Message: data})
+	if err != nil {
+		logger.Warn("storing learn request in spool failed", "error", err,
+			"event", "learnspool.add_failed")
+		return false
+	}
+
+	logger.Info("stored learn request in spool",
+		"event", "learnspool.added",
+		"learnspool.kind", kind,
+		"learnspool.pending", c.learnSpool.Len(),
+	)
+
+	return true
+}
+
+// replayLearnSpool sends the learn requests in the spool to rspamd, in the
+// order they were stored.
+// Replaying stops when rspamd is unavailable, requests that rspamd rejects
+// otherwise are discarded.
+func (c *Client) replayLearnSpool() {
+	if c.learnSpool == nil || c.learnSpool.Len() == 0 {
+		return
+	}
+
+	c.logger.Info("replaying spooled learn requests",
+		"learnspool.pending", c.learnSpool.Len())
+
+	replayed, err := c.learnSpool.Replay(func(item *learnspool.Item) error {
+		logger := c.logger.With("mail.subject", item.Headers.Subject, "learnspool.kind", item.Kind)
+
+		learnFn, fuzzyFn := c.learnFns(item.Kind)
+		if learnFn == nil {
+			logger.Warn("spooled learn request has an unsupported kind, discarding it",
+				"event", "learnspool.item_discarded")
+			return nil
+		}
+
+		err := learnFn(context.TODO(), bytes.NewReader(item.Message), item.Headers)
+		if errors.Is(err, rspamc.ErrUnavailable) {
+			return err
+		}
+		if err != nil {
+			logger.Warn("learning spooled message failed, discarding it", "error", err,
+				"event", "learnspool.item_discarded")
+			return nil
+		}
+
+		logger.Info("learned spooled message", "event", "rspamd.msg_learned")
+
+		c.updateFuzzyStorage(logger, fuzzyFn, item.Message, item.Headers)
+
+		return nil
+	})
+
+	if err != nil {
+		c.logger.Warn("replaying spooled learn requests failed, retrying later",
+			"error", err,
+			"event", "learnspool.replay_failed",
+			"learnspool.replayed", replayed,
+			"learnspool.pending", c.learnSpool.Len(),
+		)
+		return
+	}
+
+	c.logger.Info("replayed spooled learn requests",
+		"event", "learnspool.replayed",
+		"learnspool.replayed", replayed,
+		"learnspool.pending", c.learnSpool.Len(),
+	)
+}
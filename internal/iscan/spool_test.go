@@ -0,0 +1,118 @@
+package iscan
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/learnspool"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+	"github.com/fho/rspamd-iscan/internal/testutils/mock"
+)
+
+func TestLearn_Spool(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	spool, err := learnspool.Open(t.TempDir(), log.SlogTestLogger(t))
+	assert.NoError(t, err)
+	clt.learnSpool = spool
+
+	rspamcMock := mock.NewRspamc()
+	rspamcMock.LearnErr = fmt.Errorf("%w: connection refused", rspamc.ErrUnavailable)
+	clt.rspamc = rspamcMock
+
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.UndetectedMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.HamMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessSpam())
+	assert.NoError(t, clt.ProcessHam())
+
+	// the mails are moved although rspamd is unavailable
+	assert.Equal(t, 2, spool.Len())
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.UndetectedMailbox))
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.HamMailbox))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+	assert.Equal(t, 0, len(rspamcMock.Calls()))
+
+	// new learn requests are spooled while the spool is not empty
+	rspamcMock.LearnErr = nil
+	// items with an unsupported kind are discarded
+	assert.NoError(t, spool.Add(&learnspool.Item{Kind: "unknown", Headers: &rspamc.MailHeaders{}}))
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.HamMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessHam())
+	assert.Equal(t, 0, spool.Len())
+
+	calls := rspamcMock.Calls()
+	assert.Equal(t, 3, len(calls))
+	for i, expected := range []struct{ method, subject string }{
+		{"Spam", mail.SpamMailSubject},
+		{"Ham", mail.HamMailSubject},
+		{"Ham", mail.HamMailSubject},
+	} {
+		assert.Equal(t, expected.method, calls[i].Method)
+		assert.Equal(t, expected.subject, calls[i].Headers.Subject)
+	}
+}
+
+func TestLearn_SpoolNotUsedForRejectedRequests(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	spool, err := learnspool.Open(t.TempDir(), log.SlogTestLogger(t))
+	assert.NoError(t, err)
+	clt.learnSpool = spool
+
+	rspamcMock := mock.NewRspamc()
+	rspamcMock.LearnErr = &rspamc.StatusError{StatusCode: 400, Status: "400 Bad Request"}
+	clt.rspamc = rspamcMock
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.HamMailbox, time.Now(), nil))
+	assert.NoError(t, clt.ProcessHam())
+
+	assert.Equal(t, 0, spool.Len())
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.HamMailbox, mail.HamMailSubject))
+}
+
+// failingSpool fails to add items after the first one.
+type failingSpool struct {
+	*learnspool.Spool
+	adds int
+}
+
+func (s *failingSpool) Add(item *learnspool.Item) error {
+	s.adds++
+	if s.adds > 1 {
+		return errors.New("no space left on device")
+	}
+	return s.Spool.Add(item)
+}
+
+func TestLearn_SpoolAddFails(t *testing.T) {
+	srv, clt := startServerClient(t)
+
+	spool, err := learnspool.Open(t.TempDir(), log.SlogTestLogger(t))
+	assert.NoError(t, err)
+	clt.learnSpool = &failingSpool{Spool: spool}
+
+	rspamcMock := mock.NewRspamc()
+	rspamcMock.LearnErr = fmt.Errorf("%w: connection refused", rspamc.ErrUnavailable)
+	clt.rspamc = rspamcMock
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.HamMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.HamMailbox, time.Now(), nil))
+
+	for range 2 {
+		assert.NoError(t, clt.ProcessHam())
+	}
+
+	// the spooled mail is moved and not spooled again, the other one
+	// stays in the mailbox
+	assert.Equal(t, 1, spool.Len())
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.HamMailbox, mail.SpamMailSubject))
+}
@@ -0,0 +1,138 @@
+package iscan
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+const (
+	keywordPrefix       = "$rspamd-"
+	keywordScorePrefix  = keywordPrefix + "score-"
+	keywordActionPrefix = keywordPrefix + "action-"
+)
+
+// scanMessage checks msg with rspamd without storing it on disk.
+// If useCache is true, a cached result can be returned, see [Client.check].
+func (c *Client) scanMessage(msg *imapclt.Message, useCache bool) (*scannedMail, error) {
+	env := &msg.Envelope
+	logger := c.logger.With("mail.subject", env.Subject, "mail.uid", msg.UID)
+
+	scanResult, err := c.check(logger, msg.Message, envelopeToRspamcHdrs(env), useCache)
+	if err != nil {
+		return nil, err
+	}
+
+	c.logScanResult(logger, scanResult)
+
+	return &scannedMail{
+		UID:          msg.UID,
+		Envelope:     env,
+		Flags:        msg.Flags,
+		InternalDate: msg.InternalDate,
+		CheckResult:  scanResult,
+	}, nil
+}
+
+// scanResultKeywords returns the IMAP keywords that represent the scan
+// result.
+// The score is rounded down, e.g. a score of 7.8 results in the keyword
+// $rspamd-score-7. Spaces in the action are replaced by dashes, e.g.
+// $rspamd-action-add-header.
+func scanResultKeywords(r *rspamc.CheckResult) []string {
+	result := []string{
+		keywordScorePrefix + strconv.Itoa(int(math.Floor(float64(r.Score)))),
+	}
+
+	if r.Action != "" {
+		result = append(result, keywordActionPrefix+strings.ReplaceAll(r.Action, " ", "-"))
+	}
+
+	return result
+}
+
+// tagAndMoveMails adds keywords with the scan results to the mails and moves
+// them to the spam or inbox mailbox, depending on their spam score.
+// The mails are not modified otherwise.
+func (c *Client) tagAndMoveMails(mails []*scannedMail) error {
+	var errs []error
+	var spamUIDs, inboxUIDs []uint32
+	var inboxMails []*scannedMail
+
+	for _, mail := range mails {
+		var extraFlags []string
+
+		isSpam := c.isSpam(mail.CheckResult)
+		if isSpam {
+			extraFlags = c.spamFlags
+		} else {
+			extraFlags = c.inboxFlags
+		}
+
+		var keywords []string
+		if mail.Unscanned {
+			keywords = mergeFlags([]string{keywordUnscanned}, extraFlags)
+		} else {
+			keywords = mergeFlags(scanResultKeywords(mail.CheckResult), extraFlags)
+		}
+		if mail.Skipped != "" {
+			keywords = append(keywords, keywordSkipped)
+		}
+		if err := c.clt.AddFlags([]uint32{mail.UID}, keywords); err != nil {
+			errs = append(errs, fmt.Errorf(
+				"tagging mail %d (%s) failed: %w",
+				mail.UID, mail.Envelope.Subject, err,
+			))
+			continue
+		}
+
+		c.logger.Debug("tagged message with scan result",
+			"mail.subject", mail.Envelope.Subject,
+			"mail.uid", mail.UID,
+			"imap.flags", keywords,
+		)
+
+		if isSpam {
+			spamUIDs = append(spamUIDs, mail.UID)
+		} else {
+			inboxUIDs = append(inboxUIDs, mail.UID)
+			inboxMails = append(inboxMails, mail)
+		}
+	}
+
+	for _, dest := range []struct {
+		mbox  string
+		uids  []uint32
+		mails []*scannedMail
+	}{
+		{c.spamMailbox, spamUIDs, nil},
+		{c.inboxMailbox, inboxUIDs, inboxMails},
+	} {
+		mbox, uids := dest.mbox, dest.uids
+		if len(uids) == 0 {
+			continue
+		}
+
+		if err := c.clt.Move(uids, mbox); err != nil {
+			errs = append(errs, fmt.Errorf("moving tagged mails to %s failed: %w", mbox, err))
+			continue
+		}
+
+		for _, mail := range dest.mails {
+			c.trackInboxMail(mail)
+		}
+
+		c.logger.Info("moved tagged messages",
+			"mailbox.destination", mbox,
+			"count", len(uids),
+			"event", "imap.tagged_msgs_moved",
+		)
+	}
+
+	return errors.Join(errs...)
+}
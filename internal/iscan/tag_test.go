@@ -0,0 +1,66 @@
+package iscan
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+)
+
+func TestProcessScanBox_TagOnly(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.tagOnly = true
+	clt.backupMailbox = ""
+	clt.spamFlags = []string{"$Junk"}
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.BackupMailbox))
+
+	tests := []struct {
+		mailbox          string
+		expectedKeywords []string
+	}{
+		{srv.InboxMailBox, []string{"$rspamd-score-0"}},
+		{srv.SpamMailbox, []string{"$rspamd-score-100", "$Junk"}},
+	}
+
+	for _, tt := range tests {
+		cnt := 0
+		for msg, err := range clt.clt.Messages(tt.mailbox, nil) {
+			assert.NoError(t, err)
+			cnt++
+
+			// the message is not modified
+			if strings.Contains(msg.Envelope.Subject, "SPAM") {
+				t.Errorf("subject of message in %s was rewritten: %s", tt.mailbox, msg.Envelope.Subject)
+			}
+
+			for _, kw := range tt.expectedKeywords {
+				if !slices.ContainsFunc(msg.Flags, func(e string) bool { return strings.EqualFold(e, kw) }) {
+					t.Errorf("%s: keyword %q missing, message has flags: %v", tt.mailbox, kw, msg.Flags)
+				}
+			}
+		}
+		assert.Equal(t, 1, cnt)
+	}
+}
+
+func TestScanResultKeywords(t *testing.T) {
+	kws := scanResultKeywords(&rspamc.CheckResult{Score: 7.8, Action: "add header"})
+	assert.Equal(t, 2, len(kws))
+	assert.Equal(t, "$rspamd-score-7", kws[0])
+	assert.Equal(t, "$rspamd-action-add-header", kws[1])
+
+	kws = scanResultKeywords(&rspamc.CheckResult{Score: -0.5})
+	assert.Equal(t, 1, len(kws))
+	assert.Equal(t, "$rspamd-score--1", kws[0])
+}
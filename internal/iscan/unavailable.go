@@ -0,0 +1,239 @@
+package iscan
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/mail"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+// UnavailablePolicy defines how mails are handled while rspamd is
+// unavailable.
+type UnavailablePolicy string
+
+const (
+	// PolicyFailClosed leaves mails in the scan mailbox until rspamd is
+	// available again.
+	PolicyFailClosed UnavailablePolicy = "fail-closed"
+	// PolicyFailOpen moves mails unscanned to the inbox mailbox when the
+	// circuit breaker of the rspamd client is open, a
+	// X-rspamd-iscan-Unscanned header respectively the $rspamd-unscanned
+	// keyword is added. They are scanned when rspamd is available again,
+	// unless they were read meanwhile.
+	PolicyFailOpen UnavailablePolicy = "fail-open"
+)
+
+const (
+	hdrUnscanned     = hdrPrefix + "Unscanned"
+	keywordUnscanned = keywordPrefix + "unscanned"
+
+	defRspamdRetryInterval = time.Minute
+)
+
+func (p UnavailablePolicy) validate() error {
+	switch p {
+	case "", PolicyFailClosed, PolicyFailOpen:
+		return nil
+	default:
+		return fmt.Errorf("unsupported policy: %q, supported: %s, %s",
+			p, PolicyFailClosed, PolicyFailOpen)
+	}
+}
+
+// scanOrPassUnscanned scans msg from the scan mailbox.
+// If rspamd is unavailable, its circuit breaker is open and
+// [PolicyFailOpen] is configured, an unscanned mail is returned instead of
+// the error.
+func (c *Client) scanOrPassUnscanned(msg *imapclt.Message) (*scannedMail, error) {
+	var path string
+	var sm *scannedMail
+	var err error
+
+	if c.tagOnly {
+		sm, err = c.scanMessage(msg, true)
+	} else {
+		path, err = c.download(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		sm, err = c.scanFile(path, msg, true)
+	}
+	if err == nil {
+		c.setRspamdAvailable()
+		return sm, nil
+	}
+
+	if !errors.Is(err, rspamc.ErrUnavailable) {
+		c.removeTempFile(&scannedMail{Path: path})
+		return nil, err
+	}
+
+	c.setRspamdUnavailable(err)
+
+	if c.unavailablePolicy != PolicyFailOpen || !errors.Is(err, rspamc.ErrCircuitOpen) {
+		c.removeTempFile(&scannedMail{Path: path})
+		return nil, err
+	}
+
+	sm = &scannedMail{
+		Path:         path,
+		UID:          msg.UID,
+		Envelope:     &msg.Envelope,
+		Flags:        msg.Flags,
+		InternalDate: msg.InternalDate,
+		CheckResult:  &rspamc.CheckResult{},
+		Unscanned:    true,
+	}
+
+	if path != "" {
+		hdr, err := mail.AsHeaders([]*mail.Header{{Name: hdrUnscanned, Body: "rspamd unavailable"}})
+		if err != nil {
+			c.removeTempFile(sm)
+			return nil, err
+		}
+
+		if err := mail.AddHeaders(path, hdr); err != nil {
+			c.removeTempFile(sm)
+			return nil, fmt.Errorf("adding %s header failed: %w", hdrUnscanned, err)
+		}
+	}
+
+	c.logger.Info("rspamd is unavailable, passing mail through unscanned",
+		"event", "scan.msg_unscanned",
+		"mail.subject", msg.Envelope.Subject,
+		"mail.uid", msg.UID,
+	)
+
+	return sm, nil
+}
+
+// setRspamdUnavailable records that a request to rspamd failed because it
+// is unavailable.
+func (c *Client) setRspamdUnavailable(err error) {
+	if c.rspamdUnavailable {
+		return
+	}
+
+	c.rspamdUnavailable = true
+	c.logger.Warn("rspamd is unavailable, mails are not scanned until it is available again",
+		"event", "rspamd.unavailable",
+		"error", err,
+		"rspamd.unavailable_policy", cmp.Or(c.unavailablePolicy, PolicyFailClosed),
+	)
+}
+
+// setRspamdAvailable records that rspamd is available.
+func (c *Client) setRspamdAvailable() {
+	if !c.rspamdUnavailable {
+		return
+	}
+
+	c.rspamdUnavailable = false
+	c.logger.Info("rspamd is available again", "event", "rspamd.available")
+}
+
+// probeRspamd checks if rspamd is available again, if it was unavailable
+// before.
+func (c *Client) probeRspamd() {
+	if !c.rspamdUnavailable {
+		return
+	}
+
+	if err := c.rspamc.Ping(context.Background()); err != nil {
+		c.logger.Debug("rspamd is still unavailable", "error", err)
+		return
+	}
+
+	c.setRspamdAvailable()
+}
+
+// trackInboxMail is called after sm was moved to the inbox mailbox.
+// For unscanned mails a requeue is scheduled, for others a late rescan.
+func (c *Client) trackInboxMail(sm *scannedMail) {
+	if !sm.Unscanned {
+		c.scheduleLateRescan(sm)
+		return
+	}
+
+	c.requeuePending = true
+}
+
+// unscannedSearchCriteria matches unread mails that were passed unscanned to
+// the inbox mailbox, by their X-rspamd-iscan-Unscanned header respectively
+// $rspamd-unscanned keyword.
+func unscannedSearchCriteria() *imap.SearchCriteria {
+	return &imap.SearchCriteria{
+		Or: [][2]imap.SearchCriteria{{
+			{Flag: []imap.Flag{keywordUnscanned}},
+			{Header: []imap.SearchCriteriaHeaderField{{Key: hdrUnscanned}}},
+		}},
+		NotFlag: []imap.Flag{imap.FlagSeen},
+	}
+}
+
+// requeueUnscanned moves the mails that were passed unscanned to the inbox
+// mailbox back to the scan mailbox.
+// The mails are searched on the server, mails that were read meanwhile are
+// left alone.
+// The keywords that were added when moving them to the inbox mailbox are
+// removed.
+func (c *Client) requeueUnscanned() error {
+	var uids []uint32
+
+	if !c.requeuePending {
+		return nil
+	}
+
+	lrc, ok := c.clt.(LateRescanClient)
+	if !ok {
+		return errors.New("imap client does not support searching unscanned mails")
+	}
+
+	for msg, err := range lrc.SearchMessages(c.inboxMailbox, unscannedSearchCriteria()) {
+		if err != nil {
+			if _, ok := errors.AsType[*imapclt.ErrMalformedMsg](err); ok {
+				continue
+			}
+
+			return fmt.Errorf("fetching unscanned mails failed: %w", err)
+		}
+
+		stale := slices.DeleteFunc(slices.Clone(msg.Flags), func(f string) bool {
+			return !c.isInboxScanFlag(f)
+		})
+		if len(stale) > 0 {
+			if err := lrc.RemoveFlags([]uint32{msg.UID}, stale); err != nil {
+				return fmt.Errorf("removing keywords from mail %d (%s) failed: %w",
+					msg.UID, msg.Envelope.Subject, err)
+			}
+		}
+
+		uids = append(uids, msg.UID)
+	}
+
+	if len(uids) > 0 {
+		if err := c.clt.Move(uids, c.scanMailbox); err != nil {
+			return fmt.Errorf("moving unscanned mails to %s failed: %w", c.scanMailbox, err)
+		}
+	}
+
+	c.requeuePending = false
+
+	c.logger.Info("moved unscanned mails back to the scan mailbox",
+		"event", "imap.unscanned_msgs_requeued",
+		"mailbox.source", c.inboxMailbox,
+		"mailbox.destination", c.scanMailbox,
+		"count", len(uids),
+	)
+
+	return nil
+}
@@ -0,0 +1,221 @@
+package iscan
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/imapserver"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+	"github.com/fho/rspamd-iscan/internal/testutils/mock"
+)
+
+// unavailableRspamc returns a mock whose requests fail with errUnavailable.
+func unavailableRspamc(errUnavailable error) *mock.Rspamc {
+	return &mock.Rspamc{
+		CheckFn: func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error) {
+			return nil, fmt.Errorf("%w: connection refused", errUnavailable)
+		},
+		PingFn: func(context.Context) error {
+			return fmt.Errorf("%w: connection refused", errUnavailable)
+		},
+	}
+}
+
+func TestProcessScanBox_RspamdUnavailableFailClosed(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.rspamc = unavailableRspamc(rspamc.ErrCircuitOpen)
+
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.HamMailSubject))
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.InboxMailBox))
+
+	wait, ok := clt.scanBacklogWait()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, clt.rspamdRetryInterval, wait)
+
+	clt.rspamc = mock.NewRspamc()
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+	assert.Equal(t, false, clt.rspamdUnavailable)
+}
+
+func TestProcessScanBox_RspamdUnavailableFailOpenBeforeTimeout(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.unavailablePolicy = PolicyFailOpen
+	clt.rspamc = unavailableRspamc(rspamc.ErrUnavailable)
+
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.ScanMailbox, mail.SpamMailSubject))
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.InboxMailBox))
+}
+
+func TestProcessScanBox_RspamdUnavailableFailOpen(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.unavailablePolicy = PolicyFailOpen
+	clt.inboxFlags = []string{"$NotJunk"}
+	clt.rspamc = unavailableRspamc(rspamc.ErrCircuitOpen)
+
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, true, clt.requeuePending)
+
+	cnt := 0
+	for msg, err := range clt.clt.Messages(srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+		cnt++
+
+		body, err := io.ReadAll(msg.Message)
+		assert.NoError(t, err)
+		if !strings.Contains(string(body), hdrUnscanned+": rspamd unavailable\r\n") {
+			t.Errorf("mail does not contain %s header:\n%s", hdrUnscanned, body)
+		}
+	}
+	assert.Equal(t, 1, cnt)
+
+	// a failing ping does not requeue the mails
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.SpamMailSubject))
+
+	clt.rspamc = mock.NewRspamc()
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, false, clt.requeuePending)
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.InboxMailBox))
+
+	cnt = 0
+	for msg, err := range clt.clt.Messages(srv.SpamMailbox, nil) {
+		assert.NoError(t, err)
+		cnt++
+
+		body, err := io.ReadAll(msg.Message)
+		assert.NoError(t, err)
+		if strings.Contains(string(body), hdrUnscanned) {
+			t.Errorf("mail contains %s header after it was scanned:\n%s", hdrUnscanned, body)
+		}
+		if !strings.Contains(string(body), hdrRspamdScore+": 100\r\n") {
+			t.Errorf("mail does not contain %s header:\n%s", hdrRspamdScore, body)
+		}
+		if slices.Contains(msg.Flags, "$NotJunk") {
+			t.Errorf("inbox flag was not removed, message has flags: %v", msg.Flags)
+		}
+	}
+	assert.Equal(t, 1, cnt)
+}
+
+func TestProcessScanBox_RspamdUnavailableFailOpenRequeueAfterReconnect(t *testing.T) {
+	srv := imapserver.StartServer(t)
+
+	newClient := func(rspamc *mock.Rspamc) *Client {
+		cfg := testClientCfg(t, newTestClient(t, srv).clt, srv)
+		cfg.UnavailablePolicy = PolicyFailOpen
+		cfg.Rspamc = rspamc
+
+		clt, err := NewClient(cfg)
+		assert.NoError(t, err)
+		return clt
+	}
+
+	clt := newClient(unavailableRspamc(rspamc.ErrCircuitOpen))
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+	assert.NoError(t, clt.clt.Upload(mail.TestHamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.SpamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+
+	// the ham mail is read meanwhile, it is not requeued
+	for msg, err := range clt.clt.Messages(srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+		if msg.Envelope.Subject == mail.HamMailSubject {
+			assert.NoError(t, clt.clt.MarkSeen([]uint32{msg.UID}))
+		}
+	}
+
+	clt = newClient(mock.NewRspamc())
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, false, clt.requeuePending)
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.ScanMailbox))
+	assert.Equal(t, 0, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.SpamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.InboxMailBox, mail.HamMailSubject))
+	assert.Equal(t, 1, mailboxContainsMailCnt(t, clt.clt, srv.SpamMailbox, mail.SpamMailSubject))
+}
+
+func TestProcessScanBox_RspamdUnavailableFailOpenTagOnly(t *testing.T) {
+	srv, clt := startServerClient(t)
+	clt.tagOnly = true
+	clt.backupMailbox = ""
+	clt.unavailablePolicy = PolicyFailOpen
+	clt.rspamc = unavailableRspamc(rspamc.ErrCircuitOpen)
+
+	assert.NoError(t, clt.clt.Upload(mail.TestSpamMailPath(t), srv.ScanMailbox, time.Now(), nil))
+
+	assert.NoError(t, clt.ProcessScanBox())
+
+	cnt := 0
+	for msg, err := range clt.clt.Messages(srv.InboxMailBox, nil) {
+		assert.NoError(t, err)
+		cnt++
+
+		if !slices.Contains(msg.Flags, keywordUnscanned) {
+			t.Errorf("keyword %q is missing, message has flags: %v", keywordUnscanned, msg.Flags)
+		}
+	}
+	assert.Equal(t, 1, cnt)
+
+	clt.rspamc = mock.NewRspamc()
+
+	assert.NoError(t, clt.ProcessScanBox())
+	assert.Equal(t, true, mailboxIsEmpty(t, clt.clt, srv.InboxMailBox))
+
+	cnt = 0
+	for msg, err := range clt.clt.Messages(srv.SpamMailbox, nil) {
+		assert.NoError(t, err)
+		cnt++
+
+		if slices.Contains(msg.Flags, keywordUnscanned) {
+			t.Errorf("keyword %q was not removed, message has flags: %v", keywordUnscanned, msg.Flags)
+		}
+		if !slices.Contains(msg.Flags, "$rspamd-score-100") {
+			t.Errorf("keyword of scan is missing, message has flags: %v", msg.Flags)
+		}
+	}
+	assert.Equal(t, 1, cnt)
+}
+
+func TestConfigValidate_UnavailablePolicy(t *testing.T) {
+	cfg := Config{
+		ScanMailbox:       "scan",
+		InboxMailbox:      "INBOX",
+		BackupMailbox:     "backup",
+		SpamTreshold:      10,
+		TempDir:           t.TempDir(),
+		Rspamc:            mock.NewRspamc(),
+		UnavailablePolicy: PolicyFailClosed,
+	}
+	assert.NoError(t, cfg.validate())
+
+	// the IMAP client does not implement LateRescanClient
+	cfg.UnavailablePolicy = PolicyFailOpen
+	assert.Error(t, cfg.validate())
+
+	cfg.UnavailablePolicy = "ignore"
+	assert.Error(t, cfg.validate())
+}
@@ -0,0 +1,399 @@
+// Package jmap implements access to a mail account via JMAP (RFC 8620,
+// RFC 8621) with the same interface as the IMAP client in [imapclt].
+//
+// Mailbox names are the names of the mailboxes and their parents separated
+// by "/", e.g. "Archive/2024".
+// JMAP identifies emails by string IDs, the client assigns UIDs to them when
+// it reads a mailbox. They are only valid as long as the client exists, every
+// client uses a different UIDVALIDITY.
+package jmap
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/proxy"
+)
+
+const (
+	capCore = "urn:ietf:params:jmap:core"
+	capMail = "urn:ietf:params:jmap:mail"
+
+	requestTimeout = 2 * time.Minute
+	dialTimeout    = 120 * time.Second
+
+	// defMaxObjects is used when the server does not announce
+	// maxObjectsInGet or maxObjectsInSet.
+	defMaxObjects = 256
+
+	lkPrefix  = "jmap."
+	lkMailbox = lkPrefix + "mailbox"
+)
+
+type Client struct {
+	sessionURL    string
+	user          string
+	password      string
+	tokenSource   imapclt.TokenSource
+	allowInsecure bool
+	httpClt       *http.Client
+	uidValidity   uint32
+	logger        *slog.Logger
+
+	session *session
+
+	mu sync.Mutex
+	// mailboxes maps mailbox names to their IDs, it is refreshed when
+	// a name is not found.
+	mailboxes map[string]string
+	// selected is the ID of the mailbox that was last read via
+	// [Client.Messages], UIDs passed to other methods refer to it.
+	selected string
+	nextUID  uint32
+	uids     map[string]uint32
+	emailIDs map[uint32]string
+}
+
+type Config struct {
+	// URL is the URL of the JMAP session resource, e.g.
+	// https://api.fastmail.com/jmap/session
+	URL      string
+	User     string
+	Password string
+	// TokenSource is optional, if set requests are authenticated with
+	// OAuth2 bearer tokens instead of User and Password.
+	TokenSource imapclt.TokenSource
+	// TLSConfig is optional, if nil the default configuration is used.
+	TLSConfig *tls.Config
+	// Proxy is optional, if set connections are established via the
+	// SOCKS5 or HTTP CONNECT proxy, see [proxy.NewDialer] for the
+	// supported URLs.
+	Proxy *url.URL
+	// AllowInsecure allows http:// URLs.
+	AllowInsecure bool
+	Logger        *slog.Logger
+}
+
+// session is the JMAP session resource, RFC 8620 section 2.
+type session struct {
+	Capabilities    map[string]json.RawMessage `json:"capabilities"`
+	PrimaryAccounts map[string]string          `json:"primaryAccounts"`
+	APIURL          string                     `json:"apiUrl"`
+	DownloadURL     string                     `json:"downloadUrl"`
+	UploadURL       string                     `json:"uploadUrl"`
+	EventSourceURL  string                     `json:"eventSourceUrl"`
+
+	accountID       string
+	maxObjectsInGet int
+	maxObjectsInSet int
+}
+
+type coreCapability struct {
+	MaxObjectsInGet int `json:"maxObjectsInGet"`
+	MaxObjectsInSet int `json:"maxObjectsInSet"`
+}
+
+// MethodError is an error response to a JMAP method call, or an error of a
+// single object in a /set response.
+type MethodError struct {
+	Method      string
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+func (e *MethodError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("jmap %s failed: %s", e.Method, e.Type)
+	}
+	return fmt.Sprintf("jmap %s failed: %s: %s", e.Method, e.Type, e.Description)
+}
+
+// NewClient creates a new JMAP client.
+// [*Client.Connect] must be called before any other methods.
+func NewClient(cfg *Config) (*Client, error) {
+	var dialer proxy.Dialer = &net.Dialer{Timeout: dialTimeout}
+	if cfg.Proxy != nil {
+		var err error
+
+		dialer, err = proxy.NewDialer(cfg.Proxy, &net.Dialer{Timeout: dialTimeout})
+		if err != nil {
+			return nil, fmt.Errorf("creating proxy dialer failed: %w", err)
+		}
+	}
+
+	return &Client{
+		sessionURL:    cfg.URL,
+		user:          cfg.User,
+		password:      cfg.Password,
+		tokenSource:   cfg.TokenSource,
+		allowInsecure: cfg.AllowInsecure,
+		httpClt: &http.Client{
+			Transport: &http.Transport{
+				DialContext:       dialer.DialContext,
+				TLSClientConfig:   cfg.TLSConfig,
+				ForceAttemptHTTP2: true,
+			},
+		},
+		// UIDs are not persisted, a new UIDVALIDITY invalidates the
+		// sync states of previous clients
+		uidValidity: uint32(time.Now().UnixNano()) | 1,
+		logger:      log.EnsureLoggerInstance(cfg.Logger),
+		mailboxes:   map[string]string{},
+		nextUID:     1,
+		uids:        map[string]uint32{},
+		emailIDs:    map[uint32]string{},
+	}, nil
+}
+
+// Connect fetches the session resource and verifies that the server
+// supports JMAP Mail.
+func (c *Client) Connect() error {
+	u, err := url.Parse(c.sessionURL)
+	if err != nil {
+		return fmt.Errorf("invalid jmap url: %w", err)
+	}
+
+	if u.Scheme != "https" && (u.Scheme != "http" || !c.allowInsecure) {
+		return fmt.Errorf("unsupported jmap url scheme %q, must be https", u.Scheme)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	var s session
+	if err := c.doJSON(ctx, http.MethodGet, c.sessionURL, nil, nil, &s); err != nil {
+		return fmt.Errorf("fetching jmap session failed: %w", err)
+	}
+
+	if _, ok := s.Capabilities[capMail]; !ok {
+		return errors.New("jmap server does not support " + capMail)
+	}
+
+	s.accountID = s.PrimaryAccounts[capMail]
+	if s.accountID == "" {
+		return errors.New("jmap session has no primary mail account")
+	}
+
+	var coreCap coreCapability
+	if raw, ok := s.Capabilities[capCore]; ok {
+		if err := json.Unmarshal(raw, &coreCap); err != nil {
+			return fmt.Errorf("parsing jmap core capability failed: %w", err)
+		}
+	}
+	s.maxObjectsInGet = positiveOr(coreCap.MaxObjectsInGet, defMaxObjects)
+	s.maxObjectsInSet = positiveOr(coreCap.MaxObjectsInSet, defMaxObjects)
+
+	for _, ref := range []*string{&s.APIURL, &s.DownloadURL, &s.UploadURL, &s.EventSourceURL} {
+		// some servers return URLs without scheme and host, they are
+		// not resolved via url.Parse because it would escape the
+		// template variables
+		if strings.HasPrefix(*ref, "/") {
+			*ref = u.Scheme + "://" + u.Host + *ref
+		}
+	}
+
+	c.session = &s
+
+	c.logger.Info("jmap session established",
+		"event", "jmap.session_established",
+		"jmap.account_id", s.accountID,
+	)
+
+	return nil
+}
+
+// Close closes idle connections to the server.
+func (c *Client) Close() error {
+	c.httpClt.CloseIdleConnections()
+	return nil
+}
+
+func positiveOr(v, def int) int {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+// call sends the method call to the API endpoint and decodes the arguments
+// of the response into result.
+func (c *Client) call(method string, args any, result any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	reqBody, err := json.Marshal(map[string]any{
+		"using":       []string{capCore, capMail},
+		"methodCalls": []any{[]any{method, args, "0"}},
+	})
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		MethodResponses []methodResponse `json:"methodResponses"`
+	}
+
+	err = c.doJSON(ctx, http.MethodPost, c.session.APIURL, contentTypeHeader("application/json"), reqBody, &resp)
+	if err != nil {
+		return fmt.Errorf("jmap %s failed: %w", method, err)
+	}
+
+	if len(resp.MethodResponses) != 1 {
+		return fmt.Errorf("jmap %s failed: got %d method responses, expected 1",
+			method, len(resp.MethodResponses))
+	}
+
+	mresp := resp.MethodResponses[0]
+	if mresp.Name == "error" {
+		merr := MethodError{Method: method}
+		if err := json.Unmarshal(mresp.Args, &merr); err != nil {
+			return fmt.Errorf("jmap %s failed: parsing error response failed: %w", method, err)
+		}
+		return &merr
+	}
+
+	if err := json.Unmarshal(mresp.Args, result); err != nil {
+		return fmt.Errorf("jmap %s failed: parsing response failed: %w", method, err)
+	}
+
+	return nil
+}
+
+// methodResponse is an invocation in the methodResponses array of a response,
+// it is encoded as [name, arguments, method call id].
+type methodResponse struct {
+	Name string
+	Args json.RawMessage
+}
+
+func (m *methodResponse) UnmarshalJSON(data []byte) error {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+
+	if len(parts) != 3 {
+		return fmt.Errorf("invocation has %d elements, expected 3", len(parts))
+	}
+
+	if err := json.Unmarshal(parts[0], &m.Name); err != nil {
+		return err
+	}
+
+	m.Args = parts[1]
+
+	return nil
+}
+
+// doJSON sends a request and decodes the JSON response body into result.
+func (c *Client) doJSON(ctx context.Context, method, target string, hdr http.Header, body []byte, result any) error {
+	resp, err := c.do(ctx, method, target, hdr, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("parsing response failed: %w", err)
+	}
+
+	return nil
+}
+
+// do sends a request and returns the response if it has a 2xx status code.
+// When a bearer token was rejected, it is invalidated and the request is
+// retried once.
+func (c *Client) do(ctx context.Context, method, target string, hdr http.Header, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		maps.Copy(req.Header, hdr)
+
+		if err := c.authorize(ctx, req); err != nil {
+			return nil, err
+		}
+
+		resp, err := c.httpClt.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		err = responseError(resp)
+		_ = resp.Body.Close()
+
+		if resp.StatusCode == http.StatusUnauthorized && c.tokenSource != nil && attempt == 0 {
+			c.logger.Debug("access token was rejected, retrying with a new token", "error", err)
+			c.tokenSource.Invalidate()
+			continue
+		}
+
+		return nil, err
+	}
+}
+
+func (c *Client) authorize(ctx context.Context, req *http.Request) error {
+	if c.tokenSource == nil {
+		req.SetBasicAuth(c.user, c.password)
+		return nil
+	}
+
+	token, err := c.tokenSource.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("retrieving oauth2 access token failed: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return nil
+}
+
+// responseError returns an error for a non-2xx response.
+// The body can be a problem details object (RFC 7807).
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	var problem struct {
+		Type   string `json:"type"`
+		Detail string `json:"detail"`
+	}
+	if json.Unmarshal(body, &problem) == nil && problem.Type != "" {
+		return fmt.Errorf("server returned status %s: %s: %s", resp.Status, problem.Type, problem.Detail)
+	}
+
+	return fmt.Errorf("server returned status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+func contentTypeHeader(contentType string) http.Header {
+	return http.Header{"Content-Type": []string{contentType}}
+}
+
+// expandURL substitutes the variables in a URL template of the session
+// resource, RFC 6570 level 1.
+func expandURL(tmpl string, vars map[string]string) string {
+	for k, v := range vars {
+		tmpl = strings.ReplaceAll(tmpl, "{"+k+"}", url.PathEscape(v))
+	}
+	return tmpl
+}
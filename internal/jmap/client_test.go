@@ -0,0 +1,216 @@
+package jmap
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/jmapserver"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+)
+
+func newTestClient(t *testing.T, mailboxes ...string) (*Client, *jmapserver.Server) {
+	srv := jmapserver.Start(t)
+
+	clt, err := NewClient(&Config{
+		URL:           srv.URL,
+		User:          jmapserver.User,
+		Password:      jmapserver.Password,
+		AllowInsecure: true,
+		Logger:        log.SlogTestLogger(t),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, clt.Connect())
+
+	for _, mbox := range mailboxes {
+		assert.NoError(t, clt.CreateMailbox(mbox))
+	}
+
+	return clt, srv
+}
+
+func messages(t *testing.T, clt *Client, mailbox string) []*imapclt.Message {
+	var result []*imapclt.Message
+
+	for msg, err := range clt.Messages(mailbox, nil) {
+		assert.NoError(t, err)
+		result = append(result, msg)
+	}
+
+	return result
+}
+
+func TestConnect_InvalidCredentials(t *testing.T) {
+	srv := jmapserver.Start(t)
+
+	clt, err := NewClient(&Config{
+		URL:           srv.URL,
+		User:          jmapserver.User,
+		Password:      "invalid",
+		AllowInsecure: true,
+		Logger:        log.SlogTestLogger(t),
+	})
+	assert.NoError(t, err)
+	assert.Error(t, clt.Connect())
+}
+
+func TestConnect_InsecureURL(t *testing.T) {
+	srv := jmapserver.Start(t)
+
+	clt, err := NewClient(&Config{URL: srv.URL, Logger: log.SlogTestLogger(t)})
+	assert.NoError(t, err)
+	assert.Error(t, clt.Connect())
+}
+
+func TestUploadAndMessages(t *testing.T) {
+	clt, _ := newTestClient(t)
+	ts := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), "INBOX", ts, nil))
+	assert.NoError(t, clt.Upload(mail.TestSpamMailPath(t), "INBOX", ts.Add(time.Minute),
+		[]string{`\Flagged`, `\Recent`, "$Junk"}))
+	assert.NoError(t, clt.Upload(mail.TestSuspiciousMailPath(t), "INBOX", ts.Add(2*time.Minute), nil))
+
+	// the server returns at most 2 objects per Email/get call
+	msgs := messages(t, clt, "INBOX")
+	assert.Equal(t, 3, len(msgs))
+
+	assert.Equal(t, mail.HamMailSubject, msgs[0].Envelope.Subject)
+	assert.Equal(t, mail.SpamMailSubject, msgs[1].Envelope.Subject)
+	assert.Equal(t, true, msgs[0].UID < msgs[1].UID && msgs[1].UID < msgs[2].UID)
+
+	if !msgs[0].InternalDate.Equal(ts) {
+		t.Errorf("internal date is %s, expected %s", msgs[0].InternalDate, ts)
+	}
+
+	assert.Equal(t, 0, len(msgs[0].Flags))
+	assert.Equal(t, `\Flagged,$junk`, strings.Join(msgs[1].Flags, ","))
+
+	data, err := io.ReadAll(msgs[1].Message)
+	assert.NoError(t, err)
+	if !strings.Contains(string(data), "\r\n\r\n") {
+		t.Error("uploaded message does not have CRLF line endings")
+	}
+}
+
+func TestMessages_SyncState(t *testing.T) {
+	clt, _ := newTestClient(t)
+
+	assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), "INBOX", time.Now(), nil))
+
+	var state imapclt.SyncState
+	cnt := 0
+	for _, err := range clt.Messages("INBOX", &state) {
+		assert.NoError(t, err)
+		cnt++
+	}
+	assert.Equal(t, 1, cnt)
+	assert.Equal(t, clt.uidValidity, state.UIDValidity)
+
+	assert.NoError(t, clt.Upload(mail.TestSpamMailPath(t), "INBOX", time.Now(), nil))
+
+	var uids []uint32
+	for msg, err := range clt.Messages("INBOX", &state) {
+		assert.NoError(t, err)
+		uids = append(uids, msg.UID)
+	}
+	assert.Equal(t, 1, len(uids))
+	assert.Equal(t, uids[0], state.LastUID)
+}
+
+func TestMoveAndAddFlags(t *testing.T) {
+	clt, _ := newTestClient(t, "Spam")
+
+	assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), "INBOX", time.Now(), []string{"$Label1"}))
+	assert.NoError(t, clt.Upload(mail.TestSpamMailPath(t), "INBOX", time.Now(), nil))
+
+	msgs := messages(t, clt, "INBOX")
+	assert.Equal(t, 2, len(msgs))
+	uids := []uint32{msgs[0].UID, msgs[1].UID}
+
+	assert.NoError(t, clt.MarkSeen(uids[1:]))
+	assert.NoError(t, clt.AddFlags(uids, []string{"$Junk"}))
+	assert.NoError(t, clt.Move(uids, "Spam"))
+
+	assert.Equal(t, 0, len(messages(t, clt, "INBOX")))
+
+	msgs = messages(t, clt, "Spam")
+	assert.Equal(t, 2, len(msgs))
+
+	for _, msg := range msgs {
+		if msg.Envelope.Subject == mail.SpamMailSubject {
+			assert.Equal(t, `$junk,\Seen`, strings.Join(msg.Flags, ","))
+		} else {
+			assert.Equal(t, "$junk,$label1", strings.Join(msg.Flags, ","))
+		}
+	}
+
+	assert.Error(t, clt.Move([]uint32{1000}, "INBOX"))
+}
+
+func TestMailboxes(t *testing.T) {
+	clt, srv := newTestClient(t, "Archive/2024")
+	srv.AddMailbox("Junk", "junk")
+
+	mailboxes, err := clt.Mailboxes()
+	assert.NoError(t, err)
+
+	var names []string
+	for _, mbox := range mailboxes {
+		names = append(names, mbox.Name)
+		assert.Equal(t, '/', mbox.Delim)
+
+		if mbox.Name == "Junk" {
+			assert.Equal(t, true, mbox.HasAttr(`\Junk`))
+		}
+	}
+	slices.Sort(names)
+	assert.Equal(t, "Archive,Archive/2024,INBOX,Junk", strings.Join(names, ","))
+
+	// existing mailboxes are not created again
+	assert.NoError(t, clt.CreateMailbox("Archive/2025"))
+	assert.Error(t, clt.CreateMailbox("Archive//2025"))
+	assert.Error(t, clt.Upload(mail.TestHamMailPath(t), "Missing", time.Now(), nil))
+}
+
+func TestMonitor(t *testing.T) {
+	clt, srv := newTestClient(t)
+
+	ch, stop, err := clt.Monitor("INBOX")
+	assert.NoError(t, err)
+
+	clt2, err := NewClient(&Config{
+		URL:           srv.URL,
+		User:          jmapserver.User,
+		Password:      jmapserver.Password,
+		AllowInsecure: true,
+		Logger:        log.SlogTestLogger(t),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, clt2.Connect())
+	assert.NoError(t, clt2.Upload(mail.TestHamMailPath(t), "INBOX", time.Now(), nil))
+
+	select {
+	case ev := <-ch:
+		assert.Equal(t, 1, ev.NewMsgCount)
+	case <-time.After(15 * time.Second):
+		t.Fatal("no event received")
+	}
+
+	assert.NoError(t, stop())
+
+	_, ok := <-ch
+	assert.Equal(t, false, ok)
+
+	// the mailbox is not empty, the event is sent immediately
+	ch, stop, err = clt.Monitor("INBOX")
+	assert.NoError(t, err)
+	ev := <-ch
+	assert.Equal(t, 1, ev.NewMsgCount)
+	assert.NoError(t, stop())
+}
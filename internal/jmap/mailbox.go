@@ -0,0 +1,222 @@
+package jmap
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+)
+
+const (
+	delim     = '/'
+	inboxName = "INBOX"
+	roleInbox = "inbox"
+)
+
+// roleAttrs maps JMAP mailbox roles to IMAP SPECIAL-USE attributes
+// (RFC 6154).
+var roleAttrs = map[string]string{
+	"all":       `\All`,
+	"archive":   `\Archive`,
+	"drafts":    `\Drafts`,
+	"flagged":   `\Flagged`,
+	"important": `\Important`,
+	"junk":      `\Junk`,
+	"sent":      `\Sent`,
+	"trash":     `\Trash`,
+}
+
+type jmapMailbox struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ParentID    string `json:"parentId"`
+	Role        string `json:"role"`
+	TotalEmails uint32 `json:"totalEmails"`
+}
+
+// setResponse is the response of a /set method call.
+type setResponse struct {
+	Created    map[string]struct{ ID string } `json:"created"`
+	NotCreated map[string]*MethodError        `json:"notCreated"`
+	NotUpdated map[string]*MethodError        `json:"notUpdated"`
+}
+
+// fetchMailboxes returns all mailboxes of the account and refreshes the
+// mailbox name cache.
+func (c *Client) fetchMailboxes() ([]*jmapMailbox, map[string]string, error) {
+	var resp struct {
+		List []*jmapMailbox `json:"list"`
+	}
+
+	err := c.call("Mailbox/get", map[string]any{
+		"accountId":  c.session.accountID,
+		"ids":        nil,
+		"properties": []string{"id", "name", "parentId", "role", "totalEmails"},
+	}, &resp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byID := make(map[string]*jmapMailbox, len(resp.List))
+	for _, mbox := range resp.List {
+		byID[mbox.ID] = mbox
+	}
+
+	names := make(map[string]string, len(resp.List))
+	for _, mbox := range resp.List {
+		names[mailboxName(mbox, byID)] = mbox.ID
+	}
+
+	c.mu.Lock()
+	c.mailboxes = names
+	c.mu.Unlock()
+
+	return resp.List, names, nil
+}
+
+// mailboxName returns the full name of mbox, the mailbox with the inbox role
+// is named INBOX like in IMAP.
+func mailboxName(mbox *jmapMailbox, byID map[string]*jmapMailbox) string {
+	var parts []string
+
+	// the depth limit protects against cycles in invalid server data
+	for i := 0; mbox != nil && i < 64; i++ {
+		if mbox.Role == roleInbox {
+			parts = append(parts, inboxName)
+		} else {
+			parts = append(parts, mbox.Name)
+		}
+
+		mbox = byID[mbox.ParentID]
+	}
+
+	var sb strings.Builder
+	for i := len(parts) - 1; i >= 0; i-- {
+		sb.WriteString(parts[i])
+		if i != 0 {
+			sb.WriteRune(delim)
+		}
+	}
+
+	return sb.String()
+}
+
+// mailboxID returns the ID of the mailbox with the given name.
+func (c *Client) mailboxID(name string) (string, error) {
+	if strings.EqualFold(name, inboxName) {
+		name = inboxName
+	}
+
+	c.mu.Lock()
+	id, ok := c.mailboxes[name]
+	c.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	_, names, err := c.fetchMailboxes()
+	if err != nil {
+		return "", err
+	}
+
+	if id, ok := names[name]; ok {
+		return id, nil
+	}
+
+	return "", fmt.Errorf("mailbox %q does not exist", name)
+}
+
+// Mailboxes returns all mailboxes of the account.
+// The roles of the mailboxes are returned as SPECIAL-USE attributes.
+func (c *Client) Mailboxes() ([]*imapclt.MailboxInfo, error) {
+	list, names, err := c.fetchMailboxes()
+	if err != nil {
+		return nil, fmt.Errorf("listing mailboxes failed: %w", err)
+	}
+
+	roles := make(map[string]string, len(list))
+	for _, mbox := range list {
+		roles[mbox.ID] = mbox.Role
+	}
+
+	result := make([]*imapclt.MailboxInfo, 0, len(names))
+	for name, id := range names {
+		info := imapclt.MailboxInfo{Name: name, Delim: delim}
+		if attr, ok := roleAttrs[roles[id]]; ok {
+			info.Attrs = []string{attr}
+		}
+
+		result = append(result, &info)
+	}
+
+	return result, nil
+}
+
+// CreateMailbox creates a mailbox, missing parent mailboxes are created too.
+func (c *Client) CreateMailbox(name string) error {
+	parts := strings.Split(name, string(delim))
+	if slices.Contains(parts, "") {
+		return fmt.Errorf("invalid mailbox name: %q", name)
+	}
+
+	_, names, err := c.fetchMailboxes()
+	if err != nil {
+		return fmt.Errorf("creating mailbox %q failed: %w", name, err)
+	}
+
+	var parentID any
+	for i := range parts {
+		path := strings.Join(parts[:i+1], string(delim))
+		if i == 0 && strings.EqualFold(path, inboxName) {
+			path = inboxName
+		}
+
+		if id, ok := names[path]; ok {
+			parentID = id
+			continue
+		}
+
+		id, err := c.createMailbox(parts[i], parentID)
+		if err != nil {
+			return fmt.Errorf("creating mailbox %q failed: %w", path, err)
+		}
+
+		c.mu.Lock()
+		c.mailboxes[path] = id
+		c.mu.Unlock()
+
+		c.logger.Info("created mailbox", lkMailbox, path, "event", "jmap.mailbox_created")
+
+		parentID = id
+	}
+
+	return nil
+}
+
+func (c *Client) createMailbox(name string, parentID any) (string, error) {
+	var resp setResponse
+
+	err := c.call("Mailbox/set", map[string]any{
+		"accountId": c.session.accountID,
+		"create": map[string]any{
+			"c0": map[string]any{"name": name, "parentId": parentID},
+		},
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+
+	if merr, ok := resp.NotCreated["c0"]; ok {
+		merr.Method = "Mailbox/set"
+		return "", merr
+	}
+
+	created, ok := resp.Created["c0"]
+	if !ok || created.ID == "" {
+		return "", errors.New("server did not return the id of the created mailbox")
+	}
+
+	return created.ID, nil
+}
@@ -0,0 +1,494 @@
+package jmap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+)
+
+// queryLimit is the number of email IDs that are requested per Email/query
+// call.
+const queryLimit = 256
+
+// systemKeywords maps IMAP system flags to JMAP keywords, RFC 8621 section
+// 4.1.1.
+var systemKeywords = map[string]string{
+	`\Seen`:     "$seen",
+	`\Flagged`:  "$flagged",
+	`\Answered`: "$answered",
+	`\Draft`:    "$draft",
+}
+
+type jmapEmail struct {
+	ID         string          `json:"id"`
+	BlobID     string          `json:"blobId"`
+	Keywords   map[string]bool `json:"keywords"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+	SentAt     *time.Time      `json:"sentAt"`
+	Subject    string          `json:"subject"`
+	From       []emailAddress  `json:"from"`
+	To         []emailAddress  `json:"to"`
+	Cc         []emailAddress  `json:"cc"`
+	Bcc        []emailAddress  `json:"bcc"`
+	MessageID  []string        `json:"messageId"`
+}
+
+type emailAddress struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+var emailProperties = []string{
+	"id", "blobId", "keywords", "receivedAt", "sentAt",
+	"subject", "from", "to", "cc", "bcc", "messageId",
+}
+
+// flagToKeyword returns the JMAP keyword of an IMAP flag.
+// ok is false for system flags that have no keyword, like \Recent.
+func flagToKeyword(flag string) (keyword string, ok bool) {
+	for f, kw := range systemKeywords {
+		if strings.EqualFold(f, flag) {
+			return kw, true
+		}
+	}
+
+	if strings.HasPrefix(flag, `\`) {
+		return "", false
+	}
+
+	// keywords are case-insensitive, servers return them in lowercase
+	return strings.ToLower(flag), true
+}
+
+func keywordToFlag(keyword string) string {
+	for f, kw := range systemKeywords {
+		if kw == keyword {
+			return f
+		}
+	}
+
+	return keyword
+}
+
+func flagsToKeywords(flags []string) map[string]bool {
+	result := make(map[string]bool, len(flags))
+	for _, f := range flags {
+		if kw, ok := flagToKeyword(f); ok {
+			result[kw] = true
+		}
+	}
+
+	return result
+}
+
+// Messages returns an iterator over the messages in mailbox, ordered by the
+// time they were received.
+// When an error happens a nil message and an error is passed via the yield
+// function.
+//
+// If state is nil, all messages in the mailbox are fetched.
+// Otherwise only messages with an UID higher than state.LastUID are fetched,
+// state is reset when its UIDValidity differs from the one of the client.
+func (c *Client) Messages(mailbox string, state *imapclt.SyncState) iter.Seq2[*imapclt.Message, error] {
+	return func(yield func(*imapclt.Message, error) bool) {
+		mboxID, err := c.mailboxID(mailbox)
+		if err != nil {
+			yield(nil, fmt.Errorf("selecting mailbox failed: %w", err))
+			return
+		}
+
+		ids, err := c.queryEmails(mboxID)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+
+		var minUID uint32
+
+		if state != nil {
+			if state.UIDValidity != c.uidValidity {
+				*state = imapclt.SyncState{UIDValidity: c.uidValidity}
+			}
+			minUID = state.LastUID + 1
+		}
+
+		c.mu.Lock()
+		c.selected = mboxID
+		newIDs := make([]string, 0, len(ids))
+		for _, id := range ids {
+			if c.assignUID(id) >= minUID {
+				newIDs = append(newIDs, id)
+			}
+		}
+		c.mu.Unlock()
+
+		for chunk := range slices.Chunk(newIDs, c.session.maxObjectsInGet) {
+			emails, err := c.getEmails(chunk)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			for _, email := range emails {
+				msg, err := c.readMessage(email)
+				if err != nil {
+					if !yield(nil, err) {
+						return
+					}
+					continue
+				}
+
+				if state != nil && msg.UID > state.LastUID {
+					state.LastUID = msg.UID
+				}
+
+				if !yield(msg, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// assignUID returns the UID of the email, a new one is assigned if it has
+// none.
+// c.mu must be held.
+func (c *Client) assignUID(id string) uint32 {
+	uid, ok := c.uids[id]
+	if !ok {
+		uid = c.nextUID
+		c.nextUID++
+		c.uids[id] = uid
+		c.emailIDs[uid] = id
+	}
+
+	return uid
+}
+
+func (c *Client) queryEmails(mboxID string) ([]string, error) {
+	var ids []string
+
+	for {
+		var resp struct {
+			IDs []string `json:"ids"`
+		}
+
+		err := c.call("Email/query", map[string]any{
+			"accountId": c.session.accountID,
+			"filter":    map[string]any{"inMailbox": mboxID},
+			"sort": []any{
+				map[string]any{"property": "receivedAt", "isAscending": true},
+			},
+			"position": len(ids),
+			"limit":    queryLimit,
+		}, &resp)
+		if err != nil {
+			return nil, fmt.Errorf("querying emails failed: %w", err)
+		}
+
+		ids = append(ids, resp.IDs...)
+
+		if len(resp.IDs) < queryLimit {
+			return ids, nil
+		}
+	}
+}
+
+func (c *Client) getEmails(ids []string) ([]*jmapEmail, error) {
+	var resp struct {
+		List []*jmapEmail `json:"list"`
+	}
+
+	err := c.call("Email/get", map[string]any{
+		"accountId":  c.session.accountID,
+		"ids":        ids,
+		"properties": emailProperties,
+	}, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("fetching emails failed: %w", err)
+	}
+
+	// the order of the list is unspecified
+	pos := make(map[string]int, len(ids))
+	for i, id := range ids {
+		pos[id] = i
+	}
+	slices.SortFunc(resp.List, func(a, b *jmapEmail) int {
+		return pos[a.ID] - pos[b.ID]
+	})
+
+	return resp.List, nil
+}
+
+func (c *Client) readMessage(email *jmapEmail) (*imapclt.Message, error) {
+	c.mu.Lock()
+	uid := c.uids[email.ID]
+	c.mu.Unlock()
+
+	data, err := c.download(email.BlobID)
+	if err != nil {
+		return nil, fmt.Errorf("downloading email %s failed: %w", email.ID, err)
+	}
+
+	if len(data) == 0 {
+		return nil, imapclt.NewErrMalformedMsg("message is empty", uid)
+	}
+
+	flags := make([]string, 0, len(email.Keywords))
+	for _, kw := range slices.Sorted(maps.Keys(email.Keywords)) {
+		if email.Keywords[kw] {
+			flags = append(flags, keywordToFlag(kw))
+		}
+	}
+
+	env := imapclt.Envelope{
+		Subject:    email.Subject,
+		From:       addresses(email.From),
+		Recipients: slices.Concat(addresses(email.To), addresses(email.Cc), addresses(email.Bcc)),
+	}
+	if email.SentAt != nil {
+		env.Date = *email.SentAt
+	}
+	if len(email.MessageID) > 0 {
+		env.MessageID = "<" + email.MessageID[0] + ">"
+	}
+
+	return &imapclt.Message{
+		UID:          uid,
+		Message:      bytes.NewReader(data),
+		Envelope:     env,
+		Flags:        flags,
+		InternalDate: email.ReceivedAt,
+	}, nil
+}
+
+func addresses(addrs []emailAddress) []string {
+	result := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		result = append(result, a.Email)
+	}
+
+	return result
+}
+
+func (c *Client) download(blobID string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	u := expandURL(c.session.DownloadURL, map[string]string{
+		"accountId": c.session.accountID,
+		"blobId":    blobID,
+		"name":      "message.eml",
+		"type":      "message/rfc822",
+	})
+
+	resp, err := c.do(ctx, http.MethodGet, u, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// lookupEmailIDs returns the email IDs of uids.
+func (c *Client) lookupEmailIDs(uids []uint32) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ids := make([]string, 0, len(uids))
+	for _, uid := range uids {
+		id, ok := c.emailIDs[uid]
+		if !ok {
+			return nil, fmt.Errorf("message with uid %d not found", uid)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// updateEmails applies patch to the emails with the given UIDs via
+// Email/set.
+func (c *Client) updateEmails(uids []uint32, patch map[string]any) error {
+	ids, err := c.lookupEmailIDs(uids)
+	if err != nil {
+		return err
+	}
+
+	for chunk := range slices.Chunk(ids, c.session.maxObjectsInSet) {
+		update := make(map[string]any, len(chunk))
+		for _, id := range chunk {
+			update[id] = patch
+		}
+
+		var resp setResponse
+
+		err := c.call("Email/set", map[string]any{
+			"accountId": c.session.accountID,
+			"update":    update,
+		}, &resp)
+		if err != nil {
+			return err
+		}
+
+		var errs []error
+		for id, merr := range resp.NotUpdated {
+			merr.Method = "Email/set"
+			errs = append(errs, fmt.Errorf("email %s: %w", id, merr))
+		}
+		if len(errs) != 0 {
+			return errors.Join(errs...)
+		}
+	}
+
+	return nil
+}
+
+// MarkSeen adds the $seen keyword to the messages.
+func (c *Client) MarkSeen(uids []uint32) error {
+	return c.AddFlags(uids, []string{`\Seen`})
+}
+
+// AddFlags adds flags to the messages, system flags are converted to their
+// keywords.
+func (c *Client) AddFlags(uids []uint32, flags []string) error {
+	patch := map[string]any{}
+	for kw := range flagsToKeywords(flags) {
+		patch["keywords/"+escapePointer(kw)] = true
+	}
+
+	if len(patch) == 0 || len(uids) == 0 {
+		return nil
+	}
+
+	if err := c.updateEmails(uids, patch); err != nil {
+		return fmt.Errorf("adding flags failed: %w", err)
+	}
+
+	return nil
+}
+
+// Move moves the messages from the mailbox that was last read via
+// [Client.Messages] to mailbox.
+func (c *Client) Move(uids []uint32, mailbox string) error {
+	if len(uids) == 0 {
+		return nil
+	}
+
+	dstID, err := c.mailboxID(mailbox)
+	if err != nil {
+		return fmt.Errorf("moving messages failed: %w", err)
+	}
+
+	c.mu.Lock()
+	srcID := c.selected
+	c.mu.Unlock()
+
+	if srcID == "" {
+		return errors.New("moving messages failed: no mailbox selected")
+	}
+
+	if srcID == dstID {
+		return nil
+	}
+
+	err = c.updateEmails(uids, map[string]any{
+		"mailboxIds/" + escapePointer(srcID): nil,
+		"mailboxIds/" + escapePointer(dstID): true,
+	})
+	if err != nil {
+		return fmt.Errorf("moving messages failed: %w", err)
+	}
+
+	return nil
+}
+
+// escapePointer escapes a key for a JSON pointer patch path, RFC 6901.
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// Upload uploads the message in the file at path as blob and imports it into
+// mailbox via Email/import.
+// ts is the receivedAt date of the message, flags are converted to keywords.
+func (c *Client) Upload(path, mailbox string, ts time.Time, flags []string) error {
+	mboxID, err := c.mailboxID(mailbox)
+	if err != nil {
+		return fmt.Errorf("uploading message failed: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("uploading message failed: %w", err)
+	}
+
+	blobID, err := c.uploadBlob(toCRLF(data))
+	if err != nil {
+		return fmt.Errorf("uploading message failed: %w", err)
+	}
+
+	var resp setResponse
+
+	err = c.call("Email/import", map[string]any{
+		"accountId": c.session.accountID,
+		"emails": map[string]any{
+			"i0": map[string]any{
+				"blobId":     blobID,
+				"mailboxIds": map[string]bool{mboxID: true},
+				"keywords":   flagsToKeywords(flags),
+				"receivedAt": ts.UTC().Format(time.RFC3339),
+			},
+		},
+	}, &resp)
+	if err != nil {
+		return fmt.Errorf("importing message failed: %w", err)
+	}
+
+	if merr, ok := resp.NotCreated["i0"]; ok {
+		merr.Method = "Email/import"
+		return fmt.Errorf("importing message failed: %w", merr)
+	}
+
+	c.logger.Debug("uploaded message", lkMailbox, mailbox)
+
+	return nil
+}
+
+func (c *Client) uploadBlob(data []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	u := expandURL(c.session.UploadURL, map[string]string{"accountId": c.session.accountID})
+
+	var resp struct {
+		BlobID string `json:"blobId"`
+	}
+	if err := c.doJSON(ctx, http.MethodPost, u, contentTypeHeader("message/rfc822"), data, &resp); err != nil {
+		return "", err
+	}
+
+	if resp.BlobID == "" {
+		return "", errors.New("server did not return a blob id")
+	}
+
+	return resp.BlobID, nil
+}
+
+// toCRLF converts the line endings of data to CRLF, RFC 5322 requires them
+// for the imported message.
+func toCRLF(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
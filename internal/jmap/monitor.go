@@ -0,0 +1,248 @@
+package jmap
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+)
+
+const (
+	defChanBufSiz = 1
+	// pingInterval is the interval in seconds in which the server sends
+	// ping events on the event source connection.
+	pingInterval   = 60
+	reconnectDelay = 10 * time.Second
+)
+
+// Monitor starts to monitor mailbox for new messages via the event source
+// push channel of the server (RFC 8620 section 7.3).
+// It behaves like [imapclt.Client.Monitor]: when the mailbox is not empty, an
+// event is sent immediately and the channel is closed.
+// Otherwise an event is sent when a state change of the emails of the account
+// is pushed and the mailbox is not empty afterwards, until the returned stop
+// function is called.
+// When the event source connection breaks, it is reestablished.
+func (c *Client) Monitor(mailbox string) (
+	_ <-chan *imapclt.EventNewMessages, _ func() error, _ error,
+) {
+	logger := c.logger.With(lkMailbox, mailbox)
+	logger.Debug("starting to monitor mailbox for changes")
+
+	mboxID, err := c.mailboxID(mailbox)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// the connection is established before the mailbox is checked, to
+	// not miss changes in between
+	resp, err := c.openEventSource(ctx)
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("connecting to jmap event source failed: %w", err)
+	}
+
+	ch := make(chan *imapclt.EventNewMessages, defChanBufSiz)
+
+	cnt, err := c.countEmails(mboxID)
+	if err != nil || cnt != 0 {
+		cancel()
+		_ = resp.Body.Close()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		logger.Debug("mailbox has new message, skipping monitoring",
+			"count", cnt,
+		)
+		sendEventNewMessages(ch, cnt)
+		close(ch)
+		return ch, func() error { return nil }, nil
+	}
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		c.watchEventSource(ctx, resp, mboxID, ch, logger)
+	})
+
+	return ch, func() error {
+		logger.Debug("stopping monitoring")
+		cancel()
+		wg.Wait()
+		close(ch)
+		return nil
+	}, nil
+}
+
+func (c *Client) openEventSource(ctx context.Context) (*http.Response, error) {
+	u := expandURL(c.session.EventSourceURL, map[string]string{
+		"types":      "Email",
+		"closeafter": "no",
+		"ping":       fmt.Sprint(pingInterval),
+	})
+
+	return c.do(ctx, http.MethodGet, u, http.Header{"Accept": []string{"text/event-stream"}}, nil)
+}
+
+func (c *Client) countEmails(mboxID string) (uint32, error) {
+	var resp struct {
+		List []*jmapMailbox `json:"list"`
+	}
+
+	err := c.call("Mailbox/get", map[string]any{
+		"accountId":  c.session.accountID,
+		"ids":        []string{mboxID},
+		"properties": []string{"id", "totalEmails"},
+	}, &resp)
+	if err != nil {
+		return 0, fmt.Errorf("retrieving mailbox status failed: %w", err)
+	}
+
+	if len(resp.List) != 1 {
+		return 0, fmt.Errorf("mailbox %s not found", mboxID)
+	}
+
+	return resp.List[0].TotalEmails, nil
+}
+
+// watchEventSource reads events from resp until ctx is canceled.
+// When the connection breaks it is reestablished.
+func (c *Client) watchEventSource(
+	ctx context.Context,
+	resp *http.Response,
+	mboxID string,
+	ch chan<- *imapclt.EventNewMessages,
+	logger *slog.Logger,
+) {
+	for {
+		err := readEvents(resp, func(event string, data []byte) {
+			if event != "state" || !c.emailsChanged(data) {
+				return
+			}
+
+			c.checkMailbox(mboxID, ch, logger)
+		})
+		_ = resp.Body.Close()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		logger.Warn("jmap event source connection was closed, reconnecting",
+			"event", "jmap.eventsource_disconnected",
+			"error", err,
+		)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(reconnectDelay):
+			}
+
+			resp, err = c.openEventSource(ctx)
+			if err == nil {
+				break
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			logger.Warn("connecting to jmap event source failed",
+				"event", "jmap.eventsource_connect_failed",
+				"error", err,
+			)
+		}
+
+		// changes could have been missed while being disconnected
+		c.checkMailbox(mboxID, ch, logger)
+	}
+}
+
+func (c *Client) checkMailbox(mboxID string, ch chan<- *imapclt.EventNewMessages, logger *slog.Logger) {
+	cnt, err := c.countEmails(mboxID)
+	if err != nil {
+		logger.Warn("checking mailbox for new messages failed", "error", err)
+		return
+	}
+
+	if cnt != 0 {
+		sendEventNewMessages(ch, cnt)
+	}
+}
+
+// emailsChanged returns true if data is a StateChange object that contains
+// an Email state change of the account.
+func (c *Client) emailsChanged(data []byte) bool {
+	var stateChange struct {
+		Changed map[string]map[string]string `json:"changed"`
+	}
+
+	if err := json.Unmarshal(data, &stateChange); err != nil {
+		c.logger.Debug("ignoring unparsable event source state change", "error", err)
+		return false
+	}
+
+	_, ok := stateChange.Changed[c.session.accountID]["Email"]
+	return ok
+}
+
+// readEvents reads server-sent events from resp and calls fn for each of
+// them, until the connection is closed.
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+func readEvents(resp *http.Response, fn func(event string, data []byte)) error {
+	var event string
+	var data strings.Builder
+
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+
+		if line == "" {
+			if data.Len() != 0 {
+				fn(cmp.Or(event, "message"), []byte(data.String()))
+			}
+			event = ""
+			data.Reset()
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			if data.Len() != 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+		}
+	}
+
+	return sc.Err()
+}
+
+func sendEventNewMessages(ch chan<- *imapclt.EventNewMessages, newMessages uint32) {
+	select {
+	case ch <- &imapclt.EventNewMessages{NewMsgCount: newMessages}:
+	default:
+	}
+}
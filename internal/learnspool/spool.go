@@ -0,0 +1,237 @@
+// Package learnspool stores learn requests that could not be sent to rspamd
+// in a directory, to send them later in the same order.
+package learnspool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+)
+
+const (
+	fileVersion = 1
+	fileSuffix  = ".json"
+)
+
+// Kind is the type of a learn request.
+type Kind string
+
+const (
+	KindHam  Kind = "ham"
+	KindSpam Kind = "spam"
+)
+
+// Item is a spooled learn request.
+type Item struct {
+	Kind      Kind                `json:"kind"`
+	Headers   *rspamc.MailHeaders `json:"headers"`
+	Message   []byte              `json:"message"`
+	SpooledAt time.Time           `json:"spooled_at"`
+}
+
+// errInvalidFile is returned when a spool file can not be parsed.
+var errInvalidFile = errors.New("invalid spool file")
+
+type fileContent struct {
+	Version int `json:"version"`
+	*Item
+}
+
+// Spool stores items as files in a directory.
+// The files are named by a sequence number, items are replayed in the order
+// they were added.
+type Spool struct {
+	dir    string
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	nextSeq uint64
+	// seqs are the sequence numbers of the spooled items in ascending
+	// order
+	seqs []uint64
+}
+
+// Open opens the spool in dir, the directory is created if it does not
+// exist.
+func Open(dir string, logger *slog.Logger) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating learn spool directory failed: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading learn spool directory failed: %w", err)
+	}
+
+	s := Spool{
+		dir:    dir,
+		logger: log.EnsureLoggerInstance(logger).With("filepath", dir),
+	}
+
+	for _, e := range entries {
+		seq, ok := parseFilename(e.Name())
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+
+		s.seqs = append(s.seqs, seq)
+	}
+
+	slices.Sort(s.seqs)
+	if len(s.seqs) > 0 {
+		s.nextSeq = s.seqs[len(s.seqs)-1] + 1
+	}
+
+	return &s, nil
+}
+
+func parseFilename(name string) (uint64, bool) {
+	numStr, ok := strings.CutSuffix(name, fileSuffix)
+	if !ok {
+		return 0, false
+	}
+
+	seq, err := strconv.ParseUint(numStr, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return seq, true
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, fileSuffix))
+}
+
+// Len returns the number of spooled items.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.seqs)
+}
+
+// Add appends item to the spool.
+// The file is written atomically.
+func (s *Spool) Add(item *Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item.SpooledAt.IsZero() {
+		item.SpooledAt = time.Now()
+	}
+
+	buf, err := json.Marshal(&fileContent{Version: fileVersion, Item: item})
+	if err != nil {
+		return err
+	}
+
+	seq := s.nextSeq
+	path := s.path(seq)
+
+	tmpFile, err := os.CreateTemp(s.dir, ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("creating temporary spool file failed: %w", err)
+	}
+
+	_, err = tmpFile.Write(buf)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	err = errors.Join(err, tmpFile.Close())
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return fmt.Errorf("writing spool file failed: %w", err)
+	}
+
+	s.nextSeq++
+	s.seqs = append(s.seqs, seq)
+
+	return nil
+}
+
+// Replay calls fn for the spooled items in the order they were added.
+// Items for which fn succeeded are removed from the spool. When fn returns an
+// error, replaying stops and the item remains in the spool.
+// It returns the number of removed items.
+func (s *Spool) Replay(fn func(*Item) error) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var cnt int
+
+	for len(s.seqs) > 0 {
+		path := s.path(s.seqs[0])
+
+		item, err := readItem(path)
+		if errors.Is(err, errInvalidFile) {
+			// the file is kept for inspection, it would block the
+			// spool otherwise
+			s.logger.Warn("skipping invalid learn spool file",
+				"event", "learnspool.invalid_file",
+				"error", err,
+			)
+			if err := os.Rename(path, path+".invalid"); err != nil {
+				return cnt, fmt.Errorf("renaming invalid spool file failed: %w", err)
+			}
+			s.seqs = s.seqs[1:]
+			continue
+		}
+		if err != nil {
+			return cnt, err
+		}
+
+		if err := fn(item); err != nil {
+			return cnt, err
+		}
+
+		if err := os.Remove(path); err != nil {
+			return cnt, fmt.Errorf("deleting spool file failed: %w", err)
+		}
+
+		s.seqs = s.seqs[1:]
+		cnt++
+	}
+
+	return cnt, nil
+}
+
+func readItem(path string) (*Item, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading spool file failed: %w", err)
+	}
+
+	var content fileContent
+	if err := json.Unmarshal(buf, &content); err != nil {
+		return nil, fmt.Errorf("%w: parsing %s failed: %w", errInvalidFile, path, err)
+	}
+
+	if content.Version != fileVersion {
+		return nil, fmt.Errorf("%w: %s has unsupported version %d", errInvalidFile, path, content.Version)
+	}
+
+	if content.Item == nil {
+		return nil, fmt.Errorf("%w: %s contains no item", errInvalidFile, path)
+	}
+
+	if content.Headers == nil {
+		content.Headers = &rspamc.MailHeaders{}
+	}
+
+	return content.Item, nil
+}
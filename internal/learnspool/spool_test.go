@@ -0,0 +1,87 @@
+package learnspool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestSpool_ReplayInOrder(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(dir, log.SlogTestLogger(t))
+	assert.NoError(t, err)
+
+	for _, subject := range []string{"first", "second", "third"} {
+		assert.NoError(t, s.Add(&Item{
+			Kind:    KindSpam,
+			Headers: &rspamc.MailHeaders{Subject: subject},
+			Message: []byte("mail " + subject),
+		}))
+	}
+	assert.Equal(t, 3, s.Len())
+
+	// items are persisted
+	s, err = Open(dir, log.SlogTestLogger(t))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, s.Len())
+
+	var subjects []string
+	errStop := errors.New("unavailable")
+	replayed, err := s.Replay(func(item *Item) error {
+		if item.Headers.Subject == "second" {
+			return errStop
+		}
+
+		assert.Equal(t, KindSpam, item.Kind)
+		assert.Equal(t, "mail "+item.Headers.Subject, string(item.Message))
+		subjects = append(subjects, item.Headers.Subject)
+		return nil
+	})
+	assert.Equal(t, true, errors.Is(err, errStop))
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, 2, s.Len())
+
+	assert.NoError(t, s.Add(&Item{Kind: KindHam, Headers: &rspamc.MailHeaders{Subject: "fourth"}}))
+
+	replayed, err = s.Replay(func(item *Item) error {
+		subjects = append(subjects, item.Headers.Subject)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, replayed)
+	assert.Equal(t, 0, s.Len())
+	assert.Equal(t, "first,second,third,fourth", strings.Join(subjects, ","))
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(entries))
+}
+
+func TestSpool_InvalidFileIsSkipped(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000000.json"), []byte("{"), 0o600))
+
+	s, err := Open(dir, log.SlogTestLogger(t))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Add(&Item{Kind: KindHam, Headers: &rspamc.MailHeaders{Subject: "valid"}}))
+	assert.Equal(t, 2, s.Len())
+
+	var subjects []string
+	replayed, err := s.Replay(func(item *Item) error {
+		subjects = append(subjects, item.Headers.Subject)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, "valid", strings.Join(subjects, ","))
+
+	_, err = os.Stat(filepath.Join(dir, "00000000000000000000.json.invalid"))
+	assert.NoError(t, err)
+}
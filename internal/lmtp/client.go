@@ -0,0 +1,189 @@
+// Package lmtp implements a client for delivering mails via the Local Mail
+// Transfer Protocol (RFC 2033).
+package lmtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+)
+
+const (
+	dialTimeout = 30 * time.Second
+	// cmdTimeout is the maximum duration of a delivery, including the
+	// transfer of the mail data.
+	cmdTimeout = 5 * time.Minute
+)
+
+// Client delivers mails to an LMTP server.
+// A new connection is established for every delivery.
+type Client struct {
+	network  string
+	address  string
+	hostname string
+	logger   *slog.Logger
+}
+
+type Config struct {
+	// Address is either "unix:" followed by the path of a unix socket or
+	// a TCP address in the form host:port.
+	Address string
+	// Hostname is sent in the LHLO command, if empty the hostname of the
+	// system is used.
+	Hostname string
+	Logger   *slog.Logger
+}
+
+// ErrRejected is returned when the LMTP server rejected a command.
+type ErrRejected struct {
+	Cmd  string
+	Code int
+	Msg  string
+}
+
+func (e *ErrRejected) Error() string {
+	return fmt.Sprintf("lmtp server rejected %s: %d %s", e.Cmd, e.Code, e.Msg)
+}
+
+// IsTemporary returns true if the server rejected the command with a
+// temporary (4xx) error.
+func (e *ErrRejected) IsTemporary() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+func NewClient(cfg *Config) (*Client, error) {
+	if cfg.Address == "" {
+		return nil, errors.New("lmtp address is empty")
+	}
+
+	network := "tcp"
+	address := cfg.Address
+	if path, ok := strings.CutPrefix(cfg.Address, "unix:"); ok {
+		network = "unix"
+		address = path
+	}
+
+	hostname := cfg.Hostname
+	if hostname == "" {
+		var err error
+		hostname, err = os.Hostname()
+		if err != nil || hostname == "" {
+			hostname = "localhost"
+		}
+	}
+
+	return &Client{
+		network:  network,
+		address:  address,
+		hostname: hostname,
+		logger:   log.EnsureLoggerInstance(cfg.Logger).With("lmtp.address", cfg.Address),
+	}, nil
+}
+
+// Deliver reads the mail from the file at path and delivers it to recipient.
+// The mail is sent with the null reverse-path (MAIL FROM:<>), to prevent
+// that bounces or vacation replies are sent to the original sender.
+func (c *Client) Deliver(ctx context.Context, path, recipient string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, cmdTimeout)
+	defer cancel()
+
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return fmt.Errorf("connecting to lmtp server failed: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	tc := textproto.NewConn(conn)
+
+	if _, _, err := tc.ReadResponse(220); err != nil {
+		return asRejectedErr("greeting", err)
+	}
+
+	if err := c.cmd(tc, 250, "LHLO", "LHLO %s", c.hostname); err != nil {
+		return err
+	}
+
+	if err := c.cmd(tc, 250, "MAIL", "MAIL FROM:<>"); err != nil {
+		return err
+	}
+
+	if err := c.cmd(tc, 250, "RCPT", "RCPT TO:<%s>", recipient); err != nil {
+		return err
+	}
+
+	if err := c.cmd(tc, 354, "DATA", "DATA"); err != nil {
+		return err
+	}
+
+	// DotWriter converts line endings to CRLF and escapes leading dots
+	w := tc.DotWriter()
+	if _, err := io.Copy(w, fd); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("sending mail data failed: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("sending mail data failed: %w", err)
+	}
+
+	// LMTP sends one response per recipient after the data
+	if _, _, err := tc.ReadResponse(250); err != nil {
+		return asRejectedErr("DATA", err)
+	}
+
+	if err := c.cmd(tc, 221, "QUIT", "QUIT"); err != nil {
+		c.logger.Debug("quitting lmtp session failed", "error", err)
+	}
+
+	c.logger.Debug("delivered mail via lmtp",
+		"event", "lmtp.mail_delivered",
+		"lmtp.recipient", recipient,
+		"filepath", path,
+	)
+
+	return nil
+}
+
+func (c *Client) cmd(tc *textproto.Conn, expectCode int, name, format string, args ...any) error {
+	id, err := tc.Cmd(format, args...)
+	if err != nil {
+		return fmt.Errorf("sending lmtp %s command failed: %w", name, err)
+	}
+
+	tc.StartResponse(id)
+	defer tc.EndResponse(id)
+
+	if _, _, err := tc.ReadResponse(expectCode); err != nil {
+		return asRejectedErr(name, err)
+	}
+
+	return nil
+}
+
+func asRejectedErr(cmd string, err error) error {
+	if protoErr, ok := errors.AsType[*textproto.Error](err); ok {
+		return &ErrRejected{Cmd: cmd, Code: protoErr.Code, Msg: protoErr.Msg}
+	}
+
+	return fmt.Errorf("reading lmtp %s response failed: %w", cmd, err)
+}
@@ -0,0 +1,72 @@
+package lmtp
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/lmtpserver"
+)
+
+const testMail = "Subject: test\n" +
+	"From: sender@example.com\n" +
+	"\n" +
+	"hello\n" +
+	".leading dot\n"
+
+func writeTestMail(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "mail.eml")
+	assert.NoError(t, os.WriteFile(path, []byte(testMail), 0o600))
+	return path
+}
+
+func TestDeliver(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		start func(*testing.T) *lmtpserver.Server
+	}{
+		{"tcp", lmtpserver.Start},
+		{"unix", lmtpserver.StartUnix},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := tc.start(t)
+
+			clt, err := NewClient(&Config{Address: srv.Address, Logger: log.SlogTestLogger(t)})
+			assert.NoError(t, err)
+
+			err = clt.Deliver(context.Background(), writeTestMail(t), "user@example.com")
+			assert.NoError(t, err)
+
+			msgs := srv.Messages()
+			assert.Equal(t, 1, len(msgs))
+			assert.Equal(t, "", msgs[0].Sender)
+			assert.Equal(t, 1, len(msgs[0].Recipients))
+			assert.Equal(t, "user@example.com", msgs[0].Recipients[0])
+			assert.Equal(t, strings.TrimSuffix(testMail, "\n"), msgs[0].Data)
+		})
+	}
+}
+
+func TestDeliver_RecipientRejected(t *testing.T) {
+	srv := lmtpserver.Start(t)
+	srv.RejectRecipient = "unknown@example.com"
+
+	clt, err := NewClient(&Config{Address: srv.Address, Logger: log.SlogTestLogger(t)})
+	assert.NoError(t, err)
+
+	err = clt.Deliver(context.Background(), writeTestMail(t), "unknown@example.com")
+	assert.Error(t, err)
+
+	errRejected, ok := errors.AsType[*ErrRejected](err)
+	if !ok {
+		t.Fatalf("expected ErrRejected, got: %s", err)
+	}
+	assert.Equal(t, "RCPT", errRejected.Cmd)
+	assert.Equal(t, 550, errRejected.Code)
+	assert.Equal(t, 0, len(srv.Messages()))
+}
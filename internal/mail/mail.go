@@ -36,7 +36,7 @@ func AsHeader(name, body string) ([]byte, error) {
 		return nil, errors.New("header name contains an invalid character")
 	}
 
-	bClean := strEmailHdrCharsOnly(body)
+	bClean := strEmailHdrBodyCharsOnly(body)
 	if len(bClean) != len(body) {
 		return nil, errors.New("header body contains an invalid character")
 	}
@@ -274,6 +274,69 @@ func replaceHeader(in io.Reader, out io.Writer, hdr Header) error {
 	return nil
 }
 
+// StripHeaders reads an email from in, removes the headers whose name starts
+// with prefix including their continuation lines and writes the result to
+// out. Names are compared case-insensitively, the body is copied unmodified.
+func StripHeaders(in io.Reader, out io.Writer, prefix string) error {
+	emailBr := bufio.NewReader(in)
+	tmpfileBw := bufio.NewWriter(out)
+
+	upperPrefix := []byte(strings.ToUpper(prefix))
+	skipContinuation := false
+
+	for {
+		line, err := emailBr.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF { //nolint:errorlint // errors.Is unnecessary here
+				return errors.New("header end not found")
+			}
+			return fmt.Errorf("reading email failed: %w", err)
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			if _, err := tmpfileBw.Write(line); err != nil {
+				return fmt.Errorf("writing failed: %w", err)
+			}
+			break
+		}
+
+		if skipContinuation && (line[0] == ' ' || line[0] == '\t') {
+			continue
+		}
+
+		skipContinuation = bytes.HasPrefix(bytes.ToUpper(line), upperPrefix)
+		if skipContinuation {
+			continue
+		}
+
+		if _, err := tmpfileBw.Write(line); err != nil {
+			return fmt.Errorf("copying data failed: %w", err)
+		}
+	}
+
+	if _, err := io.Copy(tmpfileBw, emailBr); err != nil {
+		return fmt.Errorf("copying email failed: %w", err)
+	}
+
+	if err := tmpfileBw.Flush(); err != nil {
+		return fmt.Errorf("flushing buffer failed: %w", err)
+	}
+
+	return nil
+}
+
+// strEmailHdrBodyCharsOnly removes all chars from s that are not printable
+// ASCII chars, spaces or tabs.
+func strEmailHdrBodyCharsOnly(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 32 && r <= 126) || r == '\t' {
+			return r
+		}
+
+		return -1
+	}, s)
+}
+
 // strEmailHdrCharsOnly removes all non-printable ASCII chars and colons from s
 func strEmailHdrCharsOnly(s string) string {
 	return strings.Map(func(r rune) rune {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/fho/rspamd-iscan/internal/testutils/mail"
@@ -87,3 +88,31 @@ func TestReplaceHeader(t *testing.T) {
 		t.Errorf("Got:\n%q\nExpected:\n%q\n", string(result), expected)
 	}
 }
+
+func TestStripHeaders(t *testing.T) {
+	const in = "From: someone@example.com\r\nX-Test-Score: 1\r\nSubject: test\r\nx-test-symbol: 1\r\n folded\r\n\tfolded\r\nTo: someone_else@example.com\r\n\r\nX-Test-Score: 2\r\n"
+	const expected = "From: someone@example.com\r\nSubject: test\r\nTo: someone_else@example.com\r\n\r\nX-Test-Score: 2\r\n"
+
+	var out bytes.Buffer
+	AssertNoErr(t, StripHeaders(strings.NewReader(in), &out, "X-Test-"))
+
+	if out.String() != expected {
+		t.Errorf("Got:\n%q\nExpected:\n%q\n", out.String(), expected)
+	}
+
+	AssertErr(t, StripHeaders(strings.NewReader("From: someone@example.com\r\n"), &out, "X-Test-"))
+}
+
+func TestAsHeader(t *testing.T) {
+	hdr, err := AsHeader("X-Symbol", "0.1 [example.com:+]")
+	AssertNoErr(t, err)
+	if string(hdr) != "X-Symbol: 0.1 [example.com:+]\r\n" {
+		t.Errorf("unexpected header: %q", hdr)
+	}
+
+	_, err = AsHeader("X-Symbol", "line1\r\nline2")
+	AssertErr(t, err)
+
+	_, err = AsHeader("X Symbol", "1")
+	AssertErr(t, err)
+}
@@ -0,0 +1,647 @@
+// Package maildir implements access to a local Maildir++ directory tree with
+// the same interface as the IMAP client in [imapclt].
+//
+// The root directory of the tree is the INBOX, other mailboxes are stored in
+// subdirectories of the root that start with a dot, the hierarchy delimiter
+// is ".", e.g. ".Spam" or ".Archive.2024".
+// Flags are stored in the info suffix of the message filenames, keywords are
+// mapped to letters via the dovecot-keywords file of the mailbox.
+//
+// Message files are stored with LF line endings, like delivery agents do.
+// Messages are returned with CRLF line endings, like by IMAP servers.
+//
+// Maildir messages do not have UIDs, the client assigns UIDs when it reads a
+// mailbox. They are only valid as long as the client exists, every client
+// uses a different UIDVALIDITY.
+package maildir
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"iter"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/log"
+)
+
+const (
+	inboxName = "INBOX"
+	delim     = '.'
+
+	dirTmp = "tmp"
+	dirNew = "new"
+	dirCur = "cur"
+
+	lkMailbox = "maildir.mailbox"
+)
+
+// deliveryCounter makes unique filenames of messages that are stored in
+// the same microsecond unique.
+var deliveryCounter atomic.Uint64
+
+type Client struct {
+	root        string
+	uidValidity uint32
+	hostname    string
+	logger      *slog.Logger
+
+	mu        sync.Mutex
+	mailboxes map[string]*mailbox
+	selected  *mailbox
+}
+
+type Config struct {
+	// Path is the root directory of the Maildir++ tree.
+	Path   string
+	Logger *slog.Logger
+}
+
+// mailbox is a maildir with the UIDs the client assigned to its messages.
+type mailbox struct {
+	name string
+	dir  string
+
+	nextUID uint32
+	// uids maps the unique names of the message files to their UIDs.
+	uids map[string]uint32
+	// files maps UIDs to the paths of the message files relative to dir.
+	files map[uint32]string
+}
+
+// NewClient creates a new Maildir client.
+// [*Client.Connect] must be called before any other methods.
+func NewClient(cfg *Config) *Client {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+
+	return &Client{
+		root: cfg.Path,
+		// UIDs are not persisted, a new UIDVALIDITY invalidates the
+		// sync states of previous clients
+		uidValidity: uint32(time.Now().UnixNano()) | 1,
+		// "/" and ":" are not allowed in unique names
+		hostname:  strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname),
+		logger:    log.EnsureLoggerInstance(cfg.Logger).With("maildir.path", cfg.Path),
+		mailboxes: map[string]*mailbox{},
+	}
+}
+
+// Connect verifies that the root directory is a maildir.
+func (c *Client) Connect() error {
+	if !isMaildir(c.root) {
+		return fmt.Errorf("%s is not a maildir, it must contain the directories cur, new and tmp", c.root)
+	}
+
+	c.logger.Info("opened maildir", "event", "maildir.opened")
+
+	return nil
+}
+
+// Close does nothing, it exists to implement the same interface as the IMAP
+// client.
+func (*Client) Close() error {
+	return nil
+}
+
+func isMaildir(dir string) bool {
+	for _, sub := range []string{dirCur, dirNew, dirTmp} {
+		fi, err := os.Stat(filepath.Join(dir, sub))
+		if err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *Client) mailboxDir(name string) (string, error) {
+	if strings.EqualFold(name, inboxName) {
+		return c.root, nil
+	}
+
+	if name == "" || strings.ContainsAny(name, "/\x00") || strings.HasPrefix(name, ".") ||
+		strings.HasSuffix(name, ".") || strings.Contains(name, "..") {
+		return "", fmt.Errorf("invalid mailbox name: %q", name)
+	}
+
+	return filepath.Join(c.root, "."+name), nil
+}
+
+// mailbox returns the mailbox with the given name.
+// c.mu must be held.
+func (c *Client) mailbox(name string) (*mailbox, error) {
+	dir, err := c.mailboxDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if mbox, ok := c.mailboxes[dir]; ok {
+		return mbox, nil
+	}
+
+	if !isMaildir(dir) {
+		return nil, fmt.Errorf("mailbox %q does not exist", name)
+	}
+
+	mbox := mailbox{
+		name:    name,
+		dir:     dir,
+		nextUID: 1,
+		uids:    map[string]uint32{},
+		files:   map[uint32]string{},
+	}
+	c.mailboxes[dir] = &mbox
+
+	return &mbox, nil
+}
+
+// Mailboxes returns all mailboxes in the maildir tree.
+func (c *Client) Mailboxes() ([]*imapclt.MailboxInfo, error) {
+	entries, err := os.ReadDir(c.root)
+	if err != nil {
+		return nil, fmt.Errorf("listing mailboxes failed: %w", err)
+	}
+
+	result := []*imapclt.MailboxInfo{{Name: inboxName, Delim: delim}}
+
+	for _, e := range entries {
+		name, ok := strings.CutPrefix(e.Name(), ".")
+		if !ok || name == "" || name == "." || !e.IsDir() {
+			continue
+		}
+
+		if !isMaildir(filepath.Join(c.root, e.Name())) {
+			continue
+		}
+
+		result = append(result, &imapclt.MailboxInfo{Name: name, Delim: delim})
+	}
+
+	return result, nil
+}
+
+// CreateMailbox creates a mailbox.
+func (c *Client) CreateMailbox(name string) error {
+	dir, err := c.mailboxDir(name)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range []string{dirCur, dirNew, dirTmp} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return fmt.Errorf("creating mailbox %q failed: %w", name, err)
+		}
+	}
+
+	// marks the directory as Maildir++ subfolder for delivery agents
+	err = os.WriteFile(filepath.Join(dir, "maildirfolder"), nil, 0o600)
+	if err != nil {
+		return fmt.Errorf("creating mailbox %q failed: %w", name, err)
+	}
+
+	c.logger.Info("created mailbox", lkMailbox, name, "event", "maildir.mailbox_created")
+
+	return nil
+}
+
+// scan reads the message files of the mailbox and assigns UIDs to new ones.
+// It returns the UIDs of all messages in ascending order.
+// c.mu must be held.
+func (m *mailbox) scan() ([]uint32, error) {
+	var names []string
+
+	for _, sub := range []string{dirNew, dirCur} {
+		entries, err := os.ReadDir(filepath.Join(m.dir, sub))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			names = append(names, filepath.Join(sub, e.Name()))
+		}
+	}
+
+	// unique names start with the delivery timestamp, sorting them
+	// assigns UIDs in delivery order
+	slices.SortFunc(names, func(a, b string) int {
+		return strings.Compare(filepath.Base(a), filepath.Base(b))
+	})
+
+	seen := make(map[string]struct{}, len(names))
+	uids := make([]uint32, 0, len(names))
+	files := make(map[uint32]string, len(names))
+
+	for _, name := range names {
+		key, _ := splitFilename(filepath.Base(name))
+		if _, exists := seen[key]; exists {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		uid, ok := m.uids[key]
+		if !ok {
+			uid = m.nextUID
+			m.nextUID++
+			m.uids[key] = uid
+		}
+
+		files[uid] = name
+		uids = append(uids, uid)
+	}
+
+	for key := range m.uids {
+		if _, exists := seen[key]; !exists {
+			delete(m.uids, key)
+		}
+	}
+
+	m.files = files
+	slices.Sort(uids)
+
+	return uids, nil
+}
+
+// file returns the path of the message file with the given UID.
+// c.mu must be held.
+func (m *mailbox) file(uid uint32) (string, error) {
+	name, ok := m.files[uid]
+	if ok {
+		if _, err := os.Stat(filepath.Join(m.dir, name)); err == nil {
+			return name, nil
+		}
+	}
+
+	// the file might have been renamed by another program, e.g. because
+	// its flags changed
+	if _, err := m.scan(); err != nil {
+		return "", err
+	}
+
+	name, ok = m.files[uid]
+	if !ok {
+		return "", fmt.Errorf("message with uid %d does not exist in mailbox %q", uid, m.name)
+	}
+
+	return name, nil
+}
+
+// Messages returns an iterator over the messages in mailbox.
+// It behaves like [imapclt.Client.Messages], the mailbox becomes the
+// selected mailbox.
+// HighestModSeq of state is not used.
+func (c *Client) Messages(mailbox string, state *imapclt.SyncState) iter.Seq2[*imapclt.Message, error] {
+	return func(yield func(*imapclt.Message, error) bool) {
+		logger := c.logger.With(lkMailbox, mailbox)
+
+		c.mu.Lock()
+		mbox, err := c.mailbox(mailbox)
+		if err != nil {
+			c.mu.Unlock()
+			yield(nil, fmt.Errorf("selecting mailbox failed: %w", err))
+			return
+		}
+		c.selected = mbox
+
+		uids, err := mbox.scan()
+		if err != nil {
+			c.mu.Unlock()
+			yield(nil, fmt.Errorf("reading mailbox failed: %w", err))
+			return
+		}
+
+		kw, err := loadKeywords(mbox.dir)
+		if err != nil {
+			c.mu.Unlock()
+			yield(nil, fmt.Errorf("reading keywords failed: %w", err))
+			return
+		}
+
+		files := make(map[uint32]string, len(uids))
+		for _, uid := range uids {
+			files[uid] = mbox.files[uid]
+		}
+		c.mu.Unlock()
+
+		if state != nil && state.UIDValidity != c.uidValidity {
+			*state = imapclt.SyncState{UIDValidity: c.uidValidity}
+		}
+
+		if len(uids) == 0 {
+			logger.Debug("mailbox is empty", "event", "imap.mailbox_empty")
+			return
+		}
+
+		for _, uid := range uids {
+			if state != nil {
+				if uid <= state.LastUID {
+					continue
+				}
+				state.LastUID = uid
+			}
+
+			msg, err := c.readMessage(mbox.dir, files[uid], uid, kw)
+			if errors.Is(err, fs.ErrNotExist) {
+				// the message was moved or deleted by another
+				// program in the meantime
+				continue
+			}
+
+			if !yield(msg, err) {
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) readMessage(dir, name string, uid uint32, kw *keywords) (*imapclt.Message, error) {
+	path := filepath.Join(dir, name)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return nil, imapclt.NewErrMalformedMsg("message file is empty", uid)
+	}
+
+	env, err := parseEnvelope(data)
+	if err != nil {
+		return nil, imapclt.NewErrMalformedMsg(err.Error(), uid)
+	}
+
+	_, letters := splitFilename(filepath.Base(name))
+
+	c.logger.Debug("read message",
+		"mail.subject", env.Subject,
+		"mail.uid", uid,
+		"filepath", path,
+	)
+
+	return &imapclt.Message{
+		UID:      uid,
+		Message:  bytes.NewReader(toCRLF(data)),
+		Envelope: *env,
+		Flags:    kw.parseFlags(letters),
+		// delivery agents set the modification time to the time of
+		// delivery
+		InternalDate: fi.ModTime(),
+	}, nil
+}
+
+// Move moves the messages with the given uids from the currently selected
+// mailbox to mailbox.
+// Messages in the new directory are moved to the new directory of mailbox,
+// the flags of other messages are preserved.
+func (c *Client) Move(uids []uint32, mailbox string) error {
+	if len(uids) == 0 {
+		return errors.New("no uids were given")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	src := c.selected
+	if src == nil {
+		return errors.New("no mailbox is selected")
+	}
+
+	dest, err := c.mailbox(mailbox)
+	if err != nil {
+		return err
+	}
+
+	srcKw, err := loadKeywords(src.dir)
+	if err != nil {
+		return fmt.Errorf("reading keywords failed: %w", err)
+	}
+
+	destKw, err := loadKeywords(dest.dir)
+	if err != nil {
+		return fmt.Errorf("reading keywords failed: %w", err)
+	}
+
+	for _, uid := range uids {
+		name, err := src.file(uid)
+		if err != nil {
+			return err
+		}
+
+		// keyword letters differ between mailboxes
+		key, letters := splitFilename(filepath.Base(name))
+		destName := filepath.Join(filepath.Dir(name), key)
+		if filepath.Dir(name) == dirCur {
+			destLetters, err := destKw.formatFlags(srcKw.parseFlags(letters))
+			if err != nil {
+				return err
+			}
+			destName += infoSeparator + destLetters
+		}
+
+		err = os.Rename(filepath.Join(src.dir, name), filepath.Join(dest.dir, destName))
+		if err != nil {
+			return fmt.Errorf("moving message failed: %w", err)
+		}
+
+		delete(src.files, uid)
+		delete(src.uids, key)
+	}
+
+	c.logger.Debug(
+		"moved messages",
+		lkMailbox, mailbox,
+		"count", len(uids),
+		"event", "imap.messages_moved",
+	)
+
+	return nil
+}
+
+// MarkSeen adds the \Seen flag to the messages with the given UIDs in the
+// currently selected mailbox.
+func (c *Client) MarkSeen(uids []uint32) error {
+	if err := c.AddFlags(uids, []string{`\Seen`}); err != nil {
+		return fmt.Errorf("marking messages as seen failed: %w", err)
+	}
+
+	return nil
+}
+
+// AddFlags adds flags to the messages with the given UIDs in the currently
+// selected mailbox.
+// Messages in the new directory are moved to the cur directory.
+func (c *Client) AddFlags(uids []uint32, flags []string) error {
+	if len(uids) == 0 {
+		return errors.New("no uids were given")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mbox := c.selected
+	if mbox == nil {
+		return errors.New("no mailbox is selected")
+	}
+
+	kw, err := loadKeywords(mbox.dir)
+	if err != nil {
+		return fmt.Errorf("reading keywords failed: %w", err)
+	}
+
+	for _, uid := range uids {
+		name, err := mbox.file(uid)
+		if err != nil {
+			return err
+		}
+
+		key, letters := splitFilename(filepath.Base(name))
+		newLetters, err := kw.formatFlags(append(kw.parseFlags(letters), flags...))
+		if err != nil {
+			return err
+		}
+
+		newName := filepath.Join(dirCur, key+infoSeparator+newLetters)
+		if newName == name {
+			continue
+		}
+
+		if err := os.Rename(filepath.Join(mbox.dir, name), filepath.Join(mbox.dir, newName)); err != nil {
+			return fmt.Errorf("renaming message file failed: %w", err)
+		}
+
+		mbox.files[uid] = newName
+	}
+
+	c.logger.Debug(
+		"added flags to messages",
+		"count", len(uids),
+		"event", "imap.messages_flags_added",
+		"imap.flags", flags,
+	)
+
+	return nil
+}
+
+// Upload stores the message in the file at path in mailbox.
+// The message is written to the tmp directory and then renamed, to the new
+// directory or when flags are given to the cur directory.
+// The modification time of the file is set to ts.
+func (c *Client) Upload(path, mailbox string, ts time.Time, flags []string) error {
+	dir, err := c.mailboxDir(mailbox)
+	if err != nil {
+		return err
+	}
+
+	if !isMaildir(dir) {
+		return fmt.Errorf("mailbox %q does not exist", mailbox)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	kw, err := loadKeywords(dir)
+	var letters string
+	if err == nil {
+		letters, err = kw.formatFlags(flags)
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("storing flags failed: %w", err)
+	}
+
+	key := c.uniqueName()
+	tmpPath := filepath.Join(dir, dirTmp, key)
+
+	destPath := filepath.Join(dir, dirNew, key)
+	if letters != "" {
+		destPath = filepath.Join(dir, dirCur, key+infoSeparator+letters)
+	}
+
+	if err := writeMessageFile(tmpPath, toLF(data), ts); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("writing message to maildir failed: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("moving message to maildir failed: %w", err)
+	}
+
+	c.logger.Debug(
+		"stored message in maildir",
+		lkMailbox, mailbox,
+		"event", "imap.message_uploaded",
+		"filepath", path,
+		"imap.flags", flags,
+	)
+
+	return nil
+}
+
+func writeMessageFile(path string, data []byte, ts time.Time) error {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if ts.IsZero() {
+		return nil
+	}
+
+	return os.Chtimes(path, ts, ts)
+}
+
+// uniqueName returns a unique filename for a new message, in the format
+// described in https://cr.yp.to/proto/maildir.html
+func (c *Client) uniqueName() string {
+	now := time.Now()
+
+	return strconv.FormatInt(now.Unix(), 10) +
+		".M" + strconv.Itoa(now.Nanosecond()/1000) +
+		"P" + strconv.Itoa(os.Getpid()) +
+		"Q" + strconv.FormatUint(deliveryCounter.Add(1), 10) +
+		"." + c.hostname
+}
+
+func toLF(data []byte) []byte {
+	return bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+}
+
+func toCRLF(data []byte) []byte {
+	return bytes.ReplaceAll(toLF(data), []byte("\n"), []byte("\r\n"))
+}
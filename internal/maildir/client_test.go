@@ -0,0 +1,187 @@
+package maildir
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+	"github.com/fho/rspamd-iscan/internal/testutils/mail"
+)
+
+func newTestClient(t *testing.T, mailboxes ...string) *Client {
+	root := t.TempDir()
+	for _, sub := range []string{dirCur, dirNew, dirTmp} {
+		assert.NoError(t, os.Mkdir(filepath.Join(root, sub), 0o700))
+	}
+
+	clt := NewClient(&Config{Path: root, Logger: log.SlogTestLogger(t)})
+	assert.NoError(t, clt.Connect())
+
+	for _, mbox := range mailboxes {
+		assert.NoError(t, clt.CreateMailbox(mbox))
+	}
+
+	return clt
+}
+
+func messages(t *testing.T, clt *Client, mailbox string) []*imapclt.Message {
+	var result []*imapclt.Message
+
+	for msg, err := range clt.Messages(mailbox, nil) {
+		assert.NoError(t, err)
+		result = append(result, msg)
+	}
+
+	return result
+}
+
+func dirEntries(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+
+	result := make([]string, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, e.Name())
+	}
+
+	return result
+}
+
+func TestUploadAndMessages(t *testing.T) {
+	clt := newTestClient(t)
+	ts := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), "INBOX", ts, nil))
+	assert.NoError(t, clt.Upload(mail.TestSpamMailPath(t), "INBOX", ts, []string{`\Flagged`, "$Junk"}))
+
+	// messages without flags are stored in new, others in cur
+	assert.Equal(t, 1, len(dirEntries(t, filepath.Join(clt.root, dirNew))))
+	cur := dirEntries(t, filepath.Join(clt.root, dirCur))
+	assert.Equal(t, 1, len(cur))
+	if !strings.HasSuffix(cur[0], ":2,Fa") {
+		t.Errorf("unexpected filename of message with flags: %s", cur[0])
+	}
+	assert.Equal(t, 0, len(dirEntries(t, filepath.Join(clt.root, dirTmp))))
+
+	msgs := messages(t, clt, "INBOX")
+	assert.Equal(t, 2, len(msgs))
+
+	subjects := []string{msgs[0].Envelope.Subject, msgs[1].Envelope.Subject}
+	if !slices.Contains(subjects, mail.HamMailSubject) || !slices.Contains(subjects, mail.SpamMailSubject) {
+		t.Errorf("unexpected subjects: %v", subjects)
+	}
+
+	for _, msg := range msgs {
+		if !msg.InternalDate.Equal(ts) {
+			t.Errorf("internal date is %s, expected %s", msg.InternalDate, ts)
+		}
+
+		if msg.Envelope.Subject == mail.SpamMailSubject {
+			assert.Equal(t, 2, len(msg.Flags))
+			assert.Equal(t, `\Flagged`, msg.Flags[0])
+			assert.Equal(t, "$Junk", msg.Flags[1])
+		} else {
+			assert.Equal(t, 0, len(msg.Flags))
+		}
+	}
+}
+
+func TestMessages_SyncState(t *testing.T) {
+	clt := newTestClient(t)
+
+	assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), "INBOX", time.Now(), nil))
+
+	var state imapclt.SyncState
+	cnt := 0
+	for _, err := range clt.Messages("INBOX", &state) {
+		assert.NoError(t, err)
+		cnt++
+	}
+	assert.Equal(t, 1, cnt)
+	assert.Equal(t, clt.uidValidity, state.UIDValidity)
+
+	assert.NoError(t, clt.Upload(mail.TestSpamMailPath(t), "INBOX", time.Now(), nil))
+
+	var uids []uint32
+	for msg, err := range clt.Messages("INBOX", &state) {
+		assert.NoError(t, err)
+		uids = append(uids, msg.UID)
+	}
+	assert.Equal(t, 1, len(uids))
+	assert.Equal(t, uids[0], state.LastUID)
+}
+
+func TestMoveAndAddFlags(t *testing.T) {
+	clt := newTestClient(t, "Spam")
+
+	assert.NoError(t, clt.Upload(mail.TestHamMailPath(t), "INBOX", time.Now(), []string{"$Label1"}))
+	assert.NoError(t, clt.Upload(mail.TestSpamMailPath(t), "INBOX", time.Now(), nil))
+
+	msgs := messages(t, clt, "INBOX")
+	assert.Equal(t, 2, len(msgs))
+
+	assert.NoError(t, clt.MarkSeen([]uint32{msgs[1].UID}))
+	assert.NoError(t, clt.AddFlags([]uint32{msgs[0].UID, msgs[1].UID}, []string{"$Junk"}))
+	assert.NoError(t, clt.Move([]uint32{msgs[0].UID, msgs[1].UID}, "Spam"))
+
+	assert.Equal(t, 0, len(messages(t, clt, "INBOX")))
+
+	// keywords are remapped to the letters of the destination mailbox
+	msgs = messages(t, clt, "Spam")
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, "$Label1,$Junk", strings.Join(msgs[0].Flags, ","))
+	assert.Equal(t, `\Seen,$Junk`, strings.Join(msgs[1].Flags, ","))
+}
+
+func TestMailboxes(t *testing.T) {
+	clt := newTestClient(t, "Spam", "Archive.2024")
+
+	mailboxes, err := clt.Mailboxes()
+	assert.NoError(t, err)
+
+	var names []string
+	for _, mbox := range mailboxes {
+		names = append(names, mbox.Name)
+		assert.Equal(t, '.', mbox.Delim)
+	}
+	slices.Sort(names)
+	assert.Equal(t, "Archive.2024,INBOX,Spam", strings.Join(names, ","))
+
+	assert.Error(t, clt.CreateMailbox("../escape"))
+	assert.Error(t, clt.Upload(mail.TestHamMailPath(t), "Missing", time.Now(), nil))
+}
+
+func TestMonitor(t *testing.T) {
+	clt := newTestClient(t)
+
+	ch, stop, err := clt.Monitor("INBOX")
+	assert.NoError(t, err)
+
+	clt2 := NewClient(&Config{Path: clt.root, Logger: log.SlogTestLogger(t)})
+	assert.NoError(t, clt2.Upload(mail.TestHamMailPath(t), "INBOX", time.Now(), nil))
+
+	select {
+	case ev := <-ch:
+		assert.Equal(t, 1, ev.NewMsgCount)
+	case <-time.After(15 * time.Second):
+		t.Fatal("no event received")
+	}
+
+	assert.NoError(t, stop())
+
+	_, ok := <-ch
+	assert.Equal(t, false, ok)
+
+	// the mailbox is not empty, the event is sent immediately
+	ch, stop, err = clt.Monitor("INBOX")
+	assert.NoError(t, err)
+	ev := <-ch
+	assert.Equal(t, 1, ev.NewMsgCount)
+	assert.NoError(t, stop())
+}
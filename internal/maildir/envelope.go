@@ -0,0 +1,59 @@
+package maildir
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"slices"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+)
+
+var wordDecoder = mime.WordDecoder{}
+
+// parseEnvelope parses the header of the mail in data.
+// Address lists that can not be parsed are ignored, like IMAP servers do when
+// they build the envelope.
+func parseEnvelope(data []byte) (*imapclt.Envelope, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("parsing mail header failed: %w", err)
+	}
+
+	hdr := msg.Header
+
+	subject, err := wordDecoder.DecodeHeader(hdr.Get("Subject"))
+	if err != nil {
+		subject = hdr.Get("Subject")
+	}
+
+	// the date is zero when the header is missing or invalid
+	date, _ := hdr.Date()
+
+	return &imapclt.Envelope{
+		Date:    date,
+		Subject: subject,
+		From:    addresses(hdr, "From"),
+		Recipients: slices.Concat(
+			addresses(hdr, "To"),
+			addresses(hdr, "Cc"),
+			addresses(hdr, "Bcc"),
+		),
+		MessageID: hdr.Get("Message-Id"),
+	}, nil
+}
+
+func addresses(hdr mail.Header, key string) []string {
+	addrs, err := hdr.AddressList(key)
+	if err != nil {
+		return nil
+	}
+
+	result := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		result = append(result, a.Address)
+	}
+
+	return result
+}
@@ -0,0 +1,204 @@
+package maildir
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// infoSeparator separates the unique name of a message file from its
+	// info suffix, e.g. "1700000000.M1P2.host:2,FS".
+	infoSeparator = ":2,"
+	// keywordsFile maps the lowercase letters in the info suffix to
+	// keywords, in the format used by Dovecot.
+	keywordsFile = "dovecot-keywords"
+	maxKeywords  = 26
+)
+
+// systemFlags maps the letters of the info suffix to IMAP system flags,
+// https://cr.yp.to/proto/maildir.html
+var systemFlags = map[byte]string{
+	'D': `\Draft`,
+	'F': `\Flagged`,
+	'P': "$Forwarded",
+	'R': `\Answered`,
+	'S': `\Seen`,
+	'T': `\Deleted`,
+}
+
+// splitFilename splits the name of a message file into its unique name and
+// the flag letters of its info suffix.
+func splitFilename(name string) (key, flagLetters string) {
+	key, flagLetters, _ = strings.Cut(name, infoSeparator)
+	return key, flagLetters
+}
+
+// keywords maps the keywords of a mailbox to the letters a-z.
+type keywords struct {
+	path    string
+	names   [maxKeywords]string
+	written bool
+}
+
+func loadKeywords(mailboxDir string) (*keywords, error) {
+	kw := keywords{path: filepath.Join(mailboxDir, keywordsFile)}
+
+	fd, err := os.Open(kw.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &kw, nil
+		}
+		return nil, err
+	}
+	defer fd.Close()
+
+	sc := bufio.NewScanner(fd)
+	for sc.Scan() {
+		idxStr, name, ok := strings.Cut(sc.Text(), " ")
+		if !ok {
+			continue
+		}
+
+		idx, err := strconv.Atoi(idxStr)
+		if err != nil || idx < 0 || idx >= maxKeywords {
+			continue
+		}
+
+		kw.names[idx] = name
+	}
+
+	return &kw, sc.Err()
+}
+
+// letter returns the letter of keyword name.
+// If the keyword is unknown and create is true, it is added and the
+// keywords file is written.
+func (k *keywords) letter(name string, create bool) (byte, bool, error) {
+	free := -1
+
+	for i, n := range k.names {
+		if strings.EqualFold(n, name) {
+			return 'a' + byte(i), true, nil
+		}
+
+		if n == "" && free == -1 {
+			free = i
+		}
+	}
+
+	if !create {
+		return 0, false, nil
+	}
+
+	if free == -1 {
+		return 0, false, fmt.Errorf("keyword %q can not be stored, all %d keyword slots are in use", name, maxKeywords)
+	}
+
+	k.names[free] = name
+	if err := k.write(); err != nil {
+		return 0, false, err
+	}
+
+	return 'a' + byte(free), true, nil
+}
+
+func (k *keywords) write() error {
+	var sb strings.Builder
+	for i, n := range k.names {
+		if n != "" {
+			fmt.Fprintf(&sb, "%d %s\n", i, n)
+		}
+	}
+
+	return writeFileAtomic(k.path, []byte(sb.String()))
+}
+
+// parseFlags returns the IMAP flags of the letters of an info suffix.
+func (k *keywords) parseFlags(letters string) []string {
+	result := make([]string, 0, len(letters))
+
+	for i := range len(letters) {
+		l := letters[i]
+
+		if f, ok := systemFlags[l]; ok {
+			result = append(result, f)
+			continue
+		}
+
+		if l >= 'a' && l <= 'z' {
+			if n := k.names[l-'a']; n != "" {
+				result = append(result, n)
+			}
+		}
+	}
+
+	return result
+}
+
+// formatFlags returns the sorted letters of an info suffix for flags.
+// Unknown keywords are added to the keywords file.
+func (k *keywords) formatFlags(flags []string) (string, error) {
+	letters := make([]byte, 0, len(flags))
+
+	for _, f := range flags {
+		if l, ok := systemFlagLetter(f); ok {
+			letters = append(letters, l)
+			continue
+		}
+
+		// \Recent and other system flags can not be stored
+		if strings.HasPrefix(f, `\`) {
+			continue
+		}
+
+		l, _, err := k.letter(f, true)
+		if err != nil {
+			return "", err
+		}
+		letters = append(letters, l)
+	}
+
+	// the letters must be sorted in ASCII order
+	slices.Sort(letters)
+
+	return string(slices.Compact(letters)), nil
+}
+
+func systemFlagLetter(flag string) (byte, bool) {
+	for l, f := range systemFlags {
+		if strings.EqualFold(f, flag) {
+			return l, true
+		}
+	}
+
+	return 0, false
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path.
+func writeFileAtomic(path string, data []byte) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if cerr := tmpFile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+	}
+
+	return err
+}
@@ -0,0 +1,65 @@
+package maildir
+
+import (
+	"path/filepath"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+)
+
+const defChanBufSiz = 1
+
+// Monitor starts to monitor mailbox for new messages.
+// It behaves like [imapclt.Client.Monitor]: when the mailbox is not empty, an
+// event is sent immediately and the channel is closed.
+// Otherwise events are sent when message files are added to the new or cur
+// directory of the mailbox, until the returned stop function is called.
+func (c *Client) Monitor(mailbox string) (
+	_ <-chan *imapclt.EventNewMessages, _ func() error, _ error,
+) {
+	logger := c.logger.With(lkMailbox, mailbox)
+	logger.Debug("starting to monitor mailbox for changes")
+
+	c.mu.Lock()
+	mbox, err := c.mailbox(mailbox)
+	var uids []uint32
+	if err == nil {
+		uids, err = mbox.scan()
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch := make(chan *imapclt.EventNewMessages, defChanBufSiz)
+
+	if len(uids) != 0 {
+		logger.Debug("mailbox has new message, skipping monitoring",
+			"count", len(uids),
+		)
+		sendEventNewMessages(ch, uint32(len(uids)))
+		close(ch)
+		return ch, func() error { return nil }, nil
+	}
+
+	dirs := []string{filepath.Join(mbox.dir, dirNew), filepath.Join(mbox.dir, dirCur)}
+
+	stopWatch, err := watch(dirs, func(cnt uint32) { sendEventNewMessages(ch, cnt) }, logger)
+	if err != nil {
+		close(ch)
+		return nil, nil, err
+	}
+
+	return ch, func() error {
+		logger.Debug("stopping monitoring")
+		err := stopWatch()
+		close(ch)
+		return err
+	}, nil
+}
+
+func sendEventNewMessages(ch chan<- *imapclt.EventNewMessages, newMessages uint32) {
+	select {
+	case ch <- &imapclt.EventNewMessages{NewMsgCount: newMessages}:
+	default:
+	}
+}
@@ -0,0 +1,74 @@
+package maildir
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_MOVED_TO
+
+// watch calls notify when files are created in or moved to dirs.
+// It uses inotify, the returned function stops watching and waits until
+// notify is not called anymore.
+func watch(dirs []string, notify func(cnt uint32), logger *slog.Logger) (func() error, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("initializing inotify failed: %w", err)
+	}
+
+	for _, dir := range dirs {
+		if _, err := syscall.InotifyAddWatch(fd, dir, inotifyMask); err != nil {
+			_ = syscall.Close(fd)
+			return nil, fmt.Errorf("watching %s failed: %w", dir, err)
+		}
+	}
+
+	// the file is registered with the runtime poller because fd is
+	// non-blocking, Close interrupts a blocking Read
+	file := os.NewFile(uintptr(fd), "inotify")
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				if !errors.Is(err, os.ErrClosed) {
+					logger.Warn("reading inotify events failed", "error", err)
+				}
+				return
+			}
+
+			if cnt := countEvents(buf[:n]); cnt > 0 {
+				notify(cnt)
+			}
+		}
+	})
+
+	return func() error {
+		err := file.Close()
+		wg.Wait()
+		return err
+	}, nil
+}
+
+// countEvents returns the number of inotify events in buf.
+func countEvents(buf []byte) uint32 {
+	var cnt uint32
+
+	for off := 0; off+syscall.SizeofInotifyEvent <= len(buf); {
+		ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+		if ev.Mask&inotifyMask != 0 && ev.Mask&syscall.IN_ISDIR == 0 {
+			cnt++
+		}
+		off += syscall.SizeofInotifyEvent + int(ev.Len)
+	}
+
+	return cnt
+}
@@ -0,0 +1,68 @@
+//go:build !linux
+
+package maildir
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const pollInterval = 5 * time.Second
+
+// watch calls notify when the number of files in dirs increased.
+// The directories are polled, the returned function stops polling.
+func watch(dirs []string, notify func(cnt uint32), logger *slog.Logger) (func() error, error) {
+	prev, err := countFiles(dirs)
+	if err != nil {
+		return nil, err
+	}
+
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Go(func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+			}
+
+			cnt, err := countFiles(dirs)
+			if err != nil {
+				logger.Warn("reading maildir failed", "error", err)
+				continue
+			}
+
+			if cnt > prev {
+				notify(uint32(cnt - prev))
+			}
+			prev = cnt
+		}
+	})
+
+	return func() error {
+		close(stopCh)
+		wg.Wait()
+		return nil
+	}, nil
+}
+
+func countFiles(dirs []string) (int, error) {
+	var cnt int
+
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return 0, err
+		}
+		cnt += len(entries)
+	}
+
+	return cnt, nil
+}
@@ -0,0 +1,254 @@
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+)
+
+const (
+	// expiryMargin is the duration before the expiry of an access token
+	// at which it is already refreshed.
+	expiryMargin = 2 * time.Minute
+	// defaultExpiry is the lifetime that is assumed for access tokens when
+	// the token endpoint does not send an expires_in value.
+	defaultExpiry = 30 * time.Minute
+	httpTimeout   = 60 * time.Second
+)
+
+// TokenSource retrieves OAuth2 access tokens from a token endpoint via the
+// refresh token grant (RFC 6749, section 6).
+// Access tokens are cached and refreshed automatically before they expire.
+type TokenSource struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	httpClient   *http.Client
+	logger       *slog.Logger
+	// refreshTokenFile is optional, rotated refresh tokens are written
+	// to it.
+	refreshTokenFile string
+
+	mu           sync.Mutex
+	refreshToken string
+	accessToken  string
+	expiresAt    time.Time
+}
+
+type Config struct {
+	// TokenURL is the URL of the token endpoint of the authorization
+	// server, e.g. https://oauth2.googleapis.com/token.
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+	// RefreshTokenFile is optional, if set a refresh token that was
+	// rotated by the authorization server is written to it, to be used
+	// again after a restart.
+	RefreshTokenFile string
+	// Scopes are optional, if empty the scopes of the refresh token are
+	// requested.
+	Scopes []string
+	// HTTPClient is optional, if nil a client with a default timeout is
+	// used.
+	HTTPClient *http.Client
+	Logger     *slog.Logger
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Error        string `json:"error"`
+	ErrorDesc    string `json:"error_description"`
+}
+
+func NewTokenSource(cfg *Config) (*TokenSource, error) {
+	if cfg.TokenURL == "" {
+		return nil, errors.New("token url is empty")
+	}
+
+	if cfg.ClientID == "" {
+		return nil, errors.New("client id is empty")
+	}
+
+	if cfg.RefreshToken == "" {
+		return nil, errors.New("refresh token is empty")
+	}
+
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: httpTimeout}
+	}
+
+	return &TokenSource{
+		tokenURL:         cfg.TokenURL,
+		clientID:         cfg.ClientID,
+		clientSecret:     cfg.ClientSecret,
+		refreshToken:     cfg.RefreshToken,
+		refreshTokenFile: cfg.RefreshTokenFile,
+		scopes:           cfg.Scopes,
+		httpClient:       httpClient,
+		logger:           log.EnsureLoggerInstance(cfg.Logger).With("oauth2.token_url", cfg.TokenURL),
+	}, nil
+}
+
+// Token returns a valid access token.
+// If no token has been retrieved yet or the cached token expires soon, a new
+// one is requested from the token endpoint.
+func (s *TokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.accessToken != "" && time.Until(s.expiresAt) > expiryMargin {
+		return s.accessToken, nil
+	}
+
+	if err := s.refresh(ctx); err != nil {
+		return "", err
+	}
+
+	return s.accessToken, nil
+}
+
+// Invalidate discards the cached access token, the next [TokenSource.Token]
+// call requests a new one.
+func (s *TokenSource) Invalidate() {
+	s.mu.Lock()
+	s.accessToken = ""
+	s.expiresAt = time.Time{}
+	s.mu.Unlock()
+}
+
+func (s *TokenSource) refresh(ctx context.Context) error {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.refreshToken},
+		"client_id":     {s.clientID},
+	}
+
+	if s.clientSecret != "" {
+		form.Set("client_secret", s.clientSecret)
+	}
+
+	if len(s.scopes) > 0 {
+		form.Set("scope", strings.Join(s.scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("creating token request failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("requesting access token failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return fmt.Errorf("reading token response failed: %w", err)
+	}
+
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return fmt.Errorf("token endpoint returned status %s, decoding response failed: %w", resp.Status, err)
+	}
+
+	if resp.StatusCode != http.StatusOK || tr.Error != "" {
+		return fmt.Errorf("token endpoint returned status %s: %s: %s", resp.Status, tr.Error, tr.ErrorDesc)
+	}
+
+	if tr.AccessToken == "" {
+		return errors.New("token endpoint response does not contain an access token")
+	}
+
+	expiresIn := defaultExpiry
+	if tr.ExpiresIn > 0 {
+		expiresIn = time.Duration(tr.ExpiresIn) * time.Second
+	}
+
+	s.accessToken = tr.AccessToken
+	s.expiresAt = time.Now().Add(expiresIn)
+
+	// some authorization servers (e.g. Microsoft) rotate refresh tokens
+	if tr.RefreshToken != "" && tr.RefreshToken != s.refreshToken {
+		s.refreshToken = tr.RefreshToken
+		s.storeRefreshToken()
+	}
+
+	s.logger.Debug("retrieved new access token",
+		"event", "oauth2.token_refreshed",
+		"expires_in", expiresIn,
+	)
+
+	return nil
+}
+
+// storeRefreshToken writes a rotated refresh token to the refresh token file.
+// If no file is configured or writing fails, a warning is logged, the
+// previous refresh token might be rejected after a restart.
+func (s *TokenSource) storeRefreshToken() {
+	if s.refreshTokenFile == "" {
+		s.logger.Warn("authorization server issued a new refresh token, it is only kept in memory, update the configured refresh token",
+			"event", "oauth2.refresh_token_rotated")
+		return
+	}
+
+	if err := writeFileAtomic(s.refreshTokenFile, []byte(s.refreshToken+"\n")); err != nil {
+		s.logger.Warn("authorization server issued a new refresh token, writing it failed, it is only kept in memory, update the configured refresh token",
+			"event", "oauth2.refresh_token_store_failed",
+			"error", err,
+			"path", s.refreshTokenFile,
+		)
+		return
+	}
+
+	s.logger.Info("authorization server issued a new refresh token, stored it",
+		"event", "oauth2.refresh_token_rotated",
+		"path", s.refreshTokenFile,
+	)
+}
+
+// writeFileAtomic replaces the content of the file at path with buf.
+func writeFileAtomic(path string, buf []byte) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	err = tmpFile.Chmod(0o600)
+	if err == nil {
+		_, err = tmpFile.Write(buf)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	err = errors.Join(err, tmpFile.Close())
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return err
+	}
+
+	return nil
+}
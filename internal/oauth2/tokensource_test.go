@@ -0,0 +1,144 @@
+package oauth2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+type tokenEndpoint struct {
+	requests         atomic.Int32
+	lastRefreshToken atomic.Value
+	expiresIn        int64
+	newRefreshToken  string
+}
+
+func (e *tokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "refresh_token" ||
+		r.PostForm.Get("client_id") != "clientid" ||
+		r.PostForm.Get("client_secret") != "secret" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_client","error_description":"unknown client"}`))
+		return
+	}
+
+	n := e.requests.Add(1)
+	e.lastRefreshToken.Store(r.PostForm.Get("refresh_token"))
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"access_token":  fmt.Sprintf("token-%d", n),
+		"token_type":    "Bearer",
+		"expires_in":    e.expiresIn,
+		"refresh_token": e.newRefreshToken,
+	})
+}
+
+func newTestTokenSource(t *testing.T, endpoint *tokenEndpoint) *TokenSource {
+	srv := httptest.NewServer(endpoint)
+	t.Cleanup(srv.Close)
+
+	ts, err := NewTokenSource(&Config{
+		TokenURL:     srv.URL,
+		ClientID:     "clientid",
+		ClientSecret: "secret",
+		RefreshToken: "refresh",
+		Logger:       log.SlogTestLogger(t),
+	})
+	assert.NoError(t, err)
+
+	return ts
+}
+
+func TestTokenIsCached(t *testing.T) {
+	endpoint := tokenEndpoint{expiresIn: 3600}
+	ts := newTestTokenSource(t, &endpoint)
+
+	token, err := ts.Token(t.Context())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	token, err = ts.Token(t.Context())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+	assert.Equal(t, 1, endpoint.requests.Load())
+}
+
+func TestTokenIsRefreshedBeforeExpiry(t *testing.T) {
+	// expires within expiryMargin, every call must refresh it
+	endpoint := tokenEndpoint{expiresIn: 60}
+	ts := newTestTokenSource(t, &endpoint)
+
+	token, err := ts.Token(t.Context())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	token, err = ts.Token(t.Context())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+}
+
+func TestInvalidate(t *testing.T) {
+	endpoint := tokenEndpoint{expiresIn: 3600}
+	ts := newTestTokenSource(t, &endpoint)
+
+	_, err := ts.Token(t.Context())
+	assert.NoError(t, err)
+
+	ts.Invalidate()
+
+	token, err := ts.Token(t.Context())
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+}
+
+func TestRotatedRefreshTokenIsUsed(t *testing.T) {
+	endpoint := tokenEndpoint{expiresIn: 3600, newRefreshToken: "rotated"}
+	ts := newTestTokenSource(t, &endpoint)
+
+	_, err := ts.Token(t.Context())
+	assert.NoError(t, err)
+	assert.Equal(t, "refresh", endpoint.lastRefreshToken.Load().(string))
+
+	ts.Invalidate()
+	_, err = ts.Token(t.Context())
+	assert.NoError(t, err)
+	assert.Equal(t, "rotated", endpoint.lastRefreshToken.Load().(string))
+}
+
+func TestRotatedRefreshTokenIsStored(t *testing.T) {
+	endpoint := tokenEndpoint{expiresIn: 3600, newRefreshToken: "rotated"}
+	ts := newTestTokenSource(t, &endpoint)
+	ts.refreshTokenFile = filepath.Join(t.TempDir(), "OAuth2RefreshToken")
+
+	_, err := ts.Token(t.Context())
+	assert.NoError(t, err)
+
+	buf, err := os.ReadFile(ts.refreshTokenFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "rotated\n", string(buf))
+}
+
+func TestTokenEndpointError(t *testing.T) {
+	endpoint := tokenEndpoint{}
+	ts := newTestTokenSource(t, &endpoint)
+	ts.clientSecret = "wrong"
+
+	_, err := ts.Token(t.Context())
+	assert.Error(t, err)
+	assert.Equal(t, "token endpoint returned status 400 Bad Request: invalid_client: unknown client", err.Error())
+}
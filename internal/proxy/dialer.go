@@ -0,0 +1,334 @@
+// Package proxy implements dialers that establish TCP connections through
+// SOCKS5 (RFC 1928) or HTTP CONNECT (RFC 9110, section 9.3.6) proxies.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Dialer establishes network connections.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// NewDialer returns a dialer that connects through the proxy at proxyURL.
+// Connections to the proxy are established via forward.
+//
+// Supported schemes are:
+//   - socks5: SOCKS5, hostnames are resolved locally,
+//   - socks5h: SOCKS5, hostnames are resolved by the proxy,
+//   - http: HTTP CONNECT.
+//
+// Credentials for the proxy can be passed as userinfo in the URL.
+func NewDialer(proxyURL *url.URL, forward *net.Dialer) (Dialer, error) {
+	if proxyURL.Host == "" {
+		return nil, errors.New("proxy url has no host")
+	}
+
+	var user, password string
+	if proxyURL.User != nil {
+		user = proxyURL.User.Username()
+		password, _ = proxyURL.User.Password()
+	}
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		return &socks5Dialer{
+			proxyAddr:     hostPortWithDefault(proxyURL, "1080"),
+			user:          user,
+			password:      password,
+			remoteResolve: proxyURL.Scheme == "socks5h",
+			forward:       forward,
+		}, nil
+
+	case "http":
+		return &httpConnectDialer{
+			proxyAddr: hostPortWithDefault(proxyURL, "80"),
+			user:      user,
+			password:  password,
+			forward:   forward,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %q", proxyURL.Scheme)
+	}
+}
+
+func hostPortWithDefault(u *url.URL, defPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	return net.JoinHostPort(u.Hostname(), defPort)
+}
+
+// withHandshakeDeadline sets a deadline for the proxy handshake on conn,
+// derived from ctx.
+// The returned function resets it.
+func withHandshakeDeadline(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	return func() { _ = conn.SetDeadline(time.Time{}) }
+}
+
+type httpConnectDialer struct {
+	proxyAddr string
+	user      string
+	password  string
+	forward   *net.Dialer
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, network, d.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to http proxy %s failed: %w", d.proxyAddr, err)
+	}
+
+	resetDeadline := withHandshakeDeadline(ctx, conn)
+	defer resetDeadline()
+
+	req := http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+
+	if d.user != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(d.user + ":" + d.password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("sending http connect request failed: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("reading http connect response failed: %w", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http proxy refused connection to %s: %s", address, resp.Status)
+	}
+
+	// the proxy must not send data before the client, if it did it is
+	// buffered and must not get lost
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// SOCKS5 protocol constants, RFC 1928 and RFC 1929.
+const (
+	socks5Version          = 0x05
+	socks5AuthNone         = 0x00
+	socks5AuthUserPass     = 0x02
+	socks5AuthNoAcceptable = 0xff
+	socks5UserPassVersion  = 0x01
+	socks5CmdConnect       = 0x01
+	socks5AddrIPv4         = 0x01
+	socks5AddrDomain       = 0x03
+	socks5AddrIPv6         = 0x04
+	socks5ReplySucceeded   = 0x00
+)
+
+var socks5ReplyErrs = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+type socks5Dialer struct {
+	proxyAddr     string
+	user          string
+	password      string
+	remoteResolve bool
+	forward       *net.Dialer
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := net.LookupPort(network, portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.remoteResolve && net.ParseIP(host) == nil {
+		addrs, err := d.forward.Resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no ip address found for %s", host)
+		}
+		host = addrs[0].IP.String()
+	}
+
+	conn, err := d.forward.DialContext(ctx, network, d.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to socks5 proxy %s failed: %w", d.proxyAddr, err)
+	}
+
+	resetDeadline := withHandshakeDeadline(ctx, conn)
+	defer resetDeadline()
+
+	if err := d.handshake(conn, host, port); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("socks5 proxy %s: %w", d.proxyAddr, err)
+	}
+
+	return conn, nil
+}
+
+func (d *socks5Dialer) handshake(conn net.Conn, host string, port int) error {
+	authMethod := byte(socks5AuthNone)
+	if d.user != "" {
+		authMethod = socks5AuthUserPass
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, 1, authMethod}); err != nil {
+		return err
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return fmt.Errorf("reading method selection failed: %w", err)
+	}
+
+	if resp[0] != socks5Version {
+		return fmt.Errorf("unexpected protocol version %d", resp[0])
+	}
+
+	switch resp[1] {
+	case socks5AuthNone:
+	case socks5AuthUserPass:
+		if err := d.authenticate(conn); err != nil {
+			return err
+		}
+	case socks5AuthNoAcceptable:
+		return errors.New("no acceptable authentication method")
+	default:
+		return fmt.Errorf("proxy selected unsupported authentication method %d", resp[1])
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socks5AddrIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socks5AddrIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("hostname is too long")
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return fmt.Errorf("reading connect reply failed: %w", err)
+	}
+
+	if hdr[1] != socks5ReplySucceeded {
+		if msg, ok := socks5ReplyErrs[hdr[1]]; ok {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("connect failed with reply code %d", hdr[1])
+	}
+
+	// discard the bound address
+	var addrLen int
+	switch hdr[3] {
+	case socks5AddrIPv4:
+		addrLen = net.IPv4len
+	case socks5AddrIPv6:
+		addrLen = net.IPv6len
+	case socks5AddrDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	default:
+		return fmt.Errorf("unsupported address type %d in reply", hdr[3])
+	}
+
+	if _, err := io.CopyN(io.Discard, conn, int64(addrLen)+2); err != nil {
+		return fmt.Errorf("reading bound address failed: %w", err)
+	}
+
+	return nil
+}
+
+func (d *socks5Dialer) authenticate(conn net.Conn) error {
+	if len(d.user) > 255 || len(d.password) > 255 {
+		return errors.New("username or password is too long")
+	}
+
+	req := []byte{socks5UserPassVersion, byte(len(d.user))}
+	req = append(req, d.user...)
+	req = append(req, byte(len(d.password)))
+	req = append(req, d.password...)
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return fmt.Errorf("reading authentication response failed: %w", err)
+	}
+
+	if resp[1] != 0 {
+		return errors.New("authentication failed")
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package rspamc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defProbeInterval is the minimal interval in which requests are sent while
+// the circuit breaker is open.
+const defProbeInterval = 30 * time.Second
+
+// ErrUnavailable is wrapped by errors of requests that failed because rspamd
+// was not reachable or responded with a server error.
+var ErrUnavailable = errors.New("rspamd is unavailable")
+
+// ErrCircuitOpen is wrapped by errors of [Client.Check] when rspamd has been
+// unavailable for longer than the timeout of the circuit breaker.
+// It also wraps [ErrUnavailable].
+var ErrCircuitOpen = fmt.Errorf("%w, circuit breaker is open", ErrUnavailable)
+
+// StatusError is returned when rspamd responded with an unexpected HTTP
+// status code.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return "request failed with status: " + e.Status
+}
+
+// WithCircuitBreaker enables a circuit breaker for [Client.Check].
+// When rspamd is unavailable for longer than openAfter, the circuit breaker
+// opens. While it is open, only one request is sent every 30 seconds to
+// probe if rspamd is available again.
+func WithCircuitBreaker(openAfter time.Duration) Option {
+	return func(c *Client) {
+		c.breaker = &circuitBreaker{
+			openAfter:     openAfter,
+			probeInterval: defProbeInterval,
+		}
+	}
+}
+
+// circuitBreaker tracks the availability of rspamd.
+type circuitBreaker struct {
+	openAfter     time.Duration
+	probeInterval time.Duration
+
+	mu sync.Mutex
+	// failingSince is the time of the first failed request since the
+	// last successful one, it is zero while rspamd is available
+	failingSince time.Time
+	// lastProbeAt is the time of the last request that was sent while
+	// the circuit breaker was open
+	lastProbeAt time.Time
+	open        bool
+}
+
+// allow returns true if a request should be sent.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true
+	}
+
+	if time.Since(b.lastProbeAt) < b.probeInterval {
+		return false
+	}
+
+	b.lastProbeAt = time.Now()
+
+	return true
+}
+
+// record updates the state with the result of a request.
+// It returns if the circuit breaker is open and if its state changed.
+func (b *circuitBreaker) record(available bool) (open, changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if available {
+		changed = b.open
+		b.open = false
+		b.failingSince = time.Time{}
+
+		return false, changed
+	}
+
+	now := time.Now()
+	if b.failingSince.IsZero() {
+		b.failingSince = now
+	}
+
+	if !b.open && now.Sub(b.failingSince) >= b.openAfter {
+		b.open = true
+		b.lastProbeAt = now
+		changed = true
+	}
+
+	return b.open, changed
+}
+
+// recordAvailability updates the circuit breaker with the result of a request
+// that returned err.
+// If the circuit breaker is open, err is wrapped in [ErrCircuitOpen].
+func (c *Client) recordAvailability(err error) error {
+	if c.breaker == nil {
+		return err
+	}
+
+	// requests that rspamd answered, e.g. with 400 Bad Request, are not
+	// failures of the availability
+	open, changed := c.breaker.record(!errors.Is(err, ErrUnavailable))
+
+	switch {
+	case changed && open:
+		c.logger.Warn("rspamd is unavailable, opened circuit breaker",
+			"event", "rspamd.circuit_opened",
+			"error", err,
+			"rspamd.circuit_open_after", c.breaker.openAfter,
+		)
+	case changed:
+		c.logger.Info("rspamd is available again, closed circuit breaker",
+			"event", "rspamd.circuit_closed")
+	}
+
+	if open {
+		return fmt.Errorf("%w: %w", ErrCircuitOpen, err)
+	}
+
+	return err
+}
@@ -0,0 +1,105 @@
+package rspamc
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestCheck_CircuitBreaker(t *testing.T) {
+	var available atomic.Bool
+	var requests atomic.Int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		if !available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/ping" {
+			_, _ = w.Write([]byte("pong\r\n"))
+			return
+		}
+		_, _ = w.Write([]byte(`{"score": 1.5}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	clt := New(slog.New(slog.DiscardHandler), []string{srv.URL}, "", WithCircuitBreaker(time.Hour))
+	check := func() error {
+		_, err := clt.Check(context.Background(), strings.NewReader("mail"), &MailHeaders{})
+		return err
+	}
+
+	// rspamd is unavailable for less than the timeout
+	err := check()
+	assert.Equal(t, true, errors.Is(err, ErrUnavailable))
+	assert.Equal(t, false, errors.Is(err, ErrCircuitOpen))
+
+	clt.breaker.failingSince = time.Now().Add(-time.Hour)
+	err = check()
+	assert.Equal(t, true, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, int32(2), requests.Load())
+
+	// requests are not sent until the probe interval passed
+	err = check()
+	assert.Equal(t, true, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, int32(2), requests.Load())
+
+	clt.breaker.probeInterval = 0
+	available.Store(true)
+	assert.NoError(t, check())
+	assert.Equal(t, int32(3), requests.Load())
+	assert.Equal(t, false, clt.breaker.open)
+}
+
+func TestPing_ClosesCircuitBreaker(t *testing.T) {
+	var available atomic.Bool
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available.Load() || r.URL.Path != "/ping" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte("pong\r\n"))
+	}))
+	t.Cleanup(srv.Close)
+
+	clt := New(slog.New(slog.DiscardHandler), []string{srv.URL}, "", WithCircuitBreaker(0))
+
+	err := clt.Ping(context.Background())
+	assert.Equal(t, true, errors.Is(err, ErrCircuitOpen))
+	assert.Equal(t, true, clt.breaker.open)
+
+	available.Store(true)
+	assert.NoError(t, clt.Ping(context.Background()))
+	assert.Equal(t, false, clt.breaker.open)
+}
+
+func TestCheck_ClientErrorIsNotUnavailable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	t.Cleanup(srv.Close)
+
+	clt := New(slog.New(slog.DiscardHandler), []string{srv.URL}, "", WithCircuitBreaker(0))
+
+	_, err := clt.Check(context.Background(), strings.NewReader("mail"), &MailHeaders{})
+	assert.Error(t, err)
+	assert.Equal(t, false, errors.Is(err, ErrUnavailable))
+	assert.Equal(t, false, clt.breaker.open)
+
+	var statusErr *StatusError
+	assert.Equal(t, true, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusBadRequest, statusErr.StatusCode)
+}
@@ -0,0 +1,70 @@
+package rspamc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	hdrCompression      = "Compression"
+	compressionZstd     = "zstd"
+	hdrContentEncoding  = "Content-Encoding"
+	contentEncodingZstd = "zstd"
+)
+
+// zstdEncoder compresses request bodies, [zstd.Encoder.EncodeAll] can be
+// called concurrently.
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// WithCompression enables compressing the bodies of check and learn
+// requests with zstd.
+func WithCompression() Option {
+	return func(c *Client) {
+		c.compress = true
+	}
+}
+
+// compressBody returns msg compressed with zstd and sets the Compression
+// header in hdrs, if compression is enabled. Otherwise msg is returned
+// unchanged.
+func (c *Client) compressBody(hdrs http.Header, msg io.Reader) (io.Reader, error) {
+	if !c.compress {
+		return msg, nil
+	}
+
+	data, err := io.ReadAll(msg)
+	if err != nil {
+		return nil, fmt.Errorf("reading message failed: %w", err)
+	}
+
+	hdrs.Set(hdrCompression, compressionZstd)
+
+	return bytes.NewReader(zstdEncoder.EncodeAll(data, nil)), nil
+}
+
+// isZstdCompressed returns true if the body of resp is compressed with zstd.
+func isZstdCompressed(resp *http.Response) bool {
+	return strings.EqualFold(resp.Header.Get(hdrCompression), compressionZstd) ||
+		strings.EqualFold(resp.Header.Get(hdrContentEncoding), contentEncodingZstd)
+}
+
+// decompressBody returns a reader for the decompressed body of resp and a
+// function to release its resources.
+// If the body is not compressed, it is returned unchanged.
+func decompressBody(resp *http.Response) (io.Reader, func(), error) {
+	if !isZstdCompressed(resp) {
+		return resp.Body, func() {}, nil
+	}
+
+	dec, err := zstd.NewReader(resp.Body, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating zstd decoder failed: %w", err)
+	}
+
+	return dec, dec.Close, nil
+}
@@ -0,0 +1,91 @@
+package rspamc
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+// startZstdServer starts a rspamd stand-in that expects zstd-compressed
+// requests with the body expectedBody and responds with compressed
+// responses.
+func startZstdServer(t *testing.T, expectedBody string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Compression") != "zstd" {
+			t.Errorf("%s: request has no Compression: zstd header", r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		dec, err := zstd.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("%s: creating zstd decoder failed: %s", r.URL.Path, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer dec.Close()
+
+		body, err := io.ReadAll(dec)
+		if err != nil {
+			t.Errorf("%s: decompressing request body failed: %s", r.URL.Path, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if string(body) != expectedBody {
+			t.Errorf("%s: got request body %q, expected %q", r.URL.Path, body, expectedBody)
+		}
+
+		resp := `{"success": true}`
+		if r.URL.Path == pathCheck {
+			resp = checkResultJSON
+		}
+
+		enc, err := zstd.NewWriter(nil)
+		assert.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Compression", "zstd")
+		_, _ = w.Write(enc.EncodeAll([]byte(resp), nil))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestCompression(t *testing.T) {
+	msg := strings.Repeat("<p>newsletter</p>\r\n", 1000)
+	srv := startZstdServer(t, msg)
+
+	clt := New(slog.New(slog.DiscardHandler), []string{srv.URL}, "", WithCompression())
+	hdrs := &MailHeaders{Subject: "test"}
+
+	r, err := clt.Check(context.Background(), strings.NewReader(msg), hdrs)
+	assert.NoError(t, err)
+	assert.Equal(t, float32(5.5), r.Score)
+	assert.Equal(t, "1234@example.com", r.MessageID)
+
+	assert.NoError(t, clt.Spam(context.Background(), strings.NewReader(msg), hdrs))
+	assert.NoError(t, clt.Ham(context.Background(), strings.NewReader(msg), hdrs))
+}
+
+func TestCompression_Failover(t *testing.T) {
+	msg := "mail"
+	unavailable := startTestEndpoint(t)
+	unavailable.unavailable.Store(true)
+	srv := startZstdServer(t, msg)
+
+	clt := New(slog.New(slog.DiscardHandler), []string{unavailable.URL, srv.URL}, "", WithCompression())
+
+	// the compressed body is sent again to the next endpoint
+	r, err := clt.Check(context.Background(), strings.NewReader(msg), &MailHeaders{})
+	assert.NoError(t, err)
+	assert.Equal(t, float32(5.5), r.Score)
+}
@@ -0,0 +1,182 @@
+package rspamc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Balancing modes, they define in which order the endpoints are tried.
+const (
+	// BalancingPriority tries the endpoints in the order they were
+	// passed to [New].
+	BalancingPriority = "priority"
+	// BalancingRoundRobin starts with the next endpoint on every request.
+	BalancingRoundRobin = "round-robin"
+)
+
+// defHealthCheckInterval is the minimal interval in which unhealthy endpoints
+// are checked via /ping.
+const defHealthCheckInterval = 30 * time.Second
+
+// IsSupportedBalancing returns true if mode is one of the balancing modes
+// supported by [Client].
+func IsSupportedBalancing(mode string) bool {
+	switch strings.ToLower(mode) {
+	case "", BalancingPriority, BalancingRoundRobin:
+		return true
+	default:
+		return false
+	}
+}
+
+// WithBalancing sets the order in which the endpoints are tried, the default
+// is [BalancingPriority].
+func WithBalancing(mode string) Option {
+	return func(c *Client) {
+		c.balancing = strings.ToLower(mode)
+	}
+}
+
+// WithPrimary sets the endpoint to which learn and fuzzy requests are sent,
+// the default is the first URL passed to [New].
+// If url was not passed to [New], it is only used for learn and fuzzy
+// requests, scan requests are not sent to it.
+func WithPrimary(url string) Option {
+	return func(c *Client) {
+		idx := slices.IndexFunc(c.endpoints, func(ep *endpoint) bool { return ep.url == url })
+		if idx == -1 {
+			c.primary = &endpoint{url: url, healthy: true}
+			return
+		}
+
+		c.primary = c.endpoints[idx]
+	}
+}
+
+// endpoint is a rspamd instance.
+type endpoint struct {
+	url string
+
+	mu      sync.Mutex
+	healthy bool
+	// checkedAt is the time of the last health check, respectively when
+	// it became unhealthy
+	checkedAt time.Time
+}
+
+// endpointOrder returns the endpoints in the order they are tried.
+// Unhealthy endpoints are checked via /ping, when the health check interval
+// passed, and are skipped if they are still unhealthy. If no endpoint is
+// healthy, all are returned.
+func (c *Client) endpointOrder(ctx context.Context) []*endpoint {
+	eps := slices.Clone(c.endpoints)
+
+	if c.balancing == BalancingRoundRobin && len(eps) > 1 {
+		start := int(c.rrNext.Add(1)-1) % len(eps)
+		eps = append(eps[start:], eps[:start]...)
+	}
+
+	healthy := slices.DeleteFunc(slices.Clone(eps), func(ep *endpoint) bool {
+		return !c.checkHealth(ctx, ep)
+	})
+	if len(healthy) == 0 {
+		return eps
+	}
+
+	return healthy
+}
+
+// checkHealth returns true if ep is healthy.
+// An unhealthy endpoint is checked via /ping, if it was not checked within
+// the health check interval.
+func (c *Client) checkHealth(ctx context.Context, ep *endpoint) bool {
+	ep.mu.Lock()
+	if ep.healthy {
+		ep.mu.Unlock()
+		return true
+	}
+
+	if time.Since(ep.checkedAt) < c.healthCheckInterval {
+		ep.mu.Unlock()
+		return false
+	}
+	ep.checkedAt = time.Now()
+	ep.mu.Unlock()
+
+	err := c.ping(ctx, ep)
+	c.setHealth(ep, err)
+
+	return err == nil
+}
+
+// setHealth updates the health of ep with the result of a request that
+// returned err.
+func (c *Client) setHealth(ep *endpoint, err error) {
+	healthy := !errors.Is(err, ErrUnavailable)
+
+	ep.mu.Lock()
+	changed := ep.healthy != healthy
+	ep.healthy = healthy
+	if !healthy {
+		ep.checkedAt = time.Now()
+	}
+	ep.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if healthy {
+		c.logger.Info("rspamd endpoint is healthy again",
+			"event", "rspamd.endpoint_healthy", "server", ep.url)
+		return
+	}
+
+	c.logger.Warn("rspamd endpoint is unhealthy, skipping it until it responds to health checks",
+		"event", "rspamd.endpoint_unhealthy",
+		"server", ep.url,
+		"error", err,
+	)
+}
+
+// sendWithFailover sends a request to the endpoints in the order returned by
+// [Client.endpointOrder] until one of them is available.
+func (c *Client) sendWithFailover(ctx context.Context, path string, hdrs http.Header, msg io.Reader, result any) error {
+	var body []byte
+	var errs []error
+
+	eps := c.endpointOrder(ctx)
+	if len(eps) > 1 {
+		// the message is sent again when an endpoint is unavailable
+		var err error
+		body, err = io.ReadAll(msg)
+		if err != nil {
+			return fmt.Errorf("reading message failed: %w", err)
+		}
+	}
+
+	for _, ep := range eps {
+		r := msg
+		if body != nil {
+			r = bytes.NewReader(body)
+		}
+
+		err := c.sendRequest(ctx, ep.url+path, hdrs, r, result)
+		c.setHealth(ep, err)
+		if !errors.Is(err, ErrUnavailable) {
+			return err
+		}
+
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
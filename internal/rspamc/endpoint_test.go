@@ -0,0 +1,176 @@
+package rspamc
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+// testEndpoint is a rspamd stand-in that counts the received requests by
+// path.
+type testEndpoint struct {
+	*httptest.Server
+
+	unavailable atomic.Bool
+
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func startTestEndpoint(t *testing.T) *testEndpoint {
+	ep := testEndpoint{requests: map[string]int{}}
+
+	ep.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ep.mu.Lock()
+		ep.requests[r.URL.Path]++
+		ep.mu.Unlock()
+
+		if ep.unavailable.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == pathPing {
+			_, _ = w.Write([]byte("pong\r\n"))
+			return
+		}
+		_, _ = w.Write([]byte(`{"score": 1.5}`))
+	}))
+	t.Cleanup(ep.Close)
+
+	return &ep
+}
+
+func (e *testEndpoint) requestCnt(path string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.requests[path]
+}
+
+func check(t *testing.T, clt *Client) {
+	t.Helper()
+
+	_, err := clt.Check(context.Background(), strings.NewReader("mail"), &MailHeaders{})
+	assert.NoError(t, err)
+}
+
+func TestCheck_Failover(t *testing.T) {
+	ep1, ep2 := startTestEndpoint(t), startTestEndpoint(t)
+	ep1.unavailable.Store(true)
+
+	clt := New(slog.New(slog.DiscardHandler), []string{ep1.URL, ep2.URL}, "")
+
+	check(t, clt)
+	assert.Equal(t, 1, ep1.requestCnt(pathCheck))
+	assert.Equal(t, 1, ep2.requestCnt(pathCheck))
+
+	// the unhealthy endpoint is skipped until the health check interval
+	// passed
+	check(t, clt)
+	assert.Equal(t, 1, ep1.requestCnt(pathCheck))
+	assert.Equal(t, 0, ep1.requestCnt(pathPing))
+	assert.Equal(t, 2, ep2.requestCnt(pathCheck))
+
+	clt.healthCheckInterval = 0
+	check(t, clt)
+	assert.Equal(t, 1, ep1.requestCnt(pathPing))
+	assert.Equal(t, 3, ep2.requestCnt(pathCheck))
+
+	ep1.unavailable.Store(false)
+	check(t, clt)
+	assert.Equal(t, 2, ep1.requestCnt(pathPing))
+	assert.Equal(t, 2, ep1.requestCnt(pathCheck))
+	assert.Equal(t, 3, ep2.requestCnt(pathCheck))
+}
+
+func TestCheck_AllEndpointsUnavailable(t *testing.T) {
+	ep1, ep2 := startTestEndpoint(t), startTestEndpoint(t)
+	ep1.unavailable.Store(true)
+	ep2.unavailable.Store(true)
+
+	clt := New(slog.New(slog.DiscardHandler), []string{ep1.URL, ep2.URL}, "")
+
+	for range 2 {
+		_, err := clt.Check(context.Background(), strings.NewReader("mail"), &MailHeaders{})
+		assert.Error(t, err)
+	}
+
+	// when no endpoint is healthy, all are tried
+	assert.Equal(t, 2, ep1.requestCnt(pathCheck))
+	assert.Equal(t, 2, ep2.requestCnt(pathCheck))
+}
+
+func TestCheck_RoundRobin(t *testing.T) {
+	ep1, ep2 := startTestEndpoint(t), startTestEndpoint(t)
+
+	clt := New(slog.New(slog.DiscardHandler), []string{ep1.URL, ep2.URL}, "",
+		WithBalancing(BalancingRoundRobin))
+
+	for range 4 {
+		check(t, clt)
+	}
+
+	assert.Equal(t, 2, ep1.requestCnt(pathCheck))
+	assert.Equal(t, 2, ep2.requestCnt(pathCheck))
+}
+
+func TestLearn_Primary(t *testing.T) {
+	ep1, ep2 := startTestEndpoint(t), startTestEndpoint(t)
+
+	clt := New(slog.New(slog.DiscardHandler), []string{ep1.URL, ep2.URL}, "",
+		WithPrimary(ep2.URL))
+
+	assert.NoError(t, clt.Spam(context.Background(), strings.NewReader("mail"), &MailHeaders{}))
+	assert.NoError(t, clt.Ham(context.Background(), strings.NewReader("mail"), &MailHeaders{}))
+	assert.Equal(t, 0, ep1.requestCnt(pathSpam)+ep1.requestCnt(pathHam))
+	assert.Equal(t, 1, ep2.requestCnt(pathSpam))
+	assert.Equal(t, 1, ep2.requestCnt(pathHam))
+
+	// learn requests are not sent to other endpoints
+	ep2.unavailable.Store(true)
+	assert.Error(t, clt.Spam(context.Background(), strings.NewReader("mail"), &MailHeaders{}))
+	assert.Equal(t, 0, ep1.requestCnt(pathSpam))
+}
+
+func TestLearn_UnlistedPrimary(t *testing.T) {
+	ep1, ep2, primary := startTestEndpoint(t), startTestEndpoint(t), startTestEndpoint(t)
+
+	clt := New(slog.New(slog.DiscardHandler), []string{ep1.URL, ep2.URL}, "",
+		WithBalancing(BalancingRoundRobin), WithPrimary(primary.URL))
+
+	assert.Equal(t, 2, len(clt.endpoints))
+	assert.Equal(t, ep1.URL, clt.endpoints[0].url)
+	assert.Equal(t, ep2.URL, clt.endpoints[1].url)
+
+	assert.NoError(t, clt.Spam(context.Background(), strings.NewReader("mail"), &MailHeaders{}))
+	assert.Equal(t, 1, primary.requestCnt(pathSpam))
+
+	for range 4 {
+		check(t, clt)
+	}
+	assert.Equal(t, 2, ep1.requestCnt(pathCheck))
+	assert.Equal(t, 2, ep2.requestCnt(pathCheck))
+	assert.Equal(t, 0, primary.requestCnt(pathCheck))
+
+	// scans are not failed over to the primary endpoint
+	ep1.unavailable.Store(true)
+	ep2.unavailable.Store(true)
+	_, err := clt.Check(context.Background(), strings.NewReader("mail"), &MailHeaders{})
+	assert.Error(t, err)
+	assert.Equal(t, 0, primary.requestCnt(pathCheck))
+}
+
+func TestIsSupportedBalancing(t *testing.T) {
+	assert.Equal(t, true, IsSupportedBalancing(""))
+	assert.Equal(t, true, IsSupportedBalancing("Round-Robin"))
+	assert.Equal(t, false, IsSupportedBalancing("random"))
+}
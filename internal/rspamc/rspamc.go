@@ -3,47 +3,101 @@ package rspamc
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pathCheck    = "/checkv2"
+	pathPing     = "/ping"
+	pathHam      = "/learnham"
+	pathSpam     = "/learnspam"
+	pathFuzzyAdd = "/fuzzyadd"
+	pathFuzzyDel = "/fuzzydel"
 )
 
 type Client struct {
-	checkURL string
-	hamURL   string
-	spamURL  string
+	endpoints []*endpoint
+	// primary is the endpoint learn and fuzzy requests are sent to
+	primary   *endpoint
+	balancing string
+	// rrNext is incremented on every request with
+	// [BalancingRoundRobin], it selects the first endpoint to try
+	rrNext              atomic.Uint64
+	healthCheckInterval time.Duration
+
 	logger   *slog.Logger
 	password string
+	// compress enables compressing request bodies with zstd
+	compress bool
+
+	// breaker is nil if no circuit breaker is used
+	breaker *circuitBreaker
 }
 
-func New(logger *slog.Logger, url, password string) *Client {
-	return &Client{
-		checkURL: url + "/checkv2",
-		hamURL:   url + "/learnham",
-		spamURL:  url + "/learnspam",
-		logger:   logger.WithGroup("rspamc").With("server", url),
-		password: password,
+// Option configures optional settings of a [Client].
+type Option func(*Client)
+
+// New creates a client for the rspamd instances with the URLs urls.
+// Scan requests are sent to the first healthy endpoint, if it is
+// unavailable they are retried with the next one, see [WithBalancing].
+// Learn and fuzzy requests are only sent to the primary endpoint, see
+// [WithPrimary].
+func New(logger *slog.Logger, urls []string, password string, opts ...Option) *Client {
+	c := &Client{
+		balancing:           BalancingPriority,
+		healthCheckInterval: defHealthCheckInterval,
+		logger:              logger.WithGroup("rspamc"),
+		password:            password,
+	}
+
+	for _, url := range urls {
+		c.endpoints = append(c.endpoints, &endpoint{url: url, healthy: true})
+	}
+	if len(c.endpoints) > 0 {
+		c.primary = c.endpoints[0]
+	}
+
+	for _, opt := range opts {
+		opt(c)
 	}
+
+	return c
 }
 
 func (c *Client) sendRequest(ctx context.Context, url string, hdrs http.Header, msg io.Reader, result any) error {
-	logger := c.logger.With("url", url)
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, msg)
 	if err != nil {
-		return nil
+		return fmt.Errorf("creating http request failed: %w", err)
 	}
 
 	if hdrs != nil {
 		req.Header = hdrs.Clone()
 	}
+
+	return c.do(req, result)
+}
+
+// do sends req with the controller password and decodes the JSON response
+// body into result, if result is not nil.
+func (c *Client) do(req *http.Request, result any) error {
+	ctx := req.Context()
+	logger := c.logger.With("url", req.URL.String())
+
 	req.Header.Add("password", c.password)
 
 	// TODO: use custom client with configured timeouts
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
 	}
 
 	defer func() {
@@ -67,7 +121,12 @@ func (c *Client) sendRequest(ctx context.Context, url string, hdrs http.Header,
 			return nil
 		}
 
-		return fmt.Errorf("request failed with status: %s", resp.Status)
+		err := &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+
+		return err
 	}
 
 	const contentTypeJSON = "application/json"
@@ -76,8 +135,14 @@ func (c *Client) sendRequest(ctx context.Context, url string, hdrs http.Header,
 		return fmt.Errorf("got response with content-type: %q, expecting: %q", ctype, contentTypeJSON)
 	}
 
+	body, closeBody, err := decompressBody(resp)
+	if err != nil {
+		return err
+	}
+	defer closeBody()
+
 	if result == nil {
-		buf, err := io.ReadAll(resp.Body)
+		buf, err := io.ReadAll(body)
 		if err != nil {
 			logger.Error("rspamc reading http error body failed", "error", err)
 		}
@@ -89,7 +154,7 @@ func (c *Client) sendRequest(ctx context.Context, url string, hdrs http.Header,
 		return nil
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(result)
+	err = json.NewDecoder(body).Decode(result)
 	if err != nil {
 		return err
 	}
@@ -97,37 +162,193 @@ func (c *Client) sendRequest(ctx context.Context, url string, hdrs http.Header,
 	return nil
 }
 
+// Check scans msg.
+// If a circuit breaker is configured and rspamd was unavailable for longer
+// than its timeout, requests are only sent periodically to probe if rspamd
+// is available again. Otherwise an error wrapping [ErrCircuitOpen] is
+// returned.
 func (c *Client) Check(ctx context.Context, msg io.Reader, hdrs *MailHeaders) (*CheckResult, error) {
 	var result CheckResult
+
+	if c.breaker != nil && !c.breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	h := hdrs.asHeader()
+	body, err := c.compressBody(h, msg)
+	if err != nil {
+		return nil, err
+	}
+
 	// wrap in NopCloser to prevent that http.NewRequest closes the reader,
 	// it is not responsible for closing it, the caller is
-	err := c.sendRequest(ctx, c.checkURL, hdrs.asHeader(), io.NopCloser(msg), &result)
+	err = c.sendWithFailover(ctx, pathCheck, h, io.NopCloser(body), &result)
+	err = c.recordAvailability(err)
 	if err != nil {
 		return nil, err
 	}
 	return &result, err
 }
 
+// Ping checks if rspamd is available via the /ping endpoint of all
+// endpoints. It succeeds if one of them is available.
+// It is sent regardless of the state of the circuit breaker, a successful
+// request closes it.
+func (c *Client) Ping(ctx context.Context) error {
+	var errs []error
+
+	for _, ep := range c.endpoints {
+		err := c.ping(ctx, ep)
+		c.setHealth(ep, err)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) < len(c.endpoints) {
+		return c.recordAvailability(nil)
+	}
+
+	return c.recordAvailability(errors.Join(errs...))
+}
+
+func (c *Client) ping(ctx context.Context, ep *endpoint) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ep.url+pathPing, nil)
+	if err != nil {
+		return fmt.Errorf("creating http request failed: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+
+	defer func() {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 512*1024))
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %w", ErrUnavailable,
+			&StatusError{StatusCode: resp.StatusCode, Status: resp.Status})
+	}
+
+	return nil
+}
+
+// sendToPrimary sends a request to the primary endpoint, it is not retried
+// with other endpoints.
+func (c *Client) sendToPrimary(ctx context.Context, path string, hdrs http.Header, msg io.Reader) error {
+	err := c.sendRequest(ctx, c.primary.url+path, hdrs, msg, nil)
+	c.setHealth(c.primary, err)
+
+	return err
+}
+
 func (c *Client) Ham(ctx context.Context, msg io.Reader, hdrs *MailHeaders) error {
 	// resp code 208 == already learned, returns a json with an "error"
 	// field
-	return c.sendRequest(ctx, c.hamURL, hdrs.asHeader(), msg, nil)
+	return c.learn(ctx, pathHam, msg, hdrs)
 }
 
 func (c *Client) Spam(ctx context.Context, msg io.Reader, hdrs *MailHeaders) error {
-	return c.sendRequest(ctx, c.spamURL, hdrs.asHeader(), msg, nil)
+	return c.learn(ctx, pathSpam, msg, hdrs)
 }
 
-type CheckResult struct {
-	Action    string             `json:"action"`
-	Score     float32            `json:"score"`
-	IsSkipped bool               `json:"is_skipped"`
-	Symbols   map[string]*Symbol `json:"symbols"`
-	Subject   string             `json:"subject,omitempty"`
+func (c *Client) learn(ctx context.Context, path string, msg io.Reader, hdrs *MailHeaders) error {
+	h := hdrs.asHeader()
+	body, err := c.compressBody(h, msg)
+	if err != nil {
+		return err
+	}
+
+	return c.sendToPrimary(ctx, path, h, body)
+}
+
+// FuzzyAdd adds the fuzzy hashes of msg to the fuzzy storage with flag and
+// weight.
+func (c *Client) FuzzyAdd(ctx context.Context, msg io.Reader, hdrs *MailHeaders, flag, weight int) error {
+	h := hdrs.asHeader()
+	h.Set("Flag", strconv.Itoa(flag))
+	h.Set("Weight", strconv.Itoa(weight))
+
+	return c.sendToPrimary(ctx, pathFuzzyAdd, h, msg)
+}
+
+// FuzzyDel removes the fuzzy hashes of msg with flag from the fuzzy storage.
+func (c *Client) FuzzyDel(ctx context.Context, msg io.Reader, hdrs *MailHeaders, flag int) error {
+	h := hdrs.asHeader()
+	h.Set("Flag", strconv.Itoa(flag))
+
+	return c.sendToPrimary(ctx, pathFuzzyDel, h, msg)
 }
 
+// CheckResult is the result of a /checkv2 request.
 // https://docs.rspamd.com/developers/protocol#protocol-basics
+type CheckResult struct {
+	Action string  `json:"action"`
+	Score  float32 `json:"score"`
+	// RequiredScore is the score of the reject action.
+	RequiredScore float32            `json:"required_score"`
+	IsSkipped     bool               `json:"is_skipped"`
+	Symbols       map[string]*Symbol `json:"symbols"`
+	Subject       string             `json:"subject,omitempty"`
+	MessageID     string             `json:"message-id,omitempty"`
+	// URLs are the hostnames of the URLs found in the message.
+	URLs   []string `json:"urls,omitempty"`
+	Emails []string `json:"emails,omitempty"`
+	// Messages are messages of rspamd plugins, e.g. the SMTP message of
+	// the reject action, keyed by their type.
+	Messages map[string]string `json:"messages,omitempty"`
+	// DKIMSignatures are the DKIM-Signature headers created by rspamd.
+	DKIMSignatures DKIMSignatures `json:"dkim-signature,omitempty"`
+	// TimeReal is the processing time of the request in seconds.
+	TimeReal float64 `json:"time_real,omitempty"`
+}
+
+// Symbol is a rule that matched the message.
 type Symbol struct {
 	Name  string  `json:"name"`
 	Score float32 `json:"score"`
+	// MetricScore is the weight of the symbol, Score is MetricScore
+	// multiplied by the dynamic weight of the match.
+	MetricScore float32 `json:"metric_score,omitempty"`
+	Description string  `json:"description,omitempty"`
+	Group       string  `json:"group,omitempty"`
+	// Options are additional details of the match, e.g. the matched
+	// domains.
+	Options []string `json:"options,omitempty"`
+}
+
+// String returns the symbol in the format used in the X-Spamd-Result header,
+// e.g. "DKIM_TRACE(0.00)[example.com:+]".
+func (s *Symbol) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "%s(%.2f)", s.Name, s.Score)
+	if len(s.Options) > 0 {
+		sb.WriteString("[" + strings.Join(s.Options, ",") + "]")
+	}
+
+	return sb.String()
+}
+
+// DKIMSignatures are DKIM-Signature header values.
+// rspamd returns a string for a single signature and an array for multiple.
+type DKIMSignatures []string
+
+func (d *DKIMSignatures) UnmarshalJSON(data []byte) error {
+	var sig string
+	if err := json.Unmarshal(data, &sig); err == nil {
+		*d = DKIMSignatures{sig}
+		return nil
+	}
+
+	var sigs []string
+	if err := json.Unmarshal(data, &sigs); err != nil {
+		return fmt.Errorf("dkim-signature is neither a string nor an array of strings: %w", err)
+	}
+	*d = sigs
+
+	return nil
 }
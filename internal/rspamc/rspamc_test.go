@@ -0,0 +1,106 @@
+package rspamc
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+const checkResultJSON = `{
+  "is_skipped": false,
+  "score": 5.5,
+  "required_score": 15,
+  "action": "add header",
+  "thresholds": {"reject": 15, "add header": 6},
+  "symbols": {
+    "DKIM_TRACE": {
+      "name": "DKIM_TRACE",
+      "score": 0,
+      "metric_score": 0,
+      "options": ["example.com:+"],
+      "description": "DKIM trace symbol",
+      "group": "policies"
+    },
+    "BAYES_SPAM": {"name": "BAYES_SPAM", "score": 5.5, "metric_score": 5.1}
+  },
+  "messages": {"smtp_message": "Spam message rejected"},
+  "message-id": "1234@example.com",
+  "urls": ["example.com", "example.org"],
+  "emails": ["user@example.com"],
+  "dkim-signature": "v=1; a=rsa-sha256; d=example.com",
+  "time_real": 0.25,
+  "milter": {"add_headers": {}}
+}`
+
+func TestCheckResult_Unmarshal(t *testing.T) {
+	var r CheckResult
+	assert.NoError(t, json.Unmarshal([]byte(checkResultJSON), &r))
+
+	assert.Equal(t, float32(5.5), r.Score)
+	assert.Equal(t, float32(15), r.RequiredScore)
+	assert.Equal(t, "add header", r.Action)
+	assert.Equal(t, "1234@example.com", r.MessageID)
+	assert.Equal(t, "example.com,example.org", strings.Join(r.URLs, ","))
+	assert.Equal(t, "user@example.com", strings.Join(r.Emails, ","))
+	assert.Equal(t, "Spam message rejected", r.Messages["smtp_message"])
+	assert.Equal(t, 1, len(r.DKIMSignatures))
+	assert.Equal(t, "v=1; a=rsa-sha256; d=example.com", r.DKIMSignatures[0])
+	assert.Equal(t, 0.25, r.TimeReal)
+
+	sym := r.Symbols["DKIM_TRACE"]
+	assert.Equal(t, "DKIM trace symbol", sym.Description)
+	assert.Equal(t, "policies", sym.Group)
+	assert.Equal(t, "example.com:+", strings.Join(sym.Options, ","))
+	assert.Equal(t, "DKIM_TRACE(0.00)[example.com:+]", sym.String())
+
+	sym = r.Symbols["BAYES_SPAM"]
+	assert.Equal(t, float32(5.1), sym.MetricScore)
+	assert.Equal(t, "BAYES_SPAM(5.50)", sym.String())
+}
+
+func TestDKIMSignatures_UnmarshalArray(t *testing.T) {
+	var r CheckResult
+	assert.NoError(t, json.Unmarshal([]byte(`{"dkim-signature": ["sig1", "sig2"]}`), &r))
+	assert.Equal(t, "sig1,sig2", strings.Join(r.DKIMSignatures, ","))
+
+	assert.Error(t, json.Unmarshal([]byte(`{"dkim-signature": 1}`), &r))
+}
+
+func TestFuzzy(t *testing.T) {
+	type request struct {
+		path, flag, weight, subject, body string
+	}
+	var reqs []request
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		reqs = append(reqs, request{
+			path:    r.URL.Path,
+			flag:    r.Header.Get("Flag"),
+			weight:  r.Header.Get("Weight"),
+			subject: r.Header.Get("Subject"),
+			body:    string(body),
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"success":true}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	clt := New(slog.New(slog.DiscardHandler), []string{srv.URL}, "")
+	hdrs := &MailHeaders{Subject: "test"}
+
+	assert.NoError(t, clt.FuzzyAdd(context.Background(), strings.NewReader("mail"), hdrs, 11, 5))
+	assert.NoError(t, clt.FuzzyDel(context.Background(), strings.NewReader("mail"), hdrs, 11))
+
+	assert.Equal(t, 2, len(reqs))
+	assert.Equal(t, request{path: "/fuzzyadd", flag: "11", weight: "5", subject: "test", body: "mail"}, reqs[0])
+	assert.Equal(t, request{path: "/fuzzydel", flag: "11", subject: "test", body: "mail"}, reqs[1])
+}
@@ -0,0 +1,89 @@
+package rspamc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+const (
+	pathStat    = "/stat"
+	pathSymbols = "/symbols"
+)
+
+// Stat is the result of a /stat request to the controller.
+type Stat struct {
+	ReadOnly bool `json:"read_only"`
+	// Scanned is the number of scanned messages.
+	Scanned int64 `json:"scanned"`
+	// Learned is the number of learned messages.
+	Learned int64 `json:"learned"`
+	// Actions are the number of scanned messages by action.
+	Actions   map[string]int64 `json:"actions"`
+	Statfiles []Statfile       `json:"statfiles"`
+	// FuzzyHashes are the number of stored hashes by fuzzy storage.
+	FuzzyHashes map[string]int64 `json:"fuzzy_hashes"`
+}
+
+// Statfile is the state of a statistics file of a classifier, e.g. of
+// BAYES_SPAM.
+type Statfile struct {
+	Symbol string `json:"symbol"`
+	Type   string `json:"type"`
+	// Revision is the number of messages learned into the statfile.
+	Revision int64 `json:"revision"`
+	Users    int64 `json:"users"`
+	Used     int64 `json:"used"`
+	Total    int64 `json:"total"`
+	Size     int64 `json:"size"`
+}
+
+// SymbolGroup is a group of symbols returned by a /symbols request.
+type SymbolGroup struct {
+	Group string       `json:"group"`
+	Rules []SymbolRule `json:"rules"`
+}
+
+// SymbolRule is the configuration and statistics of a symbol.
+type SymbolRule struct {
+	Symbol      string  `json:"symbol"`
+	Weight      float64 `json:"weight"`
+	Description string  `json:"description,omitempty"`
+	// Frequency is the rate of scanned messages the symbol matched.
+	Frequency float64 `json:"frequency"`
+	// Time is the average processing time of the rule in seconds.
+	Time float64 `json:"time"`
+}
+
+// Stat returns the statistics of the primary endpoint.
+func (c *Client) Stat(ctx context.Context) (*Stat, error) {
+	var result Stat
+
+	if err := c.get(ctx, pathStat, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Symbols returns the symbols configured at the primary endpoint.
+func (c *Client) Symbols(ctx context.Context) ([]SymbolGroup, error) {
+	var result []SymbolGroup
+
+	if err := c.get(ctx, pathSymbols, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// get sends a GET request for path to the primary endpoint and decodes the
+// response into result.
+func (c *Client) get(ctx context.Context, path string, result any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.primary.url+path, nil)
+	if err != nil {
+		return fmt.Errorf("creating http request failed: %w", err)
+	}
+
+	return c.do(req, result)
+}
@@ -0,0 +1,79 @@
+package rspamc
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+const statJSON = `{
+  "read_only": false,
+  "scanned": 1234,
+  "learned": 420,
+  "actions": {"reject": 12, "no action": 1100},
+  "statfiles": [
+    {"revision": 300, "used": 0, "total": 0, "size": 0, "symbol": "BAYES_SPAM", "type": "redis", "languages": 0, "users": 1},
+    {"revision": 120, "used": 0, "total": 0, "size": 0, "symbol": "BAYES_HAM", "type": "redis", "languages": 0, "users": 1}
+  ],
+  "total_learns": 420,
+  "fuzzy_hashes": {"local": 17}
+}`
+
+const symbolsJSON = `[
+  {"group": "bayes", "rules": [
+    {"symbol": "BAYES_SPAM", "weight": 5.1, "description": "Message probably spam", "frequency": 0.1, "time": 0.001}
+  ]}
+]`
+
+func TestStatAndSymbols(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("got %s request, expected GET", r.Method)
+		}
+		if r.Header.Get("password") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case pathStat:
+			_, _ = w.Write([]byte(statJSON))
+		case pathSymbols:
+			_, _ = w.Write([]byte(symbolsJSON))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	clt := New(slog.New(slog.DiscardHandler), []string{srv.URL}, "secret")
+
+	stat, err := clt.Stat(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1234), stat.Scanned)
+	assert.Equal(t, int64(420), stat.Learned)
+	assert.Equal(t, int64(12), stat.Actions["reject"])
+	assert.Equal(t, 2, len(stat.Statfiles))
+	assert.Equal(t, "BAYES_HAM", stat.Statfiles[1].Symbol)
+	assert.Equal(t, int64(120), stat.Statfiles[1].Revision)
+	assert.Equal(t, int64(17), stat.FuzzyHashes["local"])
+
+	groups, err := clt.Symbols(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(groups))
+	assert.Equal(t, "bayes", groups[0].Group)
+	assert.Equal(t, 1, len(groups[0].Rules))
+	assert.Equal(t, 5.1, groups[0].Rules[0].Weight)
+
+	clt = New(slog.New(slog.DiscardHandler), []string{srv.URL}, "wrong")
+	_, err = clt.Stat(context.Background())
+	var statusErr *StatusError
+	assert.Equal(t, true, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusForbidden, statusErr.StatusCode)
+}
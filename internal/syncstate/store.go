@@ -0,0 +1,176 @@
+// Package syncstate stores the synchronization state of IMAP mailboxes and
+// the schedule of late rescans.
+package syncstate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/log"
+)
+
+const fileVersion = 1
+
+// Store keeps the [imapclt.SyncState] of mailboxes and the due times of late
+// rescans in memory and optionally persists them to a JSON file.
+type Store struct {
+	path    string
+	account string
+	logger  *slog.Logger
+
+	mu          sync.Mutex
+	states      map[string]imapclt.SyncState
+	lateRescans map[string]time.Time
+}
+
+type fileContent struct {
+	Version     int                          `json:"version"`
+	Account     string                       `json:"account"`
+	Mailboxes   map[string]imapclt.SyncState `json:"mailboxes"`
+	LateRescans map[string]time.Time         `json:"late_rescans,omitempty"`
+}
+
+// NewMemoryStore returns a store that does not persist the states.
+func NewMemoryStore() *Store {
+	return &Store{
+		logger: log.EnsureLoggerInstance(nil),
+		states: map[string]imapclt.SyncState{},
+	}
+}
+
+// Open loads the states from the file at path.
+// If the file does not exist, the store is empty and the file is created
+// on the first [Store.Set] call.
+// account identifies the IMAP account, when the file contains the states of
+// a different account, they are discarded.
+func Open(path, account string, logger *slog.Logger) (*Store, error) {
+	s := Store{
+		path:    path,
+		account: account,
+		logger:  log.EnsureLoggerInstance(logger).With("filepath", path),
+		states:  map[string]imapclt.SyncState{},
+	}
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &s, nil
+		}
+		return nil, fmt.Errorf("reading sync state file failed: %w", err)
+	}
+
+	var content fileContent
+	if err := json.Unmarshal(buf, &content); err != nil {
+		return nil, fmt.Errorf("parsing sync state file %s failed: %w", path, err)
+	}
+
+	if content.Version != fileVersion {
+		return nil, fmt.Errorf("sync state file %s has unsupported version %d", path, content.Version)
+	}
+
+	if content.Account != account {
+		s.logger.Warn("sync state file belongs to a different account, discarding it",
+			"event", "syncstate.account_mismatch",
+			"account.file", content.Account,
+			"account.expected", account,
+		)
+		return &s, nil
+	}
+
+	if content.Mailboxes != nil {
+		s.states = content.Mailboxes
+	}
+	s.lateRescans = content.LateRescans
+
+	return &s, nil
+}
+
+// Get returns the state of mailbox.
+// If no state is known, the zero value is returned.
+func (s *Store) Get(mailbox string) imapclt.SyncState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.states[mailbox]
+}
+
+// Set stores the state of mailbox.
+// If the store has a file, it is written atomically.
+func (s *Store) Set(mailbox string, state imapclt.SyncState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.states[mailbox] = state
+
+	if s.path == "" {
+		return nil
+	}
+
+	return s.write()
+}
+
+// LateRescans returns the due times of the late rescans, keyed by
+// Message-ID.
+func (s *Store) LateRescans() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return maps.Clone(s.lateRescans)
+}
+
+// SetLateRescans stores the due times of the late rescans, keyed by
+// Message-ID.
+// If the store has a file, it is written atomically.
+func (s *Store) SetLateRescans(rescans map[string]time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lateRescans = maps.Clone(rescans)
+
+	if s.path == "" {
+		return nil
+	}
+
+	return s.write()
+}
+
+func (s *Store) write() error {
+	buf, err := json.MarshalIndent(&fileContent{
+		Version:     fileVersion,
+		Account:     s.account,
+		Mailboxes:   s.states,
+		LateRescans: s.lateRescans,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("creating temporary sync state file failed: %w", err)
+	}
+
+	_, err = tmpFile.Write(buf)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	err = errors.Join(err, tmpFile.Close())
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), s.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return fmt.Errorf("writing sync state file failed: %w", err)
+	}
+
+	return nil
+}
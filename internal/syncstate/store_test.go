@@ -0,0 +1,56 @@
+package syncstate
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/imapclt"
+	"github.com/fho/rspamd-iscan/internal/log"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+func TestStore_Persists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	s, err := Open(path, "user@imap:993", log.SlogTestLogger(t))
+	assert.NoError(t, err)
+	assert.Equal(t, imapclt.SyncState{}, s.Get("INBOX"))
+
+	state := imapclt.SyncState{UIDValidity: 7, LastUID: 42, HighestModSeq: 1000}
+	assert.NoError(t, s.Set("INBOX", state))
+
+	s, err = Open(path, "user@imap:993", log.SlogTestLogger(t))
+	assert.NoError(t, err)
+	assert.Equal(t, state, s.Get("INBOX"))
+	assert.Equal(t, imapclt.SyncState{}, s.Get("Spam"))
+}
+
+func TestStore_AccountMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	s, err := Open(path, "user@imap:993", log.SlogTestLogger(t))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Set("INBOX", imapclt.SyncState{UIDValidity: 1, LastUID: 3}))
+
+	s, err = Open(path, "other@imap:993", log.SlogTestLogger(t))
+	assert.NoError(t, err)
+	assert.Equal(t, imapclt.SyncState{}, s.Get("INBOX"))
+}
+
+func TestStore_PersistsLateRescans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	s, err := Open(path, "user@imap:993", log.SlogTestLogger(t))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(s.LateRescans()))
+
+	dueAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, s.SetLateRescans(map[string]time.Time{"<a@example.com>": dueAt}))
+
+	s, err = Open(path, "user@imap:993", log.SlogTestLogger(t))
+	assert.NoError(t, err)
+	rescans := s.LateRescans()
+	assert.Equal(t, 1, len(rescans))
+	assert.Equal(t, true, rescans["<a@example.com>"].Equal(dueAt))
+}
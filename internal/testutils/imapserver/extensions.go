@@ -0,0 +1,227 @@
+package imapserver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// extensionListener wraps the accepted connections in [extensionConn].
+type extensionListener struct {
+	net.Listener
+	srv      *Server
+	compress bool
+	quota    bool
+	// startTLS is optional, if set STARTTLS commands are answered by
+	// [extensionConn]
+	startTLS *tls.Config
+}
+
+func (l *extensionListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &extensionConn{
+		Conn:     conn,
+		br:       bufio.NewReader(conn),
+		srv:      l.srv,
+		compress: l.compress,
+		quota:    l.quota,
+		startTLS: l.startTLS,
+	}, nil
+}
+
+// extensionConn implements the server side of the COMPRESS (RFC 4978) and
+// GETQUOTAROOT (RFC 9208) commands, which are not supported by imapserver.
+// The commands are answered by extensionConn and not forwarded, the
+// capabilities are added to the capability lists sent by the server.
+// STARTTLS is also answered by extensionConn if startTLS is set, otherwise
+// imapserver would establish TLS above the compression layer.
+type extensionConn struct {
+	net.Conn
+
+	srv      *Server
+	compress bool
+	quota    bool
+	startTLS *tls.Config
+
+	br      *bufio.Reader
+	fr      io.Reader
+	pending []byte
+
+	wmu sync.Mutex
+	fw  *flate.Writer
+}
+
+func (c *extensionConn) Read(p []byte) (int, error) {
+	for {
+		if len(c.pending) > 0 {
+			n := copy(p, c.pending)
+			c.pending = c.pending[n:]
+			return n, nil
+		}
+
+		var line []byte
+		var err error
+		if c.fr != nil {
+			line, err = readLine(c.fr)
+		} else {
+			line, err = c.br.ReadBytes('\n')
+		}
+		if err != nil {
+			if len(line) == 0 {
+				return 0, err
+			}
+			c.pending = line
+			continue
+		}
+
+		fields := bytes.Fields(line)
+		if len(fields) < 2 {
+			c.pending = line
+			continue
+		}
+
+		tag, cmd := fields[0], string(bytes.ToUpper(fields[1]))
+		switch {
+		case c.compress && cmd == "COMPRESS" && len(fields) == 3:
+			err = c.startCompression(tag, fields[2])
+		case c.startTLS != nil && cmd == "STARTTLS" && len(fields) == 2:
+			err = c.upgradeTLS(tag)
+		case c.quota && cmd == "GETQUOTAROOT" && len(fields) == 3:
+			err = c.writeQuota(tag, fields[2])
+		default:
+			c.pending = line
+			continue
+		}
+
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readLine reads a line byte by byte from r, to not read data after the
+// line.
+func readLine(r io.Reader) ([]byte, error) {
+	var line []byte
+	b := make([]byte, 1)
+
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return line, err
+		}
+
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			return line, nil
+		}
+	}
+}
+
+func (c *extensionConn) startCompression(tag, mechanism []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.fw != nil {
+		return c.write(string(tag) + " NO [COMPRESSIONACTIVE] DEFLATE active via COMPRESS\r\n")
+	}
+
+	if !bytes.EqualFold(mechanism, []byte("DEFLATE")) {
+		return c.write(string(tag) + " BAD unsupported compression mechanism\r\n")
+	}
+
+	if err := c.write(string(tag) + " OK DEFLATE active\r\n"); err != nil {
+		return err
+	}
+
+	fw, err := flate.NewWriter(c.Conn, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	c.fw = fw
+	c.fr = flate.NewReader(c.br)
+
+	return nil
+}
+
+// upgradeTLS answers the STARTTLS command and upgrades the connection to
+// TLS. imapserver does not notice the upgrade.
+func (c *extensionConn) upgradeTLS(tag []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := c.write(string(tag) + " OK begin TLS negotiation now\r\n"); err != nil {
+		return err
+	}
+
+	tlsConn := tls.Server(&bufferedConn{Conn: c.Conn, r: c.br}, c.startTLS)
+	c.Conn = tlsConn
+	c.br = bufio.NewReader(tlsConn)
+
+	return nil
+}
+
+// bufferedConn is a connection whose data is read from r.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *extensionConn) writeQuota(tag, mailbox []byte) error {
+	usage, limit := c.srv.quota()
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return c.write(fmt.Sprintf(
+		"* QUOTAROOT %s \"\"\r\n* QUOTA \"\" (STORAGE %d %d)\r\n%s OK GETQUOTAROOT completed\r\n",
+		mailbox, usage, limit, tag,
+	))
+}
+
+// write writes s to the connection, compressed if compression is enabled.
+// c.wmu must be held.
+func (c *extensionConn) write(s string) error {
+	if c.fw == nil {
+		_, err := c.Conn.Write([]byte(s))
+		return err
+	}
+
+	if _, err := c.fw.Write([]byte(s)); err != nil {
+		return err
+	}
+
+	return c.fw.Flush()
+}
+
+func (c *extensionConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	caps := "CAPABILITY IMAP4rev1"
+	if c.compress {
+		caps += " COMPRESS=DEFLATE"
+	}
+	if c.quota {
+		caps += " QUOTA"
+	}
+
+	data := bytes.ReplaceAll(p, []byte("CAPABILITY IMAP4rev1"), []byte(caps))
+	if err := c.write(string(data)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
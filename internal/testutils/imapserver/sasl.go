@@ -0,0 +1,88 @@
+package imapserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-sasl"
+)
+
+const mechXOAuth2 = "XOAUTH2"
+
+// saslSession extends a session with support for the PLAIN, XOAUTH2 and
+// OAUTHBEARER SASL mechanisms.
+// The OAuth mechanisms accept [Server.OAuthAccessToken] as access token.
+type saslSession struct {
+	imapserver.SessionIMAP4rev2
+	srv *Server
+}
+
+func (s *saslSession) AuthenticateMechanisms() []string {
+	return []string{sasl.Plain, mechXOAuth2, sasl.OAuthBearer}
+}
+
+func (s *saslSession) Authenticate(mech string) (sasl.Server, error) {
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(_, username, password string) error {
+			return s.Login(username, password)
+		}), nil
+
+	case mechXOAuth2:
+		return &xoauth2Server{authenticate: s.loginWithToken}, nil
+
+	case sasl.OAuthBearer:
+		return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+			if err := s.loginWithToken(opts.Username, opts.Token); err != nil {
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+			return nil
+		}), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported mechanism: %s", mech)
+	}
+}
+
+func (s *saslSession) loginWithToken(username, token string) error {
+	if s.srv.OAuthAccessToken == "" || token != s.srv.OAuthAccessToken {
+		return imapserver.ErrAuthFailed
+	}
+
+	return s.Login(username, s.srv.UserPasswd)
+}
+
+type xoauth2Server struct {
+	authenticate func(user, token string) error
+	failed       bool
+}
+
+func (a *xoauth2Server) Next(response []byte) ([]byte, bool, error) {
+	if a.failed {
+		// the response to the error challenge is empty
+		return nil, true, imapserver.ErrAuthFailed
+	}
+
+	var user, token string
+	for field := range bytes.SplitSeq(response, []byte{0x01}) {
+		if v, ok := bytes.CutPrefix(field, []byte("user=")); ok {
+			user = string(v)
+		}
+		if v, ok := bytes.CutPrefix(field, []byte("auth=Bearer ")); ok {
+			token = string(v)
+		}
+	}
+
+	if user == "" || token == "" {
+		return nil, true, errors.New("malformed xoauth2 response")
+	}
+
+	if err := a.authenticate(user, token); err != nil {
+		a.failed = true
+		return []byte(`{"status":"401","schemes":"bearer"}`), false, nil
+	}
+
+	return nil, true, nil
+}
@@ -1,9 +1,13 @@
 package imapserver
 
 import (
+	"crypto/tls"
 	"errors"
+	"net"
+	"sync"
 	"testing"
 
+	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapserver"
 	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
 )
@@ -12,6 +16,9 @@ type Server struct {
 	UserName   string
 	UserPasswd string
 	ListenAddr string
+	// OAuthAccessToken is the access token that is accepted by the XOAUTH2
+	// and OAUTHBEARER authentication mechanisms.
+	OAuthAccessToken string
 
 	BackupMailbox     string
 	HamMailbox        string
@@ -22,13 +29,81 @@ type Server struct {
 
 	srv *imapserver.Server
 	ch  chan error
+
+	quotaMu    sync.Mutex
+	quotaUsage int64
+	quotaLimit int64
+}
+
+// Option configures the test server.
+type Option func(*options)
+
+type options struct {
+	tlsConfig   *tls.Config
+	implicitTLS bool
+	caps        imap.CapSet
+	compress    bool
+	quota       bool
+	quotaUsage  int64
+	quotaLimit  int64
+}
+
+// DefaultCaps are the capabilities the server advertises by default.
+var DefaultCaps = imap.CapSet{
+	imap.CapIMAP4rev1: {},
+	imap.CapMove:      {},
+	imap.CapUIDPlus:   {},
+}
+
+// WithCaps sets the capabilities the server advertises, it must contain
+// IMAP4rev1.
+func WithCaps(caps ...imap.Cap) Option {
+	return func(o *options) {
+		o.caps = imap.CapSet{}
+		for _, c := range caps {
+			o.caps[c] = struct{}{}
+		}
+	}
+}
+
+// WithTLS enables TLS, if implicit is true connections are TLS encrypted
+// from the start, otherwise STARTTLS is supported.
+func WithTLS(cfg *tls.Config, implicit bool) Option {
+	return func(o *options) {
+		o.tlsConfig = cfg
+		o.implicitTLS = implicit
+	}
+}
+
+// WithCompression enables support for the COMPRESS=DEFLATE extension
+// (RFC 4978) and advertises its capability.
+func WithCompression() Option {
+	return func(o *options) {
+		o.compress = true
+	}
+}
+
+// WithQuota enables support for the GETQUOTAROOT command (RFC 9208) and
+// advertises the QUOTA capability. All mailboxes belong to the same quota
+// root with the given storage usage and limit in units of 1024 octets.
+func WithQuota(usage, limit int64) Option {
+	return func(o *options) {
+		o.quota = true
+		o.quotaUsage = usage
+		o.quotaLimit = limit
+	}
 }
 
-func StartServer(t *testing.T) *Server {
+func StartServer(t *testing.T, opts ...Option) *Server {
+	o := options{caps: DefaultCaps}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	srv := Server{
 		UserName:          "user",
 		UserPasswd:        "none",
-		ListenAddr:        "localhost:10143",
+		OAuthAccessToken:  "test-access-token",
 		ch:                make(chan error, 2),
 		InboxMailBox:      "INBOX",
 		ScanMailbox:       "unscanned",
@@ -36,6 +111,8 @@ func StartServer(t *testing.T) *Server {
 		HamMailbox:        "ham",
 		SpamMailbox:       "spam",
 		UndetectedMailbox: "undetected",
+		quotaUsage:        o.quotaUsage,
+		quotaLimit:        o.quotaLimit,
 	}
 
 	user := imapmemserver.NewUser(srv.UserName, srv.UserPasswd)
@@ -51,15 +128,38 @@ func StartServer(t *testing.T) *Server {
 
 	isrv := imapserver.New(&imapserver.Options{
 		NewSession: func(*imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
-			return msrv.NewSession(), nil, nil
+			return &saslSession{
+				SessionIMAP4rev2: msrv.NewSession().(imapserver.SessionIMAP4rev2),
+				srv:              &srv,
+			}, nil, nil
 		},
 		Logger:       testLoggerAsImapServerLogger(t),
 		InsecureAuth: true,
+		TLSConfig:    o.tlsConfig,
+		Caps:         o.caps,
 	})
 
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listening for imap connections failed: %s", err)
+	}
+	srv.ListenAddr = ln.Addr().String()
+
+	if o.tlsConfig != nil && o.implicitTLS {
+		ln = tls.NewListener(ln, o.tlsConfig)
+	}
+
+	if o.compress || o.quota {
+		el := extensionListener{Listener: ln, srv: &srv, compress: o.compress, quota: o.quota}
+		if o.tlsConfig != nil && !o.implicitTLS {
+			el.startTLS = o.tlsConfig
+		}
+		ln = &el
+	}
+
 	t.Cleanup(func() { _ = isrv.Close() })
 	go func() {
-		err := isrv.ListenAndServe(srv.ListenAddr)
+		err := isrv.Serve(ln)
 		srv.ch <- err
 		close(srv.ch)
 	}()
@@ -73,6 +173,23 @@ func createMailbox(t *testing.T, user *imapmemserver.User, mailboxName string) {
 	}
 }
 
+// SetQuota sets the storage usage and limit that are reported when the
+// server was started with [WithQuota].
+func (s *Server) SetQuota(usage, limit int64) {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+
+	s.quotaUsage = usage
+	s.quotaLimit = limit
+}
+
+func (s *Server) quota() (usage, limit int64) {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+
+	return s.quotaUsage, s.quotaLimit
+}
+
 func (s *Server) Close() error {
 	err := s.srv.Close()
 
@@ -0,0 +1,750 @@
+// Package jmapserver provides a minimal in-memory JMAP server for tests.
+//
+// It supports the session resource, blob upload and download, the event
+// source push channel and the methods Mailbox/get, Mailbox/set (create),
+// Email/query (inMailbox filter), Email/get, Email/set (update) and
+// Email/import.
+package jmapserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	AccountID = "a1"
+	User      = "user"
+	Password  = "password"
+
+	capCore = "urn:ietf:params:jmap:core"
+	capMail = "urn:ietf:params:jmap:mail"
+)
+
+// Server is an in-memory JMAP server that accepts the credentials [User] and
+// [Password] via basic authentication.
+type Server struct {
+	// URL is the URL of the session resource.
+	URL string
+	// InboxID is the ID of the mailbox with the inbox role.
+	InboxID string
+
+	srv *httptest.Server
+
+	mu          sync.Mutex
+	nextID      int
+	state       int
+	mailboxes   map[string]*mailbox
+	emails      map[string]*email
+	blobs       map[string][]byte
+	subscribers map[chan struct{}]struct{}
+}
+
+type mailbox struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	ParentID *string `json:"parentId"`
+	Role     *string `json:"role"`
+}
+
+type address struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type email struct {
+	ID         string          `json:"id"`
+	BlobID     string          `json:"blobId"`
+	MailboxIDs map[string]bool `json:"mailboxIds"`
+	Keywords   map[string]bool `json:"keywords"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+	Size       int             `json:"size"`
+	SentAt     *time.Time      `json:"sentAt"`
+	Subject    string          `json:"subject"`
+	From       []address       `json:"from"`
+	To         []address       `json:"to"`
+	Cc         []address       `json:"cc"`
+	Bcc        []address       `json:"bcc"`
+	MessageID  []string        `json:"messageId"`
+}
+
+type methodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+// Start starts a server that listens on a random localhost port.
+func Start(t *testing.T) *Server {
+	s := Server{
+		mailboxes:   map[string]*mailbox{},
+		emails:      map[string]*email{},
+		blobs:       map[string][]byte{},
+		subscribers: map[chan struct{}]struct{}{},
+	}
+
+	role := "inbox"
+	s.InboxID = s.newID("M")
+	s.mailboxes[s.InboxID] = &mailbox{ID: s.InboxID, Name: "Inbox", Role: &role}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jmap/session", s.handleSession)
+	mux.HandleFunc("POST /jmap/api", s.handleAPI)
+	mux.HandleFunc("POST /jmap/upload/{accountId}/", s.handleUpload)
+	mux.HandleFunc("GET /jmap/download/{accountId}/{blobId}/{name}", s.handleDownload)
+	mux.HandleFunc("GET /jmap/eventsource", s.handleEventSource)
+
+	s.srv = httptest.NewServer(s.authenticate(mux))
+	t.Cleanup(s.srv.Close)
+
+	s.URL = s.srv.URL + "/jmap/session"
+
+	return &s
+}
+
+// AddMailbox creates a mailbox with the given role, it returns its ID.
+func (s *Server) AddMailbox(name, role string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.newID("M")
+	mbox := mailbox{ID: id, Name: name}
+	if role != "" {
+		mbox.Role = &role
+	}
+	s.mailboxes[id] = &mbox
+
+	return id
+}
+
+// newID returns a new object ID.
+// s.mu must be held.
+func (s *Server) newID(prefix string) string {
+	s.nextID++
+	return prefix + strconv.Itoa(s.nextID)
+}
+
+// changed increments the state and notifies event source subscribers.
+// s.mu must be held.
+func (s *Server) changed() {
+	s.state++
+	for ch := range s.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != User || password != Password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="jmap"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handleSession(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	state := s.state
+	s.mu.Unlock()
+
+	writeJSON(w, map[string]any{
+		"capabilities": map[string]any{
+			capCore: map[string]any{"maxObjectsInGet": 2, "maxObjectsInSet": 2},
+			capMail: map[string]any{},
+		},
+		"accounts": map[string]any{
+			AccountID: map[string]any{"name": User, "isPersonal": true},
+		},
+		"primaryAccounts": map[string]string{capMail: AccountID},
+		"username":        User,
+		"apiUrl":          s.srv.URL + "/jmap/api",
+		"downloadUrl":     s.srv.URL + "/jmap/download/{accountId}/{blobId}/{name}?accept={type}",
+		"uploadUrl":       s.srv.URL + "/jmap/upload/{accountId}/",
+		// a relative URL, it must be resolved by the client
+		"eventSourceUrl": "/jmap/eventsource?types={types}&closeafter={closeafter}&ping={ping}",
+		"state":          strconv.Itoa(state),
+	})
+}
+
+func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MethodCalls [][]json.RawMessage `json:"methodCalls"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	responses := make([]any, 0, len(req.MethodCalls))
+	for _, call := range req.MethodCalls {
+		if len(call) != 3 {
+			http.Error(w, "invalid method call", http.StatusBadRequest)
+			return
+		}
+
+		var name, callID string
+		if json.Unmarshal(call[0], &name) != nil || json.Unmarshal(call[2], &callID) != nil {
+			http.Error(w, "invalid method call", http.StatusBadRequest)
+			return
+		}
+
+		result, merr := s.dispatch(name, call[1])
+		if merr != nil {
+			responses = append(responses, []any{"error", merr, callID})
+			continue
+		}
+		responses = append(responses, []any{name, result, callID})
+	}
+
+	writeJSON(w, map[string]any{
+		"methodResponses": responses,
+		"sessionState":    strconv.Itoa(s.state),
+	})
+}
+
+// dispatch executes a method call.
+// s.mu must be held.
+func (s *Server) dispatch(name string, rawArgs json.RawMessage) (any, *methodError) {
+	var args struct {
+		AccountID string `json:"accountId"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return nil, &methodError{Type: "invalidArguments", Description: err.Error()}
+	}
+
+	if args.AccountID != AccountID {
+		return nil, &methodError{Type: "accountNotFound"}
+	}
+
+	var fn func(json.RawMessage) (any, *methodError)
+
+	switch name {
+	case "Mailbox/get":
+		fn = s.mailboxGet
+	case "Mailbox/set":
+		fn = s.mailboxSet
+	case "Email/query":
+		fn = s.emailQuery
+	case "Email/get":
+		fn = s.emailGet
+	case "Email/set":
+		fn = s.emailSet
+	case "Email/import":
+		fn = s.emailImport
+	default:
+		return nil, &methodError{Type: "unknownMethod"}
+	}
+
+	return fn(rawArgs)
+}
+
+func (s *Server) mailboxGet(rawArgs json.RawMessage) (any, *methodError) {
+	var args struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return nil, &methodError{Type: "invalidArguments", Description: err.Error()}
+	}
+
+	ids := args.IDs
+	if ids == nil {
+		for id := range s.mailboxes {
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+	}
+
+	list := []any{}
+	notFound := []string{}
+
+	for _, id := range ids {
+		mbox, ok := s.mailboxes[id]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+
+		total := 0
+		for _, e := range s.emails {
+			if e.MailboxIDs[id] {
+				total++
+			}
+		}
+
+		list = append(list, map[string]any{
+			"id":          mbox.ID,
+			"name":        mbox.Name,
+			"parentId":    mbox.ParentID,
+			"role":        mbox.Role,
+			"totalEmails": total,
+		})
+	}
+
+	return map[string]any{
+		"accountId": AccountID,
+		"state":     strconv.Itoa(s.state),
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+func (s *Server) mailboxSet(rawArgs json.RawMessage) (any, *methodError) {
+	var args struct {
+		Create map[string]struct {
+			Name     string  `json:"name"`
+			ParentID *string `json:"parentId"`
+		} `json:"create"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return nil, &methodError{Type: "invalidArguments", Description: err.Error()}
+	}
+
+	created := map[string]any{}
+	notCreated := map[string]*methodError{}
+
+	for cid, obj := range args.Create {
+		if obj.Name == "" {
+			notCreated[cid] = &methodError{Type: "invalidProperties", Description: "name is empty"}
+			continue
+		}
+
+		if obj.ParentID != nil {
+			if _, ok := s.mailboxes[*obj.ParentID]; !ok {
+				notCreated[cid] = &methodError{Type: "invalidProperties", Description: "parent not found"}
+				continue
+			}
+		}
+
+		exists := slices.ContainsFunc(slices.Collect(maps.Values(s.mailboxes)), func(m *mailbox) bool {
+			return m.Name == obj.Name && ptrEqual(m.ParentID, obj.ParentID)
+		})
+		if exists {
+			notCreated[cid] = &methodError{Type: "invalidProperties", Description: "mailbox exists"}
+			continue
+		}
+
+		id := s.newID("M")
+		s.mailboxes[id] = &mailbox{ID: id, Name: obj.Name, ParentID: obj.ParentID}
+		created[cid] = map[string]any{"id": id}
+	}
+
+	s.changed()
+
+	return map[string]any{
+		"accountId":  AccountID,
+		"newState":   strconv.Itoa(s.state),
+		"created":    created,
+		"notCreated": notCreated,
+	}, nil
+}
+
+func (s *Server) emailQuery(rawArgs json.RawMessage) (any, *methodError) {
+	var args struct {
+		Filter struct {
+			InMailbox string `json:"inMailbox"`
+		} `json:"filter"`
+		Position int  `json:"position"`
+		Limit    *int `json:"limit"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return nil, &methodError{Type: "invalidArguments", Description: err.Error()}
+	}
+
+	var emails []*email
+	for _, e := range s.emails {
+		if args.Filter.InMailbox == "" || e.MailboxIDs[args.Filter.InMailbox] {
+			emails = append(emails, e)
+		}
+	}
+
+	slices.SortFunc(emails, func(a, b *email) int {
+		if c := a.ReceivedAt.Compare(b.ReceivedAt); c != 0 {
+			return c
+		}
+		return idCompare(a.ID, b.ID)
+	})
+
+	ids := []string{}
+	for i := args.Position; i < len(emails); i++ {
+		if args.Limit != nil && len(ids) == *args.Limit {
+			break
+		}
+		ids = append(ids, emails[i].ID)
+	}
+
+	return map[string]any{
+		"accountId":  AccountID,
+		"queryState": strconv.Itoa(s.state),
+		"position":   args.Position,
+		"ids":        ids,
+	}, nil
+}
+
+func (s *Server) emailGet(rawArgs json.RawMessage) (any, *methodError) {
+	var args struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return nil, &methodError{Type: "invalidArguments", Description: err.Error()}
+	}
+
+	list := []*email{}
+	notFound := []string{}
+
+	// the list is returned in reverse order, clients must not rely on it
+	for _, id := range slices.Backward(args.IDs) {
+		e, ok := s.emails[id]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+
+		list = append(list, e)
+	}
+
+	return map[string]any{
+		"accountId": AccountID,
+		"state":     strconv.Itoa(s.state),
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+func (s *Server) emailSet(rawArgs json.RawMessage) (any, *methodError) {
+	var args struct {
+		Update map[string]map[string]json.RawMessage `json:"update"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return nil, &methodError{Type: "invalidArguments", Description: err.Error()}
+	}
+
+	updated := map[string]any{}
+	notUpdated := map[string]*methodError{}
+
+	for id, patch := range args.Update {
+		e, ok := s.emails[id]
+		if !ok {
+			notUpdated[id] = &methodError{Type: "notFound"}
+			continue
+		}
+
+		if merr := s.applyPatch(e, patch); merr != nil {
+			notUpdated[id] = merr
+			continue
+		}
+
+		updated[id] = nil
+	}
+
+	s.changed()
+
+	return map[string]any{
+		"accountId":  AccountID,
+		"newState":   strconv.Itoa(s.state),
+		"updated":    updated,
+		"notUpdated": notUpdated,
+	}, nil
+}
+
+// applyPatch applies a PatchObject to e, it is only changed when the patch
+// is valid.
+func (s *Server) applyPatch(e *email, patch map[string]json.RawMessage) *methodError {
+	keywords := cloneMap(e.Keywords)
+	mailboxIDs := cloneMap(e.MailboxIDs)
+
+	for path, rawValue := range patch {
+		var value *bool
+		if err := json.Unmarshal(rawValue, &value); err != nil {
+			return &methodError{Type: "invalidPatch", Description: err.Error()}
+		}
+
+		prop, key, _ := strings.Cut(path, "/")
+		key = strings.NewReplacer("~1", "/", "~0", "~").Replace(key)
+
+		var m map[string]bool
+		switch prop {
+		case "keywords":
+			m = keywords
+		case "mailboxIds":
+			m = mailboxIDs
+			if _, ok := s.mailboxes[key]; !ok && value != nil {
+				return &methodError{Type: "invalidProperties", Description: "mailbox not found"}
+			}
+		default:
+			return &methodError{Type: "invalidPatch", Description: "unsupported property " + prop}
+		}
+
+		if key == "" {
+			return &methodError{Type: "invalidPatch", Description: "replacing " + prop + " is not supported"}
+		}
+
+		if value != nil && *value {
+			m[key] = true
+		} else {
+			delete(m, key)
+		}
+	}
+
+	if len(mailboxIDs) == 0 {
+		return &methodError{Type: "invalidProperties", Description: "email must be in at least 1 mailbox"}
+	}
+
+	e.Keywords = keywords
+	e.MailboxIDs = mailboxIDs
+
+	return nil
+}
+
+func (s *Server) emailImport(rawArgs json.RawMessage) (any, *methodError) {
+	var args struct {
+		Emails map[string]struct {
+			BlobID     string          `json:"blobId"`
+			MailboxIDs map[string]bool `json:"mailboxIds"`
+			Keywords   map[string]bool `json:"keywords"`
+			ReceivedAt *time.Time      `json:"receivedAt"`
+		} `json:"emails"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return nil, &methodError{Type: "invalidArguments", Description: err.Error()}
+	}
+
+	created := map[string]any{}
+	notCreated := map[string]*methodError{}
+
+	for cid, obj := range args.Emails {
+		data, ok := s.blobs[obj.BlobID]
+		if !ok {
+			notCreated[cid] = &methodError{Type: "blobNotFound"}
+			continue
+		}
+
+		if len(obj.MailboxIDs) == 0 {
+			notCreated[cid] = &methodError{Type: "invalidProperties", Description: "mailboxIds is empty"}
+			continue
+		}
+
+		for id := range obj.MailboxIDs {
+			if _, ok := s.mailboxes[id]; !ok {
+				notCreated[cid] = &methodError{Type: "invalidProperties", Description: "mailbox not found"}
+				break
+			}
+		}
+		if _, ok := notCreated[cid]; ok {
+			continue
+		}
+
+		e, err := parseEmail(data)
+		if err != nil {
+			notCreated[cid] = &methodError{Type: "invalidEmail", Description: err.Error()}
+			continue
+		}
+
+		e.ID = s.newID("E")
+		e.BlobID = obj.BlobID
+		e.MailboxIDs = cloneMap(obj.MailboxIDs)
+		e.Keywords = map[string]bool{}
+		for kw := range obj.Keywords {
+			e.Keywords[strings.ToLower(kw)] = true
+		}
+		e.ReceivedAt = time.Now().UTC().Truncate(time.Second)
+		if obj.ReceivedAt != nil {
+			e.ReceivedAt = obj.ReceivedAt.UTC()
+		}
+
+		s.emails[e.ID] = e
+		created[cid] = map[string]any{"id": e.ID, "blobId": e.BlobID, "size": e.Size}
+	}
+
+	s.changed()
+
+	return map[string]any{
+		"accountId":  AccountID,
+		"newState":   strconv.Itoa(s.state),
+		"created":    created,
+		"notCreated": notCreated,
+	}, nil
+}
+
+func parseEmail(data []byte) (*email, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := msg.Header
+	dec := mime.WordDecoder{}
+
+	subject, err := dec.DecodeHeader(hdr.Get("Subject"))
+	if err != nil {
+		subject = hdr.Get("Subject")
+	}
+
+	e := email{
+		Size:    len(data),
+		Subject: subject,
+		From:    addressList(hdr, "From"),
+		To:      addressList(hdr, "To"),
+		Cc:      addressList(hdr, "Cc"),
+		Bcc:     addressList(hdr, "Bcc"),
+	}
+
+	if date, err := hdr.Date(); err == nil {
+		e.SentAt = &date
+	}
+
+	if id := hdr.Get("Message-Id"); id != "" {
+		e.MessageID = []string{strings.Trim(id, "<> ")}
+	}
+
+	return &e, nil
+}
+
+func addressList(hdr mail.Header, key string) []address {
+	addrs, err := hdr.AddressList(key)
+	if err != nil {
+		return nil
+	}
+
+	result := make([]address, 0, len(addrs))
+	for _, a := range addrs {
+		result = append(result, address{Name: a.Name, Email: a.Address})
+	}
+
+	return result
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.PathValue("accountId") != AccountID {
+		http.Error(w, "account not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	blobID := s.newID("B")
+	s.blobs[blobID] = data
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, map[string]any{
+		"accountId": AccountID,
+		"blobId":    blobID,
+		"type":      r.Header.Get("Content-Type"),
+		"size":      len(data),
+	})
+}
+
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	data, ok := s.blobs[r.PathValue("blobId")]
+	s.mu.Unlock()
+
+	if !ok || r.PathValue("accountId") != AccountID {
+		http.Error(w, "blob not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", r.URL.Query().Get("accept"))
+	_, _ = w.Write(data)
+}
+
+func (s *Server) handleEventSource(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ch:
+		}
+
+		s.mu.Lock()
+		state := strconv.Itoa(s.state)
+		s.mu.Unlock()
+
+		data, _ := json.Marshal(map[string]any{
+			"@type": "StateChange",
+			"changed": map[string]any{
+				AccountID: map[string]string{"Email": state, "Mailbox": state},
+			},
+		})
+
+		_, err := fmt.Fprintf(w, "event: state\ndata: %s\n\n", data)
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func cloneMap(m map[string]bool) map[string]bool {
+	result := make(map[string]bool, len(m))
+	maps.Copy(result, m)
+	return result
+}
+
+func ptrEqual(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// idCompare compares IDs by their numeric suffix.
+func idCompare(a, b string) int {
+	na, _ := strconv.Atoi(a[1:])
+	nb, _ := strconv.Atoi(b[1:])
+	return na - nb
+}
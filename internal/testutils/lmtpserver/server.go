@@ -0,0 +1,170 @@
+// Package lmtpserver provides a minimal LMTP server for tests.
+package lmtpserver
+
+import (
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Message is a mail that was delivered to the server.
+type Message struct {
+	Sender     string
+	Recipients []string
+	Data       string
+}
+
+// Server accepts all mails and records them.
+type Server struct {
+	// Address is the address that is passed to the lmtp client, for unix
+	// sockets it is prefixed with "unix:".
+	Address string
+	// RejectRecipient is optional, RCPT commands for this recipient are
+	// rejected.
+	RejectRecipient string
+
+	mu       sync.Mutex
+	messages []*Message
+}
+
+// Start starts a server that listens on a random localhost TCP port.
+func Start(t *testing.T) *Server {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listening failed: %s", err)
+	}
+
+	return serve(t, ln, ln.Addr().String())
+}
+
+// StartUnix starts a server that listens on a unix socket.
+func StartUnix(t *testing.T) *Server {
+	path := filepath.Join(t.TempDir(), "lmtp.sock")
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listening failed: %s", err)
+	}
+
+	return serve(t, ln, "unix:"+path)
+}
+
+func serve(t *testing.T, ln net.Listener, address string) *Server {
+	t.Cleanup(func() { _ = ln.Close() })
+
+	srv := Server{Address: address}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.handle(t, conn)
+		}
+	}()
+
+	return &srv
+}
+
+// Messages returns the delivered messages.
+func (s *Server) Messages() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*Message(nil), s.messages...)
+}
+
+func (s *Server) handle(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	tc := textproto.NewConn(conn)
+	reply := func(format string, args ...any) bool {
+		if err := tc.PrintfLine(format, args...); err != nil {
+			t.Logf("lmtpserver: writing reply failed: %s", err)
+			return false
+		}
+		return true
+	}
+
+	if !reply("220 localhost LMTP ready") {
+		return
+	}
+
+	var msg *Message
+
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "LHLO":
+			reply("250-localhost")
+			reply("250-PIPELINING")
+			reply("250 8BITMIME")
+
+		case "MAIL":
+			sender, ok := strings.CutPrefix(arg, "FROM:")
+			if !ok {
+				reply("501 syntax error")
+				continue
+			}
+			msg = &Message{Sender: strings.Trim(sender, "<>")}
+			reply("250 2.1.0 OK")
+
+		case "RCPT":
+			rcpt, ok := strings.CutPrefix(arg, "TO:")
+			if !ok || msg == nil {
+				reply("503 bad sequence of commands")
+				continue
+			}
+			rcpt = strings.Trim(rcpt, "<>")
+			if rcpt == s.RejectRecipient {
+				reply("550 5.1.1 user unknown")
+				continue
+			}
+			msg.Recipients = append(msg.Recipients, rcpt)
+			reply("250 2.1.5 OK")
+
+		case "DATA":
+			if msg == nil || len(msg.Recipients) == 0 {
+				reply("503 bad sequence of commands")
+				continue
+			}
+			reply("354 start mail input")
+
+			lines, err := tc.ReadDotLines()
+			if err != nil {
+				return
+			}
+			msg.Data = strings.Join(lines, "\n")
+
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+
+			for range msg.Recipients {
+				reply("250 2.0.0 OK")
+			}
+			msg = nil
+
+		case "RSET":
+			msg = nil
+			reply("250 OK")
+
+		case "QUIT":
+			reply("221 bye")
+			return
+
+		default:
+			reply("500 unknown command")
+		}
+	}
+}
@@ -3,12 +3,33 @@ package mock
 import (
 	"context"
 	"io"
+	"slices"
+	"sync"
 
 	"github.com/fho/rspamd-iscan/internal/rspamc"
 )
 
 type Rspamc struct {
 	CheckFn func(context.Context, io.Reader, *rspamc.MailHeaders) (*rspamc.CheckResult, error)
+	// PingFn is optional, if nil Ping succeeds.
+	PingFn func(context.Context) error
+	// LearnErr is returned by Spam and Ham if it is not nil, the
+	// requests are not recorded then.
+	LearnErr error
+
+	mu    sync.Mutex
+	calls []*Call
+}
+
+// Call is a learn or fuzzy request that was sent to [Rspamc].
+type Call struct {
+	// Method is the name of the called method, e.g. "Spam" or
+	// "FuzzyAdd".
+	Method  string
+	Headers *rspamc.MailHeaders
+	Body    []byte
+	Flag    int
+	Weight  int
 }
 
 func NewRspamc() *Rspamc {
@@ -51,10 +72,57 @@ func (c *Rspamc) Check(ctx context.Context, r io.Reader, hdr *rspamc.MailHeaders
 	return c.CheckFn(ctx, r, hdr)
 }
 
-func (*Rspamc) Spam(context.Context, io.Reader, *rspamc.MailHeaders) error {
-	return nil
+func (c *Rspamc) Ping(ctx context.Context) error {
+	if c.PingFn == nil {
+		return nil
+	}
+
+	return c.PingFn(ctx)
+}
+
+func (c *Rspamc) Spam(_ context.Context, r io.Reader, hdrs *rspamc.MailHeaders) error {
+	if c.LearnErr != nil {
+		return c.LearnErr
+	}
+
+	return c.record(&Call{Method: "Spam", Headers: hdrs}, r)
+}
+
+func (c *Rspamc) Ham(_ context.Context, r io.Reader, hdrs *rspamc.MailHeaders) error {
+	if c.LearnErr != nil {
+		return c.LearnErr
+	}
+
+	return c.record(&Call{Method: "Ham", Headers: hdrs}, r)
+}
+
+func (c *Rspamc) FuzzyAdd(_ context.Context, r io.Reader, hdrs *rspamc.MailHeaders, flag, weight int) error {
+	return c.record(&Call{Method: "FuzzyAdd", Headers: hdrs, Flag: flag, Weight: weight}, r)
+}
+
+func (c *Rspamc) FuzzyDel(_ context.Context, r io.Reader, hdrs *rspamc.MailHeaders, flag int) error {
+	return c.record(&Call{Method: "FuzzyDel", Headers: hdrs, Flag: flag}, r)
 }
 
-func (*Rspamc) Ham(context.Context, io.Reader, *rspamc.MailHeaders) error {
+func (c *Rspamc) record(call *Call, r io.Reader) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	call.Body = body
+
+	c.mu.Lock()
+	c.calls = append(c.calls, call)
+	c.mu.Unlock()
+
 	return nil
 }
+
+// Calls returns the learn and fuzzy requests that were sent, in the order
+// they were received.
+func (c *Rspamc) Calls() []*Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return slices.Clone(c.calls)
+}
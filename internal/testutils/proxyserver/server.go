@@ -0,0 +1,254 @@
+// Package proxyserver provides minimal SOCKS5 and HTTP CONNECT proxies for
+// tests.
+package proxyserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+type Protocol int
+
+const (
+	SOCKS5 Protocol = iota
+	HTTPConnect
+)
+
+// Server is a proxy that relays connections to the requested target.
+// It records the targets and the data that was relayed.
+type Server struct {
+	ListenAddr string
+	// User and Password are the credentials the proxy requires, if User
+	// is empty no authentication is required.
+	User     string
+	Password string
+
+	protocol Protocol
+
+	mu      sync.Mutex
+	targets []string
+	relayed bytes.Buffer
+}
+
+// Start starts a proxy that listens on a random localhost port.
+// If user is not empty, clients must authenticate with user and password.
+func Start(t *testing.T, protocol Protocol, user, password string) *Server {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("listening failed: %s", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	srv := Server{
+		ListenAddr: ln.Addr().String(),
+		User:       user,
+		Password:   password,
+		protocol:   protocol,
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.handle(t, conn)
+		}
+	}()
+
+	return &srv
+}
+
+// Targets returns the addresses the proxy established connections to.
+func (s *Server) Targets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.targets...)
+}
+
+// Relayed returns all data that was relayed between clients and targets.
+func (s *Server) Relayed() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return bytes.Clone(s.relayed.Bytes())
+}
+
+func (s *Server) handle(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+
+	var target string
+	var ok bool
+	if s.protocol == SOCKS5 {
+		target, ok = s.socks5Handshake(br, conn)
+	} else {
+		target, ok = s.httpConnectHandshake(br, conn)
+	}
+	if !ok {
+		return
+	}
+
+	targetConn, err := net.Dial("tcp", target)
+	if err != nil {
+		t.Logf("proxy: connecting to %s failed: %s", target, err)
+		return
+	}
+	defer targetConn.Close()
+
+	s.mu.Lock()
+	s.targets = append(s.targets, target)
+	s.mu.Unlock()
+
+	if s.protocol == SOCKS5 {
+		_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	} else {
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	}
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		_, _ = io.Copy(s.recorder(targetConn), br)
+		_ = targetConn.Close()
+	})
+	_, _ = io.Copy(s.recorder(conn), targetConn)
+	_ = conn.Close()
+	wg.Wait()
+}
+
+func (s *Server) recorder(w io.Writer) io.Writer {
+	return io.MultiWriter(w, writerFunc(func(p []byte) (int, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.relayed.Write(p)
+	}))
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func (s *Server) socks5Handshake(br *bufio.Reader, conn net.Conn) (string, bool) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil || hdr[0] != 5 {
+		return "", false
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", false
+	}
+
+	wantMethod := byte(0)
+	if s.User != "" {
+		wantMethod = 2
+	}
+
+	if !bytes.Contains(methods, []byte{wantMethod}) {
+		_, _ = conn.Write([]byte{5, 0xff})
+		return "", false
+	}
+	_, _ = conn.Write([]byte{5, wantMethod})
+
+	if s.User != "" {
+		user, passwd, ok := readSocks5Credentials(br)
+		if !ok || user != s.User || passwd != s.Password {
+			_, _ = conn.Write([]byte{1, 1})
+			return "", false
+		}
+		_, _ = conn.Write([]byte{1, 0})
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(br, req[:]); err != nil || req[1] != 1 {
+		return "", false
+	}
+
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", false
+		}
+		host = net.IP(ip).String()
+	case 4:
+		ip := make([]byte, 16)
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", false
+		}
+		host = net.IP(ip).String()
+	case 3:
+		l, err := br.ReadByte()
+		if err != nil {
+			return "", false
+		}
+		name := make([]byte, l)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return "", false
+		}
+		host = string(name)
+	default:
+		return "", false
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(br, port[:]); err != nil {
+		return "", false
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), true
+}
+
+func readSocks5Credentials(br *bufio.Reader) (user, passwd string, ok bool) {
+	readStr := func() (string, bool) {
+		l, err := br.ReadByte()
+		if err != nil {
+			return "", false
+		}
+		buf := make([]byte, l)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return "", false
+		}
+		return string(buf), true
+	}
+
+	if v, err := br.ReadByte(); err != nil || v != 1 {
+		return "", "", false
+	}
+
+	user, ok = readStr()
+	if !ok {
+		return "", "", false
+	}
+
+	passwd, ok = readStr()
+	return user, passwd, ok
+}
+
+func (s *Server) httpConnectHandshake(br *bufio.Reader, conn net.Conn) (string, bool) {
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Method != http.MethodConnect {
+		return "", false
+	}
+
+	if s.User != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(s.User + ":" + s.Password))
+		if req.Header.Get("Proxy-Authorization") != "Basic "+creds {
+			_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return "", false
+		}
+	}
+
+	return req.Host, true
+}
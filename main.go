@@ -1,20 +1,32 @@
 package main
 
 import (
+	"cmp"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/fho/rspamd-iscan/internal/checkcache"
 	"github.com/fho/rspamd-iscan/internal/config"
 	"github.com/fho/rspamd-iscan/internal/imapclt"
 	"github.com/fho/rspamd-iscan/internal/iscan"
+	"github.com/fho/rspamd-iscan/internal/jmap"
+	"github.com/fho/rspamd-iscan/internal/learnspool"
+	"github.com/fho/rspamd-iscan/internal/lmtp"
+	"github.com/fho/rspamd-iscan/internal/maildir"
 	"github.com/fho/rspamd-iscan/internal/neterr"
+	"github.com/fho/rspamd-iscan/internal/oauth2"
 	"github.com/fho/rspamd-iscan/internal/retry"
 	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/syncstate"
 
 	flag "github.com/spf13/pflag"
 )
@@ -34,6 +46,10 @@ type flags struct {
 	printVersion         bool
 	once                 bool
 	dryRun               bool
+	// command is the subcommand, it is empty when mailboxes are
+	// processed
+	command string
+	stats   statsFlags
 }
 
 func mustParseFlags() *flags {
@@ -52,8 +68,25 @@ func mustParseFlags() *flags {
 		"simulates modifying operations on the IMAP server, also enables --once",
 	)
 
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [FLAGS] [%s [STATS-FLAGS]]\n", os.Args[0], cmdStats)
+		flag.PrintDefaults()
+	}
+	// flags after the subcommand belong to it
+	flag.CommandLine.SetInterspersed(false)
 	flag.Parse()
 
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+	case cmdStats:
+		result.command = cmd
+		parseStatsFlags(&result.stats, flag.Args()[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %q\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	if result.dryRun {
 		result.once = true
 	}
@@ -104,16 +137,83 @@ func installSigHandler(logger *slog.Logger, clt *iscan.Client) {
 	}()
 }
 
-func newIMAPClient(cfg *config.Config, flags *flags, logger *slog.Logger) (iscan.IMAPClient, error) {
+func newTokenSource(cfg *config.Config, flags *flags, logger *slog.Logger) (imapclt.TokenSource, error) {
+	if !cfg.UsesOAuth2() {
+		return nil, nil
+	}
+
+	// a rotated refresh token replaces the one in the credentials
+	// directory, if it was read from there
+	var refreshTokenFile string
+	if flags.credentialsDirectory != "" {
+		path := filepath.Join(flags.credentialsDirectory, "OAuth2RefreshToken")
+		if _, err := os.Stat(path); err == nil {
+			refreshTokenFile = path
+		}
+	}
+
+	return oauth2.NewTokenSource(&oauth2.Config{
+		TokenURL:         cfg.OAuth2TokenURL,
+		ClientID:         cfg.OAuth2ClientID,
+		ClientSecret:     cfg.OAuth2ClientSecret,
+		RefreshToken:     cfg.OAuth2RefreshToken,
+		RefreshTokenFile: refreshTokenFile,
+		Scopes:           cfg.OAuth2Scopes,
+		Logger:           logger,
+	})
+}
+
+func newIMAPClient(
+	cfg *config.Config,
+	flags *flags,
+	logger *slog.Logger,
+	tokenSource imapclt.TokenSource,
+) (iscan.IMAPClient, error) {
 	var clt iscan.IMAPClient
 
+	if cfg.Maildir != "" {
+		return newMaildirClient(cfg, flags, logger)
+	}
+
+	tlsCfg, err := imapclt.NewTLSConfig(&imapclt.TLSOptions{
+		CAFile:           cfg.ImapTLSCAFile,
+		ClientCertFile:   cfg.ImapTLSClientCertFile,
+		ClientKeyFile:    cfg.ImapTLSClientKeyFile,
+		ServerName:       cfg.ImapTLSServerName,
+		PinnedCertSHA256: cfg.ImapTLSPinnedCertSHA256,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid imap tls configuration: %w", err)
+	}
+
+	var proxyURL *url.URL
+	if cfg.ImapProxy != "" {
+		proxyURL, err = url.Parse(cfg.ImapProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ImapProxy url: %w", err)
+		}
+	}
+
+	if cfg.UsesJMAP() {
+		return newJMAPClient(cfg, flags, logger, tokenSource, tlsCfg, proxyURL)
+	}
+
 	imapCfg := imapclt.Config{
 		Address:       cfg.ImapAddr,
 		User:          cfg.ImapUser,
 		Password:      cfg.ImapPassword,
+		AuthMechanism: cfg.ImapAuthMechanism,
+		TokenSource:   tokenSource,
+		TLSMode:       cfg.ImapTLSMode,
+		TLSConfig:     tlsCfg,
+		Proxy:         proxyURL,
 		AllowInsecure: false,
 		Logger:        logger,
 		LogIMAPData:   cfg.LogIMAPData,
+
+		AllowExpungeFallback:   cfg.ImapAllowExpunge,
+		DisableCompression:     cfg.ImapDisableCompression,
+		LogIMAPDataMaxBodySize: cfg.LogIMAPDataMaxBodySize,
 	}
 
 	if flags.dryRun {
@@ -130,11 +230,139 @@ func newIMAPClient(cfg *config.Config, flags *flags, logger *slog.Logger) (iscan
 	return clt, nil
 }
 
+func newMaildirClient(cfg *config.Config, flags *flags, logger *slog.Logger) (*maildir.Client, error) {
+	if flags.dryRun {
+		return nil, errors.New("--dry-run is not supported with Maildir")
+	}
+
+	clt := maildir.NewClient(&maildir.Config{Path: cfg.Maildir, Logger: logger})
+	if err := clt.Connect(); err != nil {
+		return nil, err
+	}
+
+	return clt, nil
+}
+
+func newJMAPClient(
+	cfg *config.Config,
+	flags *flags,
+	logger *slog.Logger,
+	tokenSource imapclt.TokenSource,
+	tlsCfg *tls.Config,
+	proxyURL *url.URL,
+) (*jmap.Client, error) {
+	if flags.dryRun {
+		return nil, errors.New("--dry-run is not supported with JMAP")
+	}
+
+	clt, err := jmap.NewClient(&jmap.Config{
+		URL:         cfg.ImapAddr,
+		User:        cfg.ImapUser,
+		Password:    cfg.ImapPassword,
+		TokenSource: tokenSource,
+		TLSConfig:   tlsCfg,
+		Proxy:       proxyURL,
+		Logger:      logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := clt.Connect(); err != nil {
+		return nil, err
+	}
+
+	return clt, nil
+}
+
+// newSyncStateStore returns the store for the mailbox sync states.
+// In dry-run mode messages are not moved, the states are only kept in memory
+// to not skip the messages in later runs.
+func newSyncStateStore(cfg *config.Config, flags *flags, logger *slog.Logger) (*syncstate.Store, error) {
+	if cfg.SyncStateFile == "" || flags.dryRun {
+		return syncstate.NewMemoryStore(), nil
+	}
+
+	account := cfg.ImapUser + "@" + cfg.ImapAddr
+	if cfg.Maildir != "" {
+		account = "maildir:" + cfg.Maildir
+	}
+
+	store, err := syncstate.Open(cfg.SyncStateFile, account, logger)
+	if err != nil {
+		return nil, fmt.Errorf("opening sync state file failed: %w", err)
+	}
+
+	return store, nil
+}
+
+// newLearnSpool returns the spool for learn requests that failed because
+// rspamd was unavailable, it is nil if no spool directory is configured.
+// In dry-run mode no spool is used, learn requests are not sent.
+func newLearnSpool(cfg *config.Config, flags *flags, logger *slog.Logger) (iscan.LearnSpool, error) {
+	if cfg.LearnSpoolDir == "" || flags.dryRun {
+		return nil, nil
+	}
+
+	spool, err := learnspool.Open(cfg.LearnSpoolDir, logger)
+	if err != nil {
+		return nil, fmt.Errorf("opening learn spool failed: %w", err)
+	}
+
+	if pending := spool.Len(); pending > 0 {
+		logger.Info("learn spool contains pending learn requests",
+			"event", "learnspool.opened",
+			"learnspool.pending", pending,
+		)
+	}
+
+	return spool, nil
+}
+
+// newCheckCache returns the cache for check results, it is nil if no TTL is
+// configured.
+func newCheckCache(cfg *config.Config) iscan.CheckCache {
+	if cfg.RspamdCacheTTL.Duration <= 0 {
+		return nil
+	}
+
+	return checkcache.New(cfg.RspamdCacheTTL.Duration, cfg.RspamdCacheMaxEntries)
+}
+
+// newRspamcClient returns a client for the configured rspamd instances.
+func newRspamcClient(cfg *config.Config, logger *slog.Logger) (*rspamc.Client, error) {
+	if len(cfg.RspamdURLs()) == 0 {
+		return nil, errors.New("RspamdURL can not be empty")
+	}
+
+	if !rspamc.IsSupportedBalancing(cfg.RspamdBalancing) {
+		return nil, fmt.Errorf("unsupported RspamdBalancing: %q", cfg.RspamdBalancing)
+	}
+
+	rspamcOpts := []rspamc.Option{
+		rspamc.WithCircuitBreaker(cfg.RspamdUnavailableAfter.Duration),
+		rspamc.WithBalancing(cfg.RspamdBalancing),
+	}
+	if cfg.RspamdCompression {
+		rspamcOpts = append(rspamcOpts, rspamc.WithCompression())
+	}
+	if cfg.RspamdPrimaryURL != "" {
+		rspamcOpts = append(rspamcOpts, rspamc.WithPrimary(cfg.RspamdPrimaryURL))
+	}
+
+	// TODO: allow passing all attrs as single URL to rspamc http client
+	return rspamc.New(logger, cfg.RspamdURLs(), cfg.RspamdPassword, rspamcOpts...), nil
+}
+
 func newIscanClient(
 	cfg *config.Config,
+	flags *flags,
 	logger *slog.Logger,
 	rspamc iscan.RspamdClient,
 	imapClt iscan.IMAPClient,
+	syncState iscan.SyncStateStore,
+	learnSpool iscan.LearnSpool,
+	checkCache iscan.CheckCache,
 ) (*iscan.Client, error) {
 	iscanCfg := iscan.Config{
 		ScanMailbox:             cfg.ScanMailbox,
@@ -144,12 +372,53 @@ func newIscanClient(
 		UndetectedMailboxName:   cfg.UndetectedMailbox,
 		BackupMailbox:           cfg.BackupMailbox,
 		SpamTreshold:            cfg.SpamThreshold,
+		TagOnly:                 cfg.TagOnly,
+		SpamFlags:               cfg.SpamFlags,
+		InboxFlags:              cfg.InboxFlags,
 		TempDir:                 cfg.TempDir,
 		KeepTempFiles:           cfg.KeepTempFiles,
 		MarkLearnedAsSpamAsRead: cfg.MarkLearnedAsSpamAsRead,
 		Logger:                  logger,
 		Rspamc:                  rspamc,
 		IMAPClient:              imapClt,
+		SyncState:               syncState,
+		LearnSpool:              learnSpool,
+		CheckCache:              checkCache,
+		QuotaMinFree:            cfg.ImapQuotaMinFreeKiB * 1024,
+		SkippedPolicy:           iscan.UnverifiedPolicy(cfg.SkippedPolicy),
+		GreylistPolicy:          iscan.UnverifiedPolicy(cfg.GreylistPolicy),
+		PendingMailbox:          cfg.PendingMailbox,
+		RescanDelay:             cfg.RescanDelay.Duration,
+		MaxRescans:              cfg.MaxRescans,
+		LateRescanMargin:        cfg.LateRescanMargin,
+		LateRescanDelay:         cfg.LateRescanDelay.Duration,
+		FuzzyFlag:               cfg.RspamdFuzzyFlag,
+		FuzzyWeight:             cfg.RspamdFuzzyWeight,
+		UnavailablePolicy:       iscan.UnavailablePolicy(cfg.RspamdUnavailablePolicy),
+	}
+
+	if cfg.LMTPAddr != "" {
+		if flags.dryRun {
+			logger.Info("dry-run: mails are not delivered via lmtp")
+		} else {
+			deliverer, err := lmtp.NewClient(&lmtp.Config{Address: cfg.LMTPAddr, Logger: logger})
+			if err != nil {
+				return nil, fmt.Errorf("creating lmtp client failed: %w", err)
+			}
+
+			iscanCfg.Deliverer = deliverer
+			iscanCfg.DeliveryRecipient = cmp.Or(cfg.LMTPRecipient, cfg.ImapUser)
+			iscanCfg.SpamDeliveryRecipient = cfg.LMTPSpamRecipient
+		}
+	}
+
+	err := iscan.ProvisionMailboxes(imapClt, &iscanCfg, &iscan.MailboxOptions{
+		CreateMissing:    cfg.CreateMissingMailboxes,
+		DetectSpecialUse: cfg.DetectSpecialUse,
+		Logger:           logger,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("checking mailboxes failed: %w", err)
 	}
 
 	return iscan.NewClient(&iscanCfg)
@@ -160,13 +429,17 @@ func runOnceAndTerminate(
 	flags *flags,
 	logger *slog.Logger,
 	rspamc iscan.RspamdClient,
+	tokenSource imapclt.TokenSource,
+	syncState iscan.SyncStateStore,
+	learnSpool iscan.LearnSpool,
+	checkCache iscan.CheckCache,
 ) error {
-	imapClt, err := newIMAPClient(cfg, flags, logger)
+	imapClt, err := newIMAPClient(cfg, flags, logger, tokenSource)
 	if err != nil {
 		return fmt.Errorf("creating imap client failed: %w", err)
 	}
 
-	clt, err := newIscanClient(cfg, logger, rspamc, imapClt)
+	clt, err := newIscanClient(cfg, flags, logger, rspamc, imapClt, syncState, learnSpool, checkCache)
 	if err != nil {
 		return fmt.Errorf("creating iscan client failed %w", err)
 	}
@@ -179,13 +452,17 @@ func monitor(
 	flags *flags,
 	logger *slog.Logger,
 	rspamc iscan.RspamdClient,
+	tokenSource imapclt.TokenSource,
+	syncState iscan.SyncStateStore,
+	learnSpool iscan.LearnSpool,
+	checkCache iscan.CheckCache,
 ) error {
-	imapClt, err := newIMAPClient(cfg, flags, logger)
+	imapClt, err := newIMAPClient(cfg, flags, logger, tokenSource)
 	if err != nil {
 		return fmt.Errorf("creating imap client failed: %w", err)
 	}
 
-	clt, err := newIscanClient(cfg, logger, rspamc, imapClt)
+	clt, err := newIscanClient(cfg, flags, logger, rspamc, imapClt, syncState, learnSpool, checkCache)
 	if err != nil {
 		return err
 	}
@@ -241,21 +518,62 @@ func run() error {
 		}
 	}
 
+	if flags.command == cmdStats {
+		rspamc, err := newRspamcClient(cfg, logger)
+		if err != nil {
+			return err
+		}
+
+		return printStats(os.Stdout, rspamc, &flags.stats)
+	}
+
 	fmt.Print(cfg.String())
 
-	// TODO: allow passing all attrs as single URL to rspamc http client
-	rspamc := rspamc.New(logger, cfg.RspamdURL, cfg.RspamdPassword)
+	if !imapclt.IsSupportedAuthMechanism(cfg.ImapAuthMechanism) {
+		return fmt.Errorf("unsupported ImapAuthMechanism: %q", cfg.ImapAuthMechanism)
+	}
+
+	if !imapclt.IsSupportedTLSMode(cfg.ImapTLSMode) {
+		return fmt.Errorf("unsupported ImapTLSMode: %q", cfg.ImapTLSMode)
+	}
+
+	// the token source is shared between reconnects, access tokens are
+	// only requested when the cached one expires soon
+	tokenSource, err := newTokenSource(cfg, flags, logger)
+	if err != nil {
+		return fmt.Errorf("configuring oauth2 failed: %w", err)
+	}
+
+	syncState, err := newSyncStateStore(cfg, flags, logger)
+	if err != nil {
+		return err
+	}
+
+	learnSpool, err := newLearnSpool(cfg, flags, logger)
+	if err != nil {
+		return err
+	}
+
+	// the cache is shared between reconnects
+	checkCache := newCheckCache(cfg)
+
+	rspamc, err := newRspamcClient(cfg, logger)
+	if err != nil {
+		return err
+	}
 
 	if flags.once {
 		logger.Info("running once and terminating (--once)")
-		return runOnceAndTerminate(cfg, flags, logger, rspamc)
+		return runOnceAndTerminate(cfg, flags, logger, rspamc, tokenSource, syncState, learnSpool, checkCache)
 	}
 
 	logger.Info("monitoring IMAP mailboxes continuously, retrying on retryable errors",
 		"max_retries_same_error", maxRetriesSameError)
 
 	retryRunner := retry.Runner{
-		Fn:                  func() error { return monitor(cfg, flags, logger, rspamc) },
+		Fn: func() error {
+			return monitor(cfg, flags, logger, rspamc, tokenSource, syncState, learnSpool, checkCache)
+		},
 		IsRetryable:         neterr.IsRetryableError,
 		MaxRetriesSameError: maxRetriesSameError,
 		RetryIntervals: []time.Duration{
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	cmdStats = "stats"
+
+	statsTimeout = 30 * time.Second
+)
+
+type statsFlags struct {
+	json      bool
+	top       int
+	minLearns int64
+}
+
+func parseStatsFlags(result *statsFlags, args []string) {
+	fs := flag.NewFlagSet(cmdStats, flag.ExitOnError)
+	fs.BoolVar(&result.json, "json", false,
+		"print the statistics as JSON instead of tables")
+	fs.IntVar(&result.top, "top", 10,
+		"number of symbols that are printed, sorted by their impact, the absolute weight multiplied with the frequency")
+	fs.Int64Var(&result.minLearns, "min-learns", 200,
+		"number of learned mails per statfile the Bayes classifier requires (min_learns)")
+
+	_ = fs.Parse(args)
+}
+
+type statsReport struct {
+	ReadOnly   bool             `json:"read_only"`
+	Scanned    int64            `json:"scanned"`
+	Learned    int64            `json:"learned"`
+	Classifier classifierHealth `json:"classifier"`
+	Statfiles  []statfileReport `json:"statfiles"`
+	TopSymbols []symbolReport   `json:"top_symbols"`
+}
+
+// classifierHealth describes if the Bayes classifier classifies mails.
+type classifierHealth struct {
+	Active    bool   `json:"active"`
+	MinLearns int64  `json:"min_learns"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type statfileReport struct {
+	Symbol  string `json:"symbol"`
+	Type    string `json:"type"`
+	Learned int64  `json:"learned"`
+	Users   int64  `json:"users"`
+	// MissingLearns is the number of mails that must be learned until
+	// the statfile is used for classification.
+	MissingLearns int64 `json:"missing_learns"`
+}
+
+type symbolReport struct {
+	Group string `json:"group"`
+	rspamc.SymbolRule
+	// Impact is the absolute weight multiplied with the frequency, the
+	// average contribution of the symbol to the score of a mail.
+	Impact float64 `json:"impact"`
+}
+
+func newStatsReport(stat *rspamc.Stat, groups []rspamc.SymbolGroup, f *statsFlags) *statsReport {
+	result := statsReport{
+		ReadOnly:   stat.ReadOnly,
+		Scanned:    stat.Scanned,
+		Learned:    stat.Learned,
+		Classifier: classifierHealth{Active: true, MinLearns: f.minLearns},
+		Statfiles:  []statfileReport{},
+		TopSymbols: []symbolReport{},
+	}
+
+	for _, sf := range stat.Statfiles {
+		r := statfileReport{
+			Symbol:        sf.Symbol,
+			Type:          sf.Type,
+			Learned:       sf.Revision,
+			Users:         sf.Users,
+			MissingLearns: max(f.minLearns-sf.Revision, 0),
+		}
+		result.Statfiles = append(result.Statfiles, r)
+
+		if r.MissingLearns > 0 && result.Classifier.Active {
+			result.Classifier.Active = false
+			result.Classifier.Reason = fmt.Sprintf(
+				"%s has %d of %d required learned mails", r.Symbol, r.Learned, f.minLearns,
+			)
+		}
+	}
+
+	if len(stat.Statfiles) == 0 {
+		result.Classifier.Active = false
+		result.Classifier.Reason = "rspamd reported no statfiles, the Bayes classifier is not configured"
+	}
+
+	for _, g := range groups {
+		for _, rule := range g.Rules {
+			result.TopSymbols = append(result.TopSymbols, symbolReport{
+				Group:      g.Group,
+				SymbolRule: rule,
+				Impact:     math.Abs(rule.Weight) * rule.Frequency,
+			})
+		}
+	}
+
+	slices.SortFunc(result.TopSymbols, func(a, b symbolReport) int {
+		return cmp.Or(
+			cmp.Compare(b.Impact, a.Impact),
+			cmp.Compare(b.Weight, a.Weight),
+			cmp.Compare(a.Symbol, b.Symbol),
+		)
+	})
+	if len(result.TopSymbols) > f.top {
+		result.TopSymbols = result.TopSymbols[:max(f.top, 0)]
+	}
+
+	return &result
+}
+
+// printStats queries the statistics and symbols of the primary rspamd
+// instance and writes them to w.
+func printStats(w io.Writer, clt *rspamc.Client, f *statsFlags) error {
+	ctx, cancel := context.WithTimeout(context.Background(), statsTimeout)
+	defer cancel()
+
+	stat, err := clt.Stat(ctx)
+	if err != nil {
+		return fmt.Errorf("querying rspamd statistics failed: %w", err)
+	}
+
+	groups, err := clt.Symbols(ctx)
+	if err != nil {
+		return fmt.Errorf("querying rspamd symbols failed: %w", err)
+	}
+
+	report := newStatsReport(stat, groups, f)
+
+	if f.json {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	return writeStatsTables(w, report)
+}
+
+func writeStatsTables(w io.Writer, r *statsReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	classifier := "active"
+	if !r.Classifier.Active {
+		classifier = "inactive, " + r.Classifier.Reason
+	}
+
+	fmt.Fprintf(tw, "Scanned Mails:\t%d\n", r.Scanned)
+	fmt.Fprintf(tw, "Learned Mails:\t%d\n", r.Learned)
+	fmt.Fprintf(tw, "Bayes Classifier:\t%s\n", classifier)
+	fmt.Fprintf(tw, "Read-Only:\t%t\n", r.ReadOnly)
+
+	if len(r.Statfiles) > 0 {
+		fmt.Fprintf(tw, "\nSTATFILE\tTYPE\tLEARNED\tUSERS\tSTATUS\n")
+		for _, sf := range r.Statfiles {
+			status := "ok"
+			if sf.MissingLearns > 0 {
+				status = fmt.Sprintf("%d more learns required", sf.MissingLearns)
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", sf.Symbol, sf.Type, sf.Learned, sf.Users, status)
+		}
+	}
+
+	if len(r.TopSymbols) > 0 {
+		fmt.Fprintf(tw, "\nSYMBOL\tGROUP\tWEIGHT\tFREQUENCY\tIMPACT\tDESCRIPTION\n")
+		for _, s := range r.TopSymbols {
+			fmt.Fprintf(tw, "%s\t%s\t%.2f\t%.4f\t%.4f\t%s\n", s.Symbol, s.Group, s.Weight, s.Frequency, s.Impact, s.Description)
+		}
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fho/rspamd-iscan/internal/rspamc"
+	"github.com/fho/rspamd-iscan/internal/testutils/assert"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+func testSymbolGroups() []rspamc.SymbolGroup {
+	return []rspamc.SymbolGroup{
+		{Group: "bayes", Rules: []rspamc.SymbolRule{
+			{Symbol: "BAYES_SPAM", Weight: 5.1, Description: "Message probably spam", Frequency: 0.1},
+			{Symbol: "BAYES_HAM", Weight: -3, Description: "Message probably ham", Frequency: 0.5},
+		}},
+		{Group: "headers", Rules: []rspamc.SymbolRule{
+			{Symbol: "MISSING_DATE", Weight: 1},
+			{Symbol: "FORGED_SENDER", Weight: 5.1, Frequency: 0.01},
+		}},
+		{Group: "rbl", Rules: []rspamc.SymbolRule{
+			{Symbol: "RBL_SPAMHAUS_SBL", Weight: 6.5, Description: "From address is listed in Spamhaus SBL"},
+		}},
+	}
+}
+
+func topSymbolNames(r *statsReport) string {
+	names := make([]string, 0, len(r.TopSymbols))
+	for _, s := range r.TopSymbols {
+		names = append(names, s.Symbol)
+	}
+
+	return strings.Join(names, ",")
+}
+
+func TestNewStatsReport_TopSymbols(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		top      int
+		expected string
+	}{
+		{
+			name:     "sorted_by_impact_then_weight",
+			top:      10,
+			expected: "BAYES_HAM,BAYES_SPAM,FORGED_SENDER,RBL_SPAMHAUS_SBL,MISSING_DATE",
+		},
+		{
+			name:     "limited",
+			top:      2,
+			expected: "BAYES_HAM,BAYES_SPAM",
+		},
+		{
+			name:     "zero",
+			top:      0,
+			expected: "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newStatsReport(&rspamc.Stat{}, testSymbolGroups(), &statsFlags{top: tc.top})
+			assert.Equal(t, tc.expected, topSymbolNames(r))
+		})
+	}
+}
+
+func TestNewStatsReport_ClassifierHealth(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		statfiles     []rspamc.Statfile
+		minLearns     int64
+		active        bool
+		reason        string
+		missingLearns string
+	}{
+		{
+			name: "active",
+			statfiles: []rspamc.Statfile{
+				{Symbol: "BAYES_SPAM", Revision: 300},
+				{Symbol: "BAYES_HAM", Revision: 200},
+			},
+			minLearns:     200,
+			active:        true,
+			missingLearns: "0,0",
+		},
+		{
+			name: "too_few_learns",
+			statfiles: []rspamc.Statfile{
+				{Symbol: "BAYES_SPAM", Revision: 300},
+				{Symbol: "BAYES_HAM", Revision: 120},
+			},
+			minLearns:     200,
+			reason:        "BAYES_HAM has 120 of 200 required learned mails",
+			missingLearns: "0,80",
+		},
+		{
+			name: "first_statfile_with_too_few_learns_is_reported",
+			statfiles: []rspamc.Statfile{
+				{Symbol: "BAYES_SPAM", Revision: 10},
+				{Symbol: "BAYES_HAM", Revision: 20},
+			},
+			minLearns:     200,
+			reason:        "BAYES_SPAM has 10 of 200 required learned mails",
+			missingLearns: "190,180",
+		},
+		{
+			name: "min_learns_disabled",
+			statfiles: []rspamc.Statfile{
+				{Symbol: "BAYES_SPAM"},
+				{Symbol: "BAYES_HAM"},
+			},
+			active:        true,
+			missingLearns: "0,0",
+		},
+		{
+			name:      "no_statfiles",
+			minLearns: 200,
+			reason:    "rspamd reported no statfiles, the Bayes classifier is not configured",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newStatsReport(
+				&rspamc.Stat{Statfiles: tc.statfiles},
+				nil,
+				&statsFlags{minLearns: tc.minLearns},
+			)
+
+			assert.Equal(t, tc.active, r.Classifier.Active)
+			assert.Equal(t, tc.reason, r.Classifier.Reason)
+			assert.Equal(t, tc.minLearns, r.Classifier.MinLearns)
+
+			var missing []string
+			for _, sf := range r.Statfiles {
+				missing = append(missing, strconv.FormatInt(sf.MissingLearns, 10))
+			}
+			assert.Equal(t, tc.missingLearns, strings.Join(missing, ","))
+		})
+	}
+}
+
+const testStatJSON = `{
+  "read_only": false,
+  "scanned": 1234,
+  "learned": 420,
+  "statfiles": [
+    {"revision": 300, "symbol": "BAYES_SPAM", "type": "redis", "users": 1},
+    {"revision": 120, "symbol": "BAYES_HAM", "type": "redis", "users": 1}
+  ]
+}`
+
+const testSymbolsJSON = `[
+  {"group": "bayes", "rules": [
+    {"symbol": "BAYES_SPAM", "weight": 5.1, "description": "Message probably spam", "frequency": 0.1, "time": 0.001},
+    {"symbol": "BAYES_HAM", "weight": -3, "description": "Message probably ham", "frequency": 0.5, "time": 0.001}
+  ]},
+  {"group": "rbl", "rules": [
+    {"symbol": "RBL_SPAMHAUS_SBL", "weight": 6.5, "description": "From address is listed in Spamhaus SBL", "frequency": 0.02, "time": 0.01}
+  ]}
+]`
+
+func startTestRspamd(t *testing.T) *rspamc.Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/stat":
+			_, _ = w.Write([]byte(testStatJSON))
+		case "/symbols":
+			_, _ = w.Write([]byte(testSymbolsJSON))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return rspamc.New(slog.New(slog.DiscardHandler), []string{srv.URL}, "")
+}
+
+// assertGolden compares actual with the content of the golden file name in
+// testdata, with -update the file is written instead.
+func assertGolden(t *testing.T, name string, actual []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name)
+
+	if *updateGolden {
+		assert.NoError(t, os.MkdirAll("testdata", 0o755))
+		assert.NoError(t, os.WriteFile(path, actual, 0o644))
+		return
+	}
+
+	expected, err := os.ReadFile(path)
+	assert.NoError(t, err)
+
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("output does not match %s, run the test with -update to update it\nexpected:\n%s\ngot:\n%s",
+			path, expected, actual)
+	}
+}
+
+func TestPrintStats(t *testing.T) {
+	clt := startTestRspamd(t)
+
+	for _, tc := range []struct {
+		golden string
+		json   bool
+	}{
+		{golden: "stats.golden.txt"},
+		{golden: "stats.golden.json", json: true},
+	} {
+		t.Run(tc.golden, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			err := printStats(&buf, clt, &statsFlags{json: tc.json, top: 10, minLearns: 200})
+			assert.NoError(t, err)
+			assertGolden(t, tc.golden, buf.Bytes())
+		})
+	}
+}